@@ -0,0 +1,255 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"html"
+	"html/template"
+	"log"
+	"net/http"
+	db "openai-api-proxy/db"
+	"strings"
+)
+
+func (a *ApiHandler) GetAdminKeysTable(w http.ResponseWriter, r *http.Request) {
+	ok, err := a.auth.ValidateAdminSession(w, r)
+	if err == nil && ok {
+		keys, err := a.db.ListAllApiKeys()
+		if err != nil {
+			log.Printf("Error fetching keys: %v", err)
+			http.Error(w, "Error fetching keys", http.StatusInternalServerError)
+			return
+		}
+		users, err := a.db.ListUsers()
+		if err != nil {
+			log.Printf("Error fetching users: %v", err)
+		}
+		for i := range keys {
+			keys[i].ExpiresAt = keys[i].ExpiresAt.In(a.location())
+			keys[i].LastUsedAt = keys[i].LastUsedAt.In(a.location())
+		}
+
+		templContent := `
+<div class="mt-8">
+    <h2 class="text-2xl font-bold mb-4">API Keys</h2>
+    <div class="mb-4">
+        <form hx-post="/api2/admin/keys/issue" hx-target="#popup-content" hx-swap="innerHTML">
+            <input type="text" name="owner" list="key-owners" placeholder="User ID" class="p-2 bg-gray-50 border border-gray-300 text-gray-900 text-sm rounded-lg focus:ring-blue-500 focus:border-blue-500 dark:bg-gray-700 dark:border-gray-600 dark:placeholder-gray-400 dark:text-white dark:focus:ring-blue-500 dark:focus:border-blue-500" required>
+            <datalist id="key-owners">
+                {{range .Users}}<option value="{{.Sub}}">{{.Name}}</option>{{end}}
+            </datalist>
+            <input type="text" name="beschreibung" placeholder="Beschreibung" class="p-2 bg-gray-50 border border-gray-300 text-gray-900 text-sm rounded-lg focus:ring-blue-500 focus:border-blue-500 dark:bg-gray-700 dark:border-gray-600 dark:placeholder-gray-400 dark:text-white dark:focus:ring-blue-500 dark:focus:border-blue-500">
+            <input type="date" name="expires" title="Gültig bis" class="p-2 bg-gray-50 border border-gray-300 text-gray-900 text-sm rounded-lg focus:ring-blue-500 focus:border-blue-500 dark:bg-gray-700 dark:border-gray-600 dark:placeholder-gray-400 dark:text-white dark:focus:ring-blue-500 dark:focus:border-blue-500">
+            <input type="text" name="models" placeholder="Modelle (optional)" class="p-2 bg-gray-50 border border-gray-300 text-gray-900 text-sm rounded-lg focus:ring-blue-500 focus:border-blue-500 dark:bg-gray-700 dark:border-gray-600 dark:placeholder-gray-400 dark:text-white dark:focus:ring-blue-500 dark:focus:border-blue-500">
+            <input type="text" name="endpoints" placeholder="Endpunkte (optional)" class="p-2 bg-gray-50 border border-gray-300 text-gray-900 text-sm rounded-lg focus:ring-blue-500 focus:border-blue-500 dark:bg-gray-700 dark:border-gray-600 dark:placeholder-gray-400 dark:text-white dark:focus:ring-blue-500 dark:focus:border-blue-500">
+            <input type="text" name="cidrs" placeholder="IP-Netze (optional)" class="p-2 bg-gray-50 border border-gray-300 text-gray-900 text-sm rounded-lg focus:ring-blue-500 focus:border-blue-500 dark:bg-gray-700 dark:border-gray-600 dark:placeholder-gray-400 dark:text-white dark:focus:ring-blue-500 dark:focus:border-blue-500">
+            <button type="submit" class="ml-2 bg-blue-500 hover:bg-blue-700 text-white font-bold py-2 px-4 rounded">
+                Issue Key
+            </button>
+        </form>
+    </div>
+    <table class="min-w-full divide-y dark:text-gray-200 divide-gray-200 shadow overflow-hidden rounded-lg">
+        <thead class="bg-gray-50 dark:bg-slate-800 dark:text-white text-gray-500">
+            <tr>
+                <th class="px-6 py-3 text-left text-xs font-medium uppercase tracking-wider">APIKEY ID</th>
+                <th class="px-6 py-3 text-left text-xs font-medium uppercase tracking-wider">User</th>
+                <th class="px-6 py-3 text-left text-xs font-medium uppercase tracking-wider">Beschreibung</th>
+                <th class="px-6 py-3 text-left text-xs font-medium uppercase tracking-wider">Zuletzt genutzt</th>
+                <th class="px-6 py-3 text-left text-xs font-medium uppercase tracking-wider"></th>
+            </tr>
+        </thead>
+        <tbody class="bg-white dark:bg-slate-900 divide-y divide-gray-200">
+            {{range .Keys}}
+            <tr{{if or .Deactivated .Expired}} class="text-gray-400"{{end}}>
+                <td class="px-6 py-4 whitespace-nowrap">{{.UUID}}</td>
+                <td class="px-6 py-4 whitespace-nowrap">{{or .OwnerName .Owner}}</td>
+                <td class="px-6 py-4 whitespace-nowrap">
+                    {{.Description}}
+                    {{if .Deactivated}}<span class="ml-2 px-2 py-0.5 rounded-full bg-gray-500 text-white text-xs font-bold uppercase">Deaktiviert</span>{{end}}
+                    {{if .Expired}}<span class="ml-2 px-2 py-0.5 rounded-full bg-red-600 text-white text-xs font-bold uppercase">Abgelaufen</span>{{end}}
+                    {{if .AuditContent}}<span class="ml-2 px-2 py-0.5 rounded-full bg-blue-600 text-white text-xs font-bold uppercase">Audit</span>{{end}}
+                    {{if .ResponseCacheOptOut}}<span class="ml-2 px-2 py-0.5 rounded-full bg-gray-500 text-white text-xs font-bold uppercase">Ohne Cache</span>{{end}}
+                </td>
+                <td class="px-6 py-4 whitespace-nowrap">{{if .LastUsedAt.IsZero}}nie{{else}}{{.LastUsedAt.Format "02.01.2006 15:04"}}{{end}}</td>
+                <td class="px-6 py-4 whitespace-nowrap text-right text-sm font-medium">
+                    {{if .AuditContent}}
+                    <button hx-post="/api2/admin/keys/audit-off/{{.UUID}}" hx-target="#admin-keys-container" hx-swap="innerHTML"
+                            class="mr-4 text-indigo-600 dark:text-indigo-500 hover:text-indigo-900">
+                        Audit aus
+                    </button>
+                    {{else}}
+                    <button hx-post="/api2/admin/keys/audit-on/{{.UUID}}" hx-target="#admin-keys-container" hx-swap="innerHTML"
+                            hx-confirm="Prompts und Antworten dieses Keys im Audit-Log speichern?"
+                            class="mr-4 text-indigo-600 dark:text-indigo-500 hover:text-indigo-900">
+                        Audit an
+                    </button>
+                    {{end}}
+                    {{if .ResponseCacheOptOut}}
+                    <button hx-post="/api2/admin/keys/cache-on/{{.UUID}}" hx-target="#admin-keys-container" hx-swap="innerHTML"
+                            class="mr-4 text-indigo-600 dark:text-indigo-500 hover:text-indigo-900">
+                        Cache an
+                    </button>
+                    {{else}}
+                    <button hx-post="/api2/admin/keys/cache-off/{{.UUID}}" hx-target="#admin-keys-container" hx-swap="innerHTML"
+                            class="mr-4 text-indigo-600 dark:text-indigo-500 hover:text-indigo-900">
+                        Cache aus
+                    </button>
+                    {{end}}
+                    {{if .Deactivated}}
+                    <button hx-post="/api2/admin/keys/reactivate/{{.UUID}}" hx-target="#admin-keys-container" hx-swap="innerHTML"
+                            class="text-indigo-600 dark:text-indigo-500 hover:text-indigo-900">
+                        Reactivate
+                    </button>
+                    {{else}}
+                    <button hx-post="/api2/admin/keys/deactivate/{{.UUID}}" hx-target="#admin-keys-container" hx-swap="innerHTML"
+                            hx-confirm="Möchtest du den Key wirklich deaktivieren?"
+                            class="text-red-600 hover:text-indigo-900">
+                        Deactivate
+                    </button>
+                    {{end}}
+                </td>
+            </tr>
+            {{end}}
+        </tbody>
+    </table>
+</div>
+`
+		templ, err := template.New("adminKeysTable").Parse(templContent)
+		if err != nil {
+			log.Printf("Error parsing template: %v", err)
+			http.Error(w, "Error parsing template", http.StatusInternalServerError)
+			return
+		}
+
+		err = templ.Execute(w, struct {
+			Keys  []db.ApiKey
+			Users []db.User
+		}{keys, users})
+		if err != nil {
+			log.Printf("Error executing template: %v", err)
+		}
+	} else {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	}
+}
+
+func (a *ApiHandler) DeactivateKey(w http.ResponseWriter, r *http.Request) {
+	a.setKeyDeactivated(w, r, "/api2/admin/keys/deactivate/", true)
+}
+
+func (a *ApiHandler) ReactivateKey(w http.ResponseWriter, r *http.Request) {
+	a.setKeyDeactivated(w, r, "/api2/admin/keys/reactivate/", false)
+}
+
+func (a *ApiHandler) setKeyDeactivated(w http.ResponseWriter, r *http.Request, prefix string, deactivated bool) {
+	ok, err := a.auth.ValidateAdminSession(w, r)
+	if err == nil && ok {
+		key := strings.TrimPrefix(r.URL.Path, prefix)
+		err := a.db.SetApiKeyDeactivated(key, deactivated)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error updating key %s: %v", key, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		a.GetAdminKeysTable(w, r)
+	} else {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	}
+}
+
+func (a *ApiHandler) EnableKeyAudit(w http.ResponseWriter, r *http.Request) {
+	a.setKeyAuditContent(w, r, "/api2/admin/keys/audit-on/", true)
+}
+
+func (a *ApiHandler) DisableKeyAudit(w http.ResponseWriter, r *http.Request) {
+	a.setKeyAuditContent(w, r, "/api2/admin/keys/audit-off/", false)
+}
+
+// setKeyAuditContent switches whether prompts and completions of a key are
+// stored in the audit log.
+func (a *ApiHandler) setKeyAuditContent(w http.ResponseWriter, r *http.Request, prefix string, enabled bool) {
+	ok, err := a.auth.ValidateAdminSession(w, r)
+	if err == nil && ok {
+		key := strings.TrimPrefix(r.URL.Path, prefix)
+		err := a.db.SetApiKeyAuditContent(key, enabled)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error updating key %s: %v", key, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		a.GetAdminKeysTable(w, r)
+	} else {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	}
+}
+
+func (a *ApiHandler) EnableKeyResponseCache(w http.ResponseWriter, r *http.Request) {
+	a.setKeyResponseCacheOptOut(w, r, "/api2/admin/keys/cache-on/", false)
+}
+
+func (a *ApiHandler) DisableKeyResponseCache(w http.ResponseWriter, r *http.Request) {
+	a.setKeyResponseCacheOptOut(w, r, "/api2/admin/keys/cache-off/", true)
+}
+
+// setKeyResponseCacheOptOut switches whether requests of a key may be
+// answered from the response cache.
+func (a *ApiHandler) setKeyResponseCacheOptOut(w http.ResponseWriter, r *http.Request, prefix string, optOut bool) {
+	ok, err := a.auth.ValidateAdminSession(w, r)
+	if err == nil && ok {
+		key := strings.TrimPrefix(r.URL.Path, prefix)
+		err := a.db.SetApiKeyResponseCacheOptOut(key, optOut)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error updating key %s: %v", key, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		a.GetAdminKeysTable(w, r)
+	} else {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	}
+}
+
+// IssueKey creates a key on behalf of another user. The key is shown once to
+// the admin, who hands it over.
+func (a *ApiHandler) IssueKey(w http.ResponseWriter, r *http.Request) {
+	ok, err := a.auth.ValidateAdminSession(w, r)
+	if err == nil && ok {
+		r.ParseForm()
+		owner := strings.TrimSpace(r.Form.Get("owner"))
+		if _, err := a.db.GetUser(owner); err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				log.Printf("Error reading user %s: %v", owner, err)
+			}
+			w.Write([]byte(`<div class="p-2 text-red-600 font-semibold">Unbekannter User ` + html.EscapeString(owner) + `</div>`))
+			return
+		}
+		h := db.ApiKey{
+			Owner:       owner,
+			Description: r.Form.Get("beschreibung"),
+		}
+		if err := a.parseKeyRestrictions(r, &h); err != nil {
+			w.Write([]byte(`<div class="p-2 text-red-600 font-semibold">` + html.EscapeString(err.Error()) + `</div>`))
+			return
+		}
+		apikey, err := a.issueKey(&h)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		a.writeKeyPopup(w, keyPopup{Key: apikey, Note: "Key für " + owner + " erstellt."})
+	} else {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	}
+}
@@ -0,0 +1,102 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	db "openai-api-proxy/db"
+	"strings"
+	"testing"
+)
+
+func TestAdminKeysRequireAdmin(t *testing.T) {
+	store := newFakeStore()
+	a := newTestHandler(store, "root")
+
+	for name, send := range map[string]func(user string) int{
+		"list": func(user string) int {
+			return request(a.GetAdminKeysTable, user, "GET", "/api2/admin/keys/get", nil).Code
+		},
+		"deactivate": func(user string) int {
+			return request(a.DeactivateKey, user, "POST", "/api2/admin/keys/deactivate/k-erin", nil).Code
+		},
+		"issue": func(user string) int {
+			return request(a.IssueKey, user, "POST", "/api2/admin/keys/issue", url.Values{"owner": {"erin"}}).Code
+		},
+	} {
+		for _, user := range []string{"", "dave"} {
+			if code := send(user); code != http.StatusForbidden {
+				t.Errorf("%s by %q: status = %d, want 403", name, user, code)
+			}
+		}
+	}
+	if store.keys["k-erin"].Deactivated || countKeys(store, "erin") != 1 {
+		t.Error("a non-admin changed the keys of another user")
+	}
+
+	if w := request(a.GetAdminKeysTable, "root", "GET", "/api2/admin/keys/get", nil); w.Code != http.StatusOK ||
+		!strings.Contains(w.Body.String(), "erins-key") || !strings.Contains(w.Body.String(), "support-bot") {
+		t.Errorf("admin list: status = %d, body %s", w.Code, w.Body.String())
+	}
+}
+
+func TestAdminDeactivateKeyOfUser(t *testing.T) {
+	store := newFakeStore()
+	store.keys["k-root"] = &db.ApiKey{UUID: "k-root", Owner: "root", Description: "admins-key"}
+	a := newTestHandler(store, "root")
+
+	if w := request(a.DeactivateKey, "root", "POST", "/api2/admin/keys/deactivate/k-erin", nil); w.Code != http.StatusOK {
+		t.Fatalf("deactivate: status = %d", w.Code)
+	}
+	if !store.keys["k-erin"].Deactivated || store.keys["k-root"].Deactivated {
+		t.Errorf("deactivated erin %v, root %v; want only the key of erin",
+			store.keys["k-erin"].Deactivated, store.keys["k-root"].Deactivated)
+	}
+	if w := request(a.ReactivateKey, "root", "POST", "/api2/admin/keys/reactivate/k-erin", nil); w.Code != http.StatusOK || store.keys["k-erin"].Deactivated {
+		t.Errorf("reactivate: status = %d, deactivated %v", w.Code, store.keys["k-erin"].Deactivated)
+	}
+	if w := request(a.DeactivateKey, "root", "POST", "/api2/admin/keys/deactivate/missing", nil); w.Code != http.StatusNotFound {
+		t.Errorf("unknown key: status = %d, want 404", w.Code)
+	}
+}
+
+func TestAdminIssueKeyForUser(t *testing.T) {
+	store := newFakeStore()
+	a := newTestHandler(store, "root")
+
+	w := request(a.IssueKey, "root", "POST", "/api2/admin/keys/issue", url.Values{"owner": {"erin"}, "beschreibung": {"onboarding"}})
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "sk-proxy-") {
+		t.Fatalf("issue: status = %d, body %s", w.Code, w.Body.String())
+	}
+	var issued *db.ApiKey
+	for _, k := range store.keys {
+		if k.Description == "onboarding" {
+			issued = k
+		}
+	}
+	if issued == nil || issued.Owner != "erin" || issued.KeyID == "" {
+		t.Fatalf("issued key %+v, want one of erin with a key ID", issued)
+	}
+	if countKeys(store, "root") != 0 {
+		t.Error("the key was issued for the admin")
+	}
+
+	w = request(a.IssueKey, "root", "POST", "/api2/admin/keys/issue", url.Values{"owner": {"mallory"}})
+	if !strings.Contains(w.Body.String(), "Unbekannter User") || countKeys(store, "mallory") != 0 {
+		t.Errorf("unknown owner: body %s", w.Body.String())
+	}
+}
+
+func TestAdminIssueKeyEscapesOwner(t *testing.T) {
+	store := newFakeStore()
+	owner := `<img src=x onerror=alert(1)>`
+	store.users[owner] = &db.User{Sub: owner, Name: "Mallory"}
+	a := newTestHandler(store, "root")
+
+	w := request(a.IssueKey, "root", "POST", "/api2/admin/keys/issue", url.Values{"owner": {owner}})
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "sk-proxy-") {
+		t.Fatalf("issue: status = %d, body %s", w.Code, w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), "<img") || !strings.Contains(w.Body.String(), "&lt;img") {
+		t.Errorf("owner not escaped: %s", w.Body.String())
+	}
+}
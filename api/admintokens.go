@@ -0,0 +1,159 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"html"
+	"html/template"
+	"log"
+	"net/http"
+	db "openai-api-proxy/db"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GetAdminTokensTable lists the tokens for the /manage/v1 API.
+func (a *ApiHandler) GetAdminTokensTable(w http.ResponseWriter, r *http.Request) {
+	ok, err := a.auth.ValidateAdminSession(w, r)
+	if err == nil && ok {
+		tokens, err := a.db.ListAdminTokens()
+		if err != nil {
+			log.Printf("Error fetching admin tokens: %v", err)
+			http.Error(w, "Error fetching admin tokens", http.StatusInternalServerError)
+			return
+		}
+		for i := range tokens {
+			tokens[i].CreatedAt = tokens[i].CreatedAt.In(a.location())
+			tokens[i].ExpiresAt = tokens[i].ExpiresAt.In(a.location())
+			tokens[i].LastUsedAt = tokens[i].LastUsedAt.In(a.location())
+		}
+
+		templContent := `
+<div class="mt-8">
+    <h2 class="text-2xl font-bold mb-4">Management API Tokens</h2>
+    <p class="mb-4 text-sm text-gray-500">Tokens für die JSON-API unter /manage/v1. Lese-Tokens dürfen nur GET-Anfragen stellen.</p>
+    <div class="mb-4">
+        <form hx-post="/api2/admin/tokens/create" hx-target="#popup-content" hx-swap="innerHTML">
+            <input type="text" name="name" placeholder="Name" class="p-2 bg-gray-50 border border-gray-300 text-gray-900 text-sm rounded-lg focus:ring-blue-500 focus:border-blue-500 dark:bg-gray-700 dark:border-gray-600 dark:placeholder-gray-400 dark:text-white dark:focus:ring-blue-500 dark:focus:border-blue-500" required>
+            <select name="scope" class="p-2 bg-gray-50 border border-gray-300 text-gray-900 text-sm rounded-lg focus:ring-blue-500 focus:border-blue-500 dark:bg-gray-700 dark:border-gray-600 dark:placeholder-gray-400 dark:text-white dark:focus:ring-blue-500 dark:focus:border-blue-500">
+                <option value="read">read</option>
+                <option value="write">write</option>
+            </select>
+            <input type="date" name="expires" title="Gültig bis" class="p-2 bg-gray-50 border border-gray-300 text-gray-900 text-sm rounded-lg focus:ring-blue-500 focus:border-blue-500 dark:bg-gray-700 dark:border-gray-600 dark:placeholder-gray-400 dark:text-white dark:focus:ring-blue-500 dark:focus:border-blue-500">
+            <button type="submit" class="ml-2 bg-blue-500 hover:bg-blue-700 text-white font-bold py-2 px-4 rounded">
+                Create Token
+            </button>
+        </form>
+    </div>
+    <table class="min-w-full divide-y dark:text-gray-200 divide-gray-200 shadow overflow-hidden rounded-lg">
+        <thead class="bg-gray-50 dark:bg-slate-800 dark:text-white text-gray-500">
+            <tr>
+                <th class="px-6 py-3 text-left text-xs font-medium uppercase tracking-wider">Name</th>
+                <th class="px-6 py-3 text-left text-xs font-medium uppercase tracking-wider">Scope</th>
+                <th class="px-6 py-3 text-left text-xs font-medium uppercase tracking-wider">Erstellt</th>
+                <th class="px-6 py-3 text-left text-xs font-medium uppercase tracking-wider">Gültig bis</th>
+                <th class="px-6 py-3 text-left text-xs font-medium uppercase tracking-wider">Zuletzt genutzt</th>
+                <th class="px-6 py-3 text-left text-xs font-medium uppercase tracking-wider"></th>
+            </tr>
+        </thead>
+        <tbody class="bg-white dark:bg-slate-900 divide-y divide-gray-200">
+            {{range .}}
+            <tr{{if not .Active}} class="text-gray-400"{{end}}>
+                <td class="px-6 py-4 whitespace-nowrap">{{.Name}}</td>
+                <td class="px-6 py-4 whitespace-nowrap">{{.Scope}}</td>
+                <td class="px-6 py-4 whitespace-nowrap">{{.CreatedAt.Format "02.01.2006 15:04"}}</td>
+                <td class="px-6 py-4 whitespace-nowrap">{{if .ExpiresAt.IsZero}}unbegrenzt{{else}}{{.ExpiresAt.Format "02.01.2006"}}{{end}}</td>
+                <td class="px-6 py-4 whitespace-nowrap">{{if .LastUsedAt.IsZero}}nie{{else}}{{.LastUsedAt.Format "02.01.2006 15:04"}}{{end}}</td>
+                <td class="px-6 py-4 whitespace-nowrap text-right text-sm font-medium">
+                    <button hx-delete="/api2/admin/tokens/revoke/{{.ID}}" hx-target="#admin-tokens-container" hx-swap="innerHTML"
+                            hx-confirm="Möchtest du den Token wirklich widerrufen?"
+                            class="text-red-600 hover:text-indigo-900">
+                        Revoke
+                    </button>
+                </td>
+            </tr>
+            {{else}}
+            <tr><td colspan="6" class="px-6 py-4 text-gray-500">Keine Tokens vorhanden.</td></tr>
+            {{end}}
+        </tbody>
+    </table>
+</div>
+`
+		templ, err := template.New("adminTokensTable").Parse(templContent)
+		if err != nil {
+			log.Printf("Error parsing template: %v", err)
+			http.Error(w, "Error parsing template", http.StatusInternalServerError)
+			return
+		}
+
+		err = templ.Execute(w, tokens)
+		if err != nil {
+			log.Printf("Error executing template: %v", err)
+		}
+	} else {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	}
+}
+
+// CreateAdminToken creates a token for the management API and shows it once.
+func (a *ApiHandler) CreateAdminToken(w http.ResponseWriter, r *http.Request) {
+	ok, err := a.auth.ValidateAdminSession(w, r)
+	if err == nil && ok {
+		claims, err := a.auth.GetClaims(r)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		r.ParseForm()
+		t := db.AdminToken{
+			Name:      strings.TrimSpace(r.Form.Get("name")),
+			Scope:     r.Form.Get("scope"),
+			CreatedBy: claims.Sub,
+		}
+		if t.Scope != db.AdminScopeWrite {
+			t.Scope = db.AdminScopeRead
+		}
+		if expires := strings.TrimSpace(r.Form.Get("expires")); expires != "" {
+			day, err := time.ParseInLocation("2006-01-02", expires, a.location())
+			if err != nil {
+				w.Write([]byte(`<div class="p-2 text-red-600 font-semibold">Ungültiges Ablaufdatum ` + html.EscapeString(expires) + `</div>`))
+				return
+			}
+			t.ExpiresAt = day.AddDate(0, 0, 1)
+		}
+		token, err := a.db.CreateAdminToken(&t)
+		if err != nil {
+			log.Printf("Error creating admin token: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		a.writeKeyPopup(w, keyPopup{Key: token, Note: "Token " + t.Name + " (" + t.Scope + ") erstellt."})
+	} else {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	}
+}
+
+func (a *ApiHandler) RevokeAdminToken(w http.ResponseWriter, r *http.Request) {
+	ok, err := a.auth.ValidateAdminSession(w, r)
+	if err == nil && ok {
+		id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/api2/admin/tokens/revoke/"), 10, 64)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		err = a.db.RevokeAdminToken(id)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error revoking admin token %d: %v", id, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		a.GetAdminTokensTable(w, r)
+	} else {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	}
+}
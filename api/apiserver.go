@@ -7,6 +7,7 @@ import (
 	auth "openai-api-proxy/auth"
 	db "openai-api-proxy/db"
 	"os"
+	"time"
 
 	"github.com/Masterminds/sprig/v3"
 )
@@ -27,15 +28,81 @@ func ApiInit(mux *http.ServeMux, a *auth.Auth, db *db.Database) {
 	mux.HandleFunc("/api2/table/get", api.GetTable)
 	mux.HandleFunc("/api2/table/entry/save", api.CreateEntry)
 	mux.HandleFunc("/api2/table/entry/delete/", api.DeleteEntry)
+	mux.HandleFunc("/api2/table/entry/rotate/", api.RotateEntry)
 	mux.HandleFunc("/api2/admin/models/get", api.GetModelsTable)
 	mux.HandleFunc("/api2/admin/models/add", api.AddModel)
 	mux.HandleFunc("/api2/admin/models/delete/", api.DeleteModel)
+	mux.HandleFunc("/api2/admin/keys/get", api.GetAdminKeysTable)
+	mux.HandleFunc("/api2/admin/keys/issue", api.IssueKey)
+	mux.HandleFunc("/api2/admin/keys/deactivate/", api.DeactivateKey)
+	mux.HandleFunc("/api2/admin/keys/reactivate/", api.ReactivateKey)
+	mux.HandleFunc("/api2/admin/keys/audit-on/", api.EnableKeyAudit)
+	mux.HandleFunc("/api2/admin/keys/audit-off/", api.DisableKeyAudit)
+	mux.HandleFunc("/api2/admin/keys/cache-on/", api.EnableKeyResponseCache)
+	mux.HandleFunc("/api2/admin/keys/cache-off/", api.DisableKeyResponseCache)
+	mux.HandleFunc("/api2/admin/keys/archived/get", api.GetArchivedKeysTable)
+	mux.HandleFunc("/api2/admin/keys/restore/", api.RestoreEntry)
+	mux.HandleFunc("/api2/admin/teams/get", api.GetTeamsTable)
+	mux.HandleFunc("/api2/admin/teams/managers/add", api.AddTeamManager)
+	mux.HandleFunc("/api2/admin/teams/managers/delete/", api.RemoveTeamManager)
+	mux.HandleFunc("/api2/admin/tokens/get", api.GetAdminTokensTable)
+	mux.HandleFunc("/api2/admin/tokens/create", api.CreateAdminToken)
+	mux.HandleFunc("/api2/admin/tokens/revoke/", api.RevokeAdminToken)
 
 }
 
+// keyTable is rendered by templates/table.html.templ.
+type keyTable struct {
+	Keys  []db.ApiKey
+	Teams []db.Team // teams the user manages keys for
+}
+
+// Store is the subset of database methods used by the web UI handlers.
+type Store interface {
+	WriteUser(u *db.User) error
+	GetUser(uid string) (*db.User, error)
+	ListUsers() ([]db.User, error)
+	WriteEntry(k *db.ApiKey) error
+	DeleteEntry(key *string, uid string) error
+	RotateApiKey(uuid, user, keyID, hash string, grace time.Duration) (time.Time, error)
+	RestoreApiKey(uuid string) error
+	ListAllApiKeys() ([]db.ApiKey, error)
+	ListArchivedApiKeys() ([]db.ApiKey, error)
+	SetApiKeyDeactivated(uuid string, deactivated bool) error
+	SetApiKeyAuditContent(uuid string, enabled bool) error
+	SetApiKeyResponseCacheOptOut(uuid string, optOut bool) error
+	LookupApiKeyInfos(uid string) ([]db.ApiKey, error)
+	LookupApiKeyUserOverview() ([]db.RequestSummary, error)
+	LookupApiKeyUserStats(uid, kind, filter string, overwriteDateTrunc bool) ([]db.RequestSummary, error)
+	LookupApiKeyUserStatsRows(uid, kind string) (int, error)
+	LookupCacheSavings(uid, kind, filter string) ([]db.RequestSummary, error)
+	LookupRequestHealth(uid, kind, filter string) ([]db.RequestHealth, error)
+	LookupCosts(model string) []db.Costs
+	ListModels() ([]db.Model, error)
+	AddConfiguredModel(m *db.Model) error
+	DeleteConfiguredModel(id string) error
+	ListManagedTeams(user string) ([]db.Team, error)
+	IsTeamManager(user string, groupID int64) (bool, error)
+	EnsureServiceAccount(groupID int64) (string, error)
+	ListTeams() ([]db.Team, error)
+	AddTeamManager(groupID int64, user string) error
+	RemoveTeamManager(groupID int64, user string) error
+	ListAdminTokens() ([]db.AdminToken, error)
+	CreateAdminToken(t *db.AdminToken) (string, error)
+	RevokeAdminToken(id int64) error
+}
+
+// Sessions checks the OIDC session of the web UI, see auth.Auth.
+type Sessions interface {
+	ValidateSessionToken(w http.ResponseWriter, r *http.Request) bool
+	ValidateAdminSession(w http.ResponseWriter, r *http.Request) (bool, error)
+	GetClaims(r *http.Request) (*auth.Claims, error)
+	LogoutHandler(w http.ResponseWriter, r *http.Request)
+}
+
 type ApiHandler struct {
-	db       *db.Database
-	auth     *auth.Auth
+	db       Store
+	auth     Sessions
 	timeZone string
 }
 
@@ -123,13 +190,34 @@ func (a *ApiHandler) GetTable(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		log.Fatal(err)
 	}
+	teams, err := a.db.ListManagedTeams(claims.Sub)
+	if err != nil {
+		log.Printf("Error fetching teams of %s: %v", claims.Sub, err)
+	}
+	for _, team := range teams {
+		teamKeys, err := a.db.LookupApiKeyInfos(team.Account)
+		if err != nil {
+			log.Printf("Error fetching keys of team %d: %v", team.ID, err)
+			continue
+		}
+		for i := range teamKeys {
+			teamKeys[i].Team = team.Title
+		}
+		keys = append(keys, teamKeys...)
+	}
+	for i := range keys {
+		keys[i].ExpiresAt = keys[i].ExpiresAt.In(a.location())
+		keys[i].LastUsedAt = keys[i].LastUsedAt.In(a.location())
+		keys[i].GraceUntil = keys[i].GraceUntil.In(a.location())
+		keys[i].GraceLastUsedAt = keys[i].GraceLastUsedAt.In(a.location())
+	}
 	templ := template.Must(template.New("table.html.templ").Funcs(sprig.FuncMap()).ParseFiles("templates/table.html.templ"))
 
 	if err != nil {
 		panic(err)
 	}
 
-	err = templ.Execute(w, keys)
+	err = templ.Execute(w, keyTable{Keys: keys, Teams: teams})
 	if err != nil {
 		panic(err)
 	}
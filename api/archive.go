@@ -0,0 +1,95 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+)
+
+func (a *ApiHandler) GetArchivedKeysTable(w http.ResponseWriter, r *http.Request) {
+	ok, err := a.auth.ValidateAdminSession(w, r)
+	if err == nil && ok {
+		keys, err := a.db.ListArchivedApiKeys()
+		if err != nil {
+			log.Printf("Error fetching archived keys: %v", err)
+			http.Error(w, "Error fetching archived keys", http.StatusInternalServerError)
+			return
+		}
+		for i := range keys {
+			keys[i].ArchivedAt = keys[i].ArchivedAt.In(a.location())
+		}
+
+		templContent := `
+<div class="mt-8">
+    <h2 class="text-2xl font-bold mb-4">Archivierte Keys</h2>
+    {{if .}}
+    <table class="min-w-full divide-y dark:text-gray-200 divide-gray-200 shadow overflow-hidden rounded-lg">
+        <thead class="bg-gray-50 dark:bg-slate-800 dark:text-white text-gray-500">
+            <tr>
+                <th class="px-6 py-3 text-left text-xs font-medium uppercase tracking-wider">APIKEY ID</th>
+                <th class="px-6 py-3 text-left text-xs font-medium uppercase tracking-wider">User</th>
+                <th class="px-6 py-3 text-left text-xs font-medium uppercase tracking-wider">Beschreibung</th>
+                <th class="px-6 py-3 text-left text-xs font-medium uppercase tracking-wider">Archiviert</th>
+                <th class="px-6 py-3 text-left text-xs font-medium uppercase tracking-wider"></th>
+            </tr>
+        </thead>
+        <tbody class="bg-white dark:bg-slate-900 divide-y divide-gray-200">
+            {{range .}}
+            <tr>
+                <td class="px-6 py-4 whitespace-nowrap">{{.UUID}}</td>
+                <td class="px-6 py-4 whitespace-nowrap">{{.Owner}}</td>
+                <td class="px-6 py-4 whitespace-nowrap">{{.Description}}</td>
+                <td class="px-6 py-4 whitespace-nowrap">{{.ArchivedAt.Format "02.01.2006 15:04"}}</td>
+                <td class="px-6 py-4 whitespace-nowrap text-right text-sm font-medium">
+                    <button hx-post="/api2/admin/keys/restore/{{.UUID}}" hx-target="#archived-keys-container" hx-swap="innerHTML"
+                            class="text-indigo-600 dark:text-indigo-500 hover:text-indigo-900">
+                        Restore
+                    </button>
+                </td>
+            </tr>
+            {{end}}
+        </tbody>
+    </table>
+    {{else}}
+        <p class="text-gray-500">Keine archivierten Keys.</p>
+    {{end}}
+</div>
+`
+		templ, err := template.New("archivedKeysTable").Parse(templContent)
+		if err != nil {
+			log.Printf("Error parsing template: %v", err)
+			http.Error(w, "Error parsing template", http.StatusInternalServerError)
+			return
+		}
+
+		err = templ.Execute(w, keys)
+		if err != nil {
+			log.Printf("Error executing template: %v", err)
+		}
+	} else {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	}
+}
+
+func (a *ApiHandler) RestoreEntry(w http.ResponseWriter, r *http.Request) {
+	ok, err := a.auth.ValidateAdminSession(w, r)
+	if err == nil && ok {
+		key := strings.TrimPrefix(r.URL.Path, "/api2/admin/keys/restore/")
+		err := a.db.RestoreApiKey(key)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error restoring key %s: %v", key, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		a.GetArchivedKeysTable(w, r)
+	} else {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	}
+}
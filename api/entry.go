@@ -1,34 +1,21 @@
 package api
 
 import (
-	"crypto/rand"
-	"encoding/base32"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html"
+	"html/template"
 	"log"
 	"net/http"
 	db "openai-api-proxy/db"
+	"strconv"
 	"strings"
-	"text/template"
+	"time"
 
 	"github.com/google/uuid"
-	"golang.org/x/crypto/bcrypt"
 )
 
-func (a *ApiHandler) generateToken(length int) string {
-	randomBytes := make([]byte, 32)
-	_, err := rand.Read(randomBytes)
-	if err != nil {
-		panic(err)
-	}
-	return base32.StdEncoding.EncodeToString(randomBytes)[:length]
-}
-func (a *ApiHandler) hashToken(token string) string {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(token), 5)
-	if err != nil {
-		log.Println("Error while hashing Secret: ", err)
-	}
-	return string(bytes)
-}
-
 func (a *ApiHandler) CreateEntry(w http.ResponseWriter, r *http.Request) {
 	// Check if Request is Authenticated
 	if !a.auth.ValidateSessionToken(w, r) {
@@ -43,18 +30,113 @@ func (a *ApiHandler) CreateEntry(w http.ResponseWriter, r *http.Request) {
 	}
 
 	r.ParseForm()
-	uuid := uuid.NewString()
-	apikey := a.generateToken(32)
 	h := db.ApiKey{
-		UUID:        uuid,
-		ApiKey:      a.hashToken(apikey),
 		Owner:       claims.Sub,
 		AiApi:       r.Form.Get("apitype"),
 		Description: r.Form.Get("beschreibung"),
 	}
-	a.db.WriteEntry(&h)
+	if err := a.parseKeyRestrictions(r, &h); err != nil {
+		w.Write([]byte(`<div class="p-2 text-red-600 font-semibold">` + html.EscapeString(err.Error()) + `</div>`))
+		return
+	}
+	if team := r.Form.Get("team"); team != "" {
+		owner, err := a.teamAccount(claims.Sub, team)
+		if err != nil {
+			log.Printf("Creating team key for %s failed: %v", team, err)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		h.Owner = owner
+	}
+	apikey, err := a.issueKey(&h)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	a.writeKeyPopup(w, keyPopup{Key: apikey})
+}
+
+// issueKey generates the UUID and secret of k, stores it and returns the
+// key to show to the user once.
+func (a *ApiHandler) issueKey(k *db.ApiKey) (string, error) {
+	apikey, keyID, hash, err := db.GenerateApiKey()
+	if err != nil {
+		return "", err
+	}
+	k.UUID = uuid.NewString()
+	k.KeyID = keyID
+	k.ApiKey = hash
+	if err := a.db.WriteEntry(k); err != nil {
+		return "", err
+	}
+	return apikey, nil
+}
+
+var errNotTeamManager = errors.New("not a manager of the team")
+
+// teamAccount returns the service account owning the keys of the team with
+// the given ID, if user manages the team.
+func (a *ApiHandler) teamAccount(user, team string) (string, error) {
+	groupID, err := strconv.ParseInt(team, 10, 64)
+	if err != nil {
+		return "", err
+	}
+	ok, err := a.db.IsTeamManager(user, groupID)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", errNotTeamManager
+	}
+	return a.db.EnsureServiceAccount(groupID)
+}
 
-	popupContent := `
+// RotateEntry issues a new secret for an existing key. The previous secret
+// keeps working for API_KEY_ROTATION_GRACE, so clients can be switched over
+// without downtime; the usage history stays with the key.
+func (a *ApiHandler) RotateEntry(w http.ResponseWriter, r *http.Request) {
+	// Check if Request is Authenticated
+	if !a.auth.ValidateSessionToken(w, r) {
+		a.Unauthenticated(w, r)
+		return
+	}
+
+	claims, err := a.auth.GetClaims(r)
+	if err != nil {
+		// If Claims Extraction Failed, user will be Redirected to Update his Token.
+		a.Unauthenticated(w, r)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/api2/table/entry/rotate/")
+	apikey, keyID, hash, err := db.GenerateApiKey()
+	if err != nil {
+		log.Println("Error while generating key: ", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	graceUntil, err := a.db.RotateApiKey(key, claims.Sub, keyID, hash, db.RotationGrace())
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Rotating key %s failed: %v", key, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	note := "Der alte Key ist ab sofort ungültig."
+	if graceUntil.After(time.Now()) {
+		note = "Der alte Key bleibt bis " + graceUntil.In(a.location()).Format("02.01.2006 15:04") + " gültig."
+	}
+	a.writeKeyPopup(w, keyPopup{Key: apikey, Note: note})
+}
+
+type keyPopup struct {
+	Key  string
+	Note string
+}
+
+var keyPopupTemplate = template.Must(template.New("keypopup").Parse(`
 	<div class="w-full max-w-[40rem] ">
     <div class="relative">
 	<div class="text-center p-2">
@@ -64,20 +146,61 @@ func (a *ApiHandler) CreateEntry(w http.ResponseWriter, r *http.Request) {
 		</div>
 	</div>
 		<label class="block text-gray-700 dark:text-gray-300 text-sm font-bold mb-2" for="apikey">Api Key:</label>
-        <input id="apikey" type="text" class="p-2 bg-gray-50 border border-gray-300 text-gray-500 text-sm rounded-lg focus:ring-blue-500 focus:border-blue-500 block w-80 p-2.5 dark:bg-gray-700 dark:border-gray-600 dark:placeholder-gray-400 dark:text-gray-400 dark:focus:ring-blue-500 dark:focus:border-blue-500" value="{{ . }}" disabled readonly>
+        <input id="apikey" type="text" class="p-2 bg-gray-50 border border-gray-300 text-gray-500 text-sm rounded-lg focus:ring-blue-500 focus:border-blue-500 block w-80 p-2.5 dark:bg-gray-700 dark:border-gray-600 dark:placeholder-gray-400 dark:text-gray-400 dark:focus:ring-blue-500 dark:focus:border-blue-500" value="{{ .Key }}" disabled readonly>
+		{{ if .Note }}<p class="mt-2 text-sm text-gray-700 dark:text-gray-300">{{ .Note }}</p>{{ end }}
 	</div>
 	</div>
 
-	`
-	popupTemplate, err := template.New(popupContent).Parse(popupContent)
-	if err != nil {
-		log.Println("Error while templating the pop up")
+	`))
+
+// writeKeyPopup shows a newly issued key once.
+func (a *ApiHandler) writeKeyPopup(w http.ResponseWriter, p keyPopup) {
+	if err := keyPopupTemplate.Execute(w, p); err != nil {
+		log.Println("Error while filling out the Template or writing Response")
+	}
+}
+
+// parseKeyRestrictions reads the optional expiry date and allow-lists of the
+// key form into k.
+func (a *ApiHandler) parseKeyRestrictions(r *http.Request, k *db.ApiKey) error {
+	if expires := strings.TrimSpace(r.Form.Get("expires")); expires != "" {
+		day, err := time.ParseInLocation("2006-01-02", expires, a.location())
+		if err != nil {
+			return fmt.Errorf("Ungültiges Ablaufdatum %q", expires)
+		}
+		// The key stays valid for the whole selected day.
+		k.ExpiresAt = day.AddDate(0, 0, 1)
+		if !k.ExpiresAt.After(time.Now()) {
+			return fmt.Errorf("Das Ablaufdatum %s liegt in der Vergangenheit", expires)
+		}
+	}
+	k.AllowedModels = splitFormList(r.Form.Get("models"))
+	k.AllowedEndpoints = splitFormList(r.Form.Get("endpoints"))
+	k.AllowedCIDRs = splitFormList(r.Form.Get("cidrs"))
+	for _, cidr := range k.AllowedCIDRs {
+		if err := db.ValidateCIDR(cidr); err != nil {
+			return fmt.Errorf("Ungültiges IP-Netz %q", cidr)
+		}
 	}
+	return nil
+}
+
+func splitFormList(s string) []string {
+	var list []string
+	for _, v := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' || r == '\n' }) {
+		list = append(list, strings.TrimSpace(v))
+	}
+	return list
+}
 
-	err = popupTemplate.Execute(w, apikey)
+// location is the time zone of the web UI, see TIMEZONE.
+func (a *ApiHandler) location() *time.Location {
+	loc, err := time.LoadLocation(a.timeZone)
 	if err != nil {
-		log.Println("Error while filling out the Template or writing Response")
+		log.Println("Error loading Timezone, maybe the TIMEZONE env is wrongly set")
+		return time.Local
 	}
+	return loc
 }
 
 func (a *ApiHandler) DeleteEntry(w http.ResponseWriter, r *http.Request) {
@@ -92,7 +215,16 @@ func (a *ApiHandler) DeleteEntry(w http.ResponseWriter, r *http.Request) {
 		// If Claims Extraction Failed, user will be Redirected to Update his Token.
 		a.Unauthenticated(w, r)
 	}
-	w.Header().Set("HX-Trigger", "rld")
 	key := strings.TrimPrefix(r.URL.Path, "/api2/table/entry/delete/")
-	a.db.DeleteEntry(&key, claims.Sub)
+	err = a.db.DeleteEntry(&key, claims.Sub)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Archiving key %s failed: %v", key, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("HX-Trigger", "rld")
 }
@@ -164,7 +164,8 @@ func (g *GraphHandler) RenderGraph(gr *Graph) {
 	// Where the magic happens
 	chartSnippet := line.RenderSnippet()
 
-	tmpl := "{{.Element}} <div class=\"content-center -ml-4 w-96 text-center text-xs grid\" ><i>{{.Filter}}: {{if .Estimated}}~{{end}}{{.TotalCount}} {{.Unit}}</i> </div> {{.Script}}"
+	tmpl := "{{.Element}} <div class=\"content-center -ml-4 w-96 text-center text-xs grid\" ><i>{{.Filter}}: {{if .Estimated}}~{{end}}{{.TotalCount}} {{.Unit}}{{if .Savings}} · {{.Savings}} {{.Unit}} aus dem Cache{{end}}</i> </div> {{.Script}}" +
+		"{{range .Health}}{{.Element}} <div class=\"content-center -ml-4 w-96 text-center text-xs grid\" ><i>{{.Caption}}</i> </div> {{.Script}}{{end}}"
 	t := template.New("snippet")
 	t, err = t.Parse(tmpl)
 	if err != nil {
@@ -179,6 +180,8 @@ func (g *GraphHandler) RenderGraph(gr *Graph) {
 		Unit       string
 		Filter     string
 		Estimated  bool
+		Savings    string
+		Health     []healthSnippet
 	}{
 		Element:    template.HTML(chartSnippet.Element),
 		Script:     template.HTML(chartSnippet.Script),
@@ -187,6 +190,8 @@ func (g *GraphHandler) RenderGraph(gr *Graph) {
 		Filter:     gr.filter,
 		Estimated:  td.isEstimated,
 		Unit:       getUnits()[gr.unit],
+		Savings:    g.cacheSavings(gr),
+		Health:     g.renderHealthCharts(gr),
 	}
         if err := t.Execute(gr.w, snippetData); err != nil {
                 log.Println("Error Templating Chart", err)
@@ -317,19 +322,7 @@ func (g *GraphHandler) SetTableGraphData(gr *Graph, d []db.RequestSummary) (*Tab
 		timeAxis: make([]string, 0),
 	}
 
-	format := "15:04"
-
-	switch gr.filter {
-	case "24 Hours":
-		format = "15:04"
-
-	case "7 days":
-		format = "Mon"
-	case "Last Month", "This Month", "30 days":
-		format = "02"
-	case "Last Year", "This Year":
-		format = "Jan"
-	}
+	format := axisFormat(gr.filter)
 
 	if len(d) < 1 {
 		http.Error(gr.w, "&emsp;&emsp;&emsp;&emsp;&emsp;&emsp;&emsp;&emsp;&emsp;&emsp;No Data", 200)
@@ -377,6 +370,155 @@ func (g *GraphHandler) SetTableGraphData(gr *Graph, d []db.RequestSummary) (*Tab
 	return td, nil
 }
 
+// cacheSavings is the total of tokens or costs that cache hits saved in the
+// timeframe of the graph, empty if there were none.
+func (g *GraphHandler) cacheSavings(gr *Graph) string {
+	rows, err := g.a.db.LookupCacheSavings(gr.key, gr.kind, gr.filter)
+	if err != nil {
+		log.Println("Error looking up cache savings", err)
+		return ""
+	}
+	return formatSavings(rows, gr.overwriteDateTrunc, func(row db.RequestSummary) float64 {
+		cost, _ := g.GetCost(row)
+		return cost
+	})
+}
+
+// formatSavings sums the saved tokens of rows, or their costs if money is set,
+// formatted like the total of the graph.
+func formatSavings(rows []db.RequestSummary, money bool, cost func(db.RequestSummary) float64) string {
+	if len(rows) == 0 {
+		return ""
+	}
+	if money {
+		var total float64
+		for _, row := range rows {
+			total += cost(row)
+		}
+		return fmt.Sprintf("%.4f", total)
+	}
+	var total int
+	for _, row := range rows {
+		total += row.SavedTokenCount
+	}
+	return fmt.Sprintf("%v", total)
+}
+
+// axisFormat is the time layout of the x axis labels for filter.
+func axisFormat(filter string) string {
+	switch filter {
+	case "7 days":
+		return "Mon"
+	case "Last Month", "This Month", "30 days":
+		return "02"
+	case "Last Year", "This Year":
+		return "Jan"
+	}
+	return "15:04"
+}
+
+type healthSnippet struct {
+	Element template.HTML
+	Script  template.HTML
+	Caption string
+}
+
+// renderHealthCharts renders the error rate and latency charts shown below
+// the token graph. Requests recorded before statuses were stored are left
+// out, so there are no charts for keys without newer requests.
+func (g *GraphHandler) renderHealthCharts(gr *Graph) []healthSnippet {
+	rows, err := g.a.db.LookupRequestHealth(gr.key, gr.kind, gr.filter)
+	if err != nil {
+		log.Println("Could not look up request health:", err)
+		return nil
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	loc, err := time.LoadLocation(g.a.timeZone)
+	if err != nil {
+		loc = time.UTC
+	}
+	hd := healthData(rows, axisFormat(gr.filter), loc)
+
+	errorChart := newHealthChart("white")
+	errorChart.SetXAxis(hd.timeAxis).AddSeries("Fehlerquote", hd.errorRate)
+	latencyChart := newHealthChart("white", "#94a3b8")
+	latencyChart.SetXAxis(hd.timeAxis).
+		AddSeries("Ø Latenz", hd.latency).
+		AddSeries("Ø TTFB", hd.ttfb)
+
+	var rate float64
+	if hd.count > 0 {
+		rate = float64(hd.errors) * 100 / float64(hd.count)
+	}
+	var snippets []healthSnippet
+	for _, c := range []struct {
+		chart   *charts.Line
+		caption string
+	}{
+		{errorChart, fmt.Sprintf("Fehlerquote: %.1f %% von %d Anfragen", rate, hd.count)},
+		{latencyChart, fmt.Sprintf("Ø Latenz: %d ms, bis zum ersten Byte: %d ms", hd.avgLatency.Milliseconds(), hd.avgTTFB.Milliseconds())},
+	} {
+		snippet := c.chart.RenderSnippet()
+		snippets = append(snippets, healthSnippet{
+			Element: template.HTML(snippet.Element),
+			Script:  template.HTML(snippet.Script),
+			Caption: c.caption,
+		})
+	}
+	return snippets
+}
+
+func newHealthChart(colors ...string) *charts.Line {
+	line := charts.NewLine()
+	line.SetGlobalOptions(
+		charts.WithColorsOpts(opts.Colors(colors)),
+		charts.WithGridOpts(opts.Grid{Width: "335px", Height: "50px", Left: "40px", Top: "6px", Bottom: "0px"}),
+		charts.WithInitializationOpts(opts.Initialization{Width: "335px", Height: "80px"}),
+		charts.WithLegendOpts(opts.Legend{Show: opts.Bool(false)}),
+		charts.WithTooltipOpts(opts.Tooltip{Show: opts.Bool(true), Trigger: "axis"}),
+		charts.WithYAxisOpts(opts.YAxis{SplitNumber: 2}),
+	)
+	return line
+}
+
+// HealthData holds the series of the error rate and latency charts.
+type HealthData struct {
+	timeAxis   []string
+	errorRate  []opts.LineData // percent
+	latency    []opts.LineData // ms
+	ttfb       []opts.LineData // ms
+	count      int
+	errors     int
+	avgLatency time.Duration // averages over all buckets
+	avgTTFB    time.Duration
+}
+
+func healthData(rows []db.RequestHealth, format string, loc *time.Location) *HealthData {
+	hd := &HealthData{}
+	var latency, ttfb time.Duration
+	for _, row := range rows {
+		hd.timeAxis = append(hd.timeAxis, row.RequestTime.In(loc).Format(format))
+		var rate float64
+		if row.Count > 0 {
+			rate = float64(row.Errors) * 100 / float64(row.Count)
+		}
+		hd.errorRate = append(hd.errorRate, opts.LineData{Value: fmt.Sprintf("%.1f", rate)})
+		hd.latency = append(hd.latency, opts.LineData{Value: row.AvgDuration.Milliseconds()})
+		hd.ttfb = append(hd.ttfb, opts.LineData{Value: row.AvgTTFB.Milliseconds()})
+		hd.count += row.Count
+		hd.errors += row.Errors
+		latency += row.AvgDuration * time.Duration(row.Count)
+		ttfb += row.AvgTTFB * time.Duration(row.Count)
+	}
+	if hd.count > 0 {
+		hd.avgLatency = latency / time.Duration(hd.count)
+		hd.avgTTFB = ttfb / time.Duration(hd.count)
+	}
+	return hd
+}
+
 func (g *GraphHandler) getCostData(dbs db.RequestSummary) (totalCosts int, estimated bool) {
 	// Delegate to helper so tests can invoke the same logic without DB access.
 	costs := g.a.db.LookupCosts(dbs.Model)
@@ -56,3 +56,44 @@ func TestComputeCosts_CorrectBehavior(t *testing.T) {
 		t.Fatalf("computeCosts returned %d, want %d (correct)", total, expectedCorrect)
 	}
 }
+
+func TestHealthData(t *testing.T) {
+	t0 := time.Date(2026, 10, 17, 8, 0, 0, 0, time.UTC)
+	rows := []db.RequestHealth{
+		{RequestTime: t0, Count: 3, Errors: 0, AvgDuration: 900 * time.Millisecond, AvgTTFB: 300 * time.Millisecond},
+		{RequestTime: t0.Add(time.Hour), Count: 1, Errors: 1, AvgDuration: 100 * time.Millisecond, AvgTTFB: 100 * time.Millisecond},
+	}
+	hd := healthData(rows, axisFormat("24 Hours"), time.UTC)
+
+	if len(hd.timeAxis) != 2 || hd.timeAxis[1] != "09:00" {
+		t.Errorf("time axis = %v", hd.timeAxis)
+	}
+	if hd.errorRate[0].Value != "0.0" || hd.errorRate[1].Value != "100.0" {
+		t.Errorf("error rate = %v", hd.errorRate)
+	}
+	if hd.latency[0].Value != int64(900) || hd.ttfb[1].Value != int64(100) {
+		t.Errorf("latency = %v, ttfb = %v", hd.latency, hd.ttfb)
+	}
+	// The averages are weighted by the number of requests per bucket.
+	if hd.count != 4 || hd.errors != 1 || hd.avgLatency != 700*time.Millisecond || hd.avgTTFB != 250*time.Millisecond {
+		t.Errorf("unexpected totals %+v", hd)
+	}
+}
+
+func TestFormatSavings(t *testing.T) {
+	rows := []db.RequestSummary{
+		{Model: "gpt-4o", SavedTokenCount: 120},
+		{Model: "gpt-5-mini", SavedTokenCount: 30},
+	}
+	cost := func(row db.RequestSummary) float64 { return float64(row.SavedTokenCount) / 1000 }
+
+	if got := formatSavings(nil, false, cost); got != "" {
+		t.Errorf("formatSavings without hits = %q, want empty", got)
+	}
+	if got := formatSavings(rows, false, cost); got != "150" {
+		t.Errorf("formatSavings tokens = %q, want 150", got)
+	}
+	if got := formatSavings(rows, true, cost); got != "0.1500" {
+		t.Errorf("formatSavings costs = %q, want 0.1500", got)
+	}
+}
@@ -4,13 +4,15 @@ import (
 	"html/template"
 	"log"
 	"net/http"
+	db "openai-api-proxy/db"
+	"strconv"
 	"strings"
 )
 
 func (a *ApiHandler) GetModelsTable(w http.ResponseWriter, r *http.Request) {
 	ok, err := a.auth.ValidateAdminSession(w, r)
 	if err == nil && ok {
-		models, err := a.db.ListConfiguredModels()
+		models, err := a.db.ListModels()
 		if err != nil {
 			log.Printf("Error fetching models: %v", err)
 			http.Error(w, "Error fetching models", http.StatusInternalServerError)
@@ -23,6 +25,20 @@ func (a *ApiHandler) GetModelsTable(w http.ResponseWriter, r *http.Request) {
     <div class="mb-4">
         <form hx-post="/api2/admin/models/add" hx-target="#models-table-container" hx-swap="innerHTML">
             <input type="text" name="model_id" placeholder="Model ID (e.g. gpt-4)" class="p-2 bg-gray-50 border border-gray-300 text-gray-900 text-sm rounded-lg focus:ring-blue-500 focus:border-blue-500 dark:bg-gray-700 dark:border-gray-600 dark:placeholder-gray-400 dark:text-white dark:focus:ring-blue-500 dark:focus:border-blue-500" required>
+            <input type="text" name="backend" placeholder="Backend (default if empty)" class="p-2 bg-gray-50 border border-gray-300 text-gray-900 text-sm rounded-lg focus:ring-blue-500 focus:border-blue-500 dark:bg-gray-700 dark:border-gray-600 dark:placeholder-gray-400 dark:text-white dark:focus:ring-blue-500 dark:focus:border-blue-500">
+            <input type="text" name="deployment" placeholder="Deployment (optional)" class="p-2 bg-gray-50 border border-gray-300 text-gray-900 text-sm rounded-lg focus:ring-blue-500 focus:border-blue-500 dark:bg-gray-700 dark:border-gray-600 dark:placeholder-gray-400 dark:text-white dark:focus:ring-blue-500 dark:focus:border-blue-500">
+            <input type="text" name="resource_host" placeholder="Azure resource host (optional)" class="p-2 bg-gray-50 border border-gray-300 text-gray-900 text-sm rounded-lg focus:ring-blue-500 focus:border-blue-500 dark:bg-gray-700 dark:border-gray-600 dark:placeholder-gray-400 dark:text-white dark:focus:ring-blue-500 dark:focus:border-blue-500">
+            <input type="text" name="api_version" placeholder="Azure api-version (optional)" class="p-2 bg-gray-50 border border-gray-300 text-gray-900 text-sm rounded-lg focus:ring-blue-500 focus:border-blue-500 dark:bg-gray-700 dark:border-gray-600 dark:placeholder-gray-400 dark:text-white dark:focus:ring-blue-500 dark:focus:border-blue-500">
+            <input type="password" name="api_key" placeholder="API key (optional)" autocomplete="off" class="p-2 bg-gray-50 border border-gray-300 text-gray-900 text-sm rounded-lg focus:ring-blue-500 focus:border-blue-500 dark:bg-gray-700 dark:border-gray-600 dark:placeholder-gray-400 dark:text-white dark:focus:ring-blue-500 dark:focus:border-blue-500">
+            <input type="number" name="weight" min="1" placeholder="Weight (1)" class="p-2 bg-gray-50 border border-gray-300 text-gray-900 text-sm rounded-lg focus:ring-blue-500 focus:border-blue-500 dark:bg-gray-700 dark:border-gray-600 dark:placeholder-gray-400 dark:text-white dark:focus:ring-blue-500 dark:focus:border-blue-500">
+            <select name="balance" class="p-2 bg-gray-50 border border-gray-300 text-gray-900 text-sm rounded-lg focus:ring-blue-500 focus:border-blue-500 dark:bg-gray-700 dark:border-gray-600 dark:placeholder-gray-400 dark:text-white dark:focus:ring-blue-500 dark:focus:border-blue-500">
+                <option value="">Balance: default</option>
+                <option value="priority">priority</option>
+                <option value="weighted">weighted</option>
+                <option value="least_outstanding">least outstanding</option>
+                <option value="remaining_tokens">remaining tokens</option>
+            </select>
+            <label class="ml-2 text-sm"><input type="checkbox" name="audit_content" value="1"> Inhalte protokollieren</label>
             <button type="submit" class="ml-2 bg-blue-500 hover:bg-blue-700 text-white font-bold py-2 px-4 rounded">
                 Add Model
             </button>
@@ -32,8 +48,8 @@ func (a *ApiHandler) GetModelsTable(w http.ResponseWriter, r *http.Request) {
         {{if .}}
             {{range .}}
             <span class="inline-flex items-center px-3 py-1 rounded-full text-sm font-medium bg-blue-100 text-blue-800 dark:bg-blue-900 dark:text-blue-200">
-                {{.}}
-                <button hx-delete="/api2/admin/models/delete/{{.}}" hx-target="#models-table-container" hx-swap="innerHTML" class="ml-2 inline-flex items-center p-0.5 rounded-full text-blue-400 hover:bg-blue-200 hover:text-blue-500 focus:outline-none">
+                {{.ID}}{{if or .Backend .Deployment .ResourceHost .ApiVersion}}<span class="ml-1 text-xs text-blue-600 dark:text-blue-300">&rarr; {{if .Backend}}{{.Backend}}{{else}}default{{end}}{{if .Deployment}}/{{.Deployment}}{{end}}{{if .ResourceHost}} @ {{.ResourceHost}}{{end}}{{if .ApiVersion}} ({{.ApiVersion}}){{end}}</span>{{end}}{{if .Balance}}<span class="ml-1 text-xs text-blue-600 dark:text-blue-300">[{{.Balance}}]</span>{{end}}{{if .AuditContent}}<span class="ml-1 text-xs text-blue-600 dark:text-blue-300">[Audit]</span>{{end}}
+                <button hx-delete="/api2/admin/models/delete/{{.ID}}" hx-target="#models-table-container" hx-swap="innerHTML" class="ml-2 inline-flex items-center p-0.5 rounded-full text-blue-400 hover:bg-blue-200 hover:text-blue-500 focus:outline-none">
                     <svg class="h-4 w-4" fill="currentColor" viewBox="0 0 20 20">
                         <path fill-rule="evenodd" d="M4.293 4.293a1 1 0 011.414 0L10 8.586l4.293-4.293a1 1 0 111.414 1.414L11.414 10l4.293 4.293a1 1 0 01-1.414 1.414L10 11.414l-4.293 4.293a1 1 0 01-1.414-1.414L8.586 10 4.293 5.707a1 1 0 010-1.414z" clip-rule="evenodd" />
                     </svg>
@@ -67,8 +83,19 @@ func (a *ApiHandler) AddModel(w http.ResponseWriter, r *http.Request) {
 	if err == nil && ok {
 		r.ParseForm()
 		modelID := strings.TrimSpace(r.Form.Get("model_id"))
+		weight, _ := strconv.Atoi(strings.TrimSpace(r.Form.Get("weight")))
 		if modelID != "" {
-			err := a.db.AddConfiguredModel(modelID)
+			err := a.db.AddConfiguredModel(&db.Model{
+				ID:           modelID,
+				Backend:      strings.TrimSpace(r.Form.Get("backend")),
+				Deployment:   strings.TrimSpace(r.Form.Get("deployment")),
+				ResourceHost: strings.TrimSpace(r.Form.Get("resource_host")),
+				ApiVersion:   strings.TrimSpace(r.Form.Get("api_version")),
+				ApiKey:       strings.TrimSpace(r.Form.Get("api_key")),
+				Weight:       weight,
+				Balance:      strings.TrimSpace(r.Form.Get("balance")),
+				AuditContent: r.Form.Get("audit_content") == "1",
+			})
 			if err != nil {
 				log.Printf("Error adding model: %v", err)
 			}
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	db "openai-api-proxy/db"
+	"strconv"
+	"strings"
+)
+
+func (a *ApiHandler) GetTeamsTable(w http.ResponseWriter, r *http.Request) {
+	ok, err := a.auth.ValidateAdminSession(w, r)
+	if err == nil && ok {
+		teams, err := a.db.ListTeams()
+		if err != nil {
+			log.Printf("Error fetching teams: %v", err)
+			http.Error(w, "Error fetching teams", http.StatusInternalServerError)
+			return
+		}
+		users, err := a.db.ListUsers()
+		if err != nil {
+			log.Printf("Error fetching users: %v", err)
+		}
+
+		templContent := `
+<div class="mt-8">
+    <h2 class="text-2xl font-bold mb-4">Team Keys</h2>
+    <p class="mb-4 text-sm text-gray-500">Manager einer Reporting-Gruppe können Keys für das Team erstellen, rotieren und einsehen. Der Ersteller der Gruppe ist immer Manager.</p>
+    <datalist id="team-users">
+        {{range .Users}}<option value="{{.Sub}}">{{.Name}}</option>{{end}}
+    </datalist>
+    <div class="flex flex-col gap-2 p-4 bg-white dark:bg-slate-900 rounded-lg shadow">
+        {{if .Teams}}
+            {{range .Teams}}
+            <div class="flex flex-wrap items-center gap-2">
+                <span class="font-semibold mr-2">{{.Title}}</span>
+                {{$team := .ID}}
+                {{range .Managers}}
+                <span class="inline-flex items-center px-3 py-1 rounded-full text-sm font-medium bg-blue-100 text-blue-800 dark:bg-blue-900 dark:text-blue-200">
+                    {{if .Name}}{{.Name}}{{else}}{{.Sub}}{{end}}
+                    <button hx-delete="/api2/admin/teams/managers/delete/{{$team}}/{{.Sub}}" hx-target="#teams-table-container" hx-swap="innerHTML" class="ml-2 inline-flex items-center p-0.5 rounded-full text-blue-400 hover:bg-blue-200 hover:text-blue-500 focus:outline-none">
+                        <svg class="h-4 w-4" fill="currentColor" viewBox="0 0 20 20">
+                            <path fill-rule="evenodd" d="M4.293 4.293a1 1 0 011.414 0L10 8.586l4.293-4.293a1 1 0 111.414 1.414L11.414 10l4.293 4.293a1 1 0 01-1.414 1.414L10 11.414l-4.293 4.293a1 1 0 01-1.414-1.414L8.586 10 4.293 5.707a1 1 0 010-1.414z" clip-rule="evenodd" />
+                        </svg>
+                    </button>
+                </span>
+                {{end}}
+                <form hx-post="/api2/admin/teams/managers/add" hx-target="#teams-table-container" hx-swap="innerHTML" class="inline-flex">
+                    <input type="hidden" name="group_id" value="{{.ID}}">
+                    <input type="text" name="user_id" list="team-users" placeholder="User ID" class="p-1 bg-gray-50 border border-gray-300 text-gray-900 text-sm rounded-lg dark:bg-gray-700 dark:border-gray-600 dark:text-white" required>
+                    <button type="submit" class="ml-2 bg-blue-500 hover:bg-blue-700 text-white font-bold py-1 px-3 rounded">Add Manager</button>
+                </form>
+            </div>
+            {{end}}
+        {{else}}
+            <p class="text-gray-500">No reporting groups configured.</p>
+        {{end}}
+    </div>
+</div>
+`
+		templ, err := template.New("teamsTable").Parse(templContent)
+		if err != nil {
+			log.Printf("Error parsing template: %v", err)
+			http.Error(w, "Error parsing template", http.StatusInternalServerError)
+			return
+		}
+
+		err = templ.Execute(w, struct {
+			Teams []db.Team
+			Users []db.User
+		}{teams, users})
+		if err != nil {
+			log.Printf("Error executing template: %v", err)
+		}
+	} else {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	}
+}
+
+func (a *ApiHandler) AddTeamManager(w http.ResponseWriter, r *http.Request) {
+	ok, err := a.auth.ValidateAdminSession(w, r)
+	if err == nil && ok {
+		r.ParseForm()
+		groupID, err := strconv.ParseInt(r.Form.Get("group_id"), 10, 64)
+		user := strings.TrimSpace(r.Form.Get("user_id"))
+		if err != nil || user == "" {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if err := a.db.AddTeamManager(groupID, user); err != nil {
+			log.Printf("Error adding manager %s to team %d: %v", user, groupID, err)
+		}
+		a.GetTeamsTable(w, r)
+	} else {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	}
+}
+
+func (a *ApiHandler) RemoveTeamManager(w http.ResponseWriter, r *http.Request) {
+	ok, err := a.auth.ValidateAdminSession(w, r)
+	if err == nil && ok {
+		group, user, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api2/admin/teams/managers/delete/"), "/")
+		groupID, err := strconv.ParseInt(group, 10, 64)
+		if err != nil || user == "" {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		err = a.db.RemoveTeamManager(groupID, user)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("Error removing manager %s from team %d: %v", user, groupID, err)
+		}
+		a.GetTeamsTable(w, r)
+	} else {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	}
+}
@@ -0,0 +1,326 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	auth "openai-api-proxy/auth"
+	db "openai-api-proxy/db"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSessions authenticates the session_token cookie as the user of the
+// same name; users listed in admins have the admin role.
+type fakeSessions struct {
+	admins map[string]bool
+}
+
+func (s *fakeSessions) ValidateSessionToken(w http.ResponseWriter, r *http.Request) bool {
+	_, err := r.Cookie("session_token")
+	return err == nil
+}
+
+func (s *fakeSessions) ValidateAdminSession(w http.ResponseWriter, r *http.Request) (bool, error) {
+	claims, err := s.GetClaims(r)
+	if err != nil {
+		return false, err
+	}
+	if !s.admins[claims.Sub] {
+		return false, errors.New("not an admin")
+	}
+	return true, nil
+}
+
+func (s *fakeSessions) GetClaims(r *http.Request) (*auth.Claims, error) {
+	c, err := r.Cookie("session_token")
+	if err != nil {
+		return nil, err
+	}
+	claims := &auth.Claims{Sub: c.Value, Name: c.Value}
+	if s.admins[c.Value] {
+		claims.Roles = []string{"admin"}
+	}
+	return claims, nil
+}
+
+func (s *fakeSessions) LogoutHandler(w http.ResponseWriter, r *http.Request) {}
+
+// fakeGroup is a reporting group with the user who created it and its
+// explicit managers from reporting_group_managers.
+type fakeGroup struct {
+	title     string
+	createdBy string
+	managers  map[string]bool
+}
+
+// fakeStore keeps users, keys and reporting groups in memory. Methods the
+// tests do not need panic through the nil Store.
+type fakeStore struct {
+	Store
+	users  map[string]*db.User
+	keys   map[string]*db.ApiKey
+	groups map[int64]*fakeGroup
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{
+		users: map[string]*db.User{
+			"carol": {Sub: "carol", Name: "Carol"},
+			"dave":  {Sub: "dave", Name: "Dave"},
+			"erin":  {Sub: "erin", Name: "Erin"},
+		},
+		keys: map[string]*db.ApiKey{
+			"k-erin":    {UUID: "k-erin", Owner: "erin", Description: "erins-key"},
+			"k-support": {UUID: "k-support", Owner: "team:7", Description: "support-bot"},
+		},
+		groups: map[int64]*fakeGroup{
+			7: {title: "Support", createdBy: "carol", managers: map[string]bool{"dave": true}},
+			8: {title: "Sales", createdBy: "erin", managers: map[string]bool{}},
+		},
+	}
+}
+
+// manages mirrors managedGroups: the creator and the explicit managers.
+func (f *fakeStore) manages(user string, groupID int64) bool {
+	g, ok := f.groups[groupID]
+	return ok && (g.createdBy == user || g.managers[user])
+}
+
+// owns mirrors ownedBy: the own keys and the team keys of managed groups.
+func (f *fakeStore) owns(user string, k *db.ApiKey) bool {
+	if k.Owner == user {
+		return true
+	}
+	for id := range f.groups {
+		if k.Owner == db.ServiceAccountID(id) && f.manages(user, id) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeStore) WriteUser(u *db.User) error {
+	if _, ok := f.users[u.Sub]; !ok {
+		c := *u
+		f.users[u.Sub] = &c
+	}
+	return nil
+}
+
+func (f *fakeStore) GetUser(uid string) (*db.User, error) {
+	u, ok := f.users[uid]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return u, nil
+}
+
+func (f *fakeStore) ListUsers() ([]db.User, error) {
+	var users []db.User
+	for _, u := range f.users {
+		users = append(users, *u)
+	}
+	return users, nil
+}
+
+func (f *fakeStore) WriteEntry(k *db.ApiKey) error {
+	c := *k
+	f.keys[k.UUID] = &c
+	return nil
+}
+
+func (f *fakeStore) DeleteEntry(key *string, uid string) error {
+	k, ok := f.keys[*key]
+	if !ok || k.Archived || !f.owns(uid, k) {
+		return sql.ErrNoRows
+	}
+	k.Archived = true
+	return nil
+}
+
+func (f *fakeStore) RotateApiKey(uuid, user, keyID, hash string, grace time.Duration) (time.Time, error) {
+	k, ok := f.keys[uuid]
+	if !ok || k.Archived || !f.owns(user, k) {
+		return time.Time{}, sql.ErrNoRows
+	}
+	k.KeyID, k.ApiKey = keyID, hash
+	return time.Now().Add(grace), nil
+}
+
+func (f *fakeStore) ListAllApiKeys() ([]db.ApiKey, error) {
+	var keys []db.ApiKey
+	for _, k := range f.keys {
+		if !k.Archived {
+			keys = append(keys, *k)
+		}
+	}
+	return keys, nil
+}
+
+func (f *fakeStore) SetApiKeyDeactivated(uuid string, deactivated bool) error {
+	k, ok := f.keys[uuid]
+	if !ok || k.Archived {
+		return sql.ErrNoRows
+	}
+	k.Deactivated = deactivated
+	return nil
+}
+
+func (f *fakeStore) LookupApiKeyInfos(uid string) ([]db.ApiKey, error) {
+	var keys []db.ApiKey
+	for _, k := range f.keys {
+		if k.Owner == uid && !k.Archived {
+			keys = append(keys, *k)
+		}
+	}
+	return keys, nil
+}
+
+func (f *fakeStore) ListManagedTeams(user string) ([]db.Team, error) {
+	var teams []db.Team
+	for id, g := range f.groups {
+		if f.manages(user, id) {
+			teams = append(teams, db.Team{ID: id, Title: g.title, Account: db.ServiceAccountID(id)})
+		}
+	}
+	return teams, nil
+}
+
+func (f *fakeStore) IsTeamManager(user string, groupID int64) (bool, error) {
+	return f.manages(user, groupID), nil
+}
+
+func (f *fakeStore) EnsureServiceAccount(groupID int64) (string, error) {
+	g, ok := f.groups[groupID]
+	if !ok {
+		return "", sql.ErrNoRows
+	}
+	id := db.ServiceAccountID(groupID)
+	f.users[id] = &db.User{Sub: id, Name: g.title}
+	return id, nil
+}
+
+func newTestHandler(store *fakeStore, admins ...string) *ApiHandler {
+	s := &fakeSessions{admins: map[string]bool{}}
+	for _, a := range admins {
+		s.admins[a] = true
+	}
+	return &ApiHandler{db: store, auth: s, timeZone: "Europe/Berlin"}
+}
+
+// request sends a request of the session of user to handler.
+func request(handler http.HandlerFunc, user, method, path string, form url.Values) *httptest.ResponseRecorder {
+	var body *strings.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	} else {
+		body = strings.NewReader("")
+	}
+	r := httptest.NewRequest(method, path, body)
+	if form != nil {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if user != "" {
+		r.AddCookie(&http.Cookie{Name: "session_token", Value: user})
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+// chdirRoot runs the test in the repository root, where the templates are.
+func chdirRoot(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(".."); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestCreateTeamKey(t *testing.T) {
+	store := newFakeStore()
+	a := newTestHandler(store)
+	form := url.Values{"team": {"7"}, "beschreibung": {"faq-bot"}}
+
+	if w := request(a.CreateEntry, "erin", "POST", "/api2/table/entry/save", form); w.Code != http.StatusForbidden {
+		t.Errorf("non-manager: status = %d, want 403", w.Code)
+	}
+	if n := countKeys(store, "team:7"); n != 1 {
+		t.Fatalf("non-manager created a team key, team has %d keys", n)
+	}
+
+	for _, manager := range []string{"carol", "dave"} { // creator, explicit manager
+		w := request(a.CreateEntry, manager, "POST", "/api2/table/entry/save", form)
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "sk-proxy-") {
+			t.Errorf("%s: status = %d, body %s", manager, w.Code, w.Body.String())
+		}
+	}
+	if n := countKeys(store, "team:7"); n != 3 {
+		t.Errorf("team has %d keys, want 3", n)
+	}
+	if n := countKeys(store, "carol") + countKeys(store, "dave"); n != 0 {
+		t.Errorf("managers own %d personal keys, want the team to own them", n)
+	}
+}
+
+func countKeys(store *fakeStore, owner string) int {
+	n := 0
+	for _, k := range store.keys {
+		if k.Owner == owner {
+			n++
+		}
+	}
+	return n
+}
+
+func TestTeamKeysListedForManagers(t *testing.T) {
+	chdirRoot(t)
+	a := newTestHandler(newFakeStore())
+
+	for user, want := range map[string]bool{"carol": true, "dave": true, "erin": false} {
+		w := request(a.GetTable, user, "GET", "/api2/table/get", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d", user, w.Code)
+		}
+		if got := strings.Contains(w.Body.String(), "support-bot"); got != want {
+			t.Errorf("%s sees the team key: %v, want %v", user, got, want)
+		}
+	}
+	if w := request(a.GetTable, "carol", "GET", "/api2/table/get", nil); strings.Contains(w.Body.String(), "erins-key") {
+		t.Error("a manager sees the personal key of another user")
+	}
+}
+
+func TestTeamKeysRotatedAndDeletedByManagers(t *testing.T) {
+	store := newFakeStore()
+	a := newTestHandler(store)
+
+	if w := request(a.RotateEntry, "erin", "POST", "/api2/table/entry/rotate/k-support", nil); w.Code != http.StatusNotFound {
+		t.Errorf("non-manager rotate: status = %d, want 404", w.Code)
+	}
+	if w := request(a.DeleteEntry, "erin", "POST", "/api2/table/entry/delete/k-support", nil); w.Code != http.StatusNotFound {
+		t.Errorf("non-manager delete: status = %d, want 404", w.Code)
+	}
+	if store.keys["k-support"].KeyID != "" || store.keys["k-support"].Archived {
+		t.Fatal("the team key was changed by a non-manager")
+	}
+
+	if w := request(a.RotateEntry, "dave", "POST", "/api2/table/entry/rotate/k-support", nil); w.Code != http.StatusOK {
+		t.Errorf("manager rotate: status = %d", w.Code)
+	}
+	if w := request(a.DeleteEntry, "carol", "POST", "/api2/table/entry/delete/k-support", nil); w.Code != http.StatusOK {
+		t.Errorf("creator delete: status = %d", w.Code)
+	}
+	if !store.keys["k-support"].Archived {
+		t.Error("the team key was not archived")
+	}
+}
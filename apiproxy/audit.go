@@ -0,0 +1,189 @@
+package apiproxy
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"net/http"
+	db "openai-api-proxy/db"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// AuditStore is the subset of database methods used by the audit log.
+type AuditStore interface {
+	WriteAuditEntry(*db.AuditEntry) error
+	PurgeAuditLog(before time.Time) (int64, error)
+}
+
+// defaultRedactPatterns are always applied to stored prompts and completions:
+// e-mail addresses, API keys and bearer tokens, IBANs, card numbers and
+// international phone numbers.
+var defaultRedactPatterns = []string{
+	`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`,
+	`\b(?:sk|pk|rk)-[A-Za-z0-9_-]{16,}`,
+	`(?i)\bbearer\s+[A-Za-z0-9._~+/=-]{16,}`,
+	`\b[A-Z]{2}\d{2}(?: ?[A-Z0-9]{4}){3,7}(?: ?[A-Z0-9]{1,3})?\b`,
+	`\b(?:\d[ -]?){12,18}\d\b`,
+	`\+\d{1,3}[ ()/-]*\d(?:[ ()/-]*\d){6,}`,
+}
+
+const redacted = "[redacted]"
+
+// auditor writes the audit trail enabled with AUDIT_LOG=true. Every request
+// that gets a response from an upstream is recorded with its key, model,
+// endpoint, status and latency; prompt and completion only if the key or the
+// model has audit_content set.
+type auditor struct {
+	store    AuditStore
+	redact   []*regexp.Regexp
+	maxBytes int // stored prompts and completions are cut off after this
+}
+
+// newAuditor compiles the built-in redaction patterns and those of the file
+// referenced by AUDIT_REDACT_FILE.
+func newAuditor(store AuditStore) (*auditor, error) {
+	patterns := defaultRedactPatterns
+	if path := os.Getenv("AUDIT_REDACT_FILE"); path != "" {
+		extra, err := readRedactFile(path)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns[:len(patterns):len(patterns)], extra...)
+	}
+	a := &auditor{store: store, maxBytes: envInt("AUDIT_MAX_CONTENT_BYTES", 1<<20)}
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("redaction pattern %q: %w", p, err)
+		}
+		a.redact = append(a.redact, re)
+	}
+	return a, nil
+}
+
+// readRedactFile reads one regular expression per line. Empty lines and
+// lines starting with # are skipped.
+func readRedactFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var patterns []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			patterns = append(patterns, line)
+		}
+	}
+	return patterns, sc.Err()
+}
+
+// sanitize redacts s and cuts it to maxBytes. The result is valid UTF-8
+// without NUL bytes, which Postgres rejects in text columns.
+func (a *auditor) sanitize(s string) string {
+	for _, re := range a.redact {
+		s = re.ReplaceAllString(s, redacted)
+	}
+	if len(s) > a.maxBytes {
+		s = s[:a.maxBytes]
+	}
+	return strings.ReplaceAll(strings.ToValidUTF8(s, ""), "\x00", "")
+}
+
+// purgeLoop deletes entries older than retention every interval.
+func (a *auditor) purgeLoop(retention, interval time.Duration) {
+	purgeEvery("audit log", interval, func() (int64, error) {
+		return a.store.PurgeAuditLog(time.Now().Add(-retention))
+	})
+}
+
+// purgeEvery calls purge now and then every interval, and logs the number of
+// entries it deleted from name.
+func purgeEvery(name string, interval time.Duration, purge func() (int64, error)) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		n, err := purge()
+		if err != nil {
+			slog.Error("Could not purge the "+name, "error", err)
+		} else if n > 0 {
+			slog.Info("Purged "+name, "entries", n)
+		}
+		<-t.C
+	}
+}
+
+// startAudit keeps the prompt of a request if the audit log is enabled and
+// the key or the routed model asks for it.
+func (rc *ResponseConf) startAudit(r *http.Request, info *requestInfo, ups []upstream, body []byte) {
+	if rc.audit == nil {
+		return
+	}
+	if p, ok := PrincipalFromContext(r.Context()); ok {
+		info.content = p.AuditContent
+	}
+	if len(ups) > 0 && ups[0].model != nil {
+		info.content = info.content || ups[0].model.AuditContent
+	}
+	if info.content {
+		info.prompt = body
+	}
+}
+
+// auditContent reports whether the completion of req is stored.
+func (rc *ResponseConf) auditContent(req *http.Request) bool {
+	info := requestInfoFrom(req)
+	return rc.audit != nil && info != nil && info.content
+}
+
+// writeAudit stores the audit entry of req once its response is complete. id
+// and model are taken from the response and may be empty.
+func (rc *ResponseConf) writeAudit(req *http.Request, id, model, completion string, streamed bool) {
+	info := requestInfoFrom(req)
+	if rc.audit == nil || info == nil {
+		return
+	}
+	e := db.AuditEntry{
+		RequestID: id,
+		Model:     model,
+		Endpoint:  info.endpoint,
+		Status:    info.status,
+		Latency:   time.Since(info.start),
+		Streamed:  streamed,
+	}
+	if e.Model == "" {
+		e.Model = info.model
+	}
+	if p, ok := PrincipalFromContext(req.Context()); ok {
+		e.ApiKeyID = p.KeyUUID
+	}
+	if info.content {
+		e.Prompt = rc.audit.sanitize(string(info.prompt))
+		e.Completion = rc.audit.sanitize(completion)
+	}
+	if err := rc.audit.store.WriteAuditEntry(&e); err != nil {
+		logFor(req).Error("Could not write audit log entry", "endpoint", info.endpoint, "error", err)
+	}
+}
+
+// streamText returns the generated text carried by one SSE event of the chat
+// completions (first choice) or the Responses API.
+func streamText(raw map[string]interface{}) string {
+	if t, _ := raw["type"].(string); t == "response.output_text.delta" {
+		s, _ := raw["delta"].(string)
+		return s
+	}
+	choices, _ := raw["choices"].([]interface{})
+	if len(choices) == 0 {
+		return ""
+	}
+	choice, _ := choices[0].(map[string]interface{})
+	delta, _ := choice["delta"].(map[string]interface{})
+	s, _ := delta["content"].(string)
+	return s
+}
@@ -0,0 +1,192 @@
+package apiproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	db "openai-api-proxy/db"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeAuditStore struct {
+	mu      sync.Mutex
+	entries []db.AuditEntry
+}
+
+func (f *fakeAuditStore) WriteAuditEntry(e *db.AuditEntry) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.entries = append(f.entries, *e)
+	return nil
+}
+
+func (f *fakeAuditStore) PurgeAuditLog(before time.Time) (int64, error) {
+	return 0, nil
+}
+
+// waitEntries waits for n entries written by stream goroutines.
+func (f *fakeAuditStore) waitEntries(t *testing.T, n int) []db.AuditEntry {
+	t.Helper()
+	for i := 0; i < 50; i++ {
+		f.mu.Lock()
+		entries := append([]db.AuditEntry(nil), f.entries...)
+		f.mu.Unlock()
+		if len(entries) >= n {
+			return entries
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("expected %d audit entries", n)
+	return nil
+}
+
+func newAuditHandle(t *testing.T, fb *fakeDBForTest, upstreamURL string) (*baseHandle, *fakeAuditStore) {
+	t.Helper()
+	store := &fakeAuditStore{}
+	a, err := newAuditor(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newTestHandle(t, fb, db.BackendConfig{Name: "openai", Kind: BackendKindOpenAI, BaseURL: upstreamURL + "/", ApiKey: "sk-upstream"})
+	h.rc.audit = a
+	return h, store
+}
+
+func TestAuditSanitize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "redact.txt")
+	os.WriteFile(path, []byte("# customer numbers\nKD-\\d{6}\n\n"), 0o600)
+	t.Setenv("AUDIT_REDACT_FILE", path)
+	t.Setenv("AUDIT_MAX_CONTENT_BYTES", "200")
+	a, err := newAuditor(&fakeAuditStore{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in := "Mail jane.doe@example.com, IBAN DE89 3704 0044 0532 0130 00, card 4111 1111 1111 1111, " +
+		"call +49 30 1234567, key sk-proxy-abcdefghijkl_XYZ, customer KD-123456, 42 tokens"
+	got := a.sanitize(in)
+	for _, leak := range []string{"jane.doe", "DE89", "4111", "1234567", "sk-proxy", "KD-123456"} {
+		if strings.Contains(got, leak) {
+			t.Errorf("%q was not redacted: %s", leak, got)
+		}
+	}
+	if !strings.Contains(got, "42 tokens") {
+		t.Errorf("unrelated text was redacted: %s", got)
+	}
+
+	if got := a.sanitize(strings.Repeat("ä", 150)); len(got) > 200 || !strings.HasPrefix(got, "ää") || strings.ContainsRune(got, '�') {
+		t.Errorf("long text was not cut to valid UTF-8: %d bytes", len(got))
+	}
+}
+
+func TestAuditInvalidRedactPattern(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "redact.txt")
+	os.WriteFile(path, []byte("(unclosed\n"), 0o600)
+	t.Setenv("AUDIT_REDACT_FILE", path)
+	if _, err := newAuditor(&fakeAuditStore{}); err == nil {
+		t.Fatal("expected an error for an invalid pattern")
+	}
+}
+
+func TestAudit_BufferedMetadataOnly(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"chatcmpl-1","object":"chat.completion","model":"gpt-4o-2024-08-06","usage":{"prompt_tokens":3,"completion_tokens":5}}`))
+	}))
+	defer ts.Close()
+	fb := newTestDB(t)
+	fb.models[0].Backend = "openai"
+	h, store := newAuditHandle(t, fb, ts.URL)
+
+	req := httptest.NewRequest("POST", "http://localhost/api/v1/chat/completions", strings.NewReader(`{"model":"gpt-4o","messages":[]}`))
+	req.Header.Set("Authorization", "Bearer TESTTOKEN")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	entries := store.waitEntries(t, 1)
+	e := entries[0]
+	if e.RequestID != "chatcmpl-1" || e.ApiKeyID != "uid-1" || e.Model != "gpt-4o-2024-08-06" ||
+		e.Endpoint != "/api/v1/chat/completions" || e.Status != http.StatusOK || e.Streamed {
+		t.Errorf("unexpected entry %+v", e)
+	}
+	if e.Prompt != "" || e.Completion != "" {
+		t.Errorf("content stored without audit_content: %+v", e)
+	}
+}
+
+func TestAudit_BufferedContentOfKey(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":{"message":"bad request from bob@example.com"}}`))
+	}))
+	defer ts.Close()
+	fb := newTestDB(t)
+	fb.apiKeys[0].AuditContent = true
+	h, store := newAuditHandle(t, fb, ts.URL)
+
+	req := httptest.NewRequest("POST", "http://localhost/api/v1/embeddings", strings.NewReader(`{"model":"gpt-4o","input":"alice@example.com"}`))
+	req.Header.Set("Authorization", "Bearer TESTTOKEN")
+	req.Header.Set("Backend", "openai")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	e := store.waitEntries(t, 1)[0]
+	if e.Status != http.StatusBadRequest || e.Model != "" {
+		t.Errorf("unexpected entry %+v", e)
+	}
+	if e.Prompt != `{"model":"gpt-4o","input":"[redacted]"}` {
+		t.Errorf("prompt = %s", e.Prompt)
+	}
+	if e.Completion != `{"error":{"message":"bad request from [redacted]"}}` {
+		t.Errorf("completion = %s", e.Completion)
+	}
+}
+
+func TestAudit_StreamedContentOfModel(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, ev := range []string{
+			`{"id":"chatcmpl-2","model":"gpt-4o","choices":[{"delta":{"role":"assistant"}}]}`,
+			`{"id":"chatcmpl-2","model":"gpt-4o","choices":[{"delta":{"content":"Hello"}}]}`,
+			`{"id":"chatcmpl-2","model":"gpt-4o","choices":[{"delta":{"content":" world"},"finish_reason":"stop"}]}`,
+			`{"id":"chatcmpl-2","model":"gpt-4o","choices":[],"usage":{"prompt_tokens":4,"completion_tokens":2}}`,
+			`[DONE]`,
+		} {
+			w.Write([]byte("data: " + ev + "\n\n"))
+		}
+	}))
+	defer ts.Close()
+	fb := newTestDB(t)
+	fb.models[0].Backend = "openai"
+	fb.models[0].AuditContent = true
+	h, store := newAuditHandle(t, fb, ts.URL)
+
+	req := httptest.NewRequest("POST", "http://localhost/api/v1/chat/completions", strings.NewReader(`{"model":"gpt-4o","stream":true}`))
+	req.Header.Set("Authorization", "Bearer TESTTOKEN")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	e := store.waitEntries(t, 1)[0]
+	if !e.Streamed || e.RequestID != "chatcmpl-2" || e.Status != http.StatusOK {
+		t.Errorf("unexpected entry %+v", e)
+	}
+	if e.Completion != "Hello world" {
+		t.Errorf("completion = %q", e.Completion)
+	}
+	// The prompt is the body sent by the client, before include_usage is added.
+	if e.Prompt != `{"model":"gpt-4o","stream":true}` {
+		t.Errorf("prompt = %s", e.Prompt)
+	}
+}
+
+func TestStreamText_ResponsesAPI(t *testing.T) {
+	if got := streamText(map[string]interface{}{"type": "response.output_text.delta", "delta": "Hi"}); got != "Hi" {
+		t.Errorf("got %q", got)
+	}
+	// The done events repeat the text of the deltas.
+	if got := streamText(map[string]interface{}{"type": "response.output_text.done", "text": "Hi"}); got != "" {
+		t.Errorf("got %q", got)
+	}
+}
@@ -0,0 +1,200 @@
+package apiproxy
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	db "openai-api-proxy/db"
+	"os"
+	"strings"
+)
+
+// Backend is an upstream API the proxy can forward requests to. Backends are
+// looked up by name in the Registry, see LoadRegistry.
+type Backend interface {
+	Name() string
+	// Rewrite maps the incoming `/api/...` request onto the backend and
+	// returns the base URL the reverse proxy should target. m is the routed
+	// model and may be nil.
+	Rewrite(r *http.Request, m *db.Model) (*url.URL, error)
+	// Authorize replaces the proxy key of the client with the backend credentials.
+	Authorize(r *http.Request, m *db.Model)
+	// ModifyResponse is attached to the reverse proxy and records the usage.
+	ModifyResponse(in *http.Response) error
+}
+
+// Backend kinds understood by newBackend.
+const (
+	BackendKindAzure  = "azure"
+	BackendKindOpenAI = "openai" // OpenAI compatible, e.g. OpenAI, OpenRouter, vLLM, Ollama
+)
+
+// newBackend builds a Backend from its configuration.
+func newBackend(c db.BackendConfig, rc *ResponseConf) (Backend, error) {
+	if c.Name == "" {
+		return nil, fmt.Errorf("backend without name")
+	}
+	apiKey := c.ApiKey
+	if apiKey == "" && c.ApiKeyEnv != "" {
+		apiKey = os.Getenv(c.ApiKeyEnv)
+	}
+	base, err := url.Parse(c.BaseURL)
+	if err != nil || base.Scheme == "" || base.Host == "" {
+		return nil, fmt.Errorf("backend %s: invalid base url %q", c.Name, c.BaseURL)
+	}
+
+	switch c.Kind {
+	case BackendKindAzure:
+		return &azureBackend{name: c.Name, baseURL: base, apiKey: apiKey, rc: rc}, nil
+	case BackendKindOpenAI, "":
+		header := c.AuthHeader
+		if header == "" {
+			header = authHeader
+		}
+		return &openAIBackend{name: c.Name, baseURL: base, apiKey: apiKey, authHeader: header, rc: rc}, nil
+	default:
+		return nil, fmt.Errorf("backend %s: unknown kind %q", c.Name, c.Kind)
+	}
+}
+
+// azureBackend forwards to an Azure OpenAI resource using the `Api-Key` header.
+type azureBackend struct {
+	name    string
+	baseURL *url.URL // e.g. https://{resource}.openai.azure.com/openai
+	apiKey  string
+	rc      *ResponseConf
+}
+
+func (b *azureBackend) Name() string { return b.name }
+
+func (b *azureBackend) Rewrite(r *http.Request, m *db.Model) (*url.URL, error) {
+	// Forward the path after `/api` unchanged. If the client sends `/api/v1/responses`
+	// the forwarded path will include `/v1/responses`, and combined with the
+	// `/openai` base will produce `/openai/v1/responses` as desired.
+	r.URL.Path = strings.TrimPrefix(r.URL.Path, "/api")
+	remoteUrl := b.SetAzureUrl(r, m)
+	if remoteUrl == nil {
+		return nil, fmt.Errorf("backend %s: no target url", b.name)
+	}
+	return remoteUrl, nil
+}
+
+func (b *azureBackend) Authorize(r *http.Request, m *db.Model) {
+	apiKey := b.apiKey
+	if m != nil && m.ApiKey != "" {
+		apiKey = m.ApiKey
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Api-Key", apiKey)
+}
+
+func (b *azureBackend) ModifyResponse(in *http.Response) error {
+	return b.rc.NewResponse(in)
+}
+
+// SetAzureUrl returns the target URL for r. By default the Azure OpenAI v1 base
+// path of the backend is used: clients call `/api/v1/...` and the proxy
+// preserves the `/v1` segment, so combining this base with the incoming path
+// yields `/openai/v1/...` as required by the v1 API.
+//
+// A model can move the request to its own resource host. If it carries an
+// api-version, the classic `/openai/deployments/{deployment}/...` path is
+// used instead and the `/v1` segment is dropped from r.
+func (b *azureBackend) SetAzureUrl(r *http.Request, m *db.Model) *url.URL {
+	u := *b.baseURL
+	if m == nil {
+		return &u
+	}
+	if m.ResourceHost != "" {
+		u.Host = azureResourceHost(m.ResourceHost)
+	}
+	if m.ApiVersion == "" {
+		return &u
+	}
+
+	deployment := m.Deployment
+	if deployment == "" {
+		deployment = m.ID
+	}
+	u.Path = "/openai/deployments/" + url.PathEscape(deployment)
+	u.RawPath = ""
+	r.URL.Path = strings.TrimPrefix(r.URL.Path, "/v1")
+	query := r.URL.Query()
+	query.Set("api-version", m.ApiVersion)
+	r.URL.RawQuery = query.Encode()
+	return &u
+}
+
+// azureResourceHost accepts either a full host or the bare name of an Azure
+// OpenAI resource, which is expanded to `{name}.openai.azure.com`.
+func azureResourceHost(host string) string {
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "https://"), "/")
+	if strings.Contains(host, ".") || strings.Contains(host, ":") {
+		return host
+	}
+	return host + ".openai.azure.com"
+}
+
+// openAIBackend forwards to any OpenAI compatible API. The provider key is sent
+// as bearer token, backends without key (e.g. a local Ollama) get none.
+type openAIBackend struct {
+	name       string
+	baseURL    *url.URL // e.g. https://api.openai.com/ or https://openrouter.ai/api/
+	apiKey     string
+	authHeader string
+	rc         *ResponseConf
+}
+
+func (b *openAIBackend) Name() string { return b.name }
+
+func (b *openAIBackend) Rewrite(r *http.Request, m *db.Model) (*url.URL, error) {
+	// `/api/v1/chat/completions` becomes `/v1/chat/completions` on OpenAI and
+	// `/api/v1/chat/completions` on OpenRouter, as its base URL ends in `/api/`.
+	r.URL.Path = strings.TrimPrefix(r.URL.Path, "/api")
+	u := *b.baseURL
+	return &u, nil
+}
+
+func (b *openAIBackend) Authorize(r *http.Request, m *db.Model) {
+	apiKey := b.apiKey
+	if m != nil && m.ApiKey != "" {
+		apiKey = m.ApiKey
+	}
+	r.Header.Del(authHeader)
+	r.Header.Del("Api-Key")
+	if apiKey == "" {
+		return
+	}
+	if strings.EqualFold(b.authHeader, authHeader) {
+		r.Header.Set(authHeader, "Bearer "+apiKey)
+		return
+	}
+	r.Header.Set(b.authHeader, apiKey)
+}
+
+func (b *openAIBackend) ModifyResponse(in *http.Response) error {
+	return b.rc.NewResponse(in)
+}
+
+// legacyBackendConfigs returns the backends that were previously hard coded,
+// configured from the DEPLOYMENT_NAME/BASE_URL/AZURE_API_KEY and
+// OPENAI_API_KEY/OPENROUTER_API_KEY environment variables.
+func legacyBackendConfigs() []db.BackendConfig {
+	configs := []db.BackendConfig{
+		{Name: "openai", Kind: BackendKindOpenAI, BaseURL: "https://api.openai.com/", ApiKeyEnv: "OPENAI_API_KEY"},
+		{Name: "openrouter", Kind: BackendKindOpenAI, BaseURL: "https://openrouter.ai/api/", ApiKeyEnv: "OPENROUTER_API_KEY"},
+	}
+	deployment, base := os.Getenv("DEPLOYMENT_NAME"), os.Getenv("BASE_URL")
+	if deployment != "" && base != "" {
+		configs = append(configs, db.BackendConfig{
+			Name:      "azure",
+			Kind:      BackendKindAzure,
+			BaseURL:   fmt.Sprintf("https://%s.%s/openai", deployment, base),
+			ApiKeyEnv: "AZURE_API_KEY",
+		})
+	} else {
+		slog.Info("DEPLOYMENT_NAME or BASE_URL unset, legacy azure backend disabled")
+	}
+	return configs
+}
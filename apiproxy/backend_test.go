@@ -0,0 +1,76 @@
+package apiproxy
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	db "openai-api-proxy/db"
+)
+
+func TestSetAzureUrl_PerModelDeployment(t *testing.T) {
+	base, _ := url.Parse("https://default-res.openai.azure.com/openai")
+	b := &azureBackend{name: "azure", baseURL: base, apiKey: "default-key"}
+
+	tests := []struct {
+		name      string
+		model     *db.Model
+		path      string
+		wantURL   string
+		wantKey   string
+		wantQuery string
+	}{
+		{
+			name:    "no model keeps v1 base",
+			model:   nil,
+			path:    "/api/v1/responses",
+			wantURL: "https://default-res.openai.azure.com/openai/v1/responses",
+			wantKey: "default-key",
+		},
+		{
+			name:    "resource host override keeps v1 path",
+			model:   &db.Model{ID: "gpt-4.1", ResourceHost: "sweden-res", ApiKey: "sweden-key"},
+			path:    "/api/v1/chat/completions",
+			wantURL: "https://sweden-res.openai.azure.com/openai/v1/chat/completions",
+			wantKey: "sweden-key",
+		},
+		{
+			name:      "api version selects classic deployments path",
+			model:     &db.Model{ID: "o3-mini", Deployment: "o3-mini-prod", ResourceHost: "eastus2-res.openai.azure.com", ApiVersion: "2024-12-01-preview"},
+			path:      "/api/v1/chat/completions",
+			wantURL:   "https://eastus2-res.openai.azure.com/openai/deployments/o3-mini-prod/chat/completions",
+			wantKey:   "default-key",
+			wantQuery: "api-version=2024-12-01-preview",
+		},
+		{
+			name:      "classic path without v1 prefix and deployment defaults to model id",
+			model:     &db.Model{ID: "gpt-4o", ApiVersion: "2024-10-21"},
+			path:      "/api/embeddings",
+			wantURL:   "https://default-res.openai.azure.com/openai/deployments/gpt-4o/embeddings",
+			wantKey:   "default-key",
+			wantQuery: "api-version=2024-10-21",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "http://localhost"+tt.path, strings.NewReader(`{}`))
+			b.Authorize(req, tt.model)
+			target, err := b.Rewrite(req, tt.model)
+			if err != nil {
+				t.Fatalf("Rewrite: %v", err)
+			}
+			got := target.Scheme + "://" + target.Host + singleJoiningSlash(target.Path, req.URL.Path)
+			if got != tt.wantURL {
+				t.Fatalf("got url %s, want %s", got, tt.wantURL)
+			}
+			if req.URL.RawQuery != tt.wantQuery {
+				t.Fatalf("got query %q, want %q", req.URL.RawQuery, tt.wantQuery)
+			}
+			if key := req.Header.Get("Api-Key"); key != tt.wantKey {
+				t.Fatalf("got api key %q, want %q", key, tt.wantKey)
+			}
+		})
+	}
+}
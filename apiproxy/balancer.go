@@ -0,0 +1,156 @@
+package apiproxy
+
+import (
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Strategies to spread the requests of a model across its upstreams, set per
+// model in models.balance or globally with UPSTREAM_BALANCE.
+const (
+	BalancePriority         = "priority"          // first healthy upstream, the others are fallbacks
+	BalanceWeighted         = "weighted"          // random, proportional to the weight
+	BalanceLeastOutstanding = "least_outstanding" // fewest in-flight requests per weight
+	BalanceRemainingTokens  = "remaining_tokens"  // most x-ratelimit-remaining-tokens left
+)
+
+// remainingTokensTTL is how long a x-ratelimit-remaining-tokens reading is
+// trusted. Azure quotas are per minute, older readings say nothing.
+const remainingTokensTTL = time.Minute
+
+// balancer orders the upstreams of a request. The first upstream receives the
+// request, the rest stay available for failover.
+type balancer struct {
+	mu    sync.Mutex
+	stats map[string]*upstreamStats
+}
+
+type upstreamStats struct {
+	outstanding     int
+	remainingTokens int
+	observed        time.Time
+}
+
+func newBalancer() *balancer {
+	return &balancer{stats: make(map[string]*upstreamStats)}
+}
+
+func (lb *balancer) get(key string) *upstreamStats {
+	s, ok := lb.stats[key]
+	if !ok {
+		s = &upstreamStats{}
+		lb.stats[key] = s
+	}
+	return s
+}
+
+// acquire counts an in-flight request to the upstream until release is called.
+func (lb *balancer) acquire(key string) (release func()) {
+	lb.mu.Lock()
+	lb.get(key).outstanding++
+	lb.mu.Unlock()
+	return func() {
+		lb.mu.Lock()
+		lb.get(key).outstanding--
+		lb.mu.Unlock()
+	}
+}
+
+// observe records the remaining token quota reported by the upstream.
+func (lb *balancer) observe(key string, h http.Header) {
+	raw := strings.TrimSpace(h.Get("X-Ratelimit-Remaining-Tokens"))
+	if raw == "" {
+		return
+	}
+	remaining, err := strconv.Atoi(raw)
+	if err != nil {
+		return
+	}
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	s := lb.get(key)
+	s.remainingTokens = remaining
+	s.observed = time.Now()
+}
+
+// order returns ups in the order they should be tried, using the strategy of
+// the routed model.
+func (lb *balancer) order(ups []upstream) []upstream {
+	if len(ups) < 2 {
+		return ups
+	}
+	strategy := balanceStrategy(ups[0])
+	ordered := append([]upstream(nil), ups...)
+
+	switch strategy {
+	case BalanceWeighted:
+		for i := range ordered {
+			// Pick the next upstream among the remaining ones by weight.
+			total := 0
+			for _, u := range ordered[i:] {
+				total += u.weight()
+			}
+			n := rand.IntN(total)
+			for j := i; j < len(ordered); j++ {
+				n -= ordered[j].weight()
+				if n < 0 {
+					ordered[i], ordered[j] = ordered[j], ordered[i]
+					break
+				}
+			}
+		}
+	case BalanceLeastOutstanding:
+		lb.mu.Lock()
+		load := make(map[string]int, len(ordered))
+		for _, u := range ordered {
+			if s, ok := lb.stats[u.key()]; ok {
+				load[u.key()] = s.outstanding
+			}
+		}
+		lb.mu.Unlock()
+		sort.SliceStable(ordered, func(i, j int) bool {
+			a, b := ordered[i], ordered[j]
+			return load[a.key()]*b.weight() < load[b.key()]*a.weight()
+		})
+	case BalanceRemainingTokens:
+		now := time.Now()
+		lb.mu.Lock()
+		remaining := make(map[string]int, len(ordered))
+		for _, u := range ordered {
+			// Unknown upstreams go first, so every upstream gets measured.
+			remaining[u.key()] = math.MaxInt
+			if s, ok := lb.stats[u.key()]; ok && now.Sub(s.observed) < remainingTokensTTL {
+				remaining[u.key()] = s.remainingTokens
+			}
+		}
+		lb.mu.Unlock()
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return remaining[ordered[i].key()] > remaining[ordered[j].key()]
+		})
+	}
+	return ordered
+}
+
+func balanceStrategy(u upstream) string {
+	if u.model != nil && u.model.Balance != "" {
+		return u.model.Balance
+	}
+	if s := strings.TrimSpace(os.Getenv("UPSTREAM_BALANCE")); s != "" {
+		return s
+	}
+	return BalancePriority
+}
+
+func (u upstream) weight() int {
+	if u.model == nil || u.model.Weight < 1 {
+		return 1
+	}
+	return u.model.Weight
+}
@@ -0,0 +1,96 @@
+package apiproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	db "openai-api-proxy/db"
+	"sync/atomic"
+	"testing"
+)
+
+func balancedUpstreams(balance string, weights ...int) []upstream {
+	var ups []upstream
+	for i, w := range weights {
+		name := string(rune('a' + i))
+		ups = append(ups, upstream{
+			backend: &openAIBackend{name: name},
+			model:   &db.Model{ID: "gpt-4.1", Backend: name, Weight: w, Balance: balance},
+		})
+	}
+	return ups
+}
+
+func TestBalancer_Weighted(t *testing.T) {
+	lb := newBalancer()
+	ups := balancedUpstreams(BalanceWeighted, 3, 1)
+	first := map[string]int{}
+	for i := 0; i < 4000; i++ {
+		ordered := lb.order(ups)
+		if len(ordered) != 2 {
+			t.Fatalf("expected both upstreams, got %d", len(ordered))
+		}
+		first[ordered[0].backend.Name()]++
+	}
+	// Expect roughly 3000 to 1000.
+	if first["a"] < 2700 || first["a"] > 3300 {
+		t.Fatalf("weighted split off: %v", first)
+	}
+}
+
+func TestBalancer_LeastOutstanding(t *testing.T) {
+	lb := newBalancer()
+	ups := balancedUpstreams(BalanceLeastOutstanding, 1, 1)
+	release := lb.acquire(ups[0].key())
+	if got := lb.order(ups)[0].backend.Name(); got != "b" {
+		t.Fatalf("expected idle upstream b first, got %s", got)
+	}
+	release()
+	if got := lb.order(ups)[0].backend.Name(); got != "a" {
+		t.Fatalf("expected a first once idle, got %s", got)
+	}
+}
+
+func TestBalancer_RemainingTokens(t *testing.T) {
+	lb := newBalancer()
+	ups := balancedUpstreams(BalanceRemainingTokens, 1, 1, 1)
+	lb.observe(ups[0].key(), http.Header{"X-Ratelimit-Remaining-Tokens": {"1000"}})
+	lb.observe(ups[1].key(), http.Header{"X-Ratelimit-Remaining-Tokens": {"90000"}})
+
+	ordered := lb.order(ups)
+	// c was never measured and is probed first, then most remaining quota.
+	got := ordered[0].backend.Name() + ordered[1].backend.Name() + ordered[2].backend.Name()
+	if got != "cba" {
+		t.Fatalf("expected order cba, got %s", got)
+	}
+}
+
+func TestServeHTTP_BalancesAcrossDeployments(t *testing.T) {
+	var hitsA, hitsB atomic.Int32
+	srv := func(hits *atomic.Int32) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits.Add(1)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(okCompletion))
+		}))
+	}
+	a, b := srv(&hitsA), srv(&hitsB)
+	defer a.Close()
+	defer b.Close()
+
+	fb := newTestDB(t)
+	fb.models = []db.Model{{ID: "gpt-4.1", Backend: "sweden", Weight: 1, Balance: BalanceWeighted}}
+	fb.upstreams = map[string][]db.Model{"gpt-4.1": {{ID: "gpt-4.1", Backend: "france", Weight: 1}}}
+	h := newTestHandle(t, fb,
+		db.BackendConfig{Name: "sweden", Kind: BackendKindOpenAI, BaseURL: a.URL + "/"},
+		db.BackendConfig{Name: "france", Kind: BackendKindOpenAI, BaseURL: b.URL + "/"},
+	)
+
+	for i := 0; i < 40; i++ {
+		if rr := postCompletion(h, "gpt-4.1"); rr.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", rr.Code)
+		}
+	}
+	if hitsA.Load() == 0 || hitsB.Load() == 0 {
+		t.Fatalf("expected both deployments to receive requests, got %d and %d", hitsA.Load(), hitsB.Load())
+	}
+}
@@ -0,0 +1,102 @@
+package apiproxy
+
+import (
+	"fmt"
+	"net/http"
+	db "openai-api-proxy/db"
+	"sync"
+	"time"
+)
+
+// budgetCache keeps the budgets of a key for BUDGET_CACHE_TTL, so the spend
+// is not queried on every request. Recorded usage is added to the cached
+// spend right away, the other keys of a user or group see it after the TTL.
+type budgetCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]cachedBudgets
+}
+
+type cachedBudgets struct {
+	budgets []db.BudgetStatus
+	expires time.Time
+}
+
+func newBudgetCache(ttl time.Duration) *budgetCache {
+	return &budgetCache{ttl: ttl, entries: make(map[string]cachedBudgets)}
+}
+
+func (c *budgetCache) get(key string) ([]db.BudgetStatus, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || time.Now().After(e.expires) {
+		return nil, false
+	}
+	return e.budgets, true
+}
+
+func (c *budgetCache) put(key string, budgets []db.BudgetStatus) {
+	if c == nil || c.ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = cachedBudgets{budgets: budgets, expires: time.Now().Add(c.ttl)}
+}
+
+// addSpend adds the cost of a recorded request to the cached budgets of key.
+func (c *budgetCache) addSpend(key string, cents float64) {
+	if c == nil || cents <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	budgets := make([]db.BudgetStatus, len(e.budgets))
+	for i, b := range e.budgets {
+		b.Spent += cents / 100
+		budgets[i] = b
+	}
+	e.budgets = budgets
+	c.entries[key] = e
+}
+
+// checkBudget rejects the request if a hard cap of the key, its owner or one
+// of the owner's reporting groups is reached. Reached soft caps are reported
+// in the X-Budget-Warning header. If the budgets cannot be loaded the
+// request is let through.
+func (h *baseHandle) checkBudget(w http.ResponseWriter, r *http.Request, p *Principal) bool {
+	budgets, ok := h.rc.budgets.get(p.KeyUUID)
+	if !ok {
+		_, span := startDBSpan(r.Context(), "SELECT", "budgets")
+		var err error
+		budgets, err = h.db.LookupBudgets(p.KeyUUID, p.Owner)
+		span.End()
+		if err != nil {
+			logFor(r).Error("Could not load budgets", "error", err)
+			return true
+		}
+		h.rc.budgets.put(p.KeyUUID, budgets)
+	}
+
+	for _, b := range budgets {
+		if b.HardLimit > 0 && b.Spent >= b.HardLimit {
+			msg := fmt.Sprintf("You exceeded the monthly budget of your %s (%.2f of %.2f spent).", b.Scope, b.Spent, b.HardLimit)
+			writeOpenAIError(w, http.StatusTooManyRequests, msg, "insufficient_quota", "insufficient_quota")
+			return false
+		}
+	}
+	for _, b := range budgets {
+		if b.SoftLimit > 0 && b.Spent >= b.SoftLimit {
+			w.Header().Add("X-Budget-Warning", fmt.Sprintf("%s budget: %.2f of %.2f spent", b.Scope, b.Spent, b.SoftLimit))
+		}
+	}
+	return true
+}
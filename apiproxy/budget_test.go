@@ -0,0 +1,73 @@
+package apiproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	db "openai-api-proxy/db"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newBudgetTestHandle(t *testing.T, budgets []db.BudgetStatus) (*baseHandle, *atomic.Int32) {
+	t.Helper()
+	var hits atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(okCompletion))
+	}))
+	t.Cleanup(ts.Close)
+
+	fb := newTestDB(t)
+	fb.models = []db.Model{{ID: "gpt-4.1"}}
+	fb.budgets = budgets
+	h := newTestHandle(t, fb, db.BackendConfig{Name: "openai", Kind: BackendKindOpenAI, BaseURL: ts.URL + "/"})
+	return h, &hits
+}
+
+func TestServeHTTP_HardBudgetRejects(t *testing.T) {
+	h, hits := newBudgetTestHandle(t, []db.BudgetStatus{
+		{Scope: db.BudgetScopeUser, Subject: "owner1", HardLimit: 100, Spent: 100.5},
+	})
+
+	rr := postCompletion(h, "gpt-4.1")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", rr.Code)
+	}
+	if hits.Load() != 0 {
+		t.Fatal("request over budget must not reach the upstream")
+	}
+	var resp OpenAIErrorResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || resp.Err.Code != "insufficient_quota" {
+		t.Fatalf("unexpected body %q", rr.Body.String())
+	}
+}
+
+func TestServeHTTP_SoftBudgetWarns(t *testing.T) {
+	h, hits := newBudgetTestHandle(t, []db.BudgetStatus{
+		{Scope: db.BudgetScopeGroup, Subject: "7", SoftLimit: 50, HardLimit: 100, Spent: 60},
+		{Scope: db.BudgetScopeKey, Subject: "uid-1", SoftLimit: 50, Spent: 10},
+	})
+
+	rr := postCompletion(h, "gpt-4.1")
+	if rr.Code != http.StatusOK || hits.Load() != 1 {
+		t.Fatalf("expected request to pass, got %d", rr.Code)
+	}
+	warnings := rr.Header().Values("X-Budget-Warning")
+	if len(warnings) != 1 || warnings[0] != "group budget: 60.00 of 50.00 spent" {
+		t.Fatalf("unexpected warnings %q", warnings)
+	}
+}
+
+func TestBudgetCache_AddSpend(t *testing.T) {
+	c := newBudgetCache(time.Minute)
+	c.put("uid-1", []db.BudgetStatus{{Scope: db.BudgetScopeKey, Subject: "uid-1", HardLimit: 1, Spent: 0.5}})
+	c.addSpend("uid-1", 60) // cents
+
+	budgets, ok := c.get("uid-1")
+	if !ok || budgets[0].Spent < 1.09 || budgets[0].Spent > 1.11 {
+		t.Fatalf("expected spend 1.10, got %+v", budgets)
+	}
+}
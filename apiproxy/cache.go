@@ -0,0 +1,331 @@
+package apiproxy
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	db "openai-api-proxy/db"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/codes"
+)
+
+// cacheHeader tells the client whether a cacheable request was answered from
+// the response cache ("hit") or forwarded ("miss").
+const cacheHeader = "X-Proxy-Cache"
+
+// cacheUpstream is recorded as upstream and backend of cache hits.
+const cacheUpstream = "cache"
+
+// similarityHeader carries the cosine similarity of the prompt of a semantic
+// cache hit to the cached one.
+const similarityHeader = "X-Proxy-Cache-Similarity"
+
+// cacheStore keeps the cached responses. The in-memory LRU is per replica,
+// the Postgres table is shared by all of them.
+type cacheStore interface {
+	// get returns the unexpired response stored under key, nil if there is none.
+	get(ctx context.Context, key string) (*db.CachedResponse, error)
+	put(ctx context.Context, e *db.CachedResponse) error
+}
+
+// responseCache answers repeated deterministic requests without forwarding
+// them, see cacheKey. It is enabled with RESPONSE_CACHE.
+type responseCache struct {
+	store    cacheStore
+	ttl      time.Duration
+	maxBytes int // larger responses are not stored
+}
+
+// newResponseCache returns the cache selected by RESPONSE_CACHE: "memory" or
+// "postgres"; nil if it is not set.
+func newResponseCache(d *db.Database) (*responseCache, error) {
+	c := &responseCache{
+		ttl:      envDuration("RESPONSE_CACHE_TTL", 24*time.Hour),
+		maxBytes: envInt("RESPONSE_CACHE_MAX_BYTES", 1<<20),
+	}
+	switch kind := os.Getenv("RESPONSE_CACHE"); kind {
+	case "", "none":
+		return nil, nil
+	case "memory":
+		c.store = newMemoryCache(envInt("RESPONSE_CACHE_SIZE", 1000))
+	case "postgres":
+		s := &dbCache{store: d}
+		go s.purgeLoop(time.Hour)
+		c.store = s
+	default:
+		return nil, fmt.Errorf("unknown RESPONSE_CACHE %q", kind)
+	}
+	return c, nil
+}
+
+// cacheEndpoints are the endpoints whose responses are cached.
+var cacheEndpoints = []string{"/chat/completions", "/embeddings", "/responses"}
+
+// cacheKey returns the key of the response to r with the given body, or false
+// if it must not be served from the cache: streamed requests, requests that
+// are not deterministic, i.e. generate with a temperature other than 0 or more
+// than one choice, requests of keys that opted out and requests sent with
+// Cache-Control: no-cache or no-store. The key is the hash of the owner of the
+// key, the routed model, the endpoint and the body with sorted fields and
+// without the user and metadata fields, which do not change the output.
+func cacheKey(r *http.Request, p *Principal, model string, body []byte) (string, bool) {
+	if !cacheableRequest(r, p) {
+		return "", false
+	}
+	endpoint := cacheEndpoint(r.URL.Path)
+	if endpoint == "" {
+		return "", false
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal(body, &payload); err != nil || payload == nil {
+		return "", false
+	}
+	if stream, _ := payload["stream"].(bool); stream {
+		return "", false
+	}
+	if endpoint != "/embeddings" {
+		if t, ok := payload["temperature"].(float64); !ok || t != 0 {
+			return "", false
+		}
+		if n, ok := payload["n"].(float64); ok && n != 1 {
+			return "", false
+		}
+	}
+	delete(payload, "user")
+	delete(payload, "metadata")
+	// Marshal sorts the fields of maps.
+	normalised, err := json.Marshal(payload)
+	if err != nil {
+		return "", false
+	}
+	h := sha256.New()
+	for _, part := range []string{p.Owner, model, endpoint} {
+		io.WriteString(h, part)
+		h.Write([]byte{0})
+	}
+	h.Write(normalised)
+	return hex.EncodeToString(h.Sum(nil)), true
+}
+
+// cacheableRequest reports whether the response to r may come from a cache:
+// it is a POST of a key that did not opt out, without Cache-Control no-cache
+// or no-store.
+func cacheableRequest(r *http.Request, p *Principal) bool {
+	if r.Method != http.MethodPost || p == nil || p.ResponseCacheOptOut {
+		return false
+	}
+	cc := strings.ToLower(r.Header.Get("Cache-Control"))
+	return !strings.Contains(cc, "no-cache") && !strings.Contains(cc, "no-store")
+}
+
+// cacheEndpoint returns the one of cacheEndpoints path ends with, or "".
+func cacheEndpoint(path string) string {
+	for _, e := range cacheEndpoints {
+		if strings.HasSuffix(path, e) {
+			return e
+		}
+	}
+	return ""
+}
+
+// serveCached answers r from the response cache or, failing that, the
+// semantic cache if one has the response. Cache hits are recorded like
+// forwarded requests, marked so they are billed as zero. On a miss the key
+// and the semantic query are kept in the request info, so NewResponse stores
+// the response.
+func (rc *ResponseConf) serveCached(w http.ResponseWriter, r *http.Request, body []byte) bool {
+	info := requestInfoFrom(r)
+	if info == nil || rc.cache == nil && rc.semantic == nil {
+		return false
+	}
+	p, _ := PrincipalFromContext(r.Context())
+	var e *db.CachedResponse
+	if rc.cache != nil {
+		if key, ok := cacheKey(r, p, info.model, body); ok {
+			var err error
+			e, err = rc.cache.store.get(r.Context(), key)
+			if err != nil {
+				logFor(r).Warn("Could not read the response cache", "error", err)
+			}
+			rc.metrics.cacheLookup(e != nil)
+			if e == nil {
+				info.cacheKey = key
+				w.Header().Set(cacheHeader, "miss")
+			}
+		}
+	}
+	if e == nil && rc.semantic != nil {
+		hit, q, err := rc.semantic.lookup(r, p, info.model, body)
+		if err != nil {
+			logFor(r).Warn("Could not look up the semantic cache", "error", err)
+		}
+		if q != nil || err != nil {
+			rc.metrics.semanticLookup(hit != nil, err)
+			w.Header().Set(cacheHeader, "miss")
+		}
+		if hit != nil {
+			e = &db.CachedResponse{Model: info.model, Status: hit.Status, ContentType: hit.ContentType, Body: hit.Body, CreatedAt: hit.CreatedAt}
+			w.Header().Set(similarityHeader, strconv.FormatFloat(hit.Similarity, 'f', 4, 64))
+		} else if q != nil && q.Embedding != nil {
+			info.semantic = q
+		}
+	}
+	if e == nil {
+		return false
+	}
+
+	info.cacheHit = true
+	info.upstream, info.backend = cacheUpstream, cacheUpstream
+	in := &http.Response{
+		StatusCode: e.Status,
+		Header:     http.Header{"Content-Type": []string{e.ContentType}},
+		Body:       io.NopCloser(bytes.NewReader(e.Body)),
+		Request:    r,
+	}
+	if err := rc.NewResponse(in); err != nil {
+		logFor(r).Warn("Could not record cached response", "error", err)
+	}
+	logFor(r).Debug("Served response from cache", "age", time.Since(e.CreatedAt).String())
+	w.Header().Set("Content-Type", e.ContentType)
+	w.Header().Set(cacheHeader, "hit")
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(e.CreatedAt).Seconds())))
+	w.WriteHeader(e.Status)
+	w.Write(e.Body)
+	return true
+}
+
+// storeResponse caches the successful JSON response to a request that missed
+// the caches.
+func (rc *ResponseConf) storeResponse(in *http.Response, body []byte, model string) {
+	info := requestInfoFrom(in.Request)
+	if info == nil || info.cacheHit || info.cacheKey == "" && info.semantic == nil {
+		return
+	}
+	ct := in.Header.Get("Content-Type")
+	if in.StatusCode != http.StatusOK || !strings.Contains(ct, "json") || in.Header.Get("Content-Encoding") != "" || len(body) == 0 {
+		return
+	}
+	now := time.Now()
+	e := &db.CachedResponse{
+		Key:         info.cacheKey,
+		Model:       model,
+		Status:      in.StatusCode,
+		ContentType: ct,
+		Body:        body,
+		CreatedAt:   now,
+	}
+	if info.cacheKey != "" && len(body) <= rc.cache.maxBytes {
+		e.ExpiresAt = now.Add(rc.cache.ttl)
+		if err := rc.cache.store.put(in.Request.Context(), e); err != nil {
+			logFor(in.Request).Warn("Could not store response in cache", "error", err)
+		}
+	}
+	if info.semantic != nil && len(body) <= rc.semantic.maxBytes {
+		if err := rc.semantic.put(in.Request.Context(), info.semantic, e); err != nil {
+			logFor(in.Request).Warn("Could not store response in semantic cache", "error", err)
+		}
+	}
+}
+
+// memoryCache is an LRU of at most size responses.
+type memoryCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List // front is the most recently used
+	entries map[string]*list.Element
+	now     func() time.Time
+}
+
+func newMemoryCache(size int) *memoryCache {
+	return &memoryCache{size: size, order: list.New(), entries: make(map[string]*list.Element), now: time.Now}
+}
+
+func (c *memoryCache) get(_ context.Context, key string) (*db.CachedResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, nil
+	}
+	e := el.Value.(*db.CachedResponse)
+	if !c.now().Before(e.ExpiresAt) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return nil, nil
+	}
+	c.order.MoveToFront(el)
+	return e, nil
+}
+
+func (c *memoryCache) put(_ context.Context, e *db.CachedResponse) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[e.Key]; ok {
+		el.Value = e
+		c.order.MoveToFront(el)
+		return nil
+	}
+	c.entries[e.Key] = c.order.PushFront(e)
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*db.CachedResponse).Key)
+	}
+	return nil
+}
+
+// CacheStore is the subset of database methods used by the Postgres cache.
+type CacheStore interface {
+	LookupCachedResponse(key string) (*db.CachedResponse, error)
+	WriteCachedResponse(*db.CachedResponse) error
+	PurgeResponseCache() (int64, error)
+}
+
+// dbCache keeps the responses in the response_cache table.
+type dbCache struct {
+	store CacheStore
+}
+
+func (c *dbCache) get(ctx context.Context, key string) (*db.CachedResponse, error) {
+	_, span := startDBSpan(ctx, "SELECT", "response_cache")
+	defer span.End()
+	e, err := c.store.LookupCachedResponse(key)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "select failed")
+		return nil, err
+	}
+	return e, nil
+}
+
+func (c *dbCache) put(ctx context.Context, e *db.CachedResponse) error {
+	_, span := startDBSpan(ctx, "INSERT", "response_cache")
+	defer span.End()
+	err := c.store.WriteCachedResponse(e)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "insert failed")
+	}
+	return err
+}
+
+// purgeLoop deletes the expired entries every interval.
+func (c *dbCache) purgeLoop(interval time.Duration) {
+	purgeEvery("response cache", interval, c.store.PurgeResponseCache)
+}
@@ -0,0 +1,152 @@
+package apiproxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	db "openai-api-proxy/db"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheKey(t *testing.T) {
+	p := &Principal{Owner: "owner1"}
+	key := func(path, body string, p *Principal) (string, bool) {
+		r := httptest.NewRequest("POST", "http://localhost/api/v1"+path, nil)
+		return cacheKey(r, p, "gpt-4o", []byte(body))
+	}
+
+	base, ok := key("/chat/completions", `{"model":"gpt-4o","temperature":0,"messages":[{"role":"user","content":"hi"}]}`, p)
+	if !ok {
+		t.Fatal("deterministic request is not cacheable")
+	}
+	same, _ := key("/chat/completions", `{"user":"bob","messages":[{"role":"user","content":"hi"}], "temperature":0.0,"model":"gpt-4o","metadata":{"a":"b"}}`, p)
+	if same != base {
+		t.Error("field order, user and metadata changed the key")
+	}
+	if other, _ := key("/chat/completions", `{"model":"gpt-4o","temperature":0,"messages":[{"role":"user","content":"ho"}]}`, p); other == base {
+		t.Error("a different prompt has the same key")
+	}
+	if other, _ := key("/chat/completions", `{"model":"gpt-4o","temperature":0,"messages":[{"role":"user","content":"hi"}]}`, &Principal{Owner: "owner2"}); other == base {
+		t.Error("another owner has the same key")
+	}
+	if _, ok := key("/embeddings", `{"model":"gpt-4o","input":"hi"}`, p); !ok {
+		t.Error("embeddings are not cacheable")
+	}
+
+	for name, tc := range map[string]struct {
+		path, body string
+		p          *Principal
+	}{
+		"no temperature": {"/chat/completions", `{"model":"gpt-4o","messages":[]}`, p},
+		"temperature":    {"/responses", `{"model":"gpt-4o","temperature":0.7,"input":"hi"}`, p},
+		"stream":         {"/chat/completions", `{"model":"gpt-4o","temperature":0,"stream":true,"messages":[]}`, p},
+		"choices":        {"/chat/completions", `{"model":"gpt-4o","temperature":0,"n":2,"messages":[]}`, p},
+		"endpoint":       {"/images/generations", `{"model":"gpt-4o","temperature":0}`, p},
+		"no json":        {"/embeddings", `input=hi`, p},
+		"no principal":   {"/embeddings", `{"input":"hi"}`, nil},
+		"opt-out":        {"/embeddings", `{"input":"hi"}`, &Principal{Owner: "owner1", ResponseCacheOptOut: true}},
+	} {
+		if _, ok := key(tc.path, tc.body, tc.p); ok {
+			t.Errorf("%s: request is cacheable", name)
+		}
+	}
+
+	r := httptest.NewRequest("POST", "http://localhost/api/v1/embeddings", nil)
+	r.Header.Set("Cache-Control", "no-cache")
+	if _, ok := cacheKey(r, p, "gpt-4o", []byte(`{"input":"hi"}`)); ok {
+		t.Error("Cache-Control: no-cache did not bypass the cache")
+	}
+}
+
+func TestMemoryCache(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	c := newMemoryCache(2)
+	c.now = func() time.Time { return now }
+	put := func(key string, ttl time.Duration) {
+		c.put(ctx, &db.CachedResponse{Key: key, Body: []byte(key), ExpiresAt: now.Add(ttl)})
+	}
+	has := func(key string) bool {
+		e, _ := c.get(ctx, key)
+		return e != nil
+	}
+
+	put("a", time.Hour)
+	put("b", time.Hour)
+	has("a") // b is now the least recently used
+	put("c", time.Hour)
+	if !has("a") || has("b") || !has("c") {
+		t.Error("the least recently used entry was not evicted")
+	}
+
+	put("d", time.Minute)
+	now = now.Add(2 * time.Minute)
+	if has("d") {
+		t.Error("an expired entry was returned")
+	}
+	if !has("c") {
+		t.Error("an unexpired entry is missing")
+	}
+}
+
+func TestResponseCache_ServesRepeatedRequest(t *testing.T) {
+	var calls atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"chatcmpl-1","object":"chat.completion","model":"gpt-4o-2024-08-06","usage":{"prompt_tokens":3,"completion_tokens":5}}`))
+	}))
+	defer ts.Close()
+
+	fb := newTestDB(t)
+	h := newTestHandle(t, fb, db.BackendConfig{Name: "openai", Kind: BackendKindOpenAI, BaseURL: ts.URL + "/", ApiKey: "sk-upstream"})
+	h.rc.cache = &responseCache{store: newMemoryCache(10), ttl: time.Hour, maxBytes: 1 << 20}
+
+	send := func() *httptest.ResponseRecorder {
+		body := `{"model":"gpt-4o","temperature":0,"messages":[{"role":"user","content":"hi"}]}`
+		req := httptest.NewRequest("POST", "http://localhost/api/v1/chat/completions", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer TESTTOKEN")
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	first := send()
+	if first.Code != http.StatusOK || first.Header().Get(cacheHeader) != "miss" {
+		t.Fatalf("first request: %d %q", first.Code, first.Header().Get(cacheHeader))
+	}
+	second := send()
+	if second.Code != http.StatusOK || second.Header().Get(cacheHeader) != "hit" {
+		t.Fatalf("second request: %d %q", second.Code, second.Header().Get(cacheHeader))
+	}
+	if second.Body.String() != first.Body.String() {
+		t.Errorf("cached body = %s, want %s", second.Body.String(), first.Body.String())
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("upstream was called %d times", n)
+	}
+
+	rqs := fb.requests()
+	if len(rqs) != 2 {
+		t.Fatalf("expected 2 recorded requests, got %d", len(rqs))
+	}
+	if rqs[0].ResponseCacheHit || !rqs[1].ResponseCacheHit {
+		t.Errorf("cache hits recorded as %v, %v", rqs[0].ResponseCacheHit, rqs[1].ResponseCacheHit)
+	}
+	if rqs[1].Upstream != cacheUpstream || rqs[1].ID == rqs[0].ID || rqs[1].OutputTokenCount != 5 {
+		t.Errorf("unexpected cache hit %+v", rqs[1])
+	}
+
+	req := httptest.NewRequest("POST", "http://localhost/api/v1/chat/completions",
+		strings.NewReader(`{"model":"gpt-4o","temperature":0,"messages":[{"role":"user","content":"hi"}]}`))
+	req.Header.Set("Authorization", "Bearer TESTTOKEN")
+	req.Header.Set("Cache-Control", "no-cache")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Header().Get(cacheHeader) != "" || calls.Load() != 2 {
+		t.Error("Cache-Control: no-cache was answered from the cache")
+	}
+}
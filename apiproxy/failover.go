@@ -0,0 +1,236 @@
+package apiproxy
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	db "openai-api-proxy/db"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// upstream is one candidate target of a request: a backend plus the settings
+// of the routed model, which is nil if the request was not routed by model.
+type upstream struct {
+	backend Backend
+	model   *db.Model
+}
+
+// key identifies the upstream for the circuit breaker.
+func (u upstream) key() string {
+	if u.model == nil {
+		return u.backend.Name()
+	}
+	return strings.Join([]string{u.backend.Name(), u.model.ResourceHost, u.model.Deployment, u.model.ID}, "|")
+}
+
+// errRetryUpstream is returned from ModifyResponse to abort a response that
+// will be retried on the next upstream. Nothing has been written to the client
+// at that point.
+var errRetryUpstream = errors.New("retrying request on next upstream")
+
+func isRetryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+// parseRetryAfter understands both forms of the Retry-After header and the
+// retry-after-ms header sent by Azure OpenAI.
+func parseRetryAfter(h http.Header) time.Duration {
+	if ms, err := strconv.Atoi(strings.TrimSpace(h.Get("Retry-After-Ms"))); err == nil && ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	raw := strings.TrimSpace(h.Get("Retry-After"))
+	if raw == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(raw); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(raw); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// attempt tracks the outcome of forwarding a request to one upstream.
+type attempt struct {
+	upstream string
+	backend  Backend
+	breaker  *breaker
+	balancer *balancer
+	last     bool // no further upstream will be tried
+	sameNext bool // the next attempt goes to the same upstream
+
+	retry      bool
+	retryAfter time.Duration
+	reason     string
+}
+
+func (a *attempt) canRetry(r *http.Request, retryAfter time.Duration) bool {
+	if a.last || r.Context().Err() != nil {
+		return false
+	}
+	// Waiting is only needed if we hit the same upstream again.
+	return !a.sameNext || retryAfter <= upstreamRetryMaxWait()
+}
+
+// modifyResponse wraps the ModifyResponse hook of the backend. Retryable
+// responses are dropped before any byte reaches the client.
+func (a *attempt) modifyResponse(in *http.Response) error {
+	setStatus(trace.SpanFromContext(in.Request.Context()), in.StatusCode, true)
+	a.balancer.observe(a.upstream, in.Header)
+	if !isRetryableStatus(in.StatusCode) {
+		a.breaker.success(a.upstream)
+		return a.backend.ModifyResponse(in)
+	}
+	retryAfter := parseRetryAfter(in.Header)
+	a.breaker.failure(a.upstream, in.StatusCode, retryAfter)
+	if a.canRetry(in.Request, retryAfter) {
+		a.retry = true
+		a.retryAfter = retryAfter
+		a.reason = in.Status
+		return errRetryUpstream
+	}
+	return a.backend.ModifyResponse(in)
+}
+
+// errorHandler replaces the ReverseProxy error handler, connection errors are
+// retried unless this is the last attempt.
+func (a *attempt) errorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errRetryUpstream) {
+		return
+	}
+	span := trace.SpanFromContext(r.Context())
+	span.RecordError(err)
+	span.SetStatus(codes.Error, "upstream error")
+	if r.Context().Err() != nil {
+		// The client went away, this is not the fault of the upstream.
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	a.breaker.failure(a.upstream, 0, 0)
+	if a.canRetry(r, 0) {
+		a.retry = true
+		a.reason = err.Error()
+		return
+	}
+	logFor(r).Error("Proxy error", "error", err)
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+// breaker is a circuit breaker per upstream. An upstream is skipped after
+// UPSTREAM_BREAKER_THRESHOLD consecutive failures for UPSTREAM_BREAKER_COOLDOWN,
+// or for the Retry-After period of a 429 response.
+type breaker struct {
+	mu       sync.Mutex
+	circuits map[string]*circuit
+}
+
+type circuit struct {
+	failures  int
+	openUntil time.Time
+}
+
+func newBreaker() *breaker {
+	return &breaker{circuits: make(map[string]*circuit)}
+}
+
+func (cb *breaker) success(key string) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	delete(cb.circuits, key)
+}
+
+func (cb *breaker) failure(key string, status int, retryAfter time.Duration) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	c, ok := cb.circuits[key]
+	if !ok {
+		c = &circuit{}
+		cb.circuits[key] = c
+	}
+	c.failures++
+	var openFor time.Duration
+	if status == http.StatusTooManyRequests && retryAfter > 0 {
+		openFor = retryAfter
+	}
+	if c.failures >= upstreamBreakerThreshold() {
+		openFor = max(openFor, upstreamBreakerCooldown())
+	}
+	if openFor > 0 {
+		c.openUntil = time.Now().Add(openFor)
+		slog.Warn("Upstream unhealthy, skipping it", "upstream", key, "failures", c.failures, "open_for", openFor.String())
+	}
+}
+
+func (cb *breaker) open(key string, now time.Time) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	c, ok := cb.circuits[key]
+	return ok && now.Before(c.openUntil)
+}
+
+// order returns the upstreams whose circuit is closed, keeping their order.
+// If every circuit is open all upstreams are returned, so requests still get
+// a chance instead of failing without trying.
+func (cb *breaker) order(ups []upstream) []upstream {
+	now := time.Now()
+	healthy := make([]upstream, 0, len(ups))
+	for _, u := range ups {
+		if !cb.open(u.key(), now) {
+			healthy = append(healthy, u)
+		}
+	}
+	if len(healthy) == 0 {
+		return ups
+	}
+	return healthy
+}
+
+func envInt(name string, def int) int {
+	if raw := strings.TrimSpace(os.Getenv(name)); raw != "" {
+		if n, err := strconv.Atoi(raw); err == nil && n > 0 {
+			return n
+		}
+	}
+	return def
+}
+
+func envDuration(name string, def time.Duration) time.Duration {
+	if raw := strings.TrimSpace(os.Getenv(name)); raw != "" {
+		if d, err := time.ParseDuration(raw); err == nil && d >= 0 {
+			return d
+		}
+	}
+	return def
+}
+
+// upstreamMaxAttempts is the number of attempts per request. Every upstream
+// of a model is tried at least once.
+func upstreamMaxAttempts() int {
+	return envInt("UPSTREAM_MAX_ATTEMPTS", 3)
+}
+
+func upstreamRetryBackoff() time.Duration {
+	return envDuration("UPSTREAM_RETRY_BACKOFF", 500*time.Millisecond)
+}
+
+func upstreamRetryMaxWait() time.Duration {
+	return envDuration("UPSTREAM_RETRY_MAX_WAIT", 10*time.Second)
+}
+
+func upstreamBreakerThreshold() int {
+	return envInt("UPSTREAM_BREAKER_THRESHOLD", 5)
+}
+
+func upstreamBreakerCooldown() time.Duration {
+	return envDuration("UPSTREAM_BREAKER_COOLDOWN", 30*time.Second)
+}
@@ -0,0 +1,168 @@
+package apiproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	db "openai-api-proxy/db"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const okCompletion = `{"id":"chatcmpl-1","object":"chat.completion","model":"x","usage":{"prompt_tokens":1,"completion_tokens":1}}`
+
+func postCompletion(h *baseHandle, model string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "http://localhost/api/v1/chat/completions", strings.NewReader(`{"model":"`+model+`","messages":[]}`))
+	req.Header.Set("Authorization", "Bearer TESTTOKEN")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestFailover_RateLimitedUpstreamFallsBack(t *testing.T) {
+	t.Setenv("UPSTREAM_RETRY_BACKOFF", "1ms")
+	var primaryHits, fallbackHits atomic.Int32
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		primaryHits.Add(1)
+		w.Header().Set("Retry-After", "20")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer primary.Close()
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fallbackHits.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(okCompletion))
+	}))
+	defer fallback.Close()
+
+	fb := newTestDB(t)
+	fb.models = []db.Model{{ID: "gpt-4.1", Backend: "sweden"}}
+	fb.upstreams = map[string][]db.Model{"gpt-4.1": {{ID: "gpt-4.1", Backend: "france"}}}
+	h := newTestHandle(t, fb,
+		db.BackendConfig{Name: "sweden", Kind: BackendKindOpenAI, BaseURL: primary.URL + "/"},
+		db.BackendConfig{Name: "france", Kind: BackendKindOpenAI, BaseURL: fallback.URL + "/"},
+	)
+
+	rr := postCompletion(h, "gpt-4.1")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if primaryHits.Load() != 1 || fallbackHits.Load() != 1 {
+		t.Fatalf("hits primary=%d fallback=%d, want 1 and 1", primaryHits.Load(), fallbackHits.Load())
+	}
+	if len(fb.requests()) != 1 {
+		t.Fatalf("expected usage to be recorded once, got %d", len(fb.requests()))
+	}
+
+	// The 429 opened the circuit of the primary, the next request skips it.
+	rr = postCompletion(h, "gpt-4.1")
+	if rr.Code != http.StatusOK || primaryHits.Load() != 1 || fallbackHits.Load() != 2 {
+		t.Fatalf("second request: code=%d primary=%d fallback=%d", rr.Code, primaryHits.Load(), fallbackHits.Load())
+	}
+}
+
+func TestFailover_RetriesSingleUpstream(t *testing.T) {
+	t.Setenv("UPSTREAM_RETRY_BACKOFF", "1ms")
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(okCompletion))
+	}))
+	defer srv.Close()
+
+	fb := newTestDB(t)
+	fb.models = []db.Model{{ID: "gpt-4.1"}}
+	h := newTestHandle(t, fb, db.BackendConfig{Name: "openai", Kind: BackendKindOpenAI, BaseURL: srv.URL + "/"})
+
+	rr := postCompletion(h, "gpt-4.1")
+	if rr.Code != http.StatusOK || hits.Load() != 3 {
+		t.Fatalf("code=%d hits=%d, want 200 after 3 attempts", rr.Code, hits.Load())
+	}
+}
+
+func TestFailover_LastErrorIsPassedThrough(t *testing.T) {
+	t.Setenv("UPSTREAM_RETRY_BACKOFF", "1ms")
+	t.Setenv("UPSTREAM_MAX_ATTEMPTS", "2")
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":{"message":"boom"}}`))
+	}))
+	defer srv.Close()
+
+	fb := newTestDB(t)
+	fb.models = []db.Model{{ID: "gpt-4.1"}}
+	h := newTestHandle(t, fb, db.BackendConfig{Name: "openai", Kind: BackendKindOpenAI, BaseURL: srv.URL + "/"})
+
+	rr := postCompletion(h, "gpt-4.1")
+	if rr.Code != http.StatusInternalServerError || hits.Load() != 2 {
+		t.Fatalf("code=%d hits=%d, want upstream 500 after 2 attempts", rr.Code, hits.Load())
+	}
+	if !strings.Contains(rr.Body.String(), "boom") {
+		t.Fatalf("expected upstream body, got %q", rr.Body.String())
+	}
+}
+
+func TestFailover_ConnectionErrorFallsBack(t *testing.T) {
+	dead := httptest.NewServer(http.NotFoundHandler())
+	deadURL := dead.URL
+	dead.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(okCompletion))
+	}))
+	defer srv.Close()
+
+	fb := newTestDB(t)
+	fb.models = []db.Model{{ID: "gpt-4.1", Backend: "dead"}}
+	fb.upstreams = map[string][]db.Model{"gpt-4.1": {{ID: "gpt-4.1", Backend: "alive"}}}
+	h := newTestHandle(t, fb,
+		db.BackendConfig{Name: "dead", Kind: BackendKindOpenAI, BaseURL: deadURL + "/"},
+		db.BackendConfig{Name: "alive", Kind: BackendKindOpenAI, BaseURL: srv.URL + "/"},
+	)
+
+	if rr := postCompletion(h, "gpt-4.1"); rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+}
+
+func TestBreaker_OpensAfterThreshold(t *testing.T) {
+	t.Setenv("UPSTREAM_BREAKER_THRESHOLD", "2")
+	cb := newBreaker()
+	a := upstream{backend: &openAIBackend{name: "a"}}
+	b := upstream{backend: &openAIBackend{name: "b"}}
+
+	cb.failure("a", http.StatusBadGateway, 0)
+	if got := cb.order([]upstream{a, b}); len(got) != 2 {
+		t.Fatalf("circuit opened before threshold: %v", got)
+	}
+	cb.failure("a", http.StatusBadGateway, 0)
+	if got := cb.order([]upstream{a, b}); len(got) != 1 || got[0].key() != "b" {
+		t.Fatalf("expected only b, got %d upstreams", len(got))
+	}
+	if got := cb.order([]upstream{a}); len(got) != 1 {
+		t.Fatal("all circuits open must still return the upstreams")
+	}
+	cb.success("a")
+	if cb.open("a", time.Now()) {
+		t.Fatal("success must close the circuit")
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	h := http.Header{}
+	h.Set("Retry-After", "3")
+	if got := parseRetryAfter(h); got != 3*time.Second {
+		t.Fatalf("got %s", got)
+	}
+	h.Set("Retry-After-Ms", "250")
+	if got := parseRetryAfter(h); got != 250*time.Millisecond {
+		t.Fatalf("got %s", got)
+	}
+}
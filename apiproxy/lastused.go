@@ -0,0 +1,65 @@
+package apiproxy
+
+import (
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// lastUsedTracker throttles the last-used updates of key secrets to one
+// write per secret and interval, so busy keys do not cause a write per
+// request.
+type lastUsedTracker struct {
+	mu       sync.Mutex
+	written  map[string]time.Time
+	interval time.Duration
+	now      func() time.Time
+	swept    time.Time // last time expired entries were dropped
+}
+
+func newLastUsedTracker(interval time.Duration) *lastUsedTracker {
+	return &lastUsedTracker{written: make(map[string]time.Time), interval: interval, now: time.Now}
+}
+
+// due reports whether the use of the secret at now should be written and
+// reserves the write if so.
+func (t *lastUsedTracker) due(secret string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if last, ok := t.written[secret]; ok && now.Sub(last) < t.interval {
+		return false
+	}
+	t.written[secret] = now
+	t.sweep(now)
+	return true
+}
+
+// sweep drops the secrets whose interval has passed, at most once per
+// interval, so secrets no longer used do not stay in memory. Their next use
+// is due either way. Callers must hold t.mu.
+func (t *lastUsedTracker) sweep(now time.Time) {
+	if now.Sub(t.swept) < t.interval {
+		return
+	}
+	t.swept = now
+	for secret, last := range t.written {
+		if now.Sub(last) >= t.interval {
+			delete(t.written, secret)
+		}
+	}
+}
+
+// touch records the use of the secret p authenticated with.
+func (rc *ResponseConf) touch(p *Principal) {
+	if rc.used == nil {
+		return
+	}
+	now := rc.used.now()
+	if !rc.used.due(p.KeyUUID+"/"+strconv.FormatInt(p.SecretID, 10), now) {
+		return
+	}
+	if err := rc.db.TouchApiKey(p.KeyUUID, p.SecretID, now); err != nil {
+		slog.Error("Could not record last use of key", "key_uuid", p.KeyUUID, "error", err)
+	}
+}
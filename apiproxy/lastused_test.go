@@ -0,0 +1,96 @@
+package apiproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	db "openai-api-proxy/db"
+)
+
+func TestRotatedSecret_ValidDuringGracePeriod(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(okCompletion))
+	}))
+	defer ts.Close()
+
+	oldToken := db.FormatApiKey("old", "SECRET")
+	newToken := db.FormatApiKey("new", "SECRET")
+	fb := newTestDB(t)
+	fb.apiKeys = []db.ApiKey{
+		{UUID: "uid-1", Owner: "owner1", KeyID: "new", ApiKey: mustHash(t, newToken)},
+		{UUID: "uid-1", Owner: "owner1", KeyID: "old", ApiKey: mustHash(t, oldToken), SecretID: 7, SecretExpiresAt: time.Now().Add(time.Hour)},
+	}
+	h := newTestHandle(t, fb, db.BackendConfig{Name: "azure", Kind: BackendKindOpenAI, BaseURL: ts.URL + "/"})
+	h.rc.keys = newApiKeyCache(time.Minute)
+	h.rc.used = newLastUsedTracker(time.Minute)
+
+	post := func(token string) int {
+		req := httptest.NewRequest("POST", "http://localhost/api/v1/chat/completions", strings.NewReader(`{"model":"gpt-4o","messages":[]}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	for _, token := range []string{newToken, oldToken, oldToken} {
+		if code := post(token); code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", code)
+		}
+	}
+	if writes := fb.requests(); len(writes) != 3 || writes[1].ApiKeyID != "uid-1" {
+		t.Fatalf("expected the usage of both secrets on uid-1, got %+v", writes)
+	}
+	fb.mu.Lock()
+	touches := strings.Join(fb.touches, ",")
+	fb.mu.Unlock()
+	if touches != "uid-1/0,uid-1/7" {
+		t.Fatalf("expected one last-used write per secret, got %q", touches)
+	}
+
+	// The old secret is still cached when its grace period ends.
+	cached, ok := h.rc.keys.get(oldToken)
+	if !ok {
+		t.Fatal("expected the old secret to be cached")
+	}
+	cached.SecretExpiresAt = time.Now().Add(-time.Second)
+	if code := post(oldToken); code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 after the grace period, got %d", code)
+	}
+	if code := post(newToken); code != http.StatusOK {
+		t.Fatalf("expected the new secret to keep working, got %d", code)
+	}
+}
+
+func TestLastUsedTracker_ThrottlesWrites(t *testing.T) {
+	tr := newLastUsedTracker(time.Minute)
+	now := time.Now()
+	if !tr.due("a", now) {
+		t.Fatal("expected the first use to be written")
+	}
+	if tr.due("a", now.Add(30*time.Second)) {
+		t.Fatal("expected uses within the interval to be skipped")
+	}
+	if !tr.due("b", now.Add(30*time.Second)) {
+		t.Fatal("expected other secrets to be tracked separately")
+	}
+	if !tr.due("a", now.Add(time.Minute)) {
+		t.Fatal("expected a write after the interval")
+	}
+}
+
+func TestLastUsedTracker_DropsExpiredSecrets(t *testing.T) {
+	tr := newLastUsedTracker(time.Minute)
+	now := time.Now()
+	tr.due("a", now)
+	tr.due("b", now.Add(90*time.Second))
+	if !tr.due("c", now.Add(2*time.Minute)) {
+		t.Fatal("expected the first use of c to be written")
+	}
+	if _, ok := tr.written["a"]; ok || len(tr.written) != 2 {
+		t.Fatalf("expected only the expired secret to be dropped, got %v", tr.written)
+	}
+}
@@ -0,0 +1,188 @@
+package apiproxy
+
+import (
+	"crypto/subtle"
+	"net/http"
+	db "openai-api-proxy/db"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics are the Prometheus metrics of the proxy, served on /metrics.
+// Counters carry the key and its owner, histograms only model, backend and
+// status to keep the number of series down.
+type metrics struct {
+	requests        *prometheus.CounterVec
+	tokens          *prometheus.CounterVec
+	cost            *prometheus.CounterVec
+	upstreamLatency *prometheus.HistogramVec
+	streamDuration  *prometheus.HistogramVec
+	dbWriteFailures prometheus.Counter
+	sseDrops        *prometheus.CounterVec
+	cacheLookups    *prometheus.CounterVec
+	cacheSaved      *prometheus.CounterVec
+	semanticLookups *prometheus.CounterVec
+}
+
+var (
+	requestLabels = []string{"model", "backend", "status", "key", "owner"}
+	latencyLabels = []string{"model", "backend", "status"}
+)
+
+// SSE events that are not counted, see sseDropped.
+const (
+	sseDropInvalidJSON = "invalid_json"
+	sseDropOversized   = "oversized"
+	sseDropReadError   = "read_error"
+)
+
+func newMetrics(reg prometheus.Registerer) *metrics {
+	m := &metrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "openai_proxy_requests_total",
+			Help: "Proxied requests by the status sent to the client.",
+		}, requestLabels),
+		tokens: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "openai_proxy_tokens_total",
+			Help: "Tokens reported by the upstreams, type is prompt, cached or completion. Cached tokens are part of the prompt tokens.",
+		}, append([]string{"type"}, requestLabels...)),
+		cost: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "openai_proxy_cost_cents_total",
+			Help: "Cost of the proxied requests from the costs table, in cents.",
+		}, requestLabels),
+		upstreamLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "openai_proxy_upstream_latency_seconds",
+			Help:    "Time until the response headers of the upstream arrived.",
+			Buckets: []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+		}, latencyLabels),
+		streamDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "openai_proxy_stream_duration_seconds",
+			Help:    "Time until the end of streamed responses.",
+			Buckets: []float64{.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600},
+		}, latencyLabels),
+		dbWriteFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "openai_proxy_db_write_failures_total",
+			Help: "Requests that could not be written to the requests table.",
+		}),
+		sseDrops: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "openai_proxy_sse_dropped_events_total",
+			Help: "SSE events skipped by the usage parser, reason is invalid_json, oversized or read_error.",
+		}, []string{"reason", "backend"}),
+		cacheLookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "openai_proxy_response_cache_lookups_total",
+			Help: "Cacheable requests by result, hit or miss.",
+		}, []string{"result"}),
+		cacheSaved: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "openai_proxy_response_cache_saved_cents_total",
+			Help: "Cost of the requests answered from the response cache, in cents.",
+		}, requestLabels),
+		semanticLookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "openai_proxy_semantic_cache_lookups_total",
+			Help: "Requests looked up in the semantic cache by result, hit, miss or error.",
+		}, []string{"result"}),
+	}
+	reg.MustRegister(m.requests, m.tokens, m.cost, m.upstreamLatency, m.streamDuration, m.dbWriteFailures, m.sseDrops,
+		m.cacheLookups, m.cacheSaved, m.semanticLookups)
+	return m
+}
+
+// observeRequest counts rq, which writeRequest tried to store; err is the
+// result of WriteRequest.
+func (m *metrics) observeRequest(p *Principal, info *requestInfo, rq *db.Request, err error) {
+	if m == nil {
+		return
+	}
+	if err != nil {
+		m.dbWriteFailures.Inc()
+	}
+	var key, owner, backend string
+	if p != nil {
+		key, owner = p.KeyUUID, p.Owner
+	}
+	if info != nil {
+		backend = info.backend
+	}
+	status := "unknown"
+	if rq.Status != 0 {
+		status = strconv.Itoa(rq.Status)
+	}
+	labels := prometheus.Labels{"model": rq.Model, "backend": backend, "status": status, "key": key, "owner": owner}
+	m.requests.With(labels).Inc()
+	m.cost.With(labels).Add(rq.CostCents)
+	if rq.ResponseCacheHit {
+		m.cacheSaved.With(labels).Add(rq.SavedCents)
+	}
+	for typ, n := range map[string]int{"prompt": rq.InputTokenCount, "cached": rq.CachedInputTokenCount, "completion": rq.OutputTokenCount} {
+		labels["type"] = typ
+		m.tokens.With(labels).Add(float64(n))
+	}
+
+	if info == nil || rq.Status == 0 {
+		return
+	}
+	latency := prometheus.Labels{"model": rq.Model, "backend": backend, "status": status}
+	if info.ttfb > 0 {
+		m.upstreamLatency.With(latency).Observe(info.ttfb.Seconds())
+	}
+	if rq.Streamed {
+		m.streamDuration.With(latency).Observe(rq.Duration.Seconds())
+	}
+}
+
+// sseDropped counts an SSE event of req the parser could not use.
+func (m *metrics) sseDropped(req *http.Request, reason string) {
+	if m == nil {
+		return
+	}
+	backend := ""
+	if info := requestInfoFrom(req); info != nil {
+		backend = info.backend
+	}
+	m.sseDrops.WithLabelValues(reason, backend).Inc()
+}
+
+// cacheLookup counts a lookup in the response cache.
+func (m *metrics) cacheLookup(hit bool) {
+	if m == nil {
+		return
+	}
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	m.cacheLookups.WithLabelValues(result).Inc()
+}
+
+// semanticLookup counts a lookup in the semantic cache; err is set if the
+// prompt could not be embedded or the lookup failed.
+func (m *metrics) semanticLookup(hit bool, err error) {
+	if m == nil {
+		return
+	}
+	result := "miss"
+	if err != nil {
+		result = "error"
+	} else if hit {
+		result = "hit"
+	}
+	m.semanticLookups.WithLabelValues(result).Inc()
+}
+
+// metricsHandler serves the metrics of g. With METRICS_TOKEN set, scrapers
+// have to send it as bearer token.
+func metricsHandler(g prometheus.Gatherer, token string) http.Handler {
+	h := promhttp.HandlerFor(g, promhttp.HandlerOpts{})
+	if token == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get(authHeader))
+		if subtle.ConstantTimeCompare(got, []byte("Bearer "+token)) != 1 {
+			http.Error(w, "Not Authorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,149 @@
+package apiproxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	db "openai-api-proxy/db"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newMetricsHandle(t *testing.T, fb *fakeDBForTest, upstreamURL string) (*baseHandle, *metrics) {
+	t.Helper()
+	fb.models[0].Backend = "openai"
+	h := newTestHandle(t, fb, db.BackendConfig{Name: "openai", Kind: BackendKindOpenAI, BaseURL: upstreamURL + "/", ApiKey: "sk-upstream"})
+	h.rc.metrics = newMetrics(prometheus.NewRegistry())
+	return h, h.rc.metrics
+}
+
+func sendChat(h http.Handler, body string) {
+	req := httptest.NewRequest("POST", "http://localhost/api/v1/chat/completions", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer TESTTOKEN")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+}
+
+// waitCounter waits for c to reach want, stream goroutines count late.
+func waitCounter(t *testing.T, c prometheus.Collector, want float64) {
+	t.Helper()
+	for i := 0; i < 50; i++ {
+		if testutil.ToFloat64(c) == want {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("counter = %v, want %v", testutil.ToFloat64(c), want)
+}
+
+func TestMetrics_Buffered(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"chatcmpl-1","object":"chat.completion","model":"gpt-4o","usage":{"prompt_tokens":10,"completion_tokens":5,"prompt_tokens_details":{"cached_tokens":4}}}`))
+	}))
+	defer ts.Close()
+	h, m := newMetricsHandle(t, newTestDB(t), ts.URL)
+
+	sendChat(h, `{"model":"gpt-4o"}`)
+	sendChat(h, `{"model":"gpt-4o"}`)
+
+	labels := []string{"gpt-4o", "openai", "200", "uid-1", "owner1"}
+	if got := testutil.ToFloat64(m.requests.WithLabelValues(labels...)); got != 2 {
+		t.Errorf("requests = %v", got)
+	}
+	for typ, want := range map[string]float64{"prompt": 20, "cached": 8, "completion": 10} {
+		if got := testutil.ToFloat64(m.tokens.WithLabelValues(append([]string{typ}, labels...)...)); got != want {
+			t.Errorf("%s tokens = %v, want %v", typ, got, want)
+		}
+	}
+	if n := testutil.CollectAndCount(m.upstreamLatency); n != 1 {
+		t.Errorf("upstream latency series = %d", n)
+	}
+	if n := testutil.CollectAndCount(m.streamDuration); n != 0 {
+		t.Errorf("stream duration series = %d", n)
+	}
+}
+
+func TestMetrics_UpstreamError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":{"message":"bad"}}`))
+	}))
+	defer ts.Close()
+	h, m := newMetricsHandle(t, newTestDB(t), ts.URL)
+
+	sendChat(h, `{"model":"gpt-4o"}`)
+
+	if got := testutil.ToFloat64(m.requests.WithLabelValues("gpt-4o", "openai", "400", "uid-1", "owner1")); got != 1 {
+		t.Errorf("requests = %v", got)
+	}
+}
+
+func TestMetrics_StreamedWithDroppedEvent(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: {\"id\":\"chatcmpl-2\",\"model\":\"gpt-4o\",\"choices\":[{\"delta\":{\"content\":\"Hi\"}}]}\n\n"))
+		w.Write([]byte("data: {not json\n\n"))
+		w.Write([]byte("data: {\"id\":\"chatcmpl-2\",\"model\":\"gpt-4o\",\"choices\":[],\"usage\":{\"prompt_tokens\":3,\"completion_tokens\":7}}\n\ndata: [DONE]\n\n"))
+	}))
+	defer ts.Close()
+	h, m := newMetricsHandle(t, newTestDB(t), ts.URL)
+
+	sendChat(h, `{"model":"gpt-4o","stream":true}`)
+
+	labels := []string{"gpt-4o", "openai", "200", "uid-1", "owner1"}
+	waitCounter(t, m.requests.WithLabelValues(labels...), 1)
+	if got := testutil.ToFloat64(m.tokens.WithLabelValues(append([]string{"completion"}, labels...)...)); got != 7 {
+		t.Errorf("completion tokens = %v", got)
+	}
+	if got := testutil.ToFloat64(m.sseDrops.WithLabelValues(sseDropInvalidJSON, "openai")); got != 1 {
+		t.Errorf("dropped events = %v", got)
+	}
+	if n := testutil.CollectAndCount(m.streamDuration); n != 1 {
+		t.Errorf("stream duration series = %d", n)
+	}
+}
+
+func TestMetrics_DBWriteFailure(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"chatcmpl-3","object":"chat.completion","model":"gpt-4o","usage":{"prompt_tokens":1,"completion_tokens":1}}`))
+	}))
+	defer ts.Close()
+	fb := newTestDB(t)
+	fb.writeErr = errors.New("connection refused")
+	h, m := newMetricsHandle(t, fb, ts.URL)
+
+	sendChat(h, `{"model":"gpt-4o"}`)
+
+	if got := testutil.ToFloat64(m.dbWriteFailures); got != 1 {
+		t.Errorf("db write failures = %v", got)
+	}
+}
+
+func TestMetricsHandler_Token(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := newMetrics(reg)
+	m.requests.WithLabelValues("gpt-4o", "openai", "200", "uid-1", "owner1").Inc()
+	h := metricsHandler(reg, "scrape-secret")
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without token, got %d", rr.Code)
+	}
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer scrape-secret")
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	body, _ := io.ReadAll(rr.Body)
+	if rr.Code != http.StatusOK || !strings.Contains(string(body), `openai_proxy_requests_total{backend="openai",key="uid-1",model="gpt-4o",owner="owner1",status="200"} 1`) {
+		t.Errorf("unexpected response %d: %s", rr.Code, body)
+	}
+}
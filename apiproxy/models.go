@@ -2,7 +2,6 @@ package apiproxy
 
 import (
 	"encoding/json"
-	"log"
 	"net/http"
 	"os"
 	"strings"
@@ -34,22 +33,42 @@ type OpenAIErrorResponse struct {
 	Err OpenAIError `json:"error"`
 }
 
+// writeOpenAIError writes an error in the format of the OpenAI API.
+func writeOpenAIError(w http.ResponseWriter, status int, message, errType, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	resp := OpenAIErrorResponse{Err: OpenAIError{
+		Message: message,
+		Type:    errType,
+		Param:   nil,
+		Code:    code,
+	}}
+	json.NewEncoder(w).Encode(resp)
+}
+
 // handleModels intercepts requests to /api/models and /api/v1/models and returns
-// static model metadata derived from environment configuration.
+// the models of the models table that can be routed to a configured backend.
 func (h *baseHandle) handleModels(w http.ResponseWriter, r *http.Request) {
 	// Enforce API key like other endpoints
-	if h.ValidateToken(w, r) == "" { // ValidateToken writes the error response
+	p := h.ValidateToken(w, r)
+	if p == nil { // ValidateToken writes the error response
 		return
 	}
 
 	path := strings.TrimPrefix(r.URL.Path, "/api")
 	path = strings.Trim(path, "/")
 
-	// Collect configured models from database
-	models, err := h.db.ListConfiguredModels()
+	// Collect configured models from database, skipping those whose backend is
+	// missing or which the key may not use
+	configured, err := h.db.ListModels()
 	if err != nil {
-		log.Printf("Error fetching models from DB: %v", err)
-		models = []string{}
+		logFor(r).Error("Could not fetch models from DB", "error", err)
+	}
+	models := make([]string, 0, len(configured))
+	for i := range configured {
+		if _, ok := h.modelBackend(&configured[i]); ok && p.allowsModel(configured[i].ID) {
+			models = append(models, configured[i].ID)
+		}
 	}
 
 	// Route: GET /models or /v1/models
@@ -88,15 +107,7 @@ func (h *baseHandle) handleModels(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 		if !found {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusNotFound)
-			resp := OpenAIErrorResponse{Err: OpenAIError{
-				Message: "The model '" + id + "' does not exist",
-				Type:    "invalid_request_error",
-				Param:   nil,
-				Code:    "model_not_found",
-			}}
-			json.NewEncoder(w).Encode(resp)
+			writeOpenAIError(w, http.StatusNotFound, "The model '"+id+"' does not exist", "invalid_request_error", "model_not_found")
 			return
 		}
 		created := time.Now().Unix()
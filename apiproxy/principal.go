@@ -0,0 +1,93 @@
+package apiproxy
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	db "openai-api-proxy/db"
+	"time"
+)
+
+// Principal is the API key a request was authenticated with. ServeHTTP stores
+// it in the request context, so later stages do not have to match the bearer
+// token against the stored hashes again.
+type Principal struct {
+	KeyUUID string
+	Owner   string // sub of the user owning the key
+	Group   int64  // reporting group of the key, see db.ApiKey.ReportingGroup
+
+	SecretID        int64     // rotated secret the key was used with, 0 for the current one
+	SecretExpiresAt time.Time // end of the grace period of a rotated secret
+
+	KeyLimit  Limit // per minute limits of the key
+	UserLimit Limit // per minute limits of the owner over all keys
+
+	ExpiresAt        time.Time      // zero if the key does not expire
+	AllowedModels    []string       // empty allows all models
+	AllowedEndpoints []string       // empty allows all endpoints
+	AllowedNets      []netip.Prefix // empty allows all clients
+
+	AuditContent        bool // prompts and completions go to the audit log
+	ResponseCacheOptOut bool // requests bypass the response cache
+}
+
+// newPrincipal builds the principal of key. Limits not set on the key or
+// user fall back to RATE_LIMIT_RPM/_TPM and RATE_LIMIT_USER_RPM/_TPM.
+func newPrincipal(key *db.ApiKey) *Principal {
+	p := &Principal{
+		KeyUUID:         key.UUID,
+		Owner:           key.Owner,
+		Group:           key.ReportingGroup,
+		SecretID:        key.SecretID,
+		SecretExpiresAt: key.SecretExpiresAt,
+		KeyLimit: Limit{
+			RPM: resolveLimit(key.RPMLimit, "RATE_LIMIT_RPM"),
+			TPM: resolveLimit(key.TPMLimit, "RATE_LIMIT_TPM"),
+		},
+		UserLimit: Limit{
+			RPM: resolveLimit(key.UserRPMLimit, "RATE_LIMIT_USER_RPM"),
+			TPM: resolveLimit(key.UserTPMLimit, "RATE_LIMIT_USER_TPM"),
+		},
+		ExpiresAt:           key.ExpiresAt,
+		AllowedModels:       key.AllowedModels,
+		AllowedEndpoints:    key.AllowedEndpoints,
+		AuditContent:        key.AuditContent,
+		ResponseCacheOptOut: key.ResponseCacheOptOut,
+	}
+	for _, cidr := range key.AllowedCIDRs {
+		prefix, err := parseCIDR(cidr)
+		if err != nil {
+			// Keep the list non-empty so a broken entry denies instead of
+			// lifting the restriction.
+			slog.Warn("Ignoring invalid CIDR", "cidr", cidr, "key_uuid", key.UUID, "error", err)
+			prefix = netip.Prefix{}
+		}
+		p.AllowedNets = append(p.AllowedNets, prefix)
+	}
+	return p
+}
+
+const principalCtx contextKey = attemptCtx + 1
+
+// WithPrincipal returns a copy of ctx carrying p.
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalCtx, p)
+}
+
+// PrincipalFromContext returns the principal stored by WithPrincipal.
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalCtx).(*Principal)
+	return p, ok && p != nil
+}
+
+// requestPrincipal returns the principal of req, falling back to resolving
+// the client key for requests that did not pass through ServeHTTP.
+func (rc *ResponseConf) requestPrincipal(req *http.Request) (*Principal, error) {
+	if req != nil {
+		if p, ok := PrincipalFromContext(req.Context()); ok {
+			return p, nil
+		}
+	}
+	return rc.LookupApiKey(clientAPIKey(req))
+}
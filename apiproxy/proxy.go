@@ -2,167 +2,259 @@ package apiproxy
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
 	db "openai-api-proxy/db"
+	"openai-api-proxy/logging"
 	"os"
 	"strings"
-)
-
-type AzureConfig struct {
-	DeploymentName string
-	RessourceName  string
-	BaseUrl        string
-	ApiKey         string
-}
+	"time"
 
-var (
-	authHeader     = "Authorization"
-	defaultBackend = "openai"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// hostTarget maps hostnames to their corresponding backend server URLs.
 var (
-	OpenAIbackendService = map[string]string{
-		// "azure": "", // see SetAzureUrl
-		"openai":     "https://api.openai.com/",
-		"openrouter": "https://openrouter.ai/api/",
-	}
-
-	backendProxy = make(map[string]*httputil.ReverseProxy)
+	authHeader = "Authorization"
 )
 
 func Init(mux *http.ServeMux, db *db.Database) {
-	// Setup Azure Vars and Connection String
-	azconf := &AzureConfig{
-		DeploymentName: os.Getenv("DEPLOYMENT_NAME"),
-		RessourceName:  os.Getenv("RESSOURCE_NAME"),
-		BaseUrl:        os.Getenv("BASE_URL"),
-	}
-	defaultBackend = os.Getenv("DEFAULT_BACKEND")
 	rc := &ResponseConf{
-		db: db,
+		db:      db,
+		keys:    newApiKeyCache(envDuration("API_KEY_CACHE_TTL", 30*time.Second)),
+		limiter: NewMemoryLimiter(),
+		budgets: newBudgetCache(envDuration("BUDGET_CACHE_TTL", 15*time.Second)),
+		used:    newLastUsedTracker(envDuration("API_KEY_LAST_USED_INTERVAL", time.Minute)),
+		metrics: newMetrics(prometheus.DefaultRegisterer),
+	}
+	db.OnApiKeyChange(rc.keys.evict)
+	if os.Getenv("AUDIT_LOG") == "true" {
+		a, err := newAuditor(db)
+		if err != nil {
+			log.Fatalf("Could not set up the audit log: %v", err)
+		}
+		rc.audit = a
+		if retention := envDuration("AUDIT_RETENTION", 90*24*time.Hour); retention > 0 {
+			go a.purgeLoop(retention, time.Hour)
+		}
+	}
+	cache, err := newResponseCache(db)
+	if err != nil {
+		log.Fatalf("Could not set up the response cache: %v", err)
+	}
+	rc.cache = cache
+	if err := setupTracing(context.Background()); err != nil {
+		log.Fatalf("Could not set up tracing: %v", err)
 	}
 	h := &baseHandle{
-		db: db,
-		az: azconf,
-		rc: rc}
+		db:       db,
+		backends: LoadRegistry(db, rc),
+		rc:       rc,
+		breaker:  newBreaker(),
+		balancer: newBalancer(),
+		proxies:  newProxyPool(newUpstreamTransport())}
+	semantic, err := newSemanticCache(db)
+	if err != nil {
+		log.Fatalf("Could not set up the semantic cache: %v", err)
+	}
+	if semantic != nil {
+		semantic.embed = h.embed
+		rc.semantic = semantic
+	}
 	mux.Handle("/api/", h)
+	mux.Handle("/metrics", metricsHandler(prometheus.DefaultGatherer, os.Getenv("METRICS_TOKEN")))
+
+}
 
+// ProxyStore is the subset of database methods used by baseHandle.
+type ProxyStore interface {
+	DBStore
+	ListModels() ([]db.Model, error)
+	LookupModel(string) (*db.Model, error)
+	LookupModelUpstreams(string) ([]db.Model, error)
+	LookupBudgets(key, user string) ([]db.BudgetStatus, error)
 }
 
 type baseHandle struct {
-	db *db.Database
-	az *AzureConfig
-	rc *ResponseConf
+	db       ProxyStore
+	backends *Registry
+	rc       *ResponseConf
+	breaker  *breaker
+	balancer *balancer
+	proxies  *proxyPool
 }
 
 func (h *baseHandle) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	backend := r.Header.Get("Backend")
 	r.Header.Del("Backend")
 
+	requestID := newRequestID(r)
+	w.Header().Set(requestIDHeader, requestID)
+	r = withLogger(r, slog.Default().With("request_id", requestID))
+
 	// Intercept OpenAI-compatible models endpoints and serve locally
 	if strings.HasPrefix(r.URL.Path, "/api/models") || strings.HasPrefix(r.URL.Path, "/api/v1/models") {
 		h.handleModels(w, r)
 		return
 	}
 
-	if fn, ok := backendProxy[backend]; ok {
-		fn.ServeHTTP(w, r)
+	r, span := startRequestSpan(r)
+	defer span.End()
+	span.SetAttributes(attribute.String("openai_proxy.request_id", requestID))
+
+	p := h.ValidateToken(w, r)
+	if p == nil { // ValidateToken writes the error response
+		span.SetAttributes(attribute.String("openai_proxy.rejected", "auth"))
+		return
+	}
+	r = r.WithContext(WithPrincipal(r.Context(), p))
+	r = addLogFields(r, "key_uuid", p.KeyUUID)
+	if !h.checkRateLimit(w, p) { // checkRateLimit writes the 429 response
+		span.SetAttributes(attribute.String("openai_proxy.rejected", "rate_limit"))
+		return
+	}
+	if !h.checkBudget(w, r, p) { // checkBudget writes the error response
+		span.SetAttributes(attribute.String("openai_proxy.rejected", "budget"))
 		return
 	}
 
-	// See if backend is OpenAI compatible
-	_, ok := OpenAIbackendService[backend]
-
-	if ok {
-		//h.HandleOpenAI(w, r, backend)
+	ups, err := h.route(r, backend)
+	if errors.Is(err, errModelNotFound) {
+		model := peekModel(r)
+		writeOpenAIError(w, http.StatusNotFound, "The model '"+model+"' does not exist", "invalid_request_error", "model_not_found")
 		return
 	}
-	if backend == "azure" {
-		h.HandleAzure(w, r, backend)
+	if err != nil {
+		logFor(r).Warn("Routing failed", "error", err)
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("404: Backend not found "))
 		return
 	}
+	h.forward(w, r, ups)
+}
 
-	if backend == "" {
-		if defaultBackend == "azure" {
-			h.HandleAzure(w, r, defaultBackend)
-			return
-		} else {
-			//h.HandleOpenAI(w, r, defaultBackend)
+// forward sends r to the first healthy upstream in the order chosen by the
+// balancer and retries on rate limits, server errors and connection failures.
+// The next upstream is tried right away, retrying the same upstream waits for
+// its Retry-After or a backoff.
+// Up to UPSTREAM_MAX_ATTEMPTS attempts are made, at least one per upstream.
+func (h *baseHandle) forward(w http.ResponseWriter, r *http.Request, ups []upstream) {
+	// Keep the proxy key around for usage accounting before it is replaced.
+	r = withClientAPIKey(r)
+
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Bad Request: could not read body", http.StatusBadRequest)
 			return
 		}
 	}
 
-	w.Write([]byte("404: Backend not found "))
-}
+	info := newRequestInfo(r, ups)
+	h.rc.startAudit(r, info, ups, body)
+	r = withRequestInfo(r, info)
+	if info.model != "" {
+		r = addLogFields(r, "model", info.model)
+	}
+	defer func() {
+		h.rc.recordFailure(r, info)
+		setStatus(trace.SpanFromContext(r.Context()), info.status, false)
+	}()
+	if h.rc.serveCached(w, r, body) {
+		return
+	}
 
-// Since OpenAI and Azure API are not really compatible, we need 2 different handler functions
+	plan := h.breaker.order(h.balancer.order(ups))
+	attempts := max(upstreamMaxAttempts(), len(plan))
+	var wait time.Duration
+	for i := 0; i < attempts; i++ {
+		if wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-r.Context().Done():
+				return
+			}
+		}
 
-// Since OpenAI and Azure API are not really compatible, we need 2 different handler functions
-func (h *baseHandle) HandleAzure(w http.ResponseWriter, r *http.Request, backend string) {
-	azureToken := h.ValidateToken(w, r)
-	if azureToken == "" {
-		http.Error(w, "Error Processing Request", http.StatusUnauthorized)
-		return
+		up := plan[i%len(plan)]
+		info.upstream = up.name()
+		info.backend = up.backend.Name()
+		info.kind = up.kind()
+		a := &attempt{
+			upstream: up.key(),
+			backend:  up.backend,
+			breaker:  h.breaker,
+			balancer: h.balancer,
+			last:     i == attempts-1,
+			sameNext: plan[(i+1)%len(plan)].key() == up.key(),
+		}
+		req := r.Clone(r.Context())
+		if body != nil {
+			req.Body = io.NopCloser(bytes.NewReader(body))
+			req.ContentLength = int64(len(body))
+		}
+		release := h.balancer.acquire(a.upstream)
+		h.HandleBackend(w, req, up, a)
+		release()
+		if !a.retry {
+			return
+		}
+
+		wait = 0
+		if a.sameNext {
+			wait = a.retryAfter
+			if wait == 0 {
+				wait = upstreamRetryBackoff() * time.Duration(i+1)
+			}
+		}
+		logFor(req).Warn("Upstream failed", "backend", up.backend.Name(), "reason", a.reason, "attempt", i+1, "attempts", attempts)
+	}
+}
+
+// HandleBackend forwards the authenticated request to one upstream. The
+// Backend takes care of the differences between the provider APIs, the model
+// holds the per-model upstream settings and may be nil. The outcome is
+// recorded in a.
+func (h *baseHandle) HandleBackend(w http.ResponseWriter, r *http.Request, up upstream, a *attempt) {
+	b, m := up.backend, up.model
+	r = addLogFields(r, "backend", b.Name())
+	if m != nil && m.Deployment != "" && m.Deployment != m.ID {
+		rewriteModel(r, m.Deployment)
 	}
-	r.Header.Set("Content-Type", "application/json")
-	r.Header.Set("Api-Key", azureToken)
+	b.Authorize(r, m)
 
-	remoteUrl := h.SetAzureUrl(r)
-	if remoteUrl == nil {
+	remoteUrl, err := b.Rewrite(r, m)
+	if err != nil {
+		logFor(r).Warn("Could not rewrite request", "error", err)
+		if info := requestInfoFrom(r); info != nil {
+			info.status = http.StatusBadRequest
+		}
 		http.Error(w, "Bad Request: missing or invalid model", http.StatusBadRequest)
 		return
 	}
 
-	proxy := httputil.NewSingleHostReverseProxy(remoteUrl)
+	proxy := h.proxies.get(remoteUrl)
 	r.Host = remoteUrl.Host
-	// Remove proxy/ingress headers that should not be forwarded to Azure.
-	// These headers are added by our ingress and clients and may be rejected
-	// or cause unexpected behavior when sent to the Azure OpenAI endpoint.
-	for _, hdr := range []string{
-		"X-Forwarded-For",
-		"X-Forwarded-Host",
-		"X-Forwarded-Port",
-		"X-Forwarded-Proto",
-		"X-Forwarded-Scheme",
-		"X-Real-Ip",
-		"X-Request-Id",
-		"X-Scheme",
-		"Forwarded",
-		"Via",
-		"Client-Ip",
-	} {
-		r.Header.Del(hdr)
-	}
-	// Normalize incoming path for Azure deployment endpoints.
-	// Incoming v1 requests under `/api/v1/...` should be forwarded to
-	// `/openai/deployments/{deployment}/...` on Azure. We remove `/api` and
-	// `/v1` here; SetAzureUrl will build the deployments base URL based on the
-	// model/deployment name.
-	// Forward the path after `/api` unchanged. If the client sends `/api/v1/responses`
-	// the forwarded path will include `/v1/responses`, and combined with the
-	// `/openai` base will produce `/openai/v1/responses` as desired.
-	r.URL.Path = strings.TrimPrefix(r.URL.Path, "/api")
-	// Preserve incoming query parameters unchanged.
-	r.URL.RawQuery = r.URL.RawQuery
+	stripForwardingHeaders(r)
 	ensureStreamUsageForChatCompletions(r)
 
-	backendProxy[r.Host] = proxy
-
 	// Before proxying, log the intended complete URL.
 	actualURL := *remoteUrl // Make a copy of the URL struct
 	// Join the deployment base path and the incoming path similar to ReverseProxy behavior.
 	actualURL.Path = singleJoiningSlash(remoteUrl.Path, r.URL.Path)
 	// Combine query params from remote (none) and the request (we already encoded api-version into r.URL.RawQuery)
 	actualURL.RawQuery = r.URL.RawQuery
-	// Dev: optionally log outgoing request details (without exposing full secrets).
-	if os.Getenv("DEV_LOG_REQUEST") == "1" {
+	// Log the outgoing request details (without exposing secrets).
+	if l := logFor(r); l.Enabled(r.Context(), logging.LevelTrace) {
 		// log method, path, masked headers, and body preview
 		var bbuf []byte
 		if r.Body != nil {
@@ -179,13 +271,57 @@ func (h *baseHandle) HandleAzure(w http.ResponseWriter, r *http.Request, backend
 				headers[k] = strings.Join(v, ",")
 			}
 		}
-		log.Printf("Outgoing request: %s %s headers=%v body_preview=%s", r.Method, actualURL.Path, headers, preview(bbuf, 200))
+		l.Log(r.Context(), logging.LevelTrace, "Outgoing request", "method", r.Method, "path", actualURL.Path, "headers", headers, "body_preview", preview(bbuf, 200))
+	}
+
+	r, span := startUpstreamSpan(r, up)
+	defer span.End()
+	proxy.ServeHTTP(w, withAttempt(r, a))
+}
+
+// stripForwardingHeaders removes proxy/ingress headers that should not be
+// forwarded upstream. These headers are added by our ingress and clients and
+// may be rejected or cause unexpected behavior at the provider.
+func stripForwardingHeaders(r *http.Request) {
+	for _, hdr := range []string{
+		"X-Forwarded-For",
+		"X-Forwarded-Host",
+		"X-Forwarded-Port",
+		"X-Forwarded-Proto",
+		"X-Forwarded-Scheme",
+		"X-Real-Ip",
+		"X-Request-Id",
+		"X-Scheme",
+		"Forwarded",
+		"Via",
+		"Client-Ip",
+	} {
+		r.Header.Del(hdr)
 	}
+}
 
-	proxy.ModifyResponse = h.rc.NewResponse
+type contextKey int
 
-	proxy.ServeHTTP(w, r)
+const clientAPIKeyCtx contextKey = iota
 
+// withClientAPIKey stores the bearer token sent by the client in the request
+// context, so the response hooks can still attribute usage to the proxy key
+// after the Authorization header was replaced with the provider key.
+func withClientAPIKey(r *http.Request) *http.Request {
+	apiKey := strings.TrimPrefix(r.Header.Get(authHeader), "Bearer ")
+	return r.WithContext(context.WithValue(r.Context(), clientAPIKeyCtx, apiKey))
+}
+
+// clientAPIKey returns the proxy key of the client for req, preferring the
+// value stored by withClientAPIKey over the Authorization header.
+func clientAPIKey(req *http.Request) string {
+	if req == nil {
+		return ""
+	}
+	if apiKey, ok := req.Context().Value(clientAPIKeyCtx).(string); ok {
+		return apiKey
+	}
+	return strings.TrimPrefix(req.Header.Get(authHeader), "Bearer ")
 }
 
 // ensureStreamUsageForChatCompletions enables usage emission for streaming chat
@@ -273,16 +409,3 @@ func preview(b []byte, n int) string {
 type OpenAIBody struct {
 	Model string `json:"model"`
 }
-
-func (h *baseHandle) SetAzureUrl(r *http.Request) *url.URL {
-	// Use the Azure OpenAI v1 base path. Clients call `/api/v1/...` and the
-	// proxy preserves the `/v1` segment, so combining this base with the
-	// incoming path yields `/openai/v1/...` as required by the v1 API.
-	azureUrl := fmt.Sprintf("https://%s.%s/openai", h.az.DeploymentName, h.az.BaseUrl)
-	url, err := url.Parse(azureUrl)
-	if err != nil {
-		log.Println("target parse fail:", err)
-		return nil
-	}
-	return url
-}
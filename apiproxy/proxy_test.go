@@ -7,6 +7,7 @@ import (
 	"net/http/httptest"
 	"net/http/httputil"
 	"net/url"
+	db "openai-api-proxy/db"
 	"strings"
 	"testing"
 )
@@ -145,3 +146,143 @@ func TestEnsureStreamUsageForChatCompletions_KeepsExistingIncludeUsage(t *testin
 		t.Fatalf("expected existing include_usage=false to remain unchanged, got: %v", streamOptions["include_usage"])
 	}
 }
+
+// newTestHandle returns a baseHandle backed by fb with the given backends
+// registered, the first one being the default.
+func newTestHandle(t *testing.T, fb *fakeDBForTest, configs ...db.BackendConfig) *baseHandle {
+	t.Helper()
+	rc := &ResponseConf{db: fb}
+	reg := NewRegistry()
+	for i, c := range configs {
+		b, err := newBackend(c, rc)
+		if err != nil {
+			t.Fatalf("newBackend: %v", err)
+		}
+		reg.Register(b)
+		if i == 0 {
+			reg.SetDefault(c.Name)
+		}
+	}
+	return &baseHandle{db: fb, backends: reg, rc: rc, breaker: newBreaker(), balancer: newBalancer(), proxies: newProxyPool(http.DefaultTransport)}
+}
+
+func newTestDB(t *testing.T) *fakeDBForTest {
+	t.Helper()
+	fb := &fakeDBForTest{}
+	fb.apiKeys = []db.ApiKey{{UUID: "uid-1", ApiKey: mustHash(t, "TESTTOKEN"), Owner: "owner1"}}
+	fb.models = []db.Model{{ID: "gpt-4o"}, {ID: "gpt-5-mini"}}
+	return fb
+}
+
+func TestHandleBackend_OpenAISwapsKeyAndRecordsUsage(t *testing.T) {
+	var gotPath string
+	var gotAuth string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotAuth = r.Header.Get("Authorization")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"chatcmpl-1","object":"chat.completion","model":"gpt-4o-2024-08-06","usage":{"prompt_tokens":3,"completion_tokens":5}}`))
+	}))
+	defer ts.Close()
+
+	fb := newTestDB(t)
+	h := newTestHandle(t, fb,
+		db.BackendConfig{Name: "azure", Kind: BackendKindAzure, BaseURL: "https://unused.example/openai"},
+		db.BackendConfig{Name: "openai", Kind: BackendKindOpenAI, BaseURL: ts.URL + "/", ApiKey: "sk-upstream"},
+	)
+
+	body := `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`
+	req := httptest.NewRequest("POST", "http://localhost/api/v1/chat/completions", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer TESTTOKEN")
+	req.Header.Set("Backend", "openai")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if gotPath != "/v1/chat/completions" {
+		t.Fatalf("expected path /v1/chat/completions, got %s", gotPath)
+	}
+	if gotAuth != "Bearer sk-upstream" {
+		t.Fatalf("expected provider key upstream, got %q", gotAuth)
+	}
+	if len(fb.requests()) != 1 || fb.requests()[0].ApiKeyID != "uid-1" || fb.requests()[0].OutputTokenCount != 5 {
+		t.Fatalf("unexpected DB writes: %+v", fb.requests())
+	}
+}
+
+func TestHandleBackend_AzureDefaultUsesApiKeyHeader(t *testing.T) {
+	var gotPath string
+	var gotApiKey string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotApiKey = r.Header.Get("Api-Key")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"resp-1","object":"response","model":"gpt-5-mini","usage":{"input_tokens":2,"output_tokens":4}}`))
+	}))
+	defer ts.Close()
+
+	fb := newTestDB(t)
+	h := newTestHandle(t, fb,
+		db.BackendConfig{Name: "azure-sweden", Kind: BackendKindAzure, BaseURL: ts.URL + "/openai", ApiKey: "az-key"},
+	)
+
+	req := httptest.NewRequest("POST", "http://localhost/api/v1/responses", strings.NewReader(`{"model":"gpt-5-mini","input":"hi"}`))
+	req.Header.Set("Authorization", "Bearer TESTTOKEN")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	if gotPath != "/openai/v1/responses" {
+		t.Fatalf("expected path /openai/v1/responses, got %s", gotPath)
+	}
+	if gotApiKey != "az-key" {
+		t.Fatalf("expected azure key upstream, got %q", gotApiKey)
+	}
+	if len(fb.requests()) != 1 || fb.requests()[0].ApiKeyID != "uid-1" {
+		t.Fatalf("unexpected DB writes: %+v", fb.requests())
+	}
+}
+
+func TestHandleBackend_RejectsInvalidToken(t *testing.T) {
+	called := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer ts.Close()
+
+	fb := newTestDB(t)
+	h := newTestHandle(t, fb,
+		db.BackendConfig{Name: "openrouter", Kind: BackendKindOpenAI, BaseURL: ts.URL + "/api/", ApiKey: "sk-or-upstream"},
+	)
+
+	req := httptest.NewRequest("POST", "http://localhost/api/v1/chat/completions", strings.NewReader(`{}`))
+	req.Header.Set("Authorization", "Bearer WRONG")
+	req.Header.Set("Backend", "openrouter")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", rr.Code)
+	}
+	if called {
+		t.Fatalf("upstream must not be called for invalid tokens")
+	}
+}
+
+func TestServeHTTP_UnknownBackend(t *testing.T) {
+	fb := newTestDB(t)
+	h := newTestHandle(t, fb,
+		db.BackendConfig{Name: "openai", Kind: BackendKindOpenAI, BaseURL: "https://unused.example/"},
+	)
+
+	req := httptest.NewRequest("POST", "http://localhost/api/v1/chat/completions", strings.NewReader(`{}`))
+	req.Header.Set("Authorization", "Bearer TESTTOKEN")
+	req.Header.Set("Backend", "nope")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", rr.Code)
+	}
+}
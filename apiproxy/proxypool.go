@@ -0,0 +1,111 @@
+package apiproxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// proxyPool keeps one long-lived ReverseProxy per upstream URL, all sharing a
+// single transport so connections are reused across requests. The state of a
+// request travels in its context, see withAttempt.
+type proxyPool struct {
+	mu        sync.RWMutex
+	proxies   map[string]*httputil.ReverseProxy
+	transport http.RoundTripper
+}
+
+func newProxyPool(transport http.RoundTripper) *proxyPool {
+	return &proxyPool{
+		proxies:   make(map[string]*httputil.ReverseProxy),
+		transport: transport,
+	}
+}
+
+// get returns the proxy for target, creating it on first use.
+func (p *proxyPool) get(target *url.URL) *httputil.ReverseProxy {
+	key := target.String()
+	p.mu.RLock()
+	proxy, ok := p.proxies[key]
+	p.mu.RUnlock()
+	if ok {
+		return proxy
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if proxy, ok := p.proxies[key]; ok {
+		return proxy
+	}
+	proxy = httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = p.transport
+	proxy.ModifyResponse = modifyAttemptResponse
+	proxy.ErrorHandler = handleAttemptError
+	p.proxies[key] = proxy
+	return proxy
+}
+
+// len returns the number of cached proxies.
+func (p *proxyPool) len() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return len(p.proxies)
+}
+
+// newUpstreamTransport returns the transport shared by all upstreams. Response
+// headers of large completions can take minutes, which is bounded by
+// UPSTREAM_RESPONSE_HEADER_TIMEOUT; the body of a stream is not limited.
+func newUpstreamTransport() *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          256,
+		MaxIdleConnsPerHost:   64,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		ResponseHeaderTimeout: envDuration("UPSTREAM_RESPONSE_HEADER_TIMEOUT", 5*time.Minute),
+	}
+}
+
+const attemptCtx contextKey = clientAPIKeyCtx + 1
+
+// withAttempt attaches a to the request, the shared proxy hooks read it back.
+func withAttempt(r *http.Request, a *attempt) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), attemptCtx, a))
+}
+
+func attemptOf(r *http.Request) (*attempt, bool) {
+	if r == nil {
+		return nil, false
+	}
+	a, ok := r.Context().Value(attemptCtx).(*attempt)
+	return a, ok
+}
+
+func modifyAttemptResponse(in *http.Response) error {
+	a, ok := attemptOf(in.Request)
+	if !ok {
+		return nil
+	}
+	return a.modifyResponse(in)
+}
+
+func handleAttemptError(w http.ResponseWriter, r *http.Request, err error) {
+	a, ok := attemptOf(r)
+	if !ok {
+		logFor(r).Error("Proxy error", "error", err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	a.errorHandler(w, r, err)
+}
@@ -0,0 +1,67 @@
+package apiproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	db "openai-api-proxy/db"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// TestServeHTTP_ConcurrentRequests drives parallel requests across two
+// upstreams; run with -race to check the shared proxies and balancer state.
+func TestServeHTTP_ConcurrentRequests(t *testing.T) {
+	var hits atomic.Int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Ratelimit-Remaining-Tokens", "1000")
+		w.Write([]byte(okCompletion))
+	})
+	a := httptest.NewServer(handler)
+	defer a.Close()
+	b := httptest.NewServer(handler)
+	defer b.Close()
+
+	fb := newTestDB(t)
+	fb.models = []db.Model{
+		{ID: "gpt-4.1", Backend: "sweden", Balance: BalanceLeastOutstanding},
+		{ID: "gpt-4.1-mini", Backend: "france"},
+	}
+	fb.upstreams = map[string][]db.Model{"gpt-4.1": {{ID: "gpt-4.1", Backend: "france"}}}
+	h := newTestHandle(t, fb,
+		db.BackendConfig{Name: "sweden", Kind: BackendKindOpenAI, BaseURL: a.URL + "/"},
+		db.BackendConfig{Name: "france", Kind: BackendKindOpenAI, BaseURL: b.URL + "/"},
+	)
+	h.proxies = newProxyPool(newUpstreamTransport())
+
+	const n = 64
+	var wg sync.WaitGroup
+	codes := make(chan int, n)
+	for i := 0; i < n; i++ {
+		model := "gpt-4.1"
+		if i%2 == 1 {
+			model = "gpt-4.1-mini"
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- postCompletion(h, model).Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	for code := range codes {
+		if code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", code)
+		}
+	}
+	if hits.Load() != n {
+		t.Fatalf("expected %d upstream requests, got %d", n, hits.Load())
+	}
+	if got := h.proxies.len(); got != 2 {
+		t.Fatalf("expected one cached proxy per upstream, got %d", got)
+	}
+}
@@ -0,0 +1,270 @@
+package apiproxy
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Limit is a requests and tokens per minute limit, zero means unlimited.
+type Limit struct {
+	RPM int
+	TPM int
+}
+
+// RateSubject is a bucket a request is charged to, e.g. its key or its user.
+type RateSubject struct {
+	Key   string
+	Limit Limit
+}
+
+// RateDecision is the outcome of RateLimiter.Allow for the most restrictive
+// subject of a request.
+type RateDecision struct {
+	Allowed           bool
+	Reason            string // "requests" or "tokens" if not allowed
+	Limit             Limit
+	RemainingRequests int
+	RemainingTokens   int
+	ResetRequests     time.Duration // until the request bucket is full again
+	ResetTokens       time.Duration // until the token bucket is full again
+	RetryAfter        time.Duration
+}
+
+// RateLimiter enforces per minute limits. The in-memory implementation keeps
+// its state per replica; a shared store (e.g. a Postgres table updated with
+// row locks) can implement the same interface so limits hold across replicas.
+type RateLimiter interface {
+	// Allow takes one request from all subjects if none of them is exhausted.
+	Allow(subjects []RateSubject) RateDecision
+	// Consume charges the tokens of a finished request. The token count is
+	// only known afterwards, so a bucket may drop below zero and then blocks
+	// until it has refilled.
+	Consume(subjects []RateSubject, tokens int)
+}
+
+// memoryLimiter is a token bucket per subject and dimension, refilled
+// continuously at the per minute rate up to the limit.
+type memoryLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*rateBuckets
+	now     func() time.Time
+	swept   time.Time // last run of sweep
+}
+
+// rateBucketIdle is how often idle buckets are dropped, see sweep.
+const rateBucketIdle = time.Minute
+
+type rateBuckets struct {
+	requests float64
+	tokens   float64
+	last     time.Time
+	limit    Limit
+}
+
+func NewMemoryLimiter() RateLimiter {
+	return &memoryLimiter{buckets: make(map[string]*rateBuckets), now: time.Now}
+}
+
+// sweep drops the buckets that have been full for a while, at most once per
+// rateBucketIdle. A dropped subject starts again with full buckets, so only
+// the memory of subjects that stopped sending requests is given back.
+// Callers must hold l.mu.
+func (l *memoryLimiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < rateBucketIdle {
+		return
+	}
+	l.swept = now
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= rateBucketIdle && b.fullAt(now) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// fullAt reports whether both buckets have refilled to their limit at now.
+func (b *rateBuckets) fullAt(now time.Time) bool {
+	minutes := now.Sub(b.last).Minutes()
+	return b.requests+minutes*float64(b.limit.RPM) >= float64(b.limit.RPM) &&
+		b.tokens+minutes*float64(b.limit.TPM) >= float64(b.limit.TPM)
+}
+
+// get returns the refilled buckets of s. Callers must hold l.mu.
+func (l *memoryLimiter) get(s RateSubject) *rateBuckets {
+	now := l.now()
+	l.sweep(now)
+	b, ok := l.buckets[s.Key]
+	if !ok || b.limit != s.Limit {
+		// New subject or changed limit, start with full buckets.
+		b = &rateBuckets{requests: float64(s.Limit.RPM), tokens: float64(s.Limit.TPM), last: now, limit: s.Limit}
+		l.buckets[s.Key] = b
+		return b
+	}
+	minutes := now.Sub(b.last).Minutes()
+	b.requests = math.Min(float64(s.Limit.RPM), b.requests+minutes*float64(s.Limit.RPM))
+	b.tokens = math.Min(float64(s.Limit.TPM), b.tokens+minutes*float64(s.Limit.TPM))
+	b.last = now
+	return b
+}
+
+func (l *memoryLimiter) Allow(subjects []RateSubject) RateDecision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	decision := RateDecision{Allowed: true}
+	var tightest float64 = math.Inf(1)
+	for _, s := range subjects {
+		if s.Limit.RPM <= 0 && s.Limit.TPM <= 0 {
+			continue
+		}
+		b := l.get(s)
+		d := b.decision(s.Limit)
+		if !d.Allowed {
+			return d
+		}
+		// Report the subject closest to its limit.
+		if share := b.share(); share < tightest {
+			tightest = share
+			decision = d
+		}
+	}
+	for _, s := range subjects {
+		if s.Limit.RPM > 0 {
+			l.buckets[s.Key].requests--
+		}
+	}
+	if decision.Limit.RPM > 0 {
+		decision.RemainingRequests = max(decision.RemainingRequests-1, 0)
+	}
+	return decision
+}
+
+func (l *memoryLimiter) Consume(subjects []RateSubject, tokens int) {
+	if tokens <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, s := range subjects {
+		if s.Limit.TPM <= 0 {
+			continue
+		}
+		l.get(s).tokens -= float64(tokens)
+	}
+}
+
+// share is the fraction of the fuller dimension that is left.
+func (b *rateBuckets) share() float64 {
+	share := 1.0
+	if b.limit.RPM > 0 {
+		share = math.Min(share, b.requests/float64(b.limit.RPM))
+	}
+	if b.limit.TPM > 0 {
+		share = math.Min(share, b.tokens/float64(b.limit.TPM))
+	}
+	return share
+}
+
+func (b *rateBuckets) decision(limit Limit) RateDecision {
+	d := RateDecision{Allowed: true, Limit: limit}
+	if limit.RPM > 0 {
+		d.RemainingRequests = max(int(b.requests), 0)
+		d.ResetRequests = refillTime(float64(limit.RPM)-b.requests, limit.RPM)
+		if b.requests < 1 {
+			d.Allowed = false
+			d.Reason = "requests"
+			d.RetryAfter = refillTime(1-b.requests, limit.RPM)
+		}
+	}
+	if limit.TPM > 0 {
+		d.RemainingTokens = max(int(b.tokens), 0)
+		d.ResetTokens = refillTime(float64(limit.TPM)-b.tokens, limit.TPM)
+		if d.Allowed && b.tokens <= 0 {
+			d.Allowed = false
+			d.Reason = "tokens"
+			// Wait until there is at least one token again.
+			d.RetryAfter = refillTime(1-b.tokens, limit.TPM)
+		}
+	}
+	return d
+}
+
+// refillTime is how long a bucket with the given per minute rate needs to
+// gain missing units.
+func refillTime(missing float64, perMinute int) time.Duration {
+	if missing <= 0 || perMinute <= 0 {
+		return 0
+	}
+	return time.Duration(missing / float64(perMinute) * float64(time.Minute)).Round(time.Millisecond)
+}
+
+// rateSubjects are the buckets charged for requests of p.
+func (p *Principal) rateSubjects() []RateSubject {
+	var subjects []RateSubject
+	if p.KeyLimit != (Limit{}) {
+		subjects = append(subjects, RateSubject{Key: "key:" + p.KeyUUID, Limit: p.KeyLimit})
+	}
+	if p.UserLimit != (Limit{}) && p.Owner != "" {
+		subjects = append(subjects, RateSubject{Key: "user:" + p.Owner, Limit: p.UserLimit})
+	}
+	return subjects
+}
+
+// resolveLimit applies the default from the environment to a configured
+// limit: positive values are used as is, zero selects the default and
+// negative values disable the limit.
+func resolveLimit(configured int, env string) int {
+	switch {
+	case configured > 0:
+		return configured
+	case configured < 0:
+		return 0
+	default:
+		return envInt(env, 0)
+	}
+}
+
+// checkRateLimit takes one request from the buckets of p and writes an
+// OpenAI style 429 response if a limit is exhausted.
+func (h *baseHandle) checkRateLimit(w http.ResponseWriter, p *Principal) bool {
+	if h.rc.limiter == nil {
+		return true
+	}
+	subjects := p.rateSubjects()
+	if len(subjects) == 0 {
+		return true
+	}
+	d := h.rc.limiter.Allow(subjects)
+	if d.Allowed {
+		return true
+	}
+
+	setRateLimitHeaders(w.Header(), d)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.RetryAfter.Seconds()))))
+	limit, used := d.Limit.RPM, d.Limit.RPM-d.RemainingRequests
+	unit := "requests per min (RPM)"
+	if d.Reason == "tokens" {
+		limit, used = d.Limit.TPM, d.Limit.TPM-d.RemainingTokens
+		unit = "tokens per min (TPM)"
+	}
+	msg := fmt.Sprintf("Rate limit reached on %s: Limit %d, Used %d. Please try again in %s.", unit, limit, used, d.RetryAfter.Round(time.Second))
+	writeOpenAIError(w, http.StatusTooManyRequests, msg, d.Reason, "rate_limit_exceeded")
+	return false
+}
+
+// setRateLimitHeaders sets the x-ratelimit-* headers the OpenAI API uses.
+func setRateLimitHeaders(h http.Header, d RateDecision) {
+	if d.Limit.RPM > 0 {
+		h.Set("X-Ratelimit-Limit-Requests", strconv.Itoa(d.Limit.RPM))
+		h.Set("X-Ratelimit-Remaining-Requests", strconv.Itoa(d.RemainingRequests))
+		h.Set("X-Ratelimit-Reset-Requests", d.ResetRequests.String())
+	}
+	if d.Limit.TPM > 0 {
+		h.Set("X-Ratelimit-Limit-Tokens", strconv.Itoa(d.Limit.TPM))
+		h.Set("X-Ratelimit-Remaining-Tokens", strconv.Itoa(d.RemainingTokens))
+		h.Set("X-Ratelimit-Reset-Tokens", d.ResetTokens.String())
+	}
+}
@@ -0,0 +1,142 @@
+package apiproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	db "openai-api-proxy/db"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestLimiter(now *time.Time) *memoryLimiter {
+	return &memoryLimiter{buckets: make(map[string]*rateBuckets), now: func() time.Time { return *now }}
+}
+
+func TestMemoryLimiter_RequestsRefill(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newTestLimiter(&now)
+	subjects := []RateSubject{{Key: "key:a", Limit: Limit{RPM: 2}}}
+
+	for i := 0; i < 2; i++ {
+		if d := l.Allow(subjects); !d.Allowed {
+			t.Fatalf("request %d rejected", i)
+		}
+	}
+	d := l.Allow(subjects)
+	if d.Allowed || d.Reason != "requests" {
+		t.Fatalf("expected requests limit, got %+v", d)
+	}
+	if d.RetryAfter != 30*time.Second {
+		t.Fatalf("expected retry after 30s, got %s", d.RetryAfter)
+	}
+
+	now = now.Add(30 * time.Second)
+	if d := l.Allow(subjects); !d.Allowed {
+		t.Fatalf("expected refilled bucket, got %+v", d)
+	}
+}
+
+func TestMemoryLimiter_TokensChargedAfterwards(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newTestLimiter(&now)
+	subjects := []RateSubject{{Key: "key:a", Limit: Limit{TPM: 1000}}}
+
+	if d := l.Allow(subjects); !d.Allowed {
+		t.Fatal("first request rejected")
+	}
+	l.Consume(subjects, 1500)
+	d := l.Allow(subjects)
+	if d.Allowed || d.Reason != "tokens" {
+		t.Fatalf("expected tokens limit, got %+v", d)
+	}
+	now = now.Add(31 * time.Second)
+	if d := l.Allow(subjects); !d.Allowed {
+		t.Fatalf("expected tokens to be refilled, got %+v", d)
+	}
+}
+
+func TestMemoryLimiter_UserLimitSpansKeys(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newTestLimiter(&now)
+	user := RateSubject{Key: "user:owner1", Limit: Limit{RPM: 1}}
+
+	if d := l.Allow([]RateSubject{{Key: "key:a", Limit: Limit{RPM: 10}}, user}); !d.Allowed {
+		t.Fatal("first key rejected")
+	}
+	if d := l.Allow([]RateSubject{{Key: "key:b", Limit: Limit{RPM: 10}}, user}); d.Allowed {
+		t.Fatal("expected the user limit to apply to the second key")
+	}
+}
+
+func TestServeHTTP_RateLimitReturnsOpenAIError(t *testing.T) {
+	var hits atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(okCompletion))
+	}))
+	defer ts.Close()
+
+	fb := newTestDB(t)
+	fb.apiKeys[0].RPMLimit = 1
+	fb.models = []db.Model{{ID: "gpt-4.1"}}
+	h := newTestHandle(t, fb, db.BackendConfig{Name: "openai", Kind: BackendKindOpenAI, BaseURL: ts.URL + "/"})
+	h.rc.limiter = NewMemoryLimiter()
+
+	if rr := postCompletion(h, "gpt-4.1"); rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	rr := postCompletion(h, "gpt-4.1")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", rr.Code)
+	}
+	if hits.Load() != 1 {
+		t.Fatalf("rejected request must not reach the upstream, got %d hits", hits.Load())
+	}
+	var resp OpenAIErrorResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || resp.Err.Code != "rate_limit_exceeded" || resp.Err.Type != "requests" {
+		t.Fatalf("unexpected body %q", rr.Body.String())
+	}
+	if got := rr.Header().Get("X-Ratelimit-Limit-Requests"); got != "1" {
+		t.Fatalf("expected x-ratelimit-limit-requests 1, got %q", got)
+	}
+	if rr.Header().Get("X-Ratelimit-Remaining-Requests") != "0" || rr.Header().Get("Retry-After") == "" {
+		t.Fatalf("missing rate limit headers: %v", rr.Header())
+	}
+}
+
+func TestResolveLimit(t *testing.T) {
+	t.Setenv("RATE_LIMIT_RPM", "60")
+	if got := resolveLimit(0, "RATE_LIMIT_RPM"); got != 60 {
+		t.Fatalf("expected default 60, got %d", got)
+	}
+	if got := resolveLimit(5, "RATE_LIMIT_RPM"); got != 5 {
+		t.Fatalf("expected configured 5, got %d", got)
+	}
+	if got := resolveLimit(-1, "RATE_LIMIT_RPM"); got != 0 {
+		t.Fatalf("expected unlimited, got %d", got)
+	}
+}
+
+func TestMemoryLimiter_DropsIdleBuckets(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newTestLimiter(&now)
+	busy := []RateSubject{{Key: "key:busy", Limit: Limit{TPM: 1000}}}
+	for _, key := range []string{"key:a", "key:b"} {
+		l.Allow([]RateSubject{{Key: key, Limit: Limit{RPM: 10}}})
+	}
+	l.Allow(busy)
+	l.Consume(busy, 3000)
+
+	now = now.Add(2 * time.Minute)
+	l.Allow([]RateSubject{{Key: "key:c", Limit: Limit{RPM: 10}}})
+	if _, ok := l.buckets["key:a"]; ok || len(l.buckets) != 2 {
+		t.Fatalf("expected the full idle buckets to be dropped, got %v", l.buckets)
+	}
+	// Still below zero after two minutes, the bucket has to keep blocking.
+	if d := l.Allow(busy); d.Allowed {
+		t.Fatalf("expected the drained bucket to be kept, got %+v", d)
+	}
+}
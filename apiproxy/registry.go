@@ -0,0 +1,133 @@
+package apiproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	db "openai-api-proxy/db"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Registry holds the configured backends by name.
+type Registry struct {
+	mu          sync.RWMutex
+	backends    map[string]Backend
+	defaultName string
+}
+
+func NewRegistry() *Registry {
+	return &Registry{backends: make(map[string]Backend)}
+}
+
+// Register adds b to the registry, replacing a backend with the same name.
+func (reg *Registry) Register(b Backend) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.backends[b.Name()] = b
+}
+
+func (reg *Registry) Get(name string) (Backend, bool) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	b, ok := reg.backends[name]
+	return b, ok
+}
+
+// SetDefault sets the backend used when a request does not select one.
+func (reg *Registry) SetDefault(name string) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.defaultName = name
+}
+
+func (reg *Registry) Default() (Backend, bool) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	b, ok := reg.backends[reg.defaultName]
+	return b, ok
+}
+
+// Names returns the names of all registered backends in sorted order.
+func (reg *Registry) Names() []string {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	names := make([]string, 0, len(reg.backends))
+	for name := range reg.backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// BackendStore is the subset of database methods used to load backends.
+type BackendStore interface {
+	ListBackends() ([]db.BackendConfig, error)
+}
+
+// BackendFile is the format of the file referenced by BACKENDS_CONFIG.
+type BackendFile struct {
+	Default  string             `json:"default"`
+	Backends []db.BackendConfig `json:"backends"`
+}
+
+// LoadRegistry builds the registry from, in increasing precedence, the legacy
+// environment variables, the JSON file referenced by BACKENDS_CONFIG and the
+// `backends` table. A later source replaces a backend with the same name.
+func LoadRegistry(store BackendStore, rc *ResponseConf) *Registry {
+	reg := NewRegistry()
+	configs := legacyBackendConfigs()
+	defaultName := os.Getenv("DEFAULT_BACKEND")
+
+	if path := os.Getenv("BACKENDS_CONFIG"); path != "" {
+		file, err := readBackendFile(path)
+		if err != nil {
+			slog.Error("Could not load backends", "path", path, "error", err)
+		} else {
+			configs = append(configs, file.Backends...)
+			if file.Default != "" && defaultName == "" {
+				defaultName = file.Default
+			}
+		}
+	}
+
+	if store != nil {
+		dbConfigs, err := store.ListBackends()
+		if err != nil {
+			slog.Error("Could not load backends from DB", "error", err)
+		}
+		configs = append(configs, dbConfigs...)
+	}
+
+	for _, c := range configs {
+		b, err := newBackend(c, rc)
+		if err != nil {
+			slog.Warn("Skipping backend", "error", err)
+			continue
+		}
+		reg.Register(b)
+	}
+
+	if defaultName == "" {
+		defaultName = "openai"
+	}
+	reg.SetDefault(defaultName)
+	if _, ok := reg.Default(); !ok {
+		slog.Warn("Default backend is not configured", "backend", defaultName)
+	}
+	slog.Info("Loaded backends", "backends", reg.Names(), "default", defaultName)
+	return reg
+}
+
+func readBackendFile(path string) (*BackendFile, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file BackendFile
+	if err := json.Unmarshal(raw, &file); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return &file, nil
+}
@@ -0,0 +1,71 @@
+package apiproxy
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	db "openai-api-proxy/db"
+)
+
+type fakeBackendStore struct {
+	backends []db.BackendConfig
+	err      error
+}
+
+func (f *fakeBackendStore) ListBackends() ([]db.BackendConfig, error) {
+	return f.backends, f.err
+}
+
+func TestLoadRegistry_MergesEnvFileAndDB(t *testing.T) {
+	t.Setenv("DEPLOYMENT_NAME", "legacy")
+	t.Setenv("BASE_URL", "openai.azure.com")
+	t.Setenv("DEFAULT_BACKEND", "")
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "backends.json")
+	file := `{
+		"default": "vllm",
+		"backends": [
+			{"name": "vllm", "kind": "openai", "base_url": "http://vllm:8000/"},
+			{"name": "azure", "kind": "azure", "base_url": "https://from-file.openai.azure.com/openai"}
+		]
+	}`
+	if err := os.WriteFile(path, []byte(file), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("BACKENDS_CONFIG", path)
+
+	store := &fakeBackendStore{backends: []db.BackendConfig{
+		{Name: "azure-eastus2", Kind: "azure", BaseURL: "https://eastus2.openai.azure.com/openai", ApiKey: "k"},
+		{Name: "broken", Kind: "unknown", BaseURL: "https://example.com"},
+	}}
+	reg := LoadRegistry(store, &ResponseConf{})
+
+	for _, name := range []string{"openai", "openrouter", "azure", "vllm", "azure-eastus2"} {
+		if _, ok := reg.Get(name); !ok {
+			t.Fatalf("expected backend %q to be registered, got %v", name, reg.Names())
+		}
+	}
+	if _, ok := reg.Get("broken"); ok {
+		t.Fatalf("backend with unknown kind must be skipped")
+	}
+	def, ok := reg.Default()
+	if !ok || def.Name() != "vllm" {
+		t.Fatalf("expected default backend from file, got %v", def)
+	}
+	az, _ := reg.Get("azure")
+	if u := az.(*azureBackend).baseURL.Host; u != "from-file.openai.azure.com" {
+		t.Fatalf("expected file to override legacy azure backend, got host %s", u)
+	}
+}
+
+func TestLoadRegistry_DBErrorKeepsOtherSources(t *testing.T) {
+	t.Setenv("DEFAULT_BACKEND", "openai")
+	t.Setenv("BACKENDS_CONFIG", "")
+	reg := LoadRegistry(&fakeBackendStore{err: errors.New("relation does not exist")}, &ResponseConf{})
+	if _, ok := reg.Default(); !ok {
+		t.Fatalf("expected default backend from legacy configuration")
+	}
+}
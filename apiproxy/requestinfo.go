@@ -0,0 +1,120 @@
+package apiproxy
+
+import (
+	"context"
+	"net/http"
+	db "openai-api-proxy/db"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// requestInfo follows a proxied request from forward to the response hooks,
+// which record it together with its usage. It travels in the request context
+// and is shared by all attempts; they run one after another.
+type requestInfo struct {
+	start    time.Time
+	endpoint string
+	model    string // routed model, the model of the response wins
+	upstream string // upstream of the current attempt
+	backend  string // backend of the current attempt
+	kind     string // kind of that backend, selects the costs rows
+	status   int    // status sent to the client
+	ttfb     time.Duration
+	streamed bool
+	recorded bool // a response hook records the request
+
+	// Audit log, see startAudit.
+	content bool // prompt and completion are stored
+	prompt  []byte
+
+	// Response cache, see serveCached.
+	cacheKey string                 // set if the response is to be cached
+	semantic *db.SemanticCacheEntry // query to store the response under in the semantic cache
+	cacheHit bool                   // answered from a cache, billed as zero
+}
+
+const requestInfoCtx contextKey = principalCtx + 1
+
+func withRequestInfo(r *http.Request, info *requestInfo) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestInfoCtx, info))
+}
+
+func requestInfoFrom(req *http.Request) *requestInfo {
+	if req == nil {
+		return nil
+	}
+	info, _ := req.Context().Value(requestInfoCtx).(*requestInfo)
+	return info
+}
+
+// newRequestInfo starts tracking r, which is routed to ups.
+func newRequestInfo(r *http.Request, ups []upstream) *requestInfo {
+	info := &requestInfo{start: time.Now(), endpoint: r.URL.Path}
+	// The routed models row comes first, its fallbacks share its ID.
+	if len(ups) > 0 && ups[0].model != nil {
+		info.model = ups[0].model.ID
+	}
+	return info
+}
+
+// responded notes the arrival of the response headers of in. The response
+// hooks record the request from then on.
+func (info *requestInfo) responded(in *http.Response, streamed bool) {
+	info.status = in.StatusCode
+	info.ttfb = time.Since(info.start)
+	info.streamed = streamed
+	info.recorded = true
+}
+
+// name identifies the upstream in the requests table: the backend, and the
+// Azure resource for models with their own.
+func (u upstream) name() string {
+	if u.model != nil && u.model.ResourceHost != "" {
+		return u.backend.Name() + "@" + u.model.ResourceHost
+	}
+	return u.backend.Name()
+}
+
+// kind is the backend kind of the upstream, matched against the
+// backend_name of the costs table. Empty for unknown backends.
+func (u upstream) kind() string {
+	switch u.backend.(type) {
+	case *azureBackend:
+		return BackendKindAzure
+	case *openAIBackend:
+		return BackendKindOpenAI
+	}
+	return ""
+}
+
+// localRequestID identifies a request without an ID from the upstream, e.g.
+// an error response.
+func localRequestID() string {
+	return "proxy-" + uuid.NewString()
+}
+
+// recordFailure writes a request that got no response from any upstream,
+// because it could not be rewritten, every attempt failed to connect or the
+// client went away.
+func (rc *ResponseConf) recordFailure(r *http.Request, info *requestInfo) {
+	if info.recorded {
+		return
+	}
+	p, ok := PrincipalFromContext(r.Context())
+	if !ok {
+		return
+	}
+	switch {
+	case info.status != 0:
+	case r.Context().Err() != nil:
+		info.status = 499 // client closed request
+	default:
+		info.status = http.StatusBadGateway
+	}
+	rq := db.Request{ID: localRequestID(), ApiKeyID: p.KeyUUID, Model: info.model}
+	if err := rc.writeRequest(r, &rq); err != nil {
+		logFor(r).Error("Could not record failed request", "endpoint", info.endpoint, "error", err)
+	}
+	rc.writeAudit(r, "", "", "", false)
+}
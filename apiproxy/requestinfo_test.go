@@ -0,0 +1,114 @@
+package apiproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	db "openai-api-proxy/db"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitRequests waits for n requests written by stream goroutines.
+func waitRequests(t *testing.T, fb *fakeDBForTest, n int) []*db.Request {
+	t.Helper()
+	for i := 0; i < 50; i++ {
+		if writes := fb.requests(); len(writes) >= n {
+			return writes
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("expected %d recorded requests, got %+v", n, fb.requests())
+	return nil
+}
+
+func TestRecordRequest_Success(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"chatcmpl-1","object":"chat.completion","model":"gpt-4o","usage":{"prompt_tokens":3,"completion_tokens":5}}`))
+	}))
+	defer ts.Close()
+	fb := newTestDB(t)
+	fb.models[0].Backend = "openai"
+	fb.models[0].ResourceHost = "res-sweden"
+	h := newTestHandle(t, fb, db.BackendConfig{Name: "openai", Kind: BackendKindOpenAI, BaseURL: ts.URL + "/", ApiKey: "sk-upstream"})
+
+	req := httptest.NewRequest("POST", "http://localhost/api/v1/chat/completions", strings.NewReader(`{"model":"gpt-4o"}`))
+	req.Header.Set("Authorization", "Bearer TESTTOKEN")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	rq := waitRequests(t, fb, 1)[0]
+	if rq.ID != "chatcmpl-1" || rq.Status != http.StatusOK || rq.Endpoint != "/api/v1/chat/completions" ||
+		rq.Upstream != "openai@res-sweden" || rq.BackendKind != BackendKindOpenAI || rq.Streamed {
+		t.Errorf("unexpected request %+v", rq)
+	}
+	if rq.TTFB <= 0 || rq.Duration < rq.TTFB {
+		t.Errorf("ttfb = %s, duration = %s", rq.TTFB, rq.Duration)
+	}
+}
+
+func TestRecordRequest_ErrorWithoutID(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":{"message":"bad","type":"invalid_request_error"}}`))
+	}))
+	defer ts.Close()
+	fb := newTestDB(t)
+	fb.models[0].Backend = "openai"
+	h := newTestHandle(t, fb, db.BackendConfig{Name: "openai", Kind: BackendKindOpenAI, BaseURL: ts.URL + "/", ApiKey: "sk-upstream"})
+
+	req := httptest.NewRequest("POST", "http://localhost/api/v1/chat/completions", strings.NewReader(`{"model":"gpt-4o"}`))
+	req.Header.Set("Authorization", "Bearer TESTTOKEN")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	rq := waitRequests(t, fb, 1)[0]
+	if !strings.HasPrefix(rq.ID, "proxy-") || rq.Status != http.StatusBadRequest || rq.Model != "gpt-4o" || rq.OutputTokenCount != 0 {
+		t.Errorf("unexpected request %+v", rq)
+	}
+}
+
+func TestRecordRequest_UpstreamUnreachable(t *testing.T) {
+	t.Setenv("UPSTREAM_MAX_ATTEMPTS", "1")
+	ts := httptest.NewServer(http.NotFoundHandler())
+	url := ts.URL
+	ts.Close()
+	fb := newTestDB(t)
+	fb.models[0].Backend = "openai"
+	h := newTestHandle(t, fb, db.BackendConfig{Name: "openai", Kind: BackendKindOpenAI, BaseURL: url + "/", ApiKey: "sk-upstream"})
+
+	req := httptest.NewRequest("POST", "http://localhost/api/v1/chat/completions", strings.NewReader(`{"model":"gpt-4o"}`))
+	req.Header.Set("Authorization", "Bearer TESTTOKEN")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusBadGateway {
+		t.Fatalf("expected 502, got %d", rr.Code)
+	}
+	writes := fb.requests()
+	if len(writes) != 1 || writes[0].Status != http.StatusBadGateway || writes[0].Upstream != "openai" ||
+		writes[0].ApiKeyID != "uid-1" || !strings.HasPrefix(writes[0].ID, "proxy-") {
+		t.Fatalf("unexpected requests %+v", writes)
+	}
+}
+
+func TestRecordRequest_Streamed(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: {\"id\":\"chatcmpl-2\",\"model\":\"gpt-4o\",\"choices\":[{\"delta\":{\"content\":\"Hi\"}}]}\n\n"))
+		w.Write([]byte("data: {\"id\":\"chatcmpl-2\",\"model\":\"gpt-4o\",\"choices\":[],\"usage\":{\"prompt_tokens\":1,\"completion_tokens\":1}}\n\ndata: [DONE]\n\n"))
+	}))
+	defer ts.Close()
+	fb := newTestDB(t)
+	fb.models[0].Backend = "openai"
+	h := newTestHandle(t, fb, db.BackendConfig{Name: "openai", Kind: BackendKindOpenAI, BaseURL: ts.URL + "/", ApiKey: "sk-upstream"})
+
+	req := httptest.NewRequest("POST", "http://localhost/api/v1/chat/completions", strings.NewReader(`{"model":"gpt-4o","stream":true}`))
+	req.Header.Set("Authorization", "Bearer TESTTOKEN")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	rq := waitRequests(t, fb, 1)[0]
+	if rq.ID != "chatcmpl-2" || !rq.Streamed || rq.Status != http.StatusOK {
+		t.Errorf("unexpected request %+v", rq)
+	}
+}
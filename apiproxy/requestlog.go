@@ -0,0 +1,60 @@
+package apiproxy
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"openai-api-proxy/logging"
+	"regexp"
+
+	"github.com/google/uuid"
+)
+
+// requestIDHeader returns the ID of a proxied request to the client. It is
+// not X-Request-Id, which the upstreams send with their own IDs.
+const requestIDHeader = "X-Proxy-Request-Id"
+
+const loggerCtx contextKey = requestInfoCtx + 1
+
+// validRequestID accepts the X-Request-Id of an ingress, e.g. nginx.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// newRequestID returns the X-Request-Id set in front of the proxy, or a new
+// ID if there is none.
+func newRequestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-Id"); validRequestID.MatchString(id) {
+		return id
+	}
+	return uuid.NewString()
+}
+
+// withLogger attaches l to the request. Later stages add their fields with
+// addLogFields, so every line of a request carries the same ones.
+func withLogger(r *http.Request, l *slog.Logger) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), loggerCtx, l))
+}
+
+// addLogFields extends the logger of r with args.
+func addLogFields(r *http.Request, args ...any) *http.Request {
+	return withLogger(r, logFor(r).With(args...))
+}
+
+// logFor returns the logger of req, which carries the request ID, key UUID,
+// model and backend as far as they are known, or the default logger.
+func logFor(req *http.Request) *slog.Logger {
+	if req != nil {
+		if l, ok := req.Context().Value(loggerCtx).(*slog.Logger); ok {
+			return l
+		}
+	}
+	return slog.Default()
+}
+
+// logTrace logs request or response content of req at logging.LevelTrace.
+func logTrace(req *http.Request, msg string, args ...any) {
+	ctx := context.Background()
+	if req != nil {
+		ctx = req.Context()
+	}
+	logFor(req).Log(ctx, logging.LevelTrace, msg, args...)
+}
@@ -0,0 +1,90 @@
+package apiproxy
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	db "openai-api-proxy/db"
+	"openai-api-proxy/logging"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureLogs sends the default logger to a buffer at debug level.
+func captureLogs(t *testing.T) *syncBuffer {
+	t.Helper()
+	var buf syncBuffer
+	prevLogger, prevLevel := slog.Default(), logging.Level()
+	slog.SetDefault(logging.New(&buf, ""))
+	logging.SetLevel(slog.LevelDebug)
+	t.Cleanup(func() {
+		slog.SetDefault(prevLogger)
+		logging.SetLevel(prevLevel)
+	})
+	return &buf
+}
+
+// logLine waits for the JSON line with msg.
+func logLine(t *testing.T, buf *syncBuffer, msg string) map[string]any {
+	t.Helper()
+	for i := 0; i < 50; i++ {
+		for _, raw := range strings.Split(buf.String(), "\n") {
+			var line map[string]any
+			if json.Unmarshal([]byte(raw), &line) == nil && line["msg"] == msg {
+				return line
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("no log line %q in:\n%s", msg, buf.String())
+	return nil
+}
+
+func TestRequestID_LoggedWithRequestFields(t *testing.T) {
+	buf := captureLogs(t)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"chatcmpl-1","object":"chat.completion","model":"gpt-4o","usage":{"prompt_tokens":10,"completion_tokens":5}}`))
+	}))
+	defer ts.Close()
+	fb := newTestDB(t)
+	fb.models[0].Backend = "openai"
+	h := newTestHandle(t, fb, db.BackendConfig{Name: "openai", Kind: BackendKindOpenAI, BaseURL: ts.URL + "/", ApiKey: "sk-upstream-0123456789abcdef"})
+
+	req := httptest.NewRequest("POST", "http://localhost/api/v1/chat/completions", strings.NewReader(`{"model":"gpt-4o"}`))
+	req.Header.Set("Authorization", "Bearer TESTTOKEN")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	id := rec.Header().Get(requestIDHeader)
+	if id == "" {
+		t.Fatal("no request ID returned")
+	}
+	line := logLine(t, buf, "Recorded request")
+	if line["request_id"] != id || line["key_uuid"] != "uid-1" || line["model"] != "gpt-4o" || line["backend"] != "openai" {
+		t.Errorf("unexpected fields %v", line)
+	}
+	if strings.Contains(buf.String(), "TESTTOKEN") || strings.Contains(buf.String(), "sk-upstream") {
+		t.Errorf("credentials logged:\n%s", buf.String())
+	}
+}
+
+func TestRequestID_ReusesIncomingID(t *testing.T) {
+	fb := newTestDB(t)
+	h := newTestHandle(t, fb)
+	for _, tc := range []struct{ incoming, want string }{
+		{"ingress-42", "ingress-42"},
+		{"not valid\n", ""},
+	} {
+		req := httptest.NewRequest("GET", "http://localhost/api/v1/models", nil)
+		req.Header.Set("X-Request-Id", tc.incoming)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		got := rec.Header().Get(requestIDHeader)
+		if tc.want != "" && got != tc.want || tc.want == "" && (got == "" || got == tc.incoming) {
+			t.Errorf("X-Request-Id %q: got request ID %q", tc.incoming, got)
+		}
+	}
+}
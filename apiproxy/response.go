@@ -3,27 +3,43 @@ package apiproxy
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	db "openai-api-proxy/db"
+	"openai-api-proxy/logging"
 	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type ResponseConf struct {
-	db DBStore
+	db       DBStore
+	keys     *apiKeyCache
+	limiter  RateLimiter // nil disables rate limiting
+	budgets  *budgetCache
+	used     *lastUsedTracker // nil disables last-used tracking
+	audit    *auditor         // nil disables the audit log
+	metrics  *metrics         // nil disables the Prometheus metrics
+	cache    *responseCache   // nil disables the response cache
+	semantic *semanticCache   // nil disables the semantic cache
 }
 
 // DBStore is the subset of database methods used by ResponseConf. Using an
 // interface allows tests to inject a fake DB implementation.
 type DBStore interface {
 	LookupApiKeys(string) ([]db.ApiKey, error)
+	LookupApiKeyByKeyID(string) (*db.ApiKey, error)
 	WriteRequest(*db.Request) error
+	TouchApiKey(uuid string, secretID int64, at time.Time) error
 }
 
 type Response struct {
@@ -31,6 +47,7 @@ type Response struct {
 	rc       *ResponseConf
 	apiKeyID string
 	content  Content
+	body     []byte // kept for the audit log
 }
 type Content struct {
 	ID           string         `json:"id"`
@@ -43,15 +60,18 @@ type Content struct {
 func (rc *ResponseConf) NewResponse(in *http.Response) error {
 
 	ct := in.Header.Get("Content-Type")
-	if os.Getenv("DEV_LOG_TOKEN_COUNT") == "1" {
-		// log basic response info so operators can verify ModifyResponse is called
-		reqInfo := ""
-		if in.Request != nil {
-			reqInfo = in.Request.Method + " " + in.Request.URL.String()
-		}
-		log.Printf("DEV LOG: NewResponse invoked for %s status=%d content-type=%q", reqInfo, in.StatusCode, ct)
+	logFor(in.Request).Debug("Upstream response", "status", in.StatusCode, "content_type", ct)
+	if in.Request != nil {
+		ctx, span := tracer().Start(in.Request.Context(), "NewResponse")
+		defer span.End()
+		in.Request = in.Request.WithContext(ctx)
+	}
+
+	streamed := strings.Contains(ct, "text/event-stream") || strings.Contains(ct, "text/event")
+	if info := requestInfoFrom(in.Request); info != nil {
+		info.responded(in, streamed)
 	}
-	if strings.Contains(ct, "text/event-stream") || strings.Contains(ct, "text/event") {
+	if streamed {
 		// Create a pipe to intercept the stream without blocking it.
 		// One end goes to the client (via in.Body), the other to our parser.
 		pr, pw := io.Pipe()
@@ -82,28 +102,77 @@ func (rc *ResponseConf) NewResponse(in *http.Response) error {
 	if err != nil {
 		return err
 	}
+	rc.storeResponse(in, r.body, r.content.Model)
 	r.ProcessValues()
+	rc.writeAudit(in.Request, r.content.ID, r.content.Model, string(r.body), false)
 	return nil
 }
 
-func (r *Response) GetApiKeyUUID() string {
-	header := r.rs.Request.Header.Get(authHeader)
-
-	apiKey := strings.TrimPrefix(header, "Bearer ")
+// LookupApiKey resolves token with the key cache shared by the proxy.
+func (rc *ResponseConf) LookupApiKey(token string) (*Principal, error) {
+	return LookupApiKey(rc.db, rc.keys, token)
+}
 
-	hashes, err := r.rc.db.LookupApiKeys("*")
-	if err != nil || len(hashes) == 0 {
-		log.Println("Error while requesting API Keys from DB", err)
+// writeRequest records the usage of req and charges its tokens to the rate
+// limits and its cost to the cached budgets of the principal. Requests that
+// passed forward also get their status, timing and upstream.
+func (rc *ResponseConf) writeRequest(req *http.Request, rq *db.Request) error {
+	var p *Principal
+	ok := false
+	if req != nil {
+		p, ok = PrincipalFromContext(req.Context())
+	}
+	info := requestInfoFrom(req)
+	if info != nil {
+		rq.Status = info.status
+		rq.Endpoint = info.endpoint
+		rq.TTFB = info.ttfb
+		rq.Duration = time.Since(info.start)
+		rq.Streamed = info.streamed
+		rq.Upstream = info.upstream
+		rq.BackendKind = info.kind
+		rq.ResponseCacheHit = info.cacheHit
+		if rq.Model == "" {
+			rq.Model = info.model
+		}
+	}
+	if ok && rc.limiter != nil && !rq.ResponseCacheHit {
+		rc.limiter.Consume(p.rateSubjects(), rq.InputTokenCount+rq.OutputTokenCount)
+	}
+	ctx := context.Background()
+	if req != nil {
+		ctx = req.Context()
+	}
+	setUsage(trace.SpanFromContext(ctx), rq)
+	_, span := startDBSpan(ctx, "INSERT", "requests")
+	err := rc.db.WriteRequest(rq)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "insert failed")
+	}
+	span.End()
+	if err == nil && ok {
+		rc.budgets.addSpend(p.KeyUUID, rq.CostCents)
 	}
+	rc.metrics.observeRequest(p, info, rq, err)
+	return err
+}
 
-	uid, _ := CompareToken(hashes, apiKey)
-	return uid
+func (r *Response) GetApiKeyUUID() string {
+	p, err := r.rc.requestPrincipal(r.rs.Request)
+	if err != nil {
+		if !errors.Is(err, errInvalidToken) {
+			logFor(r.rs.Request).Error("Could not look up API key", "error", err)
+		}
+		return ""
+	}
+	return p.KeyUUID
 }
 func (r *Response) ReadValues() error {
 	defer r.rs.Body.Close()
 	body, err := io.ReadAll(r.rs.Body)
 	if err != nil {
-		log.Println("Error Parsing Body")
+		logFor(r.rs.Request).Warn("Could not read response body", "error", err)
 		return err
 	}
 
@@ -120,6 +189,9 @@ func (r *Response) ReadValues() error {
 	}
 
 	r.rs.Body = io.NopCloser(bytes.NewReader(body))
+	if info := requestInfoFrom(r.rs.Request); r.rc.auditContent(r.rs.Request) || info != nil && (info.cacheKey != "" || info.semantic != nil) {
+		r.body = body
+	}
 	// Try to unmarshal into the expected struct first.
 	if err := json.Unmarshal(body, &r.content); err == nil {
 		if usageTotals != nil {
@@ -128,9 +200,7 @@ func (r *Response) ReadValues() error {
 		}
 		// If we found key values, return.
 		if r.content.ID != "" || r.content.Object != "" || r.content.Model != "" {
-			if os.Getenv("DEV_LOG_TOKEN_COUNT") == "1" {
-				log.Printf("DEV LOG: ReadValues quick-unmarshal id=%s model=%s object=%s usage=%v", r.content.ID, r.content.Model, r.content.Object, r.content.Usage)
-			}
+			logFor(r.rs.Request).Debug("Parsed response", "id", r.content.ID, "response_model", r.content.Model, "object", r.content.Object, "usage", r.content.Usage)
 			return nil
 		}
 	}
@@ -152,9 +222,7 @@ func (r *Response) ReadValues() error {
 	if usageTotals != nil {
 		r.content.Usage = usageTotals
 		r.content.UsageDetails = usageDetails
-		if os.Getenv("DEV_LOG_TOKEN_COUNT") == "1" {
-			log.Printf("DEV LOG: ReadValues parsed usage (fallback) id=%s model=%s usage=%v", r.content.ID, r.content.Model, r.content.Usage)
-		}
+		logFor(r.rs.Request).Debug("Parsed response usage (fallback)", "id", r.content.ID, "response_model", r.content.Model, "usage", r.content.Usage)
 	}
 	// Try to extract id/model from nested 'response' object if present
 	if r.content.ID == "" {
@@ -172,31 +240,36 @@ func (r *Response) ReadValues() error {
 
 func (r *Response) ProcessValues() {
 	c := r.content
+	lg := logFor(r.rs.Request)
 	if c.Object != "chat.completion" && c.Object != "response" {
-		log.Printf("Untested API Endpoint '%s' is used, check the Request in the DB: %s", c.Object, c.ID)
+		lg.Info("Untested API endpoint is used, check the request in the DB", "object", c.Object, "id", c.ID)
 	}
 	if r.apiKeyID = r.GetApiKeyUUID(); r.apiKeyID == "" {
-		err := errors.New("error processing Response: Key could not be looked up from DB")
-		log.Println(err)
+		lg.Error("Could not process response: key could not be looked up from DB")
 		return
 	}
-	if c.ID == "" {
-		// Log response status and optionally the raw body for debugging.
-		log.Printf("Response has no ID; skipping DB write. HTTP status: %v", r.rs.Status)
-		if os.Getenv("DEV_LOG_RAW_RESPONSE") == "1" {
+	if info := requestInfoFrom(r.rs.Request); info != nil && info.cacheHit {
+		// The ID of a cached response belongs to the request that filled
+		// the cache.
+		r.content.ID = localRequestID()
+		c.ID = r.content.ID
+	} else if c.ID == "" {
+		// Error responses and some endpoints carry no ID, they are recorded
+		// under a local one.
+		r.content.ID = localRequestID()
+		c.ID = r.content.ID
+		lg.Info("Response has no ID, recording it under a local one", "id", c.ID, "status", r.rs.StatusCode)
+		if lg.Enabled(context.Background(), logging.LevelTrace) {
 			// Read the body and log it (we already captured it in ReadValues and reset rs.Body)
 			body, _ := io.ReadAll(r.rs.Body)
 			// Reset body to allow other readers (though ModifyResponse is not expected to do more)
 			r.rs.Body = io.NopCloser(bytes.NewReader(body))
-			log.Printf("Raw response body: %s", string(body))
+			logTrace(r.rs.Request, "Raw response body", "body", string(body))
 		}
-		return
 	}
 	// Extract token counts using flexible key mapping (handles input_tokens/output_tokens etc.).
 	pcount, ccount, tot, cached := extractTokenCounts(c.Usage, c.UsageDetails)
-	if os.Getenv("DEV_LOG_TOKEN_DEBUG") == "1" {
-		log.Printf("DEV DEBUG: ProcessValues extracted counts prompt=%d completion=%d total=%d cached=%d usage=%v details=%v", pcount, ccount, tot, cached, c.Usage, c.UsageDetails)
-	}
+	lg.Debug("Extracted token counts", "prompt", pcount, "completion", ccount, "total", tot, "cached", cached, "usage", c.Usage, "details", c.UsageDetails)
 	modelAlias, snapshot := splitModelSnapshot(c.Model)
 	promptTokens := dedupPromptTokens(pcount, cached)
 	rq := db.Request{
@@ -212,21 +285,11 @@ func (r *Response) ProcessValues() {
 		IsApproximated:        false,
 	}
 
-	if os.Getenv("DEV_LOG_TOKEN_COUNT") == "1" {
-		total := rq.TokenCountPrompt + rq.TokenCountComplete
-		log.Printf("DEV LOG: Token counts for Response id=%s api_key_id=%s model=%s prompt=%d completion=%d total=%d usage=%v", r.apiKeyID, rq.ApiKeyID, rq.Model, rq.TokenCountPrompt, rq.TokenCountComplete, total, c.Usage)
-	}
-
-	if rq.ID == "" {
-		log.Printf("DEV LOG: skipping DB write for response with empty id; usage=%v", c.Usage)
-		return
-	}
-
-	if err := r.rc.db.WriteRequest(&rq); err != nil {
-		log.Println("error processing Response: Response could not be written to db DB")
-		log.Println(err)
+	if err := r.rc.writeRequest(r.rs.Request, &rq); err != nil {
+		lg.Error("Could not write request to DB", "id", rq.ID, "error", err)
 		return
 	}
+	lg.Debug("Recorded request", "id", rq.ID, "prompt", rq.TokenCountPrompt, "completion", rq.TokenCountComplete)
 
 }
 
@@ -404,9 +467,17 @@ func readSSELine(br *bufio.Reader, maxBytes int) (string, error) {
 }
 
 func (rc *ResponseConf) parseSSEStream(r io.Reader, req *http.Request) {
+	if req != nil {
+		ctx, span := tracer().Start(req.Context(), "parseSSEStream")
+		defer span.End()
+		req = req.WithContext(ctx)
+	}
+	lg := logFor(req)
 	// Re-use logic from the previous implementation but for a stream
 	var cumPrompt, cumCompletion, cumCached int
 	var accumulatedText strings.Builder
+	var completion strings.Builder // transcript for the audit log
+	captureCompletion := rc.auditContent(req)
 	var lastModel, lastID string
 	var foundAny bool
 	eventIdx := 0
@@ -424,20 +495,18 @@ func (rc *ResponseConf) parseSSEStream(r io.Reader, req *http.Request) {
 			return
 		}
 		var raw map[string]interface{}
-		if os.Getenv("DEV_LOG_TOKEN_DEBUG") == "1" {
-			preview := jsonText
-			if len(preview) > 1024 {
-				preview = preview[:1024] + "..."
-			}
-			log.Printf("DEV DEBUG: SSE event received (data line: %s)", preview)
-		}
+		logTrace(req, "SSE event received", "data", preview([]byte(jsonText), 1024))
 		if err := json.Unmarshal([]byte(jsonText), &raw); err != nil {
-			if os.Getenv("DEV_LOG_TOKEN_DEBUG") == "1" {
-				log.Printf("DEV DEBUG: SSE data-line JSON unmarshal error: %v; json=%s", err, jsonText)
-			}
+			rc.metrics.sseDropped(req, sseDropInvalidJSON)
+			lg.Debug("Skipping SSE event with invalid JSON", "error", err)
+			logTrace(req, "Invalid SSE event", "data", jsonText)
 			return
 		}
 
+		if captureCompletion && completion.Len() < rc.audit.maxBytes {
+			completion.WriteString(streamText(raw))
+		}
+
 		// Extract text for fallback estimation
 		if t, ok := raw["text"].(string); ok {
 			accumulatedText.WriteString(t)
@@ -474,9 +543,7 @@ func (rc *ResponseConf) parseSSEStream(r io.Reader, req *http.Request) {
 			foundAny = true
 			eventIdx++
 			usageFound = true
-			if os.Getenv("DEV_LOG_TOKEN_COUNT") == "1" {
-				log.Printf("DEV LOG: SSE event %d usage: prompt=%d completion=%d cached=%d (top-level)", eventIdx, pcount, ccount, cached)
-			}
+			lg.Debug("SSE event usage", "event", eventIdx, "prompt", pcount, "completion", ccount, "cached", cached)
 		}
 		// also check nested response.usage
 		if !usageFound {
@@ -490,9 +557,7 @@ func (rc *ResponseConf) parseSSEStream(r io.Reader, req *http.Request) {
 					foundAny = true
 					eventIdx++
 					usageFound = true
-					if os.Getenv("DEV_LOG_TOKEN_COUNT") == "1" {
-						log.Printf("DEV LOG: SSE event %d usage: prompt=%d completion=%d cached=%d (nested response)", eventIdx, pcount, ccount, cached)
-					}
+					lg.Debug("SSE event usage (nested response)", "event", eventIdx, "prompt", pcount, "completion", ccount, "cached", cached)
 				}
 				if idv, ok := respObj["id"].(string); ok && idv != "" {
 					lastID = idv
@@ -534,15 +599,8 @@ func (rc *ResponseConf) parseSSEStream(r io.Reader, req *http.Request) {
 
 				if respID != "" {
 					apiKeyID := ""
-					header := ""
-					if req != nil {
-						header = req.Header.Get(authHeader)
-					}
-					apiKey := strings.TrimPrefix(header, "Bearer ")
-					if hashes, err := rc.db.LookupApiKeys("*"); err == nil {
-						if uid, err := CompareToken(hashes, apiKey); err == nil {
-							apiKeyID = uid
-						}
+					if p, err := rc.requestPrincipal(req); err == nil {
+						apiKeyID = p.KeyUUID
 					}
 
 					// Final counts: prefer current event, then cumulative, then estimation
@@ -569,9 +627,7 @@ func (rc *ResponseConf) parseSSEStream(r io.Reader, req *http.Request) {
 							finalCompletion = 1
 						}
 						estimatedUsed = true
-						if os.Getenv("DEV_LOG_TOKEN_COUNT") == "1" {
-							log.Printf("DEV LOG: using estimated completion tokens: %d (chars: %d)", finalCompletion, estimatedChars)
-						}
+						lg.Debug("Using estimated completion tokens", "completion", finalCompletion, "chars", estimatedChars)
 					}
 
 					modelAlias, snapshot := splitModelSnapshot(respModel)
@@ -588,12 +644,10 @@ func (rc *ResponseConf) parseSSEStream(r io.Reader, req *http.Request) {
 						SnapshotVersion:       snapshot,
 						IsApproximated:        estimatedUsed,
 					}
-					if err := rc.db.WriteRequest(&rq); err != nil {
-						log.Printf("DEV LOG: failed to write request for SSE completed id=%s: %v", respID, err)
+					if err := rc.writeRequest(req, &rq); err != nil {
+						lg.Error("Could not write streamed request to DB", "id", respID, "error", err)
 					} else {
-						if os.Getenv("DEV_LOG_TOKEN_COUNT") == "1" {
-							log.Printf("DEV LOG: wrote SSE completed request id=%s prompt=%d completion=%d api_key_id=%s", respID, finalPrompt, finalCompletion, apiKeyID)
-						}
+						lg.Debug("Recorded streamed request", "id", respID, "prompt", finalPrompt, "completion", finalCompletion)
 					}
 					wrote = true
 				}
@@ -609,11 +663,10 @@ func (rc *ResponseConf) parseSSEStream(r io.Reader, req *http.Request) {
 	eventDataBytes := 0
 	flushEvent := func() {
 		if eventTooLarge {
+			rc.metrics.sseDropped(req, sseDropOversized)
 			oversizedEventChars += eventDataBytes
 			estimatedUsed = true
-			if os.Getenv("DEV_LOG_TOKEN_COUNT") == "1" {
-				log.Printf("DEV LOG: SSE event exceeded cap (%d bytes), token accounting approximated", maxEventBytes)
-			}
+			lg.Debug("SSE event exceeded the size cap, token accounting approximated", "max_bytes", maxEventBytes)
 		} else if eventData.Len() > 0 {
 			processEventData(eventData.String())
 		}
@@ -632,10 +685,11 @@ func (rc *ResponseConf) parseSSEStream(r io.Reader, req *http.Request) {
 				eventTooLarge = true
 				eventDataBytes += maxLineBytes
 				estimatedUsed = true
-				log.Printf("DEV LOG: oversized SSE line encountered (max=%d bytes); token accounting may be approximated", maxLineBytes)
+				lg.Debug("Oversized SSE line, token accounting may be approximated", "max_bytes", maxLineBytes)
 				continue
 			}
-			log.Printf("DEV LOG: SSE stream read error: %v", err)
+			rc.metrics.sseDropped(req, sseDropReadError)
+			lg.Warn("Could not read SSE stream", "error", err)
 			break
 		}
 
@@ -677,18 +731,14 @@ func (rc *ResponseConf) parseSSEStream(r io.Reader, req *http.Request) {
 	}
 	flushEvent()
 
-	if !wrote && lastID != "" {
-		// Try fallback if we haven't written yet (e.g. stream ended without response.completed but we have an ID)
+	if !wrote {
+		// Try fallback if we haven't written yet (e.g. stream ended without response.completed)
+		if lastID == "" {
+			lastID = localRequestID()
+		}
 		apiKeyID := ""
-		header := ""
-		if req != nil {
-			header = req.Header.Get(authHeader)
-		}
-		apiKey := strings.TrimPrefix(header, "Bearer ")
-		if hashes, err := rc.db.LookupApiKeys("*"); err == nil {
-			if uid, err := CompareToken(hashes, apiKey); err == nil {
-				apiKeyID = uid
-			}
+		if p, err := rc.requestPrincipal(req); err == nil {
+			apiKeyID = p.KeyUUID
 		}
 
 		finalPrompt := cumPrompt
@@ -719,17 +769,17 @@ func (rc *ResponseConf) parseSSEStream(r io.Reader, req *http.Request) {
 			SnapshotVersion:       snapshot,
 			IsApproximated:        estimated,
 		}
-		if err := rc.db.WriteRequest(&rq); err == nil {
-			if os.Getenv("DEV_LOG_TOKEN_COUNT") == "1" {
-				log.Printf("DEV LOG: wrote SSE request (fallback at end of stream) id=%s prompt=%d completion=%d", lastID, finalPrompt, finalCompletion)
-			}
+		if err := rc.writeRequest(req, &rq); err != nil {
+			lg.Error("Could not write streamed request to DB", "id", lastID, "error", err)
+		} else {
+			lg.Debug("Recorded streamed request at end of stream", "id", lastID, "prompt", finalPrompt, "completion", finalCompletion)
 		}
 	}
 
+	rc.writeAudit(req, lastID, lastModel, completion.String(), true)
+
 	if foundAny {
-		if os.Getenv("DEV_LOG_TOKEN_COUNT") == "1" {
-			log.Printf("DEV LOG: SSE stream processing finished: events=%d prompt_max=%d completion_max=%d", eventIdx, cumPrompt, cumCompletion)
-		}
+		lg.Debug("SSE stream processed", "events", eventIdx, "prompt_max", cumPrompt, "completion_max", cumCompletion)
 	}
 }
 
@@ -744,7 +794,7 @@ func (t *teeReadCloser) Read(p []byte) (int, error) {
 	n, err := t.src.Read(p)
 	if n > 0 && t.sink != nil {
 		if _, werr := t.sink.Write(p[:n]); werr != nil {
-			log.Printf("DEV LOG: SSE parser tap disabled after sink write error: %v", werr)
+			slog.Debug("SSE parser tap disabled after sink write error", "error", werr)
 			_ = t.sink.Close()
 			t.sink = nil
 		}
@@ -2,13 +2,17 @@ package apiproxy
 
 import (
 	"bytes"
+	"database/sql"
+	"fmt"
 	"golang.org/x/crypto/bcrypt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	db "openai-api-proxy/db"
+	"openai-api-proxy/logging"
 	"os"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -39,16 +43,15 @@ func TestNewResponse_SSENestedUsage(t *testing.T) {
 	}
 
 	// capture logs
-	var buf bytes.Buffer
-	oldOut := log.Writer()
-	log.SetOutput(&buf)
-	defer func() { log.SetOutput(oldOut) }()
+	var buf syncBuffer
+	oldLog := slog.Default()
+	slog.SetDefault(logging.New(&buf, ""))
+	defer slog.SetDefault(oldLog)
 
-	// set env to enable dev logging
-	os.Setenv("DEV_LOG_TOKEN_COUNT", "1")
-	defer os.Unsetenv("DEV_LOG_TOKEN_COUNT")
-	os.Setenv("DEV_LOG_TOKEN_DEBUG", "1")
-	defer os.Unsetenv("DEV_LOG_TOKEN_DEBUG")
+	// log SSE events and token counts
+	oldLevel := logging.Level()
+	logging.SetLevel(logging.LevelTrace)
+	defer logging.SetLevel(oldLevel)
 
 	// Set up a fake DB that will provide a hashed token and capture writes.
 	fb := &fakeDBForTest{}
@@ -68,7 +71,7 @@ func TestNewResponse_SSENestedUsage(t *testing.T) {
 	out := buf.String()
 	// Wait a bit for goroutine to process
 	for i := 0; i < 10; i++ {
-		if strings.Contains(out, "wrote SSE completed request") {
+		if strings.Contains(out, "Recorded streamed request") {
 			break
 		}
 		time.Sleep(50 * time.Millisecond)
@@ -80,10 +83,10 @@ func TestNewResponse_SSENestedUsage(t *testing.T) {
 	}
 
 	// ensure DB write occurred with expected counts
-	if len(fb.writes) != 1 {
-		t.Fatalf("expected 1 DB write, got %d; logs:\n%s", len(fb.writes), out)
+	if len(fb.requests()) != 1 {
+		t.Fatalf("expected 1 DB write, got %d; logs:\n%s", len(fb.requests()), out)
 	}
-	w := fb.writes[0]
+	w := fb.requests()[0]
 	if w.ID != "r1" || w.TokenCountPrompt != 11 || w.TokenCountComplete != 22 {
 		t.Fatalf("unexpected DB write: %+v; logs:\n%s", w, out)
 	}
@@ -123,13 +126,13 @@ func TestNewResponse_SSEOverlongLineDoesNotAbortStream(t *testing.T) {
 	}
 	resp.Body.Close()
 
-	for i := 0; i < 10 && len(fb.writes) == 0; i++ {
+	for i := 0; i < 10 && len(fb.requests()) == 0; i++ {
 		time.Sleep(50 * time.Millisecond)
 	}
-	if len(fb.writes) != 1 {
-		t.Fatalf("expected 1 DB write, got %d", len(fb.writes))
+	if len(fb.requests()) != 1 {
+		t.Fatalf("expected 1 DB write, got %d", len(fb.requests()))
 	}
-	w := fb.writes[0]
+	w := fb.requests()[0]
 	if w.ID != "r-long" || w.TokenCountPrompt != 3 || w.TokenCountComplete != 4 {
 		t.Fatalf("unexpected DB write: %+v", w)
 	}
@@ -171,13 +174,13 @@ func TestNewResponse_SSEOverCapEventApproximatesCompletionTokens(t *testing.T) {
 	}
 	resp.Body.Close()
 
-	for i := 0; i < 10 && len(fb.writes) == 0; i++ {
+	for i := 0; i < 10 && len(fb.requests()) == 0; i++ {
 		time.Sleep(50 * time.Millisecond)
 	}
-	if len(fb.writes) != 1 {
-		t.Fatalf("expected 1 DB write, got %d", len(fb.writes))
+	if len(fb.requests()) != 1 {
+		t.Fatalf("expected 1 DB write, got %d", len(fb.requests()))
 	}
-	w := fb.writes[0]
+	w := fb.requests()[0]
 	if w.ID != "r-approx" {
 		t.Fatalf("unexpected ID: %+v", w)
 	}
@@ -232,11 +235,11 @@ func TestNewResponse_ChatCompletionStoresInputTokens(t *testing.T) {
 		t.Fatalf("NewResponse error: %v", err)
 	}
 
-	if len(fb.writes) != 1 {
-		t.Fatalf("expected 1 DB write, got %d", len(fb.writes))
+	if len(fb.requests()) != 1 {
+		t.Fatalf("expected 1 DB write, got %d", len(fb.requests()))
 	}
 
-	w := fb.writes[0]
+	w := fb.requests()[0]
 	if w.InputTokenCount != 23 {
 		t.Fatalf("expected input tokens 23, got %d", w.InputTokenCount)
 	}
@@ -248,16 +251,93 @@ func TestNewResponse_ChatCompletionStoresInputTokens(t *testing.T) {
 	}
 }
 
+// syncBuffer is a bytes.Buffer safe for the log output of stream goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
 // fake DB implementation for test
 type fakeDBForTest struct {
+	mu      sync.Mutex
 	apiKeys []db.ApiKey
 	writes  []*db.Request
+	models  []db.Model
+	// upstreams are the fallbacks by model ID
+	upstreams map[string][]db.Model
+	budgets   []db.BudgetStatus
+	// touches are the recorded secret uses as "<uuid>/<secret id>"
+	touches []string
+	// writeErr fails WriteRequest
+	writeErr error
 }
 
 func (f *fakeDBForTest) LookupApiKeys(uid string) ([]db.ApiKey, error) {
-	return f.apiKeys, nil
+	// Like the database, the wildcard only returns legacy keys.
+	var keys []db.ApiKey
+	for _, k := range f.apiKeys {
+		if uid != "*" || k.KeyID == "" {
+			keys = append(keys, k)
+		}
+	}
+	return keys, nil
+}
+func (f *fakeDBForTest) LookupApiKeyByKeyID(keyID string) (*db.ApiKey, error) {
+	for i := range f.apiKeys {
+		if f.apiKeys[i].KeyID == keyID {
+			return &f.apiKeys[i], nil
+		}
+	}
+	return nil, sql.ErrNoRows
 }
 func (f *fakeDBForTest) WriteRequest(r *db.Request) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.writeErr != nil {
+		return f.writeErr
+	}
 	f.writes = append(f.writes, r)
 	return nil
 }
+
+// requests returns the recorded requests, safe against concurrent stream goroutines.
+func (f *fakeDBForTest) requests() []*db.Request {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*db.Request(nil), f.writes...)
+}
+func (f *fakeDBForTest) ListModels() ([]db.Model, error) {
+	return f.models, nil
+}
+func (f *fakeDBForTest) LookupModel(id string) (*db.Model, error) {
+	for i := range f.models {
+		if f.models[i].ID == id {
+			return &f.models[i], nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+func (f *fakeDBForTest) LookupBudgets(key, user string) ([]db.BudgetStatus, error) {
+	return f.budgets, nil
+}
+func (f *fakeDBForTest) TouchApiKey(uuid string, secretID int64, at time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.touches = append(f.touches, fmt.Sprintf("%s/%d", uuid, secretID))
+	return nil
+}
+func (f *fakeDBForTest) LookupModelUpstreams(id string) ([]db.Model, error) {
+	return f.upstreams[id], nil
+}
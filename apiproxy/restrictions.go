@@ -0,0 +1,196 @@
+package apiproxy
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+)
+
+// expired reports whether the key of p is past its expiry date.
+func (p *Principal) expired(now time.Time) bool {
+	return !p.ExpiresAt.IsZero() && !p.ExpiresAt.After(now)
+}
+
+// rotatedOut reports whether p used a rotated secret whose grace period has
+// ended since it was cached.
+func (p *Principal) rotatedOut(now time.Time) bool {
+	return !p.SecretExpiresAt.IsZero() && !p.SecretExpiresAt.After(now)
+}
+
+// allowsModel reports whether p may use model. Entries ending in * match
+// every model with that prefix.
+func (p *Principal) allowsModel(model string) bool {
+	if len(p.AllowedModels) == 0 {
+		return true
+	}
+	for _, allowed := range p.AllowedModels {
+		if prefix, ok := strings.CutSuffix(allowed, "*"); ok {
+			if strings.HasPrefix(model, prefix) {
+				return true
+			}
+		} else if model == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsEndpoint reports whether p may call the endpoint, given as the path
+// below /v1 (e.g. "chat/completions"). An entry also covers its sub paths.
+func (p *Principal) allowsEndpoint(endpoint string) bool {
+	if len(p.AllowedEndpoints) == 0 {
+		return true
+	}
+	for _, allowed := range p.AllowedEndpoints {
+		allowed = normalizeEndpoint(allowed)
+		if endpoint == allowed || strings.HasPrefix(endpoint, allowed+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsClient reports whether addr lies in one of the allowed networks.
+func (p *Principal) allowsClient(addr netip.Addr) bool {
+	if len(p.AllowedNets) == 0 {
+		return true
+	}
+	for _, prefix := range p.AllowedNets {
+		if prefix.IsValid() && prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestEndpoint is the endpoint of a proxied request, e.g.
+// /api/v1/chat/completions and /api/chat/completions both map to
+// "chat/completions".
+func requestEndpoint(r *http.Request) string {
+	return normalizeEndpoint(strings.TrimPrefix(r.URL.Path, "/api"))
+}
+
+func normalizeEndpoint(path string) string {
+	path = strings.Trim(path, "/")
+	if rest, ok := strings.CutPrefix(path, "v1/"); ok {
+		return rest
+	}
+	return path
+}
+
+// parseCIDR accepts a network in CIDR notation or a single address.
+func parseCIDR(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// clientAddr is the address of the client. With TRUST_FORWARDED_FOR=true
+// the last X-Forwarded-For entry, added by the ingress in front of the
+// proxy, is used instead of the peer address.
+func clientAddr(r *http.Request) (netip.Addr, bool) {
+	if os.Getenv("TRUST_FORWARDED_FOR") == "true" {
+		if fwd := r.Header.Values("X-Forwarded-For"); len(fwd) > 0 {
+			hops := strings.Split(fwd[len(fwd)-1], ",")
+			if addr, err := netip.ParseAddr(strings.TrimSpace(hops[len(hops)-1])); err == nil {
+				return addr.Unmap(), true
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// checkRestrictions enforces the expiry and allow-lists of p and writes the
+// error response if the request is not allowed. The models endpoints are
+// always allowed; their listing is filtered by the model allow-list instead.
+func (p *Principal) checkRestrictions(w http.ResponseWriter, r *http.Request) bool {
+	now := time.Now()
+	if p.rotatedOut(now) {
+		http.Error(w, "401 - Token Invalid", http.StatusUnauthorized)
+		return false
+	}
+	if p.expired(now) {
+		writeOpenAIError(w, http.StatusUnauthorized, "The API key has expired.", "invalid_request_error", "api_key_expired")
+		return false
+	}
+	if len(p.AllowedNets) > 0 {
+		addr, ok := clientAddr(r)
+		if !ok || !p.allowsClient(addr) {
+			writeOpenAIError(w, http.StatusForbidden, "The API key is not allowed from this IP address.", "invalid_request_error", "ip_not_allowed")
+			return false
+		}
+	}
+	endpoint := requestEndpoint(r)
+	if endpoint == "models" || strings.HasPrefix(endpoint, "models/") {
+		return true
+	}
+	if !p.allowsEndpoint(endpoint) {
+		writeOpenAIError(w, http.StatusForbidden, "The API key is not allowed to use the endpoint '/v1/"+endpoint+"'.", "invalid_request_error", "endpoint_not_allowed")
+		return false
+	}
+	if len(p.AllowedModels) == 0 || r.Body == nil || r.Body == http.NoBody {
+		return true
+	}
+	// A body whose model cannot be read could name any model upstream.
+	model := requestModel(r)
+	if model == "" {
+		writeOpenAIError(w, http.StatusForbidden, "The API key is restricted to some models, but the request does not name one.", "invalid_request_error", "model_not_allowed")
+		return false
+	}
+	if !p.allowsModel(model) {
+		writeOpenAIError(w, http.StatusForbidden, "The API key is not allowed to use the model '"+model+"'.", "invalid_request_error", "model_not_allowed")
+		return false
+	}
+	return true
+}
+
+// requestModel returns the model of a JSON body, or the model field of a
+// multipart form as sent to /audio/transcriptions or /images/edits. It is
+// empty if the body names no model.
+func requestModel(r *http.Request) string {
+	if model := peekModel(r); model != "" {
+		return model
+	}
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" || params["boundary"] == "" {
+		return ""
+	}
+	body, err := io.ReadAll(r.Body)
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return ""
+	}
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			return ""
+		}
+		if part.FormName() == "model" && part.FileName() == "" {
+			model, _ := io.ReadAll(io.LimitReader(part, 256))
+			return strings.TrimSpace(string(model))
+		}
+	}
+}
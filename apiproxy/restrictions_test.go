@@ -0,0 +1,203 @@
+package apiproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	db "openai-api-proxy/db"
+)
+
+func TestPrincipal_AllowsModel(t *testing.T) {
+	p := &Principal{AllowedModels: []string{"gpt-4o", "gpt-4.1*"}}
+	for model, want := range map[string]bool{
+		"gpt-4o":       true,
+		"gpt-4o-mini":  false,
+		"gpt-4.1":      true,
+		"gpt-4.1-nano": true,
+		"o3":           false,
+	} {
+		if got := p.allowsModel(model); got != want {
+			t.Errorf("allowsModel(%q) = %v, want %v", model, got, want)
+		}
+	}
+	if !(&Principal{}).allowsModel("anything") {
+		t.Error("expected an empty allow-list to allow every model")
+	}
+}
+
+func TestPrincipal_AllowsEndpoint(t *testing.T) {
+	p := &Principal{AllowedEndpoints: []string{"/v1/embeddings", "audio"}}
+	for endpoint, want := range map[string]bool{
+		"embeddings":           true,
+		"audio/transcriptions": true,
+		"chat/completions":     false,
+		"audiox":               false,
+	} {
+		if got := p.allowsEndpoint(endpoint); got != want {
+			t.Errorf("allowsEndpoint(%q) = %v, want %v", endpoint, got, want)
+		}
+	}
+}
+
+func TestParseCIDR(t *testing.T) {
+	for in, want := range map[string]string{
+		"10.1.2.3/8":  "10.0.0.0/8",
+		"192.0.2.7":   "192.0.2.7/32",
+		"2001:db8::1": "2001:db8::1/128",
+	} {
+		got, err := parseCIDR(in)
+		if err != nil || got.String() != want {
+			t.Errorf("parseCIDR(%q) = %v, %v, want %s", in, got, err, want)
+		}
+	}
+	if _, err := parseCIDR("10.0.0.0/40"); err == nil {
+		t.Error("expected an error for an invalid prefix")
+	}
+}
+
+func TestClientAddr_ForwardedFor(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.1:4711"
+	r.Header.Set("X-Forwarded-For", "1.2.3.4, 198.51.100.7")
+
+	if addr, _ := clientAddr(r); addr != netip.MustParseAddr("10.0.0.1") {
+		t.Fatalf("expected the peer address without TRUST_FORWARDED_FOR, got %v", addr)
+	}
+	t.Setenv("TRUST_FORWARDED_FOR", "true")
+	if addr, _ := clientAddr(r); addr != netip.MustParseAddr("198.51.100.7") {
+		t.Fatalf("expected the address added by the ingress, got %v", addr)
+	}
+}
+
+func TestValidateToken_Restrictions(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(okCompletion))
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name     string
+		key      db.ApiKey
+		path     string
+		model    string
+		wantCode int
+		wantErr  string
+	}{
+		{name: "unrestricted", path: "chat/completions", model: "gpt-4o", wantCode: http.StatusOK},
+		{name: "expired", key: db.ApiKey{ExpiresAt: time.Now().Add(-time.Minute)}, path: "chat/completions", model: "gpt-4o", wantCode: http.StatusUnauthorized, wantErr: "api_key_expired"},
+		{name: "not yet expired", key: db.ApiKey{ExpiresAt: time.Now().Add(time.Hour)}, path: "chat/completions", model: "gpt-4o", wantCode: http.StatusOK},
+		{name: "model allowed", key: db.ApiKey{AllowedModels: []string{"gpt-4*"}}, path: "chat/completions", model: "gpt-4o", wantCode: http.StatusOK},
+		{name: "model denied", key: db.ApiKey{AllowedModels: []string{"gpt-5-mini"}}, path: "chat/completions", model: "gpt-4o", wantCode: http.StatusForbidden, wantErr: "model_not_allowed"},
+		{name: "endpoint denied", key: db.ApiKey{AllowedEndpoints: []string{"embeddings"}}, path: "chat/completions", model: "gpt-4o", wantCode: http.StatusForbidden, wantErr: "endpoint_not_allowed"},
+		{name: "client allowed", key: db.ApiKey{AllowedCIDRs: []string{"192.0.2.0/24"}}, path: "chat/completions", model: "gpt-4o", wantCode: http.StatusOK},
+		{name: "client denied", key: db.ApiKey{AllowedCIDRs: []string{"10.0.0.0/8"}}, path: "chat/completions", model: "gpt-4o", wantCode: http.StatusForbidden, wantErr: "ip_not_allowed"},
+		{name: "invalid cidr denies", key: db.ApiKey{AllowedCIDRs: []string{"nonsense"}}, path: "chat/completions", model: "gpt-4o", wantCode: http.StatusForbidden, wantErr: "ip_not_allowed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fb := newTestDB(t)
+			key := tt.key
+			key.UUID, key.ApiKey, key.Owner = "uid-1", fb.apiKeys[0].ApiKey, "owner1"
+			fb.apiKeys = []db.ApiKey{key}
+			h := newTestHandle(t, fb, db.BackendConfig{Name: "azure", Kind: BackendKindOpenAI, BaseURL: ts.URL + "/"})
+
+			// httptest requests come from 192.0.2.1.
+			req := httptest.NewRequest("POST", "http://localhost/api/v1/"+tt.path, strings.NewReader(`{"model":"`+tt.model+`","messages":[]}`))
+			req.Header.Set("Authorization", "Bearer TESTTOKEN")
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+
+			if rr.Code != tt.wantCode {
+				t.Fatalf("expected %d, got %d: %s", tt.wantCode, rr.Code, rr.Body)
+			}
+			if tt.wantErr != "" && !strings.Contains(rr.Body.String(), `"code":"`+tt.wantErr+`"`) {
+				t.Fatalf("expected error code %s, got %s", tt.wantErr, rr.Body)
+			}
+		})
+	}
+}
+
+func TestValidateToken_ModelAllowListOnMultipart(t *testing.T) {
+	var upstreamCalls atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"text":"hello"}`))
+	}))
+	defer ts.Close()
+
+	fb := newTestDB(t)
+	fb.apiKeys[0].AllowedModels = []string{"gpt-4o-mini*"}
+	h := newTestHandle(t, fb, db.BackendConfig{Name: "azure", Kind: BackendKindOpenAI, BaseURL: ts.URL + "/"})
+
+	transcribe := func(fields map[string]string) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, _ := mw.CreateFormFile("file", "speech.mp3")
+		fw.Write([]byte("ID3 not really audio"))
+		for name, value := range fields {
+			mw.WriteField(name, value)
+		}
+		mw.Close()
+		req := httptest.NewRequest("POST", "http://localhost/api/v1/audio/transcriptions", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		req.Header.Set("Authorization", "Bearer TESTTOKEN")
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	for name, fields := range map[string]map[string]string{
+		"other model": {"model": "whisper-1"},
+		"no model":    {"language": "de"},
+	} {
+		if rr := transcribe(fields); rr.Code != http.StatusForbidden || !strings.Contains(rr.Body.String(), "model_not_allowed") {
+			t.Errorf("%s: expected 403 model_not_allowed, got %d: %s", name, rr.Code, rr.Body)
+		}
+	}
+	if n := upstreamCalls.Load(); n != 0 {
+		t.Fatalf("denied requests reached the upstream %d times", n)
+	}
+	if rr := transcribe(map[string]string{"model": "gpt-4o-mini-transcribe"}); rr.Code == http.StatusForbidden {
+		t.Errorf("allowed model was denied: %s", rr.Body)
+	}
+
+	req := httptest.NewRequest("POST", "http://localhost/api/v1/chat/completions", strings.NewReader("model=gpt-4o"))
+	req.Header.Set("Authorization", "Bearer TESTTOKEN")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("non-JSON body: expected 403, got %d", rr.Code)
+	}
+}
+
+func TestHandleModels_FilteredByAllowList(t *testing.T) {
+	fb := newTestDB(t)
+	fb.apiKeys[0].AllowedModels = []string{"gpt-5*"}
+	fb.apiKeys[0].AllowedEndpoints = []string{"embeddings"}
+	h := newTestHandle(t, fb, db.BackendConfig{Name: "azure", Kind: BackendKindOpenAI, BaseURL: "https://unused.example/"})
+
+	req := httptest.NewRequest("GET", "http://localhost/api/v1/models", nil)
+	req.Header.Set("Authorization", "Bearer TESTTOKEN")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body)
+	}
+	var list OpenAIModelList
+	if err := json.Unmarshal(rr.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Data) != 1 || list.Data[0].ID != "gpt-5-mini" {
+		t.Fatalf("expected only gpt-5-mini, got %+v", list.Data)
+	}
+}
@@ -0,0 +1,124 @@
+package apiproxy
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	db "openai-api-proxy/db"
+)
+
+// errModelNotFound is returned by route when the requested model is not in the models table.
+var errModelNotFound = errors.New("model not found")
+
+// route selects the upstreams for r. An explicit Backend header wins, otherwise
+// the "model" of the JSON body is looked up in the models table. Requests
+// without a model (e.g. file uploads) go to the default backend.
+//
+// A routed model yields its own row first, followed by its fallbacks from the
+// model_upstreams table in order of priority.
+func (h *baseHandle) route(r *http.Request, backend string) ([]upstream, error) {
+	if backend != "" {
+		b, ok := h.backends.Get(backend)
+		if !ok {
+			return nil, fmt.Errorf("backend %q not found", backend)
+		}
+		return []upstream{{backend: b}}, nil
+	}
+
+	model := peekModel(r)
+	if model == "" {
+		b, ok := h.backends.Default()
+		if !ok {
+			return nil, errors.New("no default backend configured")
+		}
+		return []upstream{{backend: b}}, nil
+	}
+
+	_, span := startDBSpan(r.Context(), "SELECT", "models")
+	m, err := h.db.LookupModel(model)
+	span.End()
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errModelNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("lookup model %q: %w", model, err)
+	}
+	b, ok := h.modelBackend(m)
+	if !ok {
+		return nil, fmt.Errorf("backend %q of model %q not found", m.Backend, m.ID)
+	}
+	ups := []upstream{{backend: b, model: m}}
+
+	_, span = startDBSpan(r.Context(), "SELECT", "model_upstreams")
+	fallbacks, err := h.db.LookupModelUpstreams(m.ID)
+	span.End()
+	if err != nil {
+		logFor(r).Error("Could not load fallback upstreams", "model", m.ID, "error", err)
+	}
+	for i := range fallbacks {
+		f := &fallbacks[i]
+		fb, ok := h.modelBackend(f)
+		if !ok {
+			logFor(r).Warn("Skipping fallback, backend not found", "model", m.ID, "backend", f.Backend)
+			continue
+		}
+		ups = append(ups, upstream{backend: fb, model: f})
+	}
+	return ups, nil
+}
+
+// modelBackend returns the backend configured for m, falling back to the default backend.
+func (h *baseHandle) modelBackend(m *db.Model) (Backend, bool) {
+	if m.Backend == "" {
+		return h.backends.Default()
+	}
+	return h.backends.Get(m.Backend)
+}
+
+// peekModel returns the "model" field of a JSON request body without
+// consuming the body.
+func peekModel(r *http.Request) string {
+	if r.Body == nil || r.Body == http.NoBody {
+		return ""
+	}
+	bodyBytes, err := io.ReadAll(r.Body)
+	r.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+	if err != nil {
+		logFor(r).Warn("Could not read request body", "error", err)
+		return ""
+	}
+	var body OpenAIBody
+	if err := json.Unmarshal(bodyBytes, &body); err != nil {
+		return ""
+	}
+	return body.Model
+}
+
+// rewriteModel replaces the "model" field of the JSON request body, so the
+// upstream receives the name of its deployment instead of the public model ID.
+func rewriteModel(r *http.Request, model string) {
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		return
+	}
+	defer func() {
+		r.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+	}()
+
+	var payload map[string]interface{}
+	if err := json.Unmarshal(bodyBytes, &payload); err != nil {
+		return
+	}
+	payload["model"] = model
+	updatedBody, err := json.Marshal(payload)
+	if err != nil {
+		return
+	}
+	bodyBytes = updatedBody
+	r.ContentLength = int64(len(bodyBytes))
+	r.Header.Set("Content-Length", fmt.Sprintf("%d", len(bodyBytes)))
+}
@@ -0,0 +1,157 @@
+package apiproxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	db "openai-api-proxy/db"
+	"openai-api-proxy/openapi"
+	"strings"
+	"testing"
+)
+
+func TestServeHTTP_RoutesByModel(t *testing.T) {
+	var gotModel, gotBackend string
+	upstream := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var body OpenAIBody
+			b, _ := io.ReadAll(r.Body)
+			json.Unmarshal(b, &body)
+			gotModel = body.Model
+			gotBackend = name
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"id":"chatcmpl-1","object":"chat.completion","model":"x","usage":{"prompt_tokens":1,"completion_tokens":1}}`))
+		}))
+	}
+	azure := upstream("azure")
+	defer azure.Close()
+	ollama := upstream("ollama")
+	defer ollama.Close()
+
+	fb := newTestDB(t)
+	fb.models = []db.Model{
+		{ID: "gpt-4.1"},
+		{ID: "llama3", Backend: "ollama", Deployment: "llama3.1:8b"},
+	}
+	h := newTestHandle(t, fb,
+		db.BackendConfig{Name: "azure", Kind: BackendKindAzure, BaseURL: azure.URL + "/openai"},
+		db.BackendConfig{Name: "ollama", Kind: BackendKindOpenAI, BaseURL: ollama.URL + "/"},
+	)
+
+	tests := []struct {
+		model       string
+		wantBackend string
+		wantModel   string
+	}{
+		{model: "gpt-4.1", wantBackend: "azure", wantModel: "gpt-4.1"},
+		{model: "llama3", wantBackend: "ollama", wantModel: "llama3.1:8b"},
+	}
+	for _, tt := range tests {
+		gotModel, gotBackend = "", ""
+		req := httptest.NewRequest("POST", "http://localhost/api/v1/chat/completions", strings.NewReader(`{"model":"`+tt.model+`","messages":[]}`))
+		req.Header.Set("Authorization", "Bearer TESTTOKEN")
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d: %s", tt.model, rr.Code, rr.Body.String())
+		}
+		if gotBackend != tt.wantBackend || gotModel != tt.wantModel {
+			t.Fatalf("%s: routed to %s with model %q, want %s with %q", tt.model, gotBackend, gotModel, tt.wantBackend, tt.wantModel)
+		}
+	}
+}
+
+func TestServeHTTP_UnknownModelReturnsOpenAIError(t *testing.T) {
+	fb := newTestDB(t)
+	h := newTestHandle(t, fb,
+		db.BackendConfig{Name: "azure", Kind: BackendKindAzure, BaseURL: "https://unused.example/openai"},
+	)
+
+	req := httptest.NewRequest("POST", "http://localhost/api/v1/chat/completions", strings.NewReader(`{"model":"not-configured"}`))
+	req.Header.Set("Authorization", "Bearer TESTTOKEN")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", rr.Code)
+	}
+	var resp OpenAIErrorResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || resp.Err.Code != "model_not_found" {
+		t.Fatalf("expected model_not_found error, got %s", rr.Body.String())
+	}
+}
+
+func TestHandleModels_ListsOnlyRoutableModels(t *testing.T) {
+	fb := newTestDB(t)
+	fb.models = []db.Model{
+		{ID: "gpt-4.1"},
+		{ID: "llama3", Backend: "ollama"},
+		{ID: "orphan", Backend: "removed-backend"},
+	}
+	h := newTestHandle(t, fb,
+		db.BackendConfig{Name: "azure", Kind: BackendKindAzure, BaseURL: "https://unused.example/openai"},
+		db.BackendConfig{Name: "ollama", Kind: BackendKindOpenAI, BaseURL: "http://ollama.example/"},
+	)
+
+	req := httptest.NewRequest("GET", "http://localhost/api/v1/models", nil)
+	req.Header.Set("Authorization", "Bearer TESTTOKEN")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	var list OpenAIModelList
+	if err := json.Unmarshal(rr.Body.Bytes(), &list); err != nil {
+		t.Fatalf("invalid model list: %v", err)
+	}
+	var ids []string
+	for _, m := range list.Data {
+		ids = append(ids, m.ID)
+	}
+	if strings.Join(ids, ",") != "gpt-4.1,llama3" {
+		t.Fatalf("unexpected model catalogue: %v", ids)
+	}
+}
+
+// TestHandleModels_MatchesSpec checks the served model list against the
+// ProxyModelList schema of the OpenAPI document.
+func TestHandleModels_MatchesSpec(t *testing.T) {
+	doc, err := openapi.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fb := newTestDB(t)
+	fb.models = []db.Model{{ID: "gpt-4.1"}}
+	h := newTestHandle(t, fb,
+		db.BackendConfig{Name: "azure", Kind: BackendKindAzure, BaseURL: "https://unused.example/openai"},
+	)
+
+	req := httptest.NewRequest("GET", "http://localhost/api/v1/models", nil)
+	req.Header.Set("Authorization", "Bearer TESTTOKEN")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	var list struct {
+		Data []map[string]any `json:"data"`
+	}
+	var raw map[string]any
+	if json.Unmarshal(rr.Body.Bytes(), &raw) != nil || json.Unmarshal(rr.Body.Bytes(), &list) != nil || len(list.Data) != 1 {
+		t.Fatalf("invalid model list: %s", rr.Body.String())
+	}
+	for name, got := range map[string]map[string]any{"ProxyModelList": raw, "ProxyModel": list.Data[0]} {
+		schema := doc.Components.Schemas[name]
+		if schema == nil {
+			t.Fatalf("schema %s is missing", name)
+		}
+		var documented []string
+		for _, p := range schema.Properties {
+			documented = append(documented, p.Name)
+			if _, ok := got[p.Name]; !ok {
+				t.Errorf("%s: documented property %s is missing", name, p.Name)
+			}
+		}
+		if len(got) != len(documented) {
+			t.Errorf("%s: served %v, documented %v", name, got, documented)
+		}
+	}
+}
@@ -0,0 +1,339 @@
+package apiproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	db "openai-api-proxy/db"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/codes"
+)
+
+// semanticMaxPrompt is the longest prompt in bytes that is embedded, longer
+// ones are forwarded without lookup.
+const semanticMaxPrompt = 8000
+
+// SemanticStore is the subset of database methods used by the semantic cache.
+type SemanticStore interface {
+	LookupSemanticCache(*db.SemanticCacheEntry) (*db.SemanticCacheEntry, error)
+	WriteSemanticCache(*db.SemanticCacheEntry) error
+	PurgeSemanticCache() (int64, error)
+}
+
+// semanticCache answers chat completions and responses whose last user
+// message is close enough to one answered before, see semanticQuery. The
+// prompts are compared by the cosine similarity of their embeddings, stored
+// with pgvector. It is enabled with SEMANTIC_CACHE=true.
+type semanticCache struct {
+	store          SemanticStore
+	embed          func(ctx context.Context, model, text string) ([]float32, error)
+	embeddingModel string  // models table ID of the embeddings deployment
+	threshold      float64 // minimum cosine similarity of a hit
+	scopeBy        string  // key, owner or group, see scope
+	ttl            time.Duration
+	timeout        time.Duration // of the embeddings call
+	maxBytes       int           // larger responses are not stored
+}
+
+// newSemanticCache returns the semantic cache if SEMANTIC_CACHE is true, nil
+// otherwise. It creates the semantic_cache table if needed; the embedder is
+// set by Init once the backends are loaded.
+func newSemanticCache(d *db.Database) (*semanticCache, error) {
+	if os.Getenv("SEMANTIC_CACHE") != "true" {
+		return nil, nil
+	}
+	c := &semanticCache{
+		embeddingModel: os.Getenv("SEMANTIC_CACHE_MODEL"),
+		threshold:      0.95,
+		ttl:            envDuration("SEMANTIC_CACHE_TTL", 24*time.Hour),
+		timeout:        envDuration("SEMANTIC_CACHE_TIMEOUT", 2*time.Second),
+		maxBytes:       envInt("RESPONSE_CACHE_MAX_BYTES", 1<<20),
+	}
+	if c.embeddingModel == "" {
+		return nil, errors.New("SEMANTIC_CACHE_MODEL is not set")
+	}
+	if raw := strings.TrimSpace(os.Getenv("SEMANTIC_CACHE_THRESHOLD")); raw != "" {
+		t, err := strconv.ParseFloat(raw, 64)
+		if err != nil || t <= 0 || t > 1 {
+			return nil, fmt.Errorf("invalid SEMANTIC_CACHE_THRESHOLD %q", raw)
+		}
+		c.threshold = t
+	}
+	switch c.scopeBy = os.Getenv("SEMANTIC_CACHE_SCOPE"); c.scopeBy {
+	case "", "key", "owner", "group":
+	default:
+		return nil, fmt.Errorf("unknown SEMANTIC_CACHE_SCOPE %q", c.scopeBy)
+	}
+	if err := d.EnsureSemanticCache(); err != nil {
+		return nil, fmt.Errorf("create semantic_cache, is pgvector installed? %w", err)
+	}
+	c.store = d
+	go c.purgeLoop(time.Hour)
+	return c, nil
+}
+
+// scope is the tenant whose requests share cached answers: the key, or with
+// SEMANTIC_CACHE_SCOPE=owner its owner, i.e. the user or the team of team
+// keys. With SEMANTIC_CACHE_SCOPE=group it is the reporting group of the key,
+// so the personal keys of the members share answers with the team keys; keys
+// of users without group keep their own.
+func (c *semanticCache) scope(p *Principal) string {
+	switch {
+	case c.scopeBy == "owner":
+		return "owner:" + p.Owner
+	case c.scopeBy == "group" && p.Group != 0:
+		return "group:" + strconv.FormatInt(p.Group, 10)
+	}
+	return "key:" + p.KeyUUID
+}
+
+// semanticQuery returns the prompt to embed for r with the given body and the
+// entry to look up, without embedding, or false if it must not be served from
+// the semantic cache. Eligible are non-streamed chat completions and
+// responses with at most one choice, under the same conditions as in
+// cacheKey otherwise, whose last message is a user message. Its text is the
+// prompt; the other fields of the body and all earlier messages, including
+// instructions, assistant turns and tool results, form the context, which has
+// to match exactly.
+func (c *semanticCache) semanticQuery(r *http.Request, p *Principal, model string, body []byte) (string, *db.SemanticCacheEntry, bool) {
+	if !cacheableRequest(r, p) {
+		return "", nil, false
+	}
+	endpoint := cacheEndpoint(r.URL.Path)
+	if endpoint != "/chat/completions" && endpoint != "/responses" {
+		return "", nil, false
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal(body, &payload); err != nil || payload == nil {
+		return "", nil, false
+	}
+	if stream, _ := payload["stream"].(bool); stream {
+		return "", nil, false
+	}
+	if n, ok := payload["n"].(float64); ok && n != 1 {
+		return "", nil, false
+	}
+
+	var prompt string
+	var messages []interface{}
+	if endpoint == "/chat/completions" {
+		messages, _ = payload["messages"].([]interface{})
+		delete(payload, "messages")
+	} else if input, ok := payload["input"].(string); ok {
+		prompt = input
+		delete(payload, "input")
+	} else {
+		messages, _ = payload["input"].([]interface{})
+		delete(payload, "input")
+	}
+	var history []interface{}
+	if len(messages) > 0 {
+		last := messages[len(messages)-1]
+		if messageRole(last) != "user" {
+			return "", nil, false
+		}
+		prompt = messageText(last)
+		history = messages[:len(messages)-1]
+	}
+	if strings.TrimSpace(prompt) == "" || len(prompt) > semanticMaxPrompt {
+		return "", nil, false
+	}
+
+	delete(payload, "user")
+	delete(payload, "metadata")
+	delete(payload, "model")
+	fields, err := json.Marshal(map[string]interface{}{"params": payload, "history": history})
+	if err != nil {
+		return "", nil, false
+	}
+	sum := sha256.Sum256(fields)
+	return prompt, &db.SemanticCacheEntry{
+		Scope:          c.scope(p),
+		Model:          model,
+		Endpoint:       endpoint,
+		ContextHash:    hex.EncodeToString(sum[:]),
+		EmbeddingModel: c.embeddingModel,
+	}, true
+}
+
+// messageRole returns the role of a chat message or response input item.
+func messageRole(m interface{}) string {
+	msg, _ := m.(map[string]interface{})
+	role, _ := msg["role"].(string)
+	return role
+}
+
+// messageText returns the text of a chat message or response input item,
+// empty if it has other content, e.g. images.
+func messageText(m interface{}) string {
+	msg, _ := m.(map[string]interface{})
+	switch content := msg["content"].(type) {
+	case string:
+		return content
+	case []interface{}:
+		var parts []string
+		for _, part := range content {
+			p, _ := part.(map[string]interface{})
+			text, ok := p["text"].(string)
+			if !ok {
+				return ""
+			}
+			parts = append(parts, text)
+		}
+		return strings.Join(parts, "\n")
+	}
+	return ""
+}
+
+// lookup embeds the prompt of r and returns the most similar cached answer
+// if it reaches the threshold. On a miss the query, with the embedding, is
+// returned as well, so the response can be stored under it.
+func (c *semanticCache) lookup(r *http.Request, p *Principal, model string, body []byte) (hit, query *db.SemanticCacheEntry, err error) {
+	prompt, q, ok := c.semanticQuery(r, p, model, body)
+	if !ok {
+		return nil, nil, nil
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), c.timeout)
+	defer cancel()
+	q.Embedding, err = c.embed(ctx, c.embeddingModel, prompt)
+	if err != nil {
+		return nil, nil, fmt.Errorf("embed prompt: %w", err)
+	}
+
+	_, span := startDBSpan(r.Context(), "SELECT", "semantic_cache")
+	defer span.End()
+	e, err := c.store.LookupSemanticCache(q)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, q, nil
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "select failed")
+		return nil, q, err
+	}
+	logFor(r).Debug("Semantic cache candidate", "similarity", e.Similarity, "threshold", c.threshold)
+	if !(e.Similarity >= c.threshold) { // the similarity of zero vectors is NaN
+		return nil, q, nil
+	}
+	return e, q, nil
+}
+
+// put stores the response to the request of q.
+func (c *semanticCache) put(ctx context.Context, q *db.SemanticCacheEntry, e *db.CachedResponse) error {
+	_, span := startDBSpan(ctx, "INSERT", "semantic_cache")
+	defer span.End()
+	entry := *q
+	entry.Status = e.Status
+	entry.ContentType = e.ContentType
+	entry.Body = e.Body
+	entry.CreatedAt = e.CreatedAt
+	entry.ExpiresAt = e.CreatedAt.Add(c.ttl)
+	err := c.store.WriteSemanticCache(&entry)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "insert failed")
+	}
+	return err
+}
+
+// purgeLoop deletes the expired entries every interval.
+func (c *semanticCache) purgeLoop(interval time.Duration) {
+	purgeEvery("semantic cache", interval, c.store.PurgeSemanticCache)
+}
+
+// embed returns the embedding of text from model, sent to the backend of the
+// model like a client request. The call is recorded in requests for the key
+// of ctx, so it counts against its usage, rate limits and budgets.
+func (h *baseHandle) embed(ctx context.Context, model, text string) ([]float32, error) {
+	m, err := h.db.LookupModel(model)
+	if err != nil {
+		return nil, fmt.Errorf("lookup model %q: %w", model, err)
+	}
+	b, ok := h.modelBackend(m)
+	if !ok {
+		return nil, fmt.Errorf("backend %q of model %q not found", m.Backend, m.ID)
+	}
+	name := m.ID
+	if m.Deployment != "" {
+		name = m.Deployment
+	}
+	payload, err := json.Marshal(map[string]string{"model": name, "input": text})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "/api/v1/embeddings", bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	up := upstream{backend: b, model: m}
+	// A requestInfo of its own keeps the call apart from the client request.
+	info := &requestInfo{start: time.Now(), endpoint: req.URL.Path, model: m.ID, upstream: up.name(), backend: b.Name(), kind: up.kind()}
+	record := func(tokens int) {
+		p, ok := PrincipalFromContext(ctx)
+		if !ok {
+			return
+		}
+		rq := db.Request{ID: localRequestID(), ApiKeyID: p.KeyUUID, Model: m.ID,
+			TokenCountPrompt: tokens, InputTokenCount: tokens}
+		if err := h.rc.writeRequest(withRequestInfo(req, info), &rq); err != nil {
+			logFor(req).Error("Could not record embedding of the semantic cache", "error", err)
+		}
+	}
+	b.Authorize(req, m)
+	base, err := b.Rewrite(req, m)
+	if err != nil {
+		return nil, err
+	}
+	u := *base
+	u.Path = singleJoiningSlash(base.Path, req.URL.Path)
+	u.RawQuery = req.URL.RawQuery
+	req.URL, req.Host = &u, u.Host
+	req.Header.Set("Content-Type", "application/json")
+
+	req, span := startUpstreamSpan(req, up)
+	defer span.End()
+	resp, err := (&http.Client{Transport: h.proxies.transport}).Do(req)
+	if err != nil {
+		span.RecordError(err)
+		info.status = http.StatusBadGateway
+		record(0)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	info.status = resp.StatusCode
+	info.ttfb = time.Since(info.start)
+	setStatus(span, resp.StatusCode, false)
+	if resp.StatusCode != http.StatusOK {
+		record(0)
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 200))
+		return nil, fmt.Errorf("%s: %s", resp.Status, msg)
+	}
+	var out struct {
+		Data []struct {
+			Embedding []float32 `json:"embedding"`
+		} `json:"data"`
+		Usage struct {
+			PromptTokens int `json:"prompt_tokens"`
+		} `json:"usage"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&out)
+	record(out.Usage.PromptTokens)
+	if err != nil {
+		return nil, err
+	}
+	if len(out.Data) == 0 || len(out.Data[0].Embedding) == 0 {
+		return nil, errors.New("response without embedding")
+	}
+	return out.Data[0].Embedding, nil
+}
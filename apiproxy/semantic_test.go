@@ -0,0 +1,254 @@
+package apiproxy
+
+import (
+	"database/sql"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	db "openai-api-proxy/db"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeSemanticStore compares the embeddings like pgvector's cosine distance.
+type fakeSemanticStore struct {
+	mu      sync.Mutex
+	entries []db.SemanticCacheEntry
+}
+
+func (f *fakeSemanticStore) LookupSemanticCache(q *db.SemanticCacheEntry) (*db.SemanticCacheEntry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var best *db.SemanticCacheEntry
+	for i := range f.entries {
+		e := f.entries[i]
+		if e.Scope != q.Scope || e.Model != q.Model || e.Endpoint != q.Endpoint ||
+			e.ContextHash != q.ContextHash || e.EmbeddingModel != q.EmbeddingModel {
+			continue
+		}
+		e.Similarity = cosine(e.Embedding, q.Embedding)
+		if best == nil || e.Similarity > best.Similarity {
+			best = &e
+		}
+	}
+	if best == nil {
+		return nil, sql.ErrNoRows
+	}
+	return best, nil
+}
+
+func (f *fakeSemanticStore) WriteSemanticCache(e *db.SemanticCacheEntry) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.entries = append(f.entries, *e)
+	return nil
+}
+
+func (f *fakeSemanticStore) PurgeSemanticCache() (int64, error) {
+	return 0, nil
+}
+
+func cosine(a, b []float32) float64 {
+	var dot, na, nb float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+	return dot / math.Sqrt(na*nb)
+}
+
+func TestSemanticQuery(t *testing.T) {
+	c := &semanticCache{embeddingModel: "embed"}
+	p := &Principal{KeyUUID: "uid-1", Owner: "team:7"}
+	query := func(path, body string) (string, *db.SemanticCacheEntry, bool) {
+		r := httptest.NewRequest("POST", "http://localhost/api/v1"+path, nil)
+		return c.semanticQuery(r, p, "gpt-4o", []byte(body))
+	}
+
+	prompt, q, ok := query("/chat/completions", `{"model":"gpt-4o","temperature":0.7,"messages":[
+		{"role":"system","content":"You are the support bot."},
+		{"role":"user","content":"Hi"},
+		{"role":"assistant","content":"Hello!"},
+		{"role":"user","content":[{"type":"text","text":"How do I reset"},{"type":"text","text":"my password?"}]}]}`)
+	if !ok || prompt != "How do I reset\nmy password?" {
+		t.Fatalf("chat prompt = %q, %v", prompt, ok)
+	}
+	if q.Scope != "key:uid-1" || q.Model != "gpt-4o" || q.Endpoint != "/chat/completions" || q.EmbeddingModel != "embed" {
+		t.Errorf("unexpected query %+v", q)
+	}
+	_, other, _ := query("/chat/completions", `{"model":"gpt-4o","temperature":0.7,"user":"bob","messages":[
+		{"role":"system","content":"You are the support bot."},
+		{"role":"user","content":"Hi"},
+		{"role":"assistant","content":"Hello!"},
+		{"role":"user","content":"I forgot my password"}]}`)
+	if other.ContextHash != q.ContextHash {
+		t.Error("the last user message or user field changed the context")
+	}
+
+	if prompt, _, ok := query("/responses", `{"model":"gpt-4o","instructions":"Be brief.","input":"Opening hours?"}`); !ok || prompt != "Opening hours?" {
+		t.Errorf("responses prompt = %q, %v", prompt, ok)
+	}
+	if prompt, _, ok := query("/responses", `{"model":"gpt-4o","input":[{"role":"developer","content":"Be brief."},
+		{"role":"user","content":[{"type":"input_text","text":"Opening hours?"}]}]}`); !ok || prompt != "Opening hours?" {
+		t.Errorf("responses input prompt = %q, %v", prompt, ok)
+	}
+
+	for name, tc := range map[string]struct{ path, body string }{
+		"embeddings": {"/embeddings", `{"model":"gpt-4o","input":"hi"}`},
+		"stream":     {"/chat/completions", `{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"hi"}]}`},
+		"choices":    {"/chat/completions", `{"model":"gpt-4o","n":3,"messages":[{"role":"user","content":"hi"}]}`},
+		"no user":    {"/chat/completions", `{"model":"gpt-4o","messages":[{"role":"system","content":"hi"}]}`},
+		"assistant":  {"/chat/completions", `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"},{"role":"assistant","content":"Hello!"}]}`},
+		"tool":       {"/chat/completions", `{"model":"gpt-4o","messages":[{"role":"user","content":"weather?"},{"role":"assistant","tool_calls":[{"id":"c1","type":"function","function":{"name":"weather","arguments":"{}"}}]},{"role":"tool","tool_call_id":"c1","content":"sunny"}]}`},
+		"function":   {"/responses", `{"model":"gpt-4o","input":[{"role":"user","content":"weather?"},{"type":"function_call_output","call_id":"c1","output":"sunny"}]}`},
+		"image":      {"/chat/completions", `{"model":"gpt-4o","messages":[{"role":"user","content":[{"type":"image_url","image_url":{"url":"x"}}]}]}`},
+		"too long":   {"/responses", `{"model":"gpt-4o","input":"` + strings.Repeat("a", semanticMaxPrompt+1) + `"}`},
+	} {
+		if _, _, ok := query(tc.path, tc.body); ok {
+			t.Errorf("%s: request is eligible", name)
+		}
+	}
+
+	c.scopeBy = "owner"
+	if _, q, _ := query("/responses", `{"input":"hi"}`); q.Scope != "owner:team:7" {
+		t.Errorf("owner scope = %q", q.Scope)
+	}
+	c.scopeBy = "group"
+	if _, q, _ := query("/responses", `{"input":"hi"}`); q.Scope != "key:uid-1" {
+		t.Errorf("group scope without group = %q", q.Scope)
+	}
+	p.Group = 7
+	if _, q, _ := query("/responses", `{"input":"hi"}`); q.Scope != "group:7" {
+		t.Errorf("group scope = %q", q.Scope)
+	}
+}
+
+func TestSemanticQuery_ComparesEarlierTurns(t *testing.T) {
+	c := &semanticCache{embeddingModel: "embed"}
+	p := &Principal{KeyUUID: "uid-1", Owner: "team:7"}
+	contextHash := func(messages string) string {
+		r := httptest.NewRequest("POST", "http://localhost/api/v1/chat/completions", nil)
+		prompt, q, ok := c.semanticQuery(r, p, "gpt-4o", []byte(`{"model":"gpt-4o","messages":[`+messages+`]}`))
+		if !ok || prompt != "Should I take an umbrella?" {
+			t.Fatalf("prompt = %q, %v", prompt, ok)
+		}
+		return q.ContextHash
+	}
+	const ask = `{"role":"user","content":"Should I take an umbrella?"}`
+
+	for name, pair := range map[string][2]string{
+		"earlier turns": {
+			`{"role":"user","content":"I am in Berlin."},{"role":"assistant","content":"Noted."},` + ask,
+			`{"role":"user","content":"I am in Madrid."},{"role":"assistant","content":"Noted."},` + ask,
+		},
+		"tool results": {
+			`{"role":"user","content":"Weather?"},{"role":"assistant","tool_calls":[{"id":"c1","type":"function","function":{"name":"weather","arguments":"{}"}}]},{"role":"tool","tool_call_id":"c1","content":"rain"},` + ask,
+			`{"role":"user","content":"Weather?"},{"role":"assistant","tool_calls":[{"id":"c1","type":"function","function":{"name":"weather","arguments":"{}"}}]},{"role":"tool","tool_call_id":"c1","content":"sunny"},` + ask,
+		},
+	} {
+		if contextHash(pair[0]) == contextHash(pair[1]) {
+			t.Errorf("%s: conversations that differ in %s share the context", name, name)
+		}
+	}
+}
+
+func TestSemanticCache_ServesSimilarPrompt(t *testing.T) {
+	var completions atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Input string `json:"input"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/v1/embeddings" {
+			// Questions about passwords point one way, everything else the other.
+			vec := []float32{0, 1}
+			if strings.Contains(strings.ToLower(body.Input), "password") {
+				vec = []float32{1, 0.1}
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"data":  []map[string]interface{}{{"embedding": vec}},
+				"usage": map[string]int{"prompt_tokens": 7, "total_tokens": 7},
+			})
+			return
+		}
+		completions.Add(1)
+		w.Write([]byte(`{"id":"chatcmpl-1","object":"chat.completion","model":"gpt-4o-2024-08-06","usage":{"prompt_tokens":3,"completion_tokens":5}}`))
+	}))
+	defer ts.Close()
+
+	fb := newTestDB(t)
+	fb.apiKeys = append(fb.apiKeys, db.ApiKey{UUID: "uid-2", ApiKey: mustHash(t, "OTHERTOKEN"), Owner: "owner2"})
+	fb.models = append(fb.models, db.Model{ID: "text-embedding-3-small"})
+	h := newTestHandle(t, fb, db.BackendConfig{Name: "openai", Kind: BackendKindOpenAI, BaseURL: ts.URL + "/", ApiKey: "sk-upstream"})
+	store := &fakeSemanticStore{}
+	h.rc.semantic = &semanticCache{
+		store:          store,
+		embed:          h.embed,
+		embeddingModel: "text-embedding-3-small",
+		threshold:      0.95,
+		ttl:            time.Hour,
+		timeout:        time.Second,
+		maxBytes:       1 << 20,
+	}
+
+	send := func(token, question string) *httptest.ResponseRecorder {
+		body := `{"model":"gpt-4o","messages":[{"role":"user","content":"` + question + `"}]}`
+		req := httptest.NewRequest("POST", "http://localhost/api/v1/chat/completions", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := send("TESTTOKEN", "How do I reset my password?"); rr.Header().Get(cacheHeader) != "miss" {
+		t.Fatalf("first request: %d %q", rr.Code, rr.Header().Get(cacheHeader))
+	}
+	if len(store.entries) != 1 || store.entries[0].Scope != "key:uid-1" || len(store.entries[0].Embedding) != 2 {
+		t.Fatalf("unexpected stored entries %+v", store.entries)
+	}
+	rr := send("TESTTOKEN", "I forgot my password, what now?")
+	if rr.Code != http.StatusOK || rr.Header().Get(cacheHeader) != "hit" || rr.Header().Get(similarityHeader) == "" {
+		t.Fatalf("similar request: %d %q", rr.Code, rr.Header().Get(cacheHeader))
+	}
+	if rr := send("TESTTOKEN", "When are you open?"); rr.Header().Get(cacheHeader) != "miss" {
+		t.Error("an unrelated prompt was answered from the cache")
+	}
+	if rr := send("OTHERTOKEN", "How do I reset my password?"); rr.Header().Get(cacheHeader) != "miss" {
+		t.Error("the answer leaked to another key")
+	}
+	if n := completions.Load(); n != 3 {
+		t.Errorf("upstream answered %d completions, want 3", n)
+	}
+
+	var chats, embeddings []db.Request
+	for _, rq := range fb.requests() {
+		if rq.Endpoint == "/api/v1/embeddings" {
+			embeddings = append(embeddings, *rq)
+		} else {
+			chats = append(chats, *rq)
+		}
+	}
+	if len(chats) != 4 || !chats[1].ResponseCacheHit || chats[1].Upstream != cacheUpstream || chats[2].ResponseCacheHit {
+		t.Errorf("unexpected recorded requests %+v", chats)
+	}
+	// Every lookup embeds the prompt on behalf of the calling key.
+	if len(embeddings) != 4 {
+		t.Fatalf("recorded %d embeddings, want 4", len(embeddings))
+	}
+	for i, rq := range embeddings {
+		want := "uid-1"
+		if i == 3 {
+			want = "uid-2"
+		}
+		if rq.ApiKeyID != want || rq.Model != "text-embedding-3-small" || rq.InputTokenCount != 7 ||
+			rq.Status != http.StatusOK || rq.ResponseCacheHit {
+			t.Errorf("embedding %d: %+v", i, rq)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package apiproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	db "openai-api-proxy/db"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "openai-api-proxy/apiproxy"
+
+// tracer returns the tracer of the global provider, which is a no-op unless
+// setupTracing installed an exporter.
+func tracer() trace.Tracer {
+	return otel.GetTracerProvider().Tracer(tracerName)
+}
+
+// setupTracing installs the W3C trace context propagator, so a traceparent
+// sent by the client reaches the upstream, and the tracer provider exporting
+// to the exporter chosen by newSpanExporter.
+func setupTracing(ctx context.Context) error {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	exp, err := newSpanExporter(ctx)
+	if err != nil || exp == nil {
+		return err
+	}
+	tp, err := newTracerProvider(ctx, exp)
+	if err != nil {
+		return err
+	}
+	otel.SetTracerProvider(tp)
+	return nil
+}
+
+// newSpanExporter returns the exporter selected by OTEL_TRACES_EXPORTER:
+// "otlp" sends OTLP over HTTP and is configured with the standard
+// OTEL_EXPORTER_OTLP_* variables, "none" disables tracing. If it is not set,
+// spans are exported once an OTLP endpoint is configured.
+func newSpanExporter(ctx context.Context) (sdktrace.SpanExporter, error) {
+	kind := os.Getenv("OTEL_TRACES_EXPORTER")
+	if kind == "" && (os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != "") {
+		kind = "otlp"
+	}
+	switch kind {
+	case "", "none":
+		return nil, nil
+	case "otlp":
+		return otlptracehttp.New(ctx)
+	default:
+		return nil, fmt.Errorf("unknown OTEL_TRACES_EXPORTER %q", kind)
+	}
+}
+
+// newTracerProvider batches spans to exp. The service name defaults to
+// openai-api-proxy and can be changed with OTEL_SERVICE_NAME; sampling
+// follows OTEL_TRACES_SAMPLER.
+func newTracerProvider(ctx context.Context, exp sdktrace.SpanExporter) (*sdktrace.TracerProvider, error) {
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "openai-api-proxy")),
+		resource.WithTelemetrySDK(),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp), sdktrace.WithResource(res)), nil
+}
+
+// startRequestSpan starts the server span of a proxied request, continuing
+// the trace of the client.
+func startRequestSpan(r *http.Request) (*http.Request, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer().Start(ctx, "proxy request",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("url.path", r.URL.Path),
+		))
+	return r.WithContext(ctx), span
+}
+
+// startUpstreamSpan starts the client span of one attempt and propagates it
+// to the upstream in the traceparent header.
+func startUpstreamSpan(r *http.Request, up upstream) (*http.Request, trace.Span) {
+	attrs := []attribute.KeyValue{
+		attribute.String("gen_ai.system", genAISystem(up.backend)),
+		attribute.String("openai_proxy.upstream", up.name()),
+	}
+	if op := genAIOperation(r.URL.Path); op != "" {
+		attrs = append(attrs, attribute.String("gen_ai.operation.name", op))
+	}
+	if up.model != nil {
+		attrs = append(attrs, attribute.String("gen_ai.request.model", up.model.ID))
+	}
+	ctx, span := tracer().Start(r.Context(), "upstream "+up.backend.Name(),
+		trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+	r = r.WithContext(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(r.Header))
+	return r, span
+}
+
+// startDBSpan starts the span of a database call.
+func startDBSpan(ctx context.Context, operation, table string) (context.Context, trace.Span) {
+	return tracer().Start(ctx, operation+" "+table,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "postgresql"),
+			attribute.String("db.operation.name", operation),
+			attribute.String("db.collection.name", table),
+		))
+}
+
+// setStatus records the HTTP status on span and marks server errors, and
+// for client spans every status of 400 and above, as failed.
+func setStatus(span trace.Span, status int, client bool) {
+	if status == 0 {
+		return
+	}
+	span.SetAttributes(attribute.Int("http.response.status_code", status))
+	if status >= 500 || (client && status >= 400) {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+}
+
+// setUsage adds the GenAI usage attributes of rq to span.
+func setUsage(span trace.Span, rq *db.Request) {
+	model := rq.Model
+	if rq.SnapshotVersion != "" {
+		model += "-" + rq.SnapshotVersion
+	}
+	span.SetAttributes(
+		attribute.String("gen_ai.response.id", rq.ID),
+		attribute.String("gen_ai.response.model", model),
+		attribute.Int("gen_ai.usage.input_tokens", rq.InputTokenCount),
+		attribute.Int("gen_ai.usage.output_tokens", rq.OutputTokenCount),
+		attribute.Int("openai_proxy.usage.cached_input_tokens", rq.CachedInputTokenCount),
+		attribute.Bool("openai_proxy.usage.approximated", rq.IsApproximated),
+	)
+}
+
+// genAISystem names the provider of b as in the GenAI semantic conventions.
+func genAISystem(b Backend) string {
+	if _, ok := b.(*azureBackend); ok {
+		return "az.ai.openai"
+	}
+	return "openai"
+}
+
+// genAIOperation maps the endpoint of path to gen_ai.operation.name.
+func genAIOperation(path string) string {
+	switch {
+	case strings.HasSuffix(path, "/chat/completions"), strings.HasSuffix(path, "/responses"):
+		return "chat"
+	case strings.HasSuffix(path, "/completions"):
+		return "text_completion"
+	case strings.HasSuffix(path, "/embeddings"):
+		return "embeddings"
+	}
+	return ""
+}
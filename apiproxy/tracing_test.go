@@ -0,0 +1,244 @@
+package apiproxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	db "openai-api-proxy/db"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// installTracing makes tp the global tracer provider for the test.
+func installTracing(t *testing.T, tp *sdktrace.TracerProvider) {
+	t.Helper()
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		tp.Shutdown(context.Background())
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	})
+}
+
+// waitSpan waits for the ended span called name, stream goroutines end late.
+func waitSpan(t *testing.T, rec *tracetest.SpanRecorder, name string) sdktrace.ReadOnlySpan {
+	t.Helper()
+	for i := 0; i < 50; i++ {
+		for _, s := range rec.Ended() {
+			if s.Name() == name {
+				return s
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("span %q not recorded", name)
+	return nil
+}
+
+func spanAttr(s sdktrace.ReadOnlySpan, key string) attribute.Value {
+	for _, kv := range s.Attributes() {
+		if string(kv.Key) == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+const clientTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestTracing_BufferedRequest(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	installTracing(t, sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)))
+
+	var gotTraceparent string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotTraceparent = r.Header.Get("Traceparent")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"chatcmpl-1","object":"chat.completion","model":"gpt-4o-2024-08-06","usage":{"prompt_tokens":10,"completion_tokens":5}}`))
+	}))
+	defer ts.Close()
+	fb := newTestDB(t)
+	fb.models[0].Backend = "openai"
+	h := newTestHandle(t, fb, db.BackendConfig{Name: "openai", Kind: BackendKindOpenAI, BaseURL: ts.URL + "/", ApiKey: "sk-upstream"})
+
+	req := httptest.NewRequest("POST", "http://localhost/api/v1/chat/completions", strings.NewReader(`{"model":"gpt-4o"}`))
+	req.Header.Set("Authorization", "Bearer TESTTOKEN")
+	req.Header.Set("Traceparent", clientTraceparent)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	server := waitSpan(t, rec, "proxy request")
+	traceID := server.SpanContext().TraceID().String()
+	if traceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("trace of the client not continued: %s", traceID)
+	}
+	if got := spanAttr(server, "http.response.status_code").AsInt64(); got != 200 {
+		t.Errorf("server status = %d", got)
+	}
+
+	upstream := waitSpan(t, rec, "upstream openai")
+	if !strings.Contains(gotTraceparent, upstream.SpanContext().SpanID().String()) || !strings.Contains(gotTraceparent, traceID) {
+		t.Errorf("traceparent sent upstream = %q, want span %s", gotTraceparent, upstream.SpanContext().SpanID())
+	}
+	if spanAttr(upstream, "gen_ai.system").AsString() != "openai" || spanAttr(upstream, "gen_ai.request.model").AsString() != "gpt-4o" ||
+		spanAttr(upstream, "gen_ai.operation.name").AsString() != "chat" {
+		t.Errorf("unexpected upstream attributes %v", upstream.Attributes())
+	}
+
+	resp := waitSpan(t, rec, "NewResponse")
+	if resp.Parent().SpanID() != upstream.SpanContext().SpanID() {
+		t.Errorf("NewResponse is not a child of the upstream span")
+	}
+	if spanAttr(resp, "gen_ai.usage.input_tokens").AsInt64() != 10 || spanAttr(resp, "gen_ai.usage.output_tokens").AsInt64() != 5 ||
+		spanAttr(resp, "gen_ai.response.model").AsString() != "gpt-4o-2024-08-06" || spanAttr(resp, "gen_ai.response.id").AsString() != "chatcmpl-1" {
+		t.Errorf("unexpected response attributes %v", resp.Attributes())
+	}
+
+	for _, name := range []string{"ValidateToken", "SELECT models", "INSERT requests"} {
+		if s := waitSpan(t, rec, name); s.SpanContext().TraceID().String() != traceID {
+			t.Errorf("span %q is not part of the trace", name)
+		}
+	}
+}
+
+func TestTracing_StreamedRequest(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	installTracing(t, sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)))
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: {\"id\":\"chatcmpl-2\",\"model\":\"gpt-4o\",\"choices\":[{\"delta\":{\"content\":\"Hi\"}}]}\n\n"))
+		w.Write([]byte("data: {\"id\":\"chatcmpl-2\",\"model\":\"gpt-4o\",\"choices\":[],\"usage\":{\"prompt_tokens\":3,\"completion_tokens\":7}}\n\ndata: [DONE]\n\n"))
+	}))
+	defer ts.Close()
+	fb := newTestDB(t)
+	fb.models[0].Backend = "openai"
+	h := newTestHandle(t, fb, db.BackendConfig{Name: "openai", Kind: BackendKindOpenAI, BaseURL: ts.URL + "/", ApiKey: "sk-upstream"})
+
+	req := httptest.NewRequest("POST", "http://localhost/api/v1/chat/completions", strings.NewReader(`{"model":"gpt-4o","stream":true}`))
+	req.Header.Set("Authorization", "Bearer TESTTOKEN")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	parse := waitSpan(t, rec, "parseSSEStream")
+	if spanAttr(parse, "gen_ai.usage.output_tokens").AsInt64() != 7 || spanAttr(parse, "gen_ai.response.id").AsString() != "chatcmpl-2" {
+		t.Errorf("unexpected stream attributes %v", parse.Attributes())
+	}
+	write := waitSpan(t, rec, "INSERT requests")
+	if write.Parent().SpanID() != parse.SpanContext().SpanID() {
+		t.Errorf("the write of a stream is not a child of parseSSEStream")
+	}
+}
+
+func TestTracing_UpstreamErrorStatus(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	installTracing(t, sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)))
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+	fb := newTestDB(t)
+	fb.models[0].Backend = "openai"
+	h := newTestHandle(t, fb, db.BackendConfig{Name: "openai", Kind: BackendKindOpenAI, BaseURL: ts.URL + "/", ApiKey: "sk-upstream"})
+
+	req := httptest.NewRequest("POST", "http://localhost/api/v1/embeddings", strings.NewReader(`{"model":"gpt-4o"}`))
+	req.Header.Set("Authorization", "Bearer TESTTOKEN")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	upstream := waitSpan(t, rec, "upstream openai")
+	if upstream.Status().Code.String() != "Error" || spanAttr(upstream, "gen_ai.operation.name").AsString() != "embeddings" {
+		t.Errorf("unexpected upstream span %v %v", upstream.Status(), upstream.Attributes())
+	}
+	// A 404 is the fault of the client, not of the proxy.
+	if server := waitSpan(t, rec, "proxy request"); server.Status().Code.String() == "Error" {
+		t.Errorf("server span marked as failed: %v", server.Status())
+	}
+}
+
+// TestTracing_OTLPExporter sends the spans to an in-process OTLP/HTTP collector.
+func TestTracing_OTLPExporter(t *testing.T) {
+	var mu sync.Mutex
+	var names []string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			http.NotFound(w, r)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		var export collectortrace.ExportTraceServiceRequest
+		if err := proto.Unmarshal(body, &export); err != nil {
+			t.Errorf("invalid export: %v", err)
+		}
+		mu.Lock()
+		for _, rs := range export.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, s := range ss.Spans {
+					names = append(names, s.Name)
+				}
+			}
+		}
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/x-protobuf")
+	}))
+	defer collector.Close()
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", collector.URL)
+
+	ctx := context.Background()
+	exp, err := newSpanExporter(ctx)
+	if err != nil || exp == nil {
+		t.Fatalf("newSpanExporter = %v, %v", exp, err)
+	}
+	tp, err := newTracerProvider(ctx, exp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	installTracing(t, tp)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"chatcmpl-3","object":"chat.completion","model":"gpt-4o","usage":{"prompt_tokens":1,"completion_tokens":1}}`))
+	}))
+	defer ts.Close()
+	fb := newTestDB(t)
+	fb.models[0].Backend = "openai"
+	h := newTestHandle(t, fb, db.BackendConfig{Name: "openai", Kind: BackendKindOpenAI, BaseURL: ts.URL + "/", ApiKey: "sk-upstream"})
+	req := httptest.NewRequest("POST", "http://localhost/api/v1/chat/completions", strings.NewReader(`{"model":"gpt-4o"}`))
+	req.Header.Set("Authorization", "Bearer TESTTOKEN")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	if err := tp.ForceFlush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	got := strings.Join(names, ",")
+	for _, want := range []string{"proxy request", "upstream openai", "NewResponse", "INSERT requests"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("collector did not receive %q: %s", want, got)
+		}
+	}
+}
+
+func TestNewSpanExporter_Selection(t *testing.T) {
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+	if exp, err := newSpanExporter(context.Background()); exp != nil || err != nil {
+		t.Errorf("expected tracing to be off by default, got %v, %v", exp, err)
+	}
+	t.Setenv("OTEL_TRACES_EXPORTER", "zipkin")
+	if _, err := newSpanExporter(context.Background()); err == nil {
+		t.Error("expected an error for an unknown exporter")
+	}
+}
@@ -1,55 +1,178 @@
 package apiproxy
 
 import (
-	"fmt"
-	"log"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
 	"net/http"
 	db "openai-api-proxy/db"
-	"os"
 	"strings"
+	"sync"
+	"time"
 
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/crypto/bcrypt"
 )
 
 func CompareToken(hashes []db.ApiKey, apiKey string) (string, error) {
+	key, err := matchToken(hashes, apiKey)
+	if err != nil {
+		return "", err
+	}
+	return key.UUID, nil
+}
 
-	for _, hash := range hashes {
-		if hash.Deactivated {
+// matchToken returns the first active key whose hash matches apiKey.
+// Deactivated and archived keys are skipped.
+func matchToken(hashes []db.ApiKey, apiKey string) (*db.ApiKey, error) {
+	for i, hash := range hashes {
+		if hash.Deactivated || hash.Archived {
 			continue
 		}
 		err := bcrypt.CompareHashAndPassword([]byte(hash.ApiKey), []byte(apiKey))
 		// log.Printf("Compared %s with %s", apiKey, hash.ApiKey)
 		if err == nil {
-			return hash.UUID, nil
+			return &hashes[i], nil
 		}
 	}
-	err := fmt.Errorf("received invalid bearer token")
+	return nil, errInvalidToken
+}
+
+var errInvalidToken = errors.New("received invalid bearer token")
+
+// LookupApiKey returns the principal of the active key matching token. Keys
+// issued as `sk-proxy-<key_id>_<secret>` are fetched by their key ID and
+// verified with a single bcrypt comparison; legacy keys fall back to comparing
+// every stored hash. Successful lookups are cached for API_KEY_CACHE_TTL;
+// changes of a key through this process evict it, see db.OnApiKeyChange.
+func LookupApiKey(store DBStore, cache *apiKeyCache, token string) (*Principal, error) {
+	if token == "" {
+		return nil, errInvalidToken
+	}
+	if p, ok := cache.get(token); ok {
+		return p, nil
+	}
+
+	var keys []db.ApiKey
+	if keyID, ok := db.ParseApiKeyID(token); ok {
+		key, err := store.LookupApiKeyByKeyID(keyID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errInvalidToken
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = []db.ApiKey{*key}
+	} else {
+		var err error
+		if keys, err = store.LookupApiKeys("*"); err != nil {
+			return nil, err
+		}
+	}
+	key, err := matchToken(keys, token)
+	if err != nil {
+		return nil, err
+	}
+
+	p := newPrincipal(key)
+	cache.put(token, p)
+	return p, nil
+}
+
+// apiKeyCache remembers validated tokens by their SHA-256, so the bcrypt
+// comparison runs once per key and TTL instead of on every request. A nil
+// cache disables caching.
+type apiKeyCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[[sha256.Size]byte]cachedApiKey
+}
+
+type cachedApiKey struct {
+	principal *Principal
+	expires   time.Time
+}
 
-	return "", err
+func newApiKeyCache(ttl time.Duration) *apiKeyCache {
+	return &apiKeyCache{ttl: ttl, entries: make(map[[sha256.Size]byte]cachedApiKey)}
 }
 
-func (h *baseHandle) ValidateToken(w http.ResponseWriter, r *http.Request) string {
+func (c *apiKeyCache) get(token string) (*Principal, bool) {
+	if c == nil {
+		return nil, false
+	}
+	sum := sha256.Sum256([]byte(token))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[sum]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(e.expires) {
+		delete(c.entries, sum)
+		return nil, false
+	}
+	return e.principal, true
+}
+
+func (c *apiKeyCache) put(token string, p *Principal) {
+	if c == nil || c.ttl <= 0 {
+		return
+	}
+	sum := sha256.Sum256([]byte(token))
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[sum] = cachedApiKey{principal: p, expires: now.Add(c.ttl)}
+}
+
+// evict drops the cached tokens of the key uuid, e.g. after it was
+// deactivated, archived or rotated.
+func (c *apiKeyCache) evict(uuid string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, e := range c.entries {
+		if e.principal.KeyUUID == uuid {
+			delete(c.entries, k)
+		}
+	}
+}
+
+// ValidateToken checks the bearer token of the request against the stored
+// API keys and returns the principal of the matching key. On failure an error
+// response is written and nil is returned.
+func (h *baseHandle) ValidateToken(w http.ResponseWriter, r *http.Request) *Principal {
+	_, span := tracer().Start(r.Context(), "ValidateToken")
+	defer span.End()
 	header := r.Header.Get(authHeader)
 
 	apiKey := strings.TrimPrefix(header, "Bearer ")
-	//fmt.Println("\"", apiKey, "\"")
-	if apiKey == "Bearer " {
+	if apiKey == "" {
 		http.Error(w, "401 - Token Empty", http.StatusUnauthorized)
 
-		return ""
+		return nil
 	}
 
-	hashes, err := h.db.LookupApiKeys("*")
-	if err != nil || len(hashes) == 0 {
-		log.Println("Error while requesting API Keys from DB", err)
+	p, err := h.rc.LookupApiKey(apiKey)
+	if err != nil {
+		if !errors.Is(err, errInvalidToken) {
+			logFor(r).Error("Could not look up API key", "error", err)
+		}
 		http.Error(w, "401 - Token Invalid", http.StatusUnauthorized)
-		return ""
+		return nil
 	}
-
-	if _, err := CompareToken(hashes, apiKey); err != nil {
-		http.Error(w, "401 - Token Invalid", http.StatusUnauthorized)
-		return ""
+	if !p.checkRestrictions(w, r) {
+		return nil
 	}
-	azureApiKey := os.Getenv("AZURE_API_KEY")
-	return azureApiKey
+	span.SetAttributes(attribute.String("openai_proxy.api_key.id", p.KeyUUID))
+	h.rc.touch(p)
+	return p
 }
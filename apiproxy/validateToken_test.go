@@ -1,7 +1,11 @@
 package apiproxy
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
 	db "openai-api-proxy/db"
 
@@ -43,6 +47,22 @@ func TestCompareToken_IgnoresDeactivatedKeys(t *testing.T) {
 	}
 }
 
+func TestLookupApiKey_ArchivedKeyRejected(t *testing.T) {
+	token := db.FormatApiKey("abc123", "SECRET")
+	store := &countingStore{}
+	store.apiKeys = []db.ApiKey{
+		{UUID: "archived", KeyID: "abc123", ApiKey: mustHash(t, token), Archived: true},
+		{UUID: "legacy", ApiKey: mustHash(t, "legacy-secret"), Archived: true},
+	}
+
+	if got, err := LookupApiKey(store, nil, token); err == nil {
+		t.Fatalf("expected archived key to be rejected, got %+v", got)
+	}
+	if got, err := LookupApiKey(store, nil, "legacy-secret"); err == nil {
+		t.Fatalf("expected archived legacy key to be rejected, got %+v", got)
+	}
+}
+
 func TestCompareToken_AllDeactivatedRejected(t *testing.T) {
 	keys := []db.ApiKey{
 		{
@@ -56,3 +76,148 @@ func TestCompareToken_AllDeactivatedRejected(t *testing.T) {
 		t.Fatalf("expected deactivated key to be rejected, got uuid=%q", got)
 	}
 }
+
+// countingStore counts the key lookups of LookupApiKey.
+type countingStore struct {
+	fakeDBForTest
+	scans, byID int
+}
+
+func (c *countingStore) LookupApiKeys(uid string) ([]db.ApiKey, error) {
+	c.scans++
+	return c.fakeDBForTest.LookupApiKeys(uid)
+}
+
+func (c *countingStore) LookupApiKeyByKeyID(keyID string) (*db.ApiKey, error) {
+	c.byID++
+	return c.fakeDBForTest.LookupApiKeyByKeyID(keyID)
+}
+
+func TestLookupApiKey_PrefixedKeyUsesIndex(t *testing.T) {
+	token := db.FormatApiKey("abc123", "SECRET")
+	store := &countingStore{}
+	store.apiKeys = []db.ApiKey{
+		{UUID: "legacy", ApiKey: mustHash(t, "legacy-secret")},
+		{UUID: "new", KeyID: "abc123", ApiKey: mustHash(t, token)},
+	}
+
+	if got, err := LookupApiKey(store, nil, token); err != nil || got.KeyUUID != "new" {
+		t.Fatalf("expected key new, got %+v err=%v", got, err)
+	}
+	if store.scans != 0 || store.byID != 1 {
+		t.Fatalf("expected a single indexed lookup, got scans=%d byID=%d", store.scans, store.byID)
+	}
+
+	if _, err := LookupApiKey(store, nil, db.FormatApiKey("unknown", "SECRET")); err == nil {
+		t.Fatal("expected unknown key ID to be rejected")
+	}
+	if _, err := LookupApiKey(store, nil, db.FormatApiKey("abc123", "WRONG")); err == nil {
+		t.Fatal("expected wrong secret to be rejected")
+	}
+	if store.scans != 0 {
+		t.Fatalf("prefixed keys must not fall back to scanning, got %d scans", store.scans)
+	}
+}
+
+func TestLookupApiKey_LegacyFallback(t *testing.T) {
+	store := &countingStore{}
+	store.apiKeys = []db.ApiKey{{UUID: "legacy", ApiKey: mustHash(t, "legacy-secret")}}
+
+	if got, err := LookupApiKey(store, nil, "legacy-secret"); err != nil || got.KeyUUID != "legacy" {
+		t.Fatalf("expected legacy key, got %+v err=%v", got, err)
+	}
+	if store.scans != 1 || store.byID != 0 {
+		t.Fatalf("expected one scan, got scans=%d byID=%d", store.scans, store.byID)
+	}
+}
+
+func TestLookupApiKey_Cache(t *testing.T) {
+	token := db.FormatApiKey("abc123", "SECRET")
+	store := &countingStore{}
+	store.apiKeys = []db.ApiKey{{UUID: "new", KeyID: "abc123", ApiKey: mustHash(t, token)}}
+	cache := newApiKeyCache(time.Minute)
+
+	for i := 0; i < 3; i++ {
+		if got, err := LookupApiKey(store, cache, token); err != nil || got.KeyUUID != "new" {
+			t.Fatalf("lookup %d: %+v err=%v", i, got, err)
+		}
+	}
+	if store.byID != 1 {
+		t.Fatalf("expected cached lookups, got %d DB lookups", store.byID)
+	}
+	if _, err := LookupApiKey(store, cache, db.FormatApiKey("abc123", "WRONG")); err == nil {
+		t.Fatal("cache must not accept a different secret")
+	}
+}
+
+func TestApiKeyCache_Evict(t *testing.T) {
+	cache := newApiKeyCache(time.Minute)
+	cache.put("current", &Principal{KeyUUID: "uid-1"})
+	cache.put("rotated", &Principal{KeyUUID: "uid-1", SecretID: 3})
+	cache.put("other", &Principal{KeyUUID: "uid-2"})
+
+	cache.evict("uid-1")
+	for _, token := range []string{"current", "rotated"} {
+		if _, ok := cache.get(token); ok {
+			t.Errorf("%s: token of the evicted key is still cached", token)
+		}
+	}
+	if _, ok := cache.get("other"); !ok {
+		t.Error("the token of another key was evicted")
+	}
+	(*apiKeyCache)(nil).evict("uid-1")
+}
+
+func TestParseApiKeyID(t *testing.T) {
+	tests := map[string]string{
+		"sk-proxy-abc_def":  "abc",
+		"sk-proxy-abc":      "",
+		"sk-proxy-_def":     "",
+		"ABCDEFGHIJKLMNOPQ": "",
+	}
+	for token, want := range tests {
+		got, ok := db.ParseApiKeyID(token)
+		if got != want || ok != (want != "") {
+			t.Fatalf("%s: got %q ok=%v, want %q", token, got, ok, want)
+		}
+	}
+}
+
+func TestServeHTTP_UsageAttributedToPrincipal(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(okCompletion))
+	}))
+	defer ts.Close()
+
+	store := &countingStore{}
+	store.apiKeys = []db.ApiKey{
+		{UUID: "other", ApiKey: mustHash(t, "OTHERTOKEN"), Owner: "owner2"},
+		{UUID: "uid-1", ApiKey: mustHash(t, "TESTTOKEN"), Owner: "owner1"},
+	}
+	store.models = []db.Model{{ID: "gpt-4.1"}}
+	h := newTestHandle(t, &store.fakeDBForTest, db.BackendConfig{Name: "openai", Kind: BackendKindOpenAI, BaseURL: ts.URL + "/"})
+	h.db = store
+	h.rc.db = store
+
+	if rr := postCompletion(h, "gpt-4.1"); rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	if store.scans != 1 {
+		t.Fatalf("expected the key to be matched once, got %d scans", store.scans)
+	}
+	writes := store.requests()
+	if len(writes) != 1 || writes[0].ApiKeyID != "uid-1" {
+		t.Fatalf("expected usage for uid-1, got %+v", writes)
+	}
+}
+
+func TestPrincipalFromContext(t *testing.T) {
+	if _, ok := PrincipalFromContext(context.Background()); ok {
+		t.Fatal("expected no principal")
+	}
+	ctx := WithPrincipal(context.Background(), &Principal{KeyUUID: "uid-1", Owner: "owner1"})
+	if p, ok := PrincipalFromContext(ctx); !ok || p.KeyUUID != "uid-1" || p.Owner != "owner1" {
+		t.Fatalf("unexpected principal %+v", p)
+	}
+}
@@ -11,6 +11,7 @@ import {
 	primaryKey,
 	text,
 	timestamp,
+	uniqueIndex,
 	varchar,
 } from "drizzle-orm/pg-core";
 
@@ -67,6 +68,13 @@ export const requests = pgTable(
 		outputTokenCount: integer("output_token_count").default(0).notNull(),
 		snapshotVersion: varchar("snapshot_version", { length: 255 }),
 		isApproximated: boolean("is_approximated").default(false).notNull(),
+		status: integer(),
+		endpoint: varchar({ length: 255 }),
+		ttfbMs: integer("ttfb_ms"),
+		durationMs: integer("duration_ms"),
+		streamed: boolean().default(false).notNull(),
+		upstream: varchar({ length: 255 }),
+		responseCacheHit: boolean("response_cache_hit").default(false).notNull(),
 	},
 	(table) => [
 		foreignKey({
@@ -86,6 +94,29 @@ export const apikeys = pgTable(
 		aiapi: varchar({ length: 255 }),
 		description: varchar({ length: 255 }),
 		deactivated: boolean("deactivated").default(false).notNull(),
+		keyId: varchar("key_id", { length: 64 }),
+		rpmLimit: integer("rpm_limit"),
+		tpmLimit: integer("tpm_limit"),
+		expiresAt: timestamp("expires_at", {
+			withTimezone: true,
+			mode: "string",
+		}),
+		allowedModels: text("allowed_models"),
+		allowedEndpoints: text("allowed_endpoints"),
+		allowedCidrs: text("allowed_cidrs"),
+		lastUsedAt: timestamp("last_used_at", {
+			withTimezone: true,
+			mode: "string",
+		}),
+		archivedAt: timestamp("archived_at", {
+			withTimezone: true,
+			mode: "string",
+		}),
+		archivedBy: varchar("archived_by", { length: 255 }),
+		auditContent: boolean("audit_content").default(false).notNull(),
+		responseCacheOptOut: boolean("response_cache_opt_out")
+			.default(false)
+			.notNull(),
 	},
 	(table) => [
 		foreignKey({
@@ -93,6 +124,7 @@ export const apikeys = pgTable(
 			foreignColumns: [users.id],
 			name: "apikeys_owner_fkey",
 		}),
+		uniqueIndex("apikeys_key_id_idx").on(table.keyId),
 	],
 );
 
@@ -104,6 +136,10 @@ export const users = pgTable(
 		companyId: bigint("company_id", { mode: "number" }),
 		name: varchar({ length: 255 }),
 		isAdmin: boolean("is_admin"),
+		rpmLimit: integer("rpm_limit"),
+		tpmLimit: integer("tpm_limit"),
+		// Set for the service account owning the team keys of a reporting group.
+		serviceGroupId: bigint("service_group_id", { mode: "number" }),
 	},
 	(table) => [
 		foreignKey({
@@ -111,6 +147,12 @@ export const users = pgTable(
 			foreignColumns: [company.id],
 			name: "users_company_id_fkey",
 		}),
+		foreignKey({
+			columns: [table.serviceGroupId],
+			foreignColumns: [reportingGroups.id],
+			name: "users_service_group_id_fkey",
+		}).onDelete("set null"),
+		uniqueIndex("users_service_group_id_idx").on(table.serviceGroupId),
 	],
 );
 
@@ -194,6 +236,14 @@ export const reportingGroupViewers = pgTable(
 
 export const models = pgTable("models", {
 	id: varchar({ length: 255 }).primaryKey().notNull(),
+	backend: varchar({ length: 255 }),
+	deployment: varchar({ length: 255 }),
+	resourceHost: varchar("resource_host", { length: 255 }),
+	apiVersion: varchar("api_version", { length: 64 }),
+	apiKey: text("api_key"),
+	weight: integer().default(1).notNull(),
+	balance: varchar({ length: 32 }),
+	auditContent: boolean("audit_content").default(false).notNull(),
 });
 
 export const costUnit = pgEnum("cost_unit", ["1M", "1K"]);
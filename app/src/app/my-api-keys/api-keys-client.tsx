@@ -190,6 +190,8 @@ export function ApiKeysClient() {
 						inputTokens: row.inputTokens,
 						cachedInputTokens: row.cachedInputTokens,
 						outputTokens: row.outputTokens,
+						cacheHits: row.cacheHits,
+						savedTokens: row.savedTokens,
 						createdAt: row.createdAt,
 						cost: row.cost ?? null,
 						currency: row.currency ?? null,
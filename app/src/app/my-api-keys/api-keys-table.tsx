@@ -39,6 +39,8 @@ export type ApiKeyTableRow = {
 	inputTokens: number;
 	cachedInputTokens: number;
 	outputTokens: number;
+	cacheHits?: number;
+	savedTokens?: number;
 	createdAt?: string | null;
 	cost: number | null;
 	currency?: string | null;
@@ -150,6 +152,15 @@ export function ApiKeysTable({
 				cell: ({ getValue }) => formatNumber(getValue<number>()),
 				sortingFn: "basic",
 			},
+			{
+				accessorKey: "savedTokens",
+				header: "Aus dem Cache gesparte Tokens",
+				cell: ({ row }) =>
+					row.original.kind === "model" || !row.original.cacheHits
+						? "—"
+						: `${formatNumber(row.original.savedTokens ?? 0)} (${formatNumber(row.original.cacheHits)} Treffer)`,
+				sortingFn: "basic",
+			},
 			{
 				accessorKey: "cost",
 				header: "Kosten",
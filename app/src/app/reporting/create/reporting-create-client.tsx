@@ -473,6 +473,17 @@ export function ReportingCreateClient({ isAdmin }: { isAdmin: boolean }) {
 									{numberFormatter.format(summary?.outputTokens ?? 0)}
 								</span>
 							</div>
+							{summary?.cacheHits ? (
+								<div>
+									<span className="text-muted-foreground">
+										Aus dem Response-Cache gespart:
+									</span>{" "}
+									<span className="font-semibold">
+										{numberFormatter.format(summary.savedTokens)} (
+										{numberFormatter.format(summary.cacheHits)} Treffer)
+									</span>
+								</div>
+							) : null}
 						</div>
 					</div>
 					<div className="text-right">
@@ -53,6 +53,8 @@ type UsageUser = {
 
 type UsageStats = {
 	totalTokens: number;
+	cacheHits: number;
+	savedTokens: number;
 	modelUsage: UsageModel[];
 	users: UsageUser[];
 };
@@ -209,6 +211,13 @@ export function AdminUsageDashboard({
 					<div className="mt-2 font-semibold text-3xl">
 						Verbrauchte Tokens: {numberFormatter.format(stats.totalTokens)}
 					</div>
+					{stats.cacheHits ? (
+						<div className="mt-1 text-muted-foreground text-sm">
+							Aus dem Response-Cache gespart:{" "}
+							{numberFormatter.format(stats.savedTokens)} Tokens (
+							{numberFormatter.format(stats.cacheHits)} Treffer)
+						</div>
+					) : null}
 				</div>
 			</div>
 
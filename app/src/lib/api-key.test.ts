@@ -0,0 +1,16 @@
+import assert from "node:assert/strict";
+import { test } from "node:test";
+
+import { API_KEY_PREFIX, base32Encode, generateApiKey } from "./api-key.ts";
+
+test("base32Encode matches RFC 4648", () => {
+	assert.equal(base32Encode(new TextEncoder().encode("foobar")), "MZXW6YTBOI======");
+});
+
+test("generateApiKey issues prefixed tokens with their key ID", () => {
+	const { token, keyId } = generateApiKey();
+	// The format ParseApiKeyID in db/apikey.go accepts.
+	assert.match(token, /^sk-proxy-[a-z2-7]{12}_[A-Z2-7]{32}$/);
+	assert.equal(token.slice(API_KEY_PREFIX.length).split("_")[0], keyId);
+	assert.notEqual(generateApiKey().keyId, keyId);
+});
@@ -0,0 +1,45 @@
+import { randomBytes } from "node:crypto";
+
+const BASE32_ALPHABET = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567";
+
+// Must match ApiKeyPrefix in db/apikey.go, the proxy looks keys up by the ID
+// between the prefix and the underscore.
+export const API_KEY_PREFIX = "sk-proxy-";
+
+export function base32Encode(bytes: Uint8Array) {
+	let output = "";
+	let value = 0;
+	let bits = 0;
+
+	for (const byte of bytes) {
+		value = (value << 8) | byte;
+		bits += 8;
+		while (bits >= 5) {
+			output += BASE32_ALPHABET[(value >>> (bits - 5)) & 31];
+			bits -= 5;
+		}
+	}
+
+	if (bits > 0) {
+		output += BASE32_ALPHABET[(value << (5 - bits)) & 31];
+	}
+
+	while (output.length % 8 !== 0) {
+		output += "=";
+	}
+
+	return output;
+}
+
+function randomToken(length: number) {
+	return base32Encode(randomBytes(32)).slice(0, length);
+}
+
+// generateApiKey creates the token of a new key like db.GenerateApiKey:
+// sk-proxy-<key id>_<secret>. The token is shown once, the key ID is stored
+// next to the bcrypt hash of the token.
+export function generateApiKey() {
+	const keyId = randomToken(12).toLowerCase();
+	const token = `${API_KEY_PREFIX}${keyId}_${randomToken(32)}`;
+	return { token, keyId };
+}
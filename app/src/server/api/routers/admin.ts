@@ -50,12 +50,21 @@ export const adminRouter = createTRPCRouter({
 				? sql`${requests.requestTime} >= ${since}`
 				: undefined;
 
+			// Cache hits are billed as zero, like in db/database.go.
 			const totalBase = ctx.db
 				.select({
 					totalTokens:
-						sql<number>`coalesce(sum(${requests.inputTokenCount} + ${requests.outputTokenCount}), 0)`.as(
+						sql<number>`coalesce(sum(${requests.inputTokenCount} + ${requests.outputTokenCount}) filter (where not ${requests.responseCacheHit}), 0)`.as(
 							"totalTokens",
 						),
+					cacheHits:
+						sql<number>`count(${requests.id}) filter (where ${requests.responseCacheHit})`.as(
+							"cacheHits",
+						),
+					savedTokens:
+						sql<number>`coalesce(sum(${requests.inputTokenCount} + ${requests.outputTokenCount}) filter (where ${requests.responseCacheHit}), 0)`.as(
+							"savedTokens",
+						),
 				})
 				.from(requests);
 			const totalRow = await (requestTimeFilter
@@ -66,7 +75,7 @@ export const adminRouter = createTRPCRouter({
 				.select({
 					model: requests.model,
 					tokens:
-						sql<number>`coalesce(sum(${requests.inputTokenCount} + ${requests.outputTokenCount}), 0)`.as(
+						sql<number>`coalesce(sum(${requests.inputTokenCount} + ${requests.outputTokenCount}) filter (where not ${requests.responseCacheHit}), 0)`.as(
 							"tokens",
 						),
 				})
@@ -85,22 +94,22 @@ export const adminRouter = createTRPCRouter({
 					id: users.id,
 					name: users.name,
 					inputTokens:
-						sql<number>`coalesce(sum(${requests.inputTokenCount} - ${requests.cachedInputTokenCount}), 0)`.as(
+						sql<number>`coalesce(sum(${requests.inputTokenCount} - ${requests.cachedInputTokenCount}) filter (where not ${requests.responseCacheHit}), 0)`.as(
 							"inputTokens",
 						),
 					cachedTokens:
-						sql<number>`coalesce(sum(${requests.cachedInputTokenCount}), 0)`.as(
+						sql<number>`coalesce(sum(${requests.cachedInputTokenCount}) filter (where not ${requests.responseCacheHit}), 0)`.as(
 							"cachedTokens",
 						),
 					outputTokens:
-						sql<number>`coalesce(sum(${requests.outputTokenCount}), 0)`.as(
+						sql<number>`coalesce(sum(${requests.outputTokenCount}) filter (where not ${requests.responseCacheHit}), 0)`.as(
 							"outputTokens",
 						),
 					lastActivity: sql<string | null>`max(${requests.requestTime})`.as(
 						"lastActivity",
 					),
 					totalTokens:
-						sql<number>`coalesce(sum(${requests.inputTokenCount} + ${requests.outputTokenCount}), 0)`.as(
+						sql<number>`coalesce(sum(${requests.inputTokenCount} + ${requests.outputTokenCount}) filter (where not ${requests.responseCacheHit}), 0)`.as(
 							"totalTokens",
 						),
 				})
@@ -109,13 +118,15 @@ export const adminRouter = createTRPCRouter({
 				.leftJoin(requests, requestsJoin)
 				.groupBy(users.id, users.name)
 				.orderBy(
-					sql`coalesce(sum(${requests.inputTokenCount} + ${requests.outputTokenCount}), 0) desc`,
+					sql`coalesce(sum(${requests.inputTokenCount} + ${requests.outputTokenCount}) filter (where not ${requests.responseCacheHit}), 0) desc`,
 				);
 
 			const totalTokens = Number(totalRow[0]?.totalTokens ?? 0);
 
 			return {
 				totalTokens,
+				cacheHits: Number(totalRow[0]?.cacheHits ?? 0),
+				savedTokens: Number(totalRow[0]?.savedTokens ?? 0),
 				modelUsage: modelRows
 					.map((row) => ({
 						model: row.model ?? "Unknown",
@@ -1,40 +1,15 @@
-import { randomBytes, randomUUID } from "node:crypto";
+import { randomUUID } from "node:crypto";
 import { TRPCError } from "@trpc/server";
 import { hash } from "bcryptjs";
-import { and, eq, sql } from "drizzle-orm";
+import { and, eq, isNull, sql } from "drizzle-orm";
 import { z } from "zod";
 
+import { generateApiKey } from "~/lib/api-key";
 import { createTRPCRouter, protectedProcedure } from "~/server/api/trpc";
 import { apikeys, costs, requests, users } from "~/server/db/schema";
 
-const BASE32_ALPHABET = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567";
 const DEFAULT_AIAPI = "openai";
 
-function base32Encode(bytes: Uint8Array) {
-	let output = "";
-	let value = 0;
-	let bits = 0;
-
-	for (const byte of bytes) {
-		value = (value << 8) | byte;
-		bits += 8;
-		while (bits >= 5) {
-			output += BASE32_ALPHABET[(value >>> (bits - 5)) & 31];
-			bits -= 5;
-		}
-	}
-
-	if (bits > 0) {
-		output += BASE32_ALPHABET[(value << (5 - bits)) & 31];
-	}
-
-	while (output.length % 8 !== 0) {
-		output += "=";
-	}
-
-	return output;
-}
-
 export const apiKeyRouter = createTRPCRouter({
 	getApiKeys: protectedProcedure.query(async ({ ctx }) => {
 		const userId = ctx.session.user.id;
@@ -46,18 +21,27 @@ export const apiKeyRouter = createTRPCRouter({
 				description: apikeys.description,
 				deactivated: apikeys.deactivated,
 				model: requests.model,
+				// Cache hits are billed as zero, like in db/database.go.
 				inputTokens:
-					sql<number>`coalesce(sum(${requests.inputTokenCount} - ${requests.cachedInputTokenCount}), 0)`.as(
+					sql<number>`coalesce(sum(${requests.inputTokenCount} - ${requests.cachedInputTokenCount}) filter (where not ${requests.responseCacheHit}), 0)`.as(
 						"inputTokens",
 					),
 				cachedInputTokens:
-					sql<number>`coalesce(sum(${requests.cachedInputTokenCount}), 0)`.as(
+					sql<number>`coalesce(sum(${requests.cachedInputTokenCount}) filter (where not ${requests.responseCacheHit}), 0)`.as(
 						"cachedInputTokens",
 					),
 				outputTokens:
-					sql<number>`coalesce(sum(${requests.outputTokenCount}), 0)`.as(
+					sql<number>`coalesce(sum(${requests.outputTokenCount}) filter (where not ${requests.responseCacheHit}), 0)`.as(
 						"outputTokens",
 					),
+				cacheHits:
+					sql<number>`count(${requests.id}) filter (where ${requests.responseCacheHit})`.as(
+						"cacheHits",
+					),
+				savedTokens:
+					sql<number>`coalesce(sum(${requests.inputTokenCount} + ${requests.outputTokenCount}) filter (where ${requests.responseCacheHit}), 0)`.as(
+						"savedTokens",
+					),
 				createdAt: sql<string | null>`min(${requests.requestTime})`.as(
 					"createdAt",
 				),
@@ -65,7 +49,7 @@ export const apiKeyRouter = createTRPCRouter({
 			.from(apikeys)
 			.innerJoin(users, eq(apikeys.owner, users.id))
 			.leftJoin(requests, eq(apikeys.uuid, requests.apiKeyId))
-			.where(eq(users.id, userId))
+			.where(and(eq(users.id, userId), isNull(apikeys.archivedAt)))
 			.groupBy(
 				apikeys.uuid,
 				apikeys.description,
@@ -180,6 +164,8 @@ export const apiKeyRouter = createTRPCRouter({
 				inputTokens: number;
 				cachedInputTokens: number;
 				outputTokens: number;
+				cacheHits: number;
+				savedTokens: number;
 				createdAt: string | null;
 				models: Array<{
 					model: string;
@@ -203,6 +189,8 @@ export const apiKeyRouter = createTRPCRouter({
 				inputTokens: 0,
 				cachedInputTokens: 0,
 				outputTokens: 0,
+				cacheHits: 0,
+				savedTokens: 0,
 				createdAt: row.createdAt ?? null,
 				models: [],
 				cost: 0,
@@ -216,6 +204,8 @@ export const apiKeyRouter = createTRPCRouter({
 			entry.inputTokens += inputTokens;
 			entry.cachedInputTokens += cachedInputTokens;
 			entry.outputTokens += outputTokens;
+			entry.cacheHits += Number(row.cacheHits ?? 0);
+			entry.savedTokens += Number(row.savedTokens ?? 0);
 			if (!entry.createdAt) entry.createdAt = row.createdAt ?? null;
 
 			const model = row.model ?? "Unknown";
@@ -278,6 +268,8 @@ export const apiKeyRouter = createTRPCRouter({
 			inputTokens: row.inputTokens,
 			cachedInputTokens: row.cachedInputTokens,
 			outputTokens: row.outputTokens,
+			cacheHits: row.cacheHits,
+			savedTokens: row.savedTokens,
 			createdAt: row.createdAt ?? null,
 			cost: row.cost,
 			currency: row.currency ?? null,
@@ -313,7 +305,7 @@ export const apiKeyRouter = createTRPCRouter({
 				throw new TRPCError({ code: "UNAUTHORIZED" });
 			}
 
-			const token = base32Encode(randomBytes(32)).slice(0, 32);
+			const { token, keyId } = generateApiKey();
 			const hashed = await hash(token, 5);
 			const id = randomUUID();
 
@@ -322,6 +314,7 @@ export const apiKeyRouter = createTRPCRouter({
 			await ctx.db.insert(apikeys).values({
 				uuid: id,
 				apikey: hashed,
+				keyId,
 				owner,
 				aiapi: DEFAULT_AIAPI,
 				description: input.description?.trim() || null,
@@ -417,6 +417,8 @@ export const reportingRouter = createTRPCRouter({
 							outputTokens: 0,
 							totalCost: 0,
 							currency: "EUR",
+							cacheHits: 0,
+							savedTokens: 0,
 						},
 						modelUsage: [],
 						users: [],
@@ -436,18 +438,27 @@ export const reportingRouter = createTRPCRouter({
 					userId: users.id,
 					name: users.name,
 					model: requests.model,
+					// Cache hits are billed as zero, like in db/database.go.
 					inputTokens:
-						sql<number>`coalesce(sum(${requests.inputTokenCount} - ${requests.cachedInputTokenCount}), 0)`.as(
+						sql<number>`coalesce(sum(${requests.inputTokenCount} - ${requests.cachedInputTokenCount}) filter (where not ${requests.responseCacheHit}), 0)`.as(
 							"inputTokens",
 						),
 					cachedInputTokens:
-						sql<number>`coalesce(sum(${requests.cachedInputTokenCount}), 0)`.as(
+						sql<number>`coalesce(sum(${requests.cachedInputTokenCount}) filter (where not ${requests.responseCacheHit}), 0)`.as(
 							"cachedInputTokens",
 						),
 					outputTokens:
-						sql<number>`coalesce(sum(${requests.outputTokenCount}), 0)`.as(
+						sql<number>`coalesce(sum(${requests.outputTokenCount}) filter (where not ${requests.responseCacheHit}), 0)`.as(
 							"outputTokens",
 						),
+					cacheHits:
+						sql<number>`count(${requests.id}) filter (where ${requests.responseCacheHit})`.as(
+							"cacheHits",
+						),
+					savedTokens:
+						sql<number>`coalesce(sum(${requests.inputTokenCount} + ${requests.outputTokenCount}) filter (where ${requests.responseCacheHit}), 0)`.as(
+							"savedTokens",
+						),
 				})
 				.from(users)
 				.leftJoin(apikeys, eq(apikeys.owner, users.id))
@@ -583,7 +594,11 @@ export const reportingRouter = createTRPCRouter({
 				};
 			};
 
-			const scopedConditions = [timeFilter];
+			// The charts show billed usage, cache hits are billed as zero.
+			const scopedConditions = [
+				timeFilter,
+				sql`not ${requests.responseCacheHit}`,
+			];
 			if (scopedUserIds) {
 				scopedConditions.push(inArray(apikeys.owner, scopedUserIds));
 			}
@@ -801,6 +816,8 @@ export const reportingRouter = createTRPCRouter({
 			let totalOutputTokens = 0;
 			let totalCost = 0;
 			let totalCurrency: string | null = null;
+			let totalCacheHits = 0;
+			let totalSavedTokens = 0;
 
 			for (const row of usageRows) {
 				const id = row.userId;
@@ -826,6 +843,8 @@ export const reportingRouter = createTRPCRouter({
 				totalInputTokens += inputTokens;
 				totalCachedTokens += cachedTokens;
 				totalOutputTokens += outputTokens;
+				totalCacheHits += Number(row.cacheHits ?? 0);
+				totalSavedTokens += Number(row.savedTokens ?? 0);
 
 				const model = row.model ?? null;
 				if (model && inputTokens + cachedTokens + outputTokens > 0) {
@@ -919,6 +938,8 @@ export const reportingRouter = createTRPCRouter({
 					outputTokens: totalOutputTokens,
 					totalCost: totalCost ?? null,
 					currency: totalCurrency ?? null,
+					cacheHits: totalCacheHits,
+					savedTokens: totalSavedTokens,
 				},
 				modelUsage: Array.from(modelTotals.entries())
 					.map(([model, outputTokens]) => ({
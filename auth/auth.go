@@ -63,12 +63,20 @@ func Init(mux *http.ServeMux, db *db.Database) (a *Auth) {
 	}
 
 	var verifier = provider.Verifier(&oidc.Config{ClientID: clientId})
+	// Access tokens for the management API, e.g. from the client credentials
+	// flow of a CI pipeline, are issued for their own audience.
+	audience, ok := os.LookupEnv("MANAGE_OIDC_AUDIENCE")
+	if !ok || audience == "" {
+		audience = clientId
+	}
+	var bearerVerifier = provider.Verifier(&oidc.Config{ClientID: audience})
 
 	a = &Auth{
 		oauth2Config: oauth2Config,
 		db:           db,
 		ctx:          context.Background(),
 		verifier:     verifier,
+		bearer:       bearerVerifier,
 		provider:     provider,
 		claims:       claims,
 	}
@@ -94,6 +102,7 @@ type Auth struct {
 	db           *db.Database
 	ctx          context.Context
 	verifier     *oidc.IDTokenVerifier
+	bearer       *oidc.IDTokenVerifier // access tokens for the management API
 	provider     *oidc.Provider
 	claims       *ProviderClaims
 }
@@ -197,6 +206,25 @@ func (n *NotAdmin) Error() string {
 	return fmt.Sprintf("User %s has no Admin Role", n.uid)
 }
 
+// VerifyBearer verifies a JWT access token for MANAGE_OIDC_AUDIENCE and
+// returns its claims. The token must carry the admin role.
+func (a *Auth) VerifyBearer(ctx context.Context, rawToken string) (*Claims, error) {
+	token, err := a.bearer.Verify(ctx, rawToken)
+	if err != nil {
+		return nil, err
+	}
+	claims := &Claims{}
+	if err := token.Claims(claims); err != nil {
+		return nil, err
+	}
+	for _, role := range claims.Roles {
+		if role == "admin" {
+			return claims, nil
+		}
+	}
+	return nil, &NotAdmin{uid: claims.Sub}
+}
+
 func (a *Auth) ValidateAdminSession(w http.ResponseWriter, r *http.Request) (bool, error) {
 	authenticated := a.ValidateSessionToken(w, r)
 	if !authenticated {
@@ -0,0 +1,302 @@
+// Code generated by openapi/cmd/clientgen from openapi/openapi.json. DO NOT EDIT.
+
+package client
+
+import (
+	"context"
+	"net/url"
+	"time"
+)
+
+// ApiKey is a key of the proxy. Its secret is only known when it is issued.
+type ApiKey struct {
+	// UUID of the key.
+	ID string `json:"id"`
+	// ID of the owning user or team service account.
+	Owner            string     `json:"owner"`
+	OwnerName        string     `json:"owner_name,omitempty"`
+	Description      string     `json:"description"`
+	Deactivated      bool       `json:"deactivated"`
+	Archived         bool       `json:"archived"`
+	ExpiresAt        *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt       *time.Time `json:"last_used_at,omitempty"`
+	AllowedModels    []string   `json:"allowed_models,omitempty"`
+	AllowedEndpoints []string   `json:"allowed_endpoints,omitempty"`
+	AllowedCIDRs     []string   `json:"allowed_cidrs,omitempty"`
+	// Prompts and completions of the key are stored in the audit log.
+	AuditContent bool `json:"audit_content"`
+	// Requests of the key are never answered from the response cache.
+	ResponseCacheOptOut bool `json:"response_cache_opt_out"`
+	// The key to send to the proxy, only returned by createKey and rotateKey.
+	Secret string `json:"secret,omitempty"`
+	// End of the grace period of the previous secret, only returned by rotateKey.
+	GraceUntil *time.Time `json:"grace_until,omitempty"`
+}
+
+// ApiKeyList is a list of keys.
+type ApiKeyList struct {
+	Data []ApiKey `json:"data"`
+}
+
+// CreateKeyRequest is the body of createKey.
+type CreateKeyRequest struct {
+	// ID of an existing user or team service account (team:<group id>).
+	Owner       string     `json:"owner"`
+	Description string     `json:"description,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	// A trailing * matches a prefix.
+	AllowedModels []string `json:"allowed_models,omitempty"`
+	// Paths below /v1, e.g. chat/completions.
+	AllowedEndpoints []string `json:"allowed_endpoints,omitempty"`
+	// Networks in CIDR notation or single addresses.
+	AllowedCIDRs []string `json:"allowed_cidrs,omitempty"`
+}
+
+// Error is the body of every failed request.
+type Error struct {
+	Error ErrorDetail `json:"error"`
+}
+
+// ErrorDetail describes why a request failed.
+type ErrorDetail struct {
+	Message string `json:"message"`
+	// Machine readable cause, e.g. not_found or insufficient_scope.
+	Code string `json:"code"`
+}
+
+// KeyUsage is the token usage of a single key.
+type KeyUsage struct {
+	// UUID of the key.
+	Key               string  `json:"key"`
+	Description       string  `json:"description"`
+	InputTokens       int     `json:"input_tokens"`
+	CachedInputTokens int     `json:"cached_input_tokens"`
+	OutputTokens      int     `json:"output_tokens"`
+	CacheRatioPercent float64 `json:"cache_ratio_percent"`
+	// Requests answered from the response cache, not part of the token counts.
+	ResponseCacheHits int `json:"response_cache_hits"`
+	// Tokens of the requests answered from the response cache, which are billed as zero.
+	SavedTokens int `json:"saved_tokens"`
+}
+
+// KeyUsageList is the usage per key of a user.
+type KeyUsageList struct {
+	Data []KeyUsage `json:"data"`
+}
+
+// LogLevel is the level of the proxy logs.
+type LogLevel struct {
+	// trace also logs request and response content.
+	Level string `json:"level"`
+}
+
+// Model is a configured model and where its requests are routed to.
+type Model struct {
+	ID string `json:"id"`
+	// Name of the backend, the default backend if empty.
+	Backend string `json:"backend,omitempty"`
+	// Model name sent upstream.
+	Deployment string `json:"deployment,omitempty"`
+	// Azure resource host.
+	ResourceHost string `json:"resource_host,omitempty"`
+	// Azure api-version.
+	ApiVersion string `json:"api_version,omitempty"`
+	// Provider key, never returned.
+	ApiKey    string `json:"api_key,omitempty"`
+	HasApiKey *bool  `json:"has_api_key,omitempty"`
+	Weight    int    `json:"weight,omitempty"`
+	Balance   string `json:"balance,omitempty"`
+	// Prompts and completions of the model are stored in the audit log.
+	AuditContent *bool `json:"audit_content,omitempty"`
+}
+
+// ModelList is a list of models.
+type ModelList struct {
+	Data []Model `json:"data"`
+}
+
+// ProxyModel is a model in the format of the OpenAI API.
+type ProxyModel struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+}
+
+// ProxyModelList is a list of models in the format of the OpenAI API.
+type ProxyModelList struct {
+	Object string       `json:"object"`
+	Data   []ProxyModel `json:"data"`
+}
+
+// RotateKeyRequest is the body of rotateKey.
+type RotateKeyRequest struct {
+	// Go duration the previous secret stays valid, e.g. 1h. Defaults to API_KEY_ROTATION_GRACE.
+	Grace string `json:"grace,omitempty"`
+}
+
+// UpdateKeyRequest is the body of updateKey. Fields that are not set are kept.
+type UpdateKeyRequest struct {
+	Deactivated *bool `json:"deactivated,omitempty"`
+	// Store prompts and completions of the key in the audit log.
+	AuditContent *bool `json:"audit_content,omitempty"`
+	// Never answer requests of the key from the response cache.
+	ResponseCacheOptOut *bool `json:"response_cache_opt_out,omitempty"`
+}
+
+// UserUsage is the token usage of all keys of a user or team.
+type UserUsage struct {
+	User string `json:"user"`
+	Name string `json:"name"`
+	// The user is the service account of a team.
+	Team              bool    `json:"team"`
+	InputTokens       int     `json:"input_tokens"`
+	CachedInputTokens int     `json:"cached_input_tokens"`
+	OutputTokens      int     `json:"output_tokens"`
+	CacheRatioPercent float64 `json:"cache_ratio_percent"`
+	// Requests answered from the response cache, not part of the token counts.
+	ResponseCacheHits int `json:"response_cache_hits"`
+	// Tokens of the requests answered from the response cache, which are billed as zero.
+	SavedTokens int `json:"saved_tokens"`
+}
+
+// UserUsageList is the usage per user.
+type UserUsageList struct {
+	Data []UserUsage `json:"data"`
+}
+
+// ListProxyModels lists the models the proxy key may use, in the format of the OpenAI API.
+func (c *Client) ListProxyModels(ctx context.Context) (*ProxyModelList, error) {
+	var out ProxyModelList
+	if err := c.do(ctx, "GET", "/api/v1/models", nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetProxyModel returns a model the proxy key may use, in the format of the OpenAI API.
+func (c *Client) GetProxyModel(ctx context.Context, id string) (*ProxyModel, error) {
+	var out ProxyModel
+	if err := c.do(ctx, "GET", "/api/v1/models/"+url.PathEscape(id), nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ListKeys lists all keys that are not archived.
+func (c *Client) ListKeys(ctx context.Context) (*ApiKeyList, error) {
+	var out ApiKeyList
+	if err := c.do(ctx, "GET", "/manage/v1/keys", nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// CreateKey issues a key for a user or team service account. The secret is only part of this response.
+func (c *Client) CreateKey(ctx context.Context, body *CreateKeyRequest) (*ApiKey, error) {
+	var out ApiKey
+	if err := c.do(ctx, "POST", "/manage/v1/keys", jsonBody(body), &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// DeleteKey archives a key. Archived keys are rejected by the proxy and can be restored in the admin view.
+func (c *Client) DeleteKey(ctx context.Context, id string) error {
+	return c.do(ctx, "DELETE", "/manage/v1/keys/"+url.PathEscape(id), nil, nil)
+}
+
+// GetKey returns a key, archived or not.
+func (c *Client) GetKey(ctx context.Context, id string) (*ApiKey, error) {
+	var out ApiKey
+	if err := c.do(ctx, "GET", "/manage/v1/keys/"+url.PathEscape(id), nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// UpdateKey deactivates or reactivates a key and switches the capture of its prompts and completions in the audit log.
+func (c *Client) UpdateKey(ctx context.Context, id string, body *UpdateKeyRequest) (*ApiKey, error) {
+	var out ApiKey
+	if err := c.do(ctx, "PATCH", "/manage/v1/keys/"+url.PathEscape(id), jsonBody(body), &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// RotateKey issues a new secret for a key. The previous secret stays valid for the grace period.
+func (c *Client) RotateKey(ctx context.Context, id string, body *RotateKeyRequest) (*ApiKey, error) {
+	var out ApiKey
+	if err := c.do(ctx, "POST", "/manage/v1/keys/"+url.PathEscape(id)+"/rotate", jsonBody(body), &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetLogLevel returns the log level of the proxy.
+func (c *Client) GetLogLevel(ctx context.Context) (*LogLevel, error) {
+	var out LogLevel
+	if err := c.do(ctx, "GET", "/manage/v1/log-level", nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// SetLogLevel changes the log level until the next restart, which goes back to LOG_LEVEL.
+func (c *Client) SetLogLevel(ctx context.Context, body *LogLevel) (*LogLevel, error) {
+	var out LogLevel
+	if err := c.do(ctx, "PUT", "/manage/v1/log-level", jsonBody(body), &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ListModels lists the configured models.
+func (c *Client) ListModels(ctx context.Context) (*ModelList, error) {
+	var out ModelList
+	if err := c.do(ctx, "GET", "/manage/v1/models", nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// PutModel adds a model or replaces its routing. An empty api_key keeps the stored provider key.
+func (c *Client) PutModel(ctx context.Context, body *Model) (*Model, error) {
+	var out Model
+	if err := c.do(ctx, "POST", "/manage/v1/models", jsonBody(body), &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// DeleteModel removes a model.
+func (c *Client) DeleteModel(ctx context.Context, id string) error {
+	return c.do(ctx, "DELETE", "/manage/v1/models/"+url.PathEscape(id), nil, nil)
+}
+
+// GetModel returns a configured model.
+func (c *Client) GetModel(ctx context.Context, id string) (*Model, error) {
+	var out Model
+	if err := c.do(ctx, "GET", "/manage/v1/models/"+url.PathEscape(id), nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ListUsage returns the token usage per user and team.
+func (c *Client) ListUsage(ctx context.Context) (*UserUsageList, error) {
+	var out UserUsageList
+	if err := c.do(ctx, "GET", "/manage/v1/usage", nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetUserUsage returns the token usage per key of a user.
+func (c *Client) GetUserUsage(ctx context.Context, user string) (*KeyUsageList, error) {
+	var out KeyUsageList
+	if err := c.do(ctx, "GET", "/manage/v1/usage/"+url.PathEscape(user), nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
@@ -0,0 +1,152 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newServer serves handler and checks the bearer token of every request.
+func newServer(t *testing.T, handler http.HandlerFunc) *Client {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer sk-admin-test" {
+			t.Errorf("Authorization = %q", got)
+		}
+		handler(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return New(srv.URL+"/", "sk-admin-test", WithHTTPClient(srv.Client()))
+}
+
+func TestCreateKey(t *testing.T) {
+	expires := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/manage/v1/keys" {
+			t.Errorf("got %s %s", r.Method, r.URL.Path)
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type = %q", ct)
+		}
+		var req map[string]any
+		json.NewDecoder(r.Body).Decode(&req)
+		if req["owner"] != "alice" || req["expires_at"] != "2030-01-01T00:00:00Z" {
+			t.Errorf("request body = %v", req)
+		}
+		if _, ok := req["description"]; ok {
+			t.Error("empty description was sent")
+		}
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, `{"id":"k1","owner":"alice","description":"","deactivated":false,"archived":false,
+			"expires_at":"2030-01-01T00:00:00Z","allowed_models":["gpt-4o"],"secret":"sk-proxy-abc_def"}`)
+	})
+
+	key, err := c.CreateKey(context.Background(), &CreateKeyRequest{Owner: "alice", ExpiresAt: &expires})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.ID != "k1" || key.Secret != "sk-proxy-abc_def" || len(key.AllowedModels) != 1 {
+		t.Errorf("key = %+v", key)
+	}
+	if key.ExpiresAt == nil || !key.ExpiresAt.Equal(expires) {
+		t.Errorf("expires_at = %v", key.ExpiresAt)
+	}
+	if key.LastUsedAt != nil {
+		t.Errorf("last_used_at = %v, want nil", key.LastUsedAt)
+	}
+}
+
+func TestUpdateKey(t *testing.T) {
+	c := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPatch || r.URL.Path != "/manage/v1/keys/k1" {
+			t.Errorf("got %s %s", r.Method, r.URL.Path)
+		}
+		b, _ := io.ReadAll(r.Body)
+		if string(b) != `{"deactivated":false}` {
+			t.Errorf("request body = %s", b)
+		}
+		io.WriteString(w, `{"id":"k1","owner":"alice","description":"","deactivated":false,"archived":false}`)
+	})
+	off := false
+	if _, err := c.UpdateKey(context.Background(), "k1", &UpdateKeyRequest{Deactivated: &off}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRotateKeyWithoutBody(t *testing.T) {
+	c := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/manage/v1/keys/k1/rotate" {
+			t.Errorf("path = %s", r.URL.Path)
+		}
+		if b, _ := io.ReadAll(r.Body); len(b) != 0 {
+			t.Errorf("request body = %s, want none", b)
+		}
+		io.WriteString(w, `{"id":"k1","owner":"alice","description":"","deactivated":false,"archived":false,
+			"secret":"sk-proxy-new_secret","grace_until":"2030-01-01T00:00:00Z"}`)
+	})
+	key, err := c.RotateKey(context.Background(), "k1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Secret != "sk-proxy-new_secret" || key.GraceUntil == nil {
+		t.Errorf("key = %+v", key)
+	}
+}
+
+func TestDeleteModelEscapesID(t *testing.T) {
+	c := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete || r.URL.EscapedPath() != "/manage/v1/models/openai%2Fgpt-4o" {
+			t.Errorf("got %s %s", r.Method, r.URL.EscapedPath())
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	if err := c.DeleteModel(context.Background(), "openai/gpt-4o"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListUsage(t *testing.T) {
+	c := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"data":[{"user":"team:3","name":"Platform","team":true,"input_tokens":100,
+			"cached_input_tokens":25,"output_tokens":7,"cache_ratio_percent":25}]}`)
+	})
+	usage, err := c.ListUsage(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usage.Data) != 1 || !usage.Data[0].Team || usage.Data[0].CacheRatioPercent != 25 {
+		t.Errorf("usage = %+v", usage)
+	}
+}
+
+func TestAPIError(t *testing.T) {
+	c := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, `{"error":{"message":"the token is limited to read access","code":"insufficient_scope"}}`)
+	})
+	err := c.DeleteKey(context.Background(), "k1")
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("err = %v, want *APIError", err)
+	}
+	if apiErr.StatusCode != http.StatusForbidden || apiErr.Code != "insufficient_scope" {
+		t.Errorf("err = %+v", apiErr)
+	}
+}
+
+func TestAPIErrorWithoutJSON(t *testing.T) {
+	c := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "401 - Token Invalid", http.StatusUnauthorized)
+	})
+	_, err := c.ListProxyModels(context.Background())
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized || apiErr.Message != "401 - Token Invalid" {
+		t.Errorf("err = %v", err)
+	}
+}
@@ -7,6 +7,8 @@ import (
 	proxy "openai-api-proxy/apiproxy"
 	auth "openai-api-proxy/auth"
 	db "openai-api-proxy/db"
+	"openai-api-proxy/logging"
+	manage "openai-api-proxy/manage"
 	web "openai-api-proxy/webui"
 	"os"
 	"os/signal"
@@ -21,6 +23,7 @@ func main() {
 	if err != nil {
 		log.Println("Warning: not able to loading Env File", err)
 	}
+	logging.Setup()
 	db := db.DatabaseInit()
 	defer db.Close()
 
@@ -33,6 +36,7 @@ func main() {
 	proxy.Init(mux, db)     // Start AI Proxy
 	web.Init(mux, a)        // Start Web UI
 	api.ApiInit(mux, a, db) // Start Backend API
+	manage.Init(mux, a, db) // Start Management API
 
 	log.Printf("Serving on http://localhost:%d", 8082)
 	log.Fatal(http.ListenAndServe(":8082", mux))
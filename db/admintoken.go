@@ -0,0 +1,124 @@
+package database
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+// Scopes of an admin token. A write token may read as well.
+const (
+	AdminScopeRead  = "read"
+	AdminScopeWrite = "write"
+)
+
+// adminTokenPrefix marks tokens for the management API, so they are not
+// mistaken for proxy keys.
+const adminTokenPrefix = "sk-admin-"
+
+// AdminToken authenticates scripts against the management API.
+type AdminToken struct {
+	ID         int64
+	Name       string
+	Scope      string // AdminScopeRead or AdminScopeWrite
+	CreatedBy  string
+	CreatedAt  time.Time
+	ExpiresAt  time.Time // zero for tokens that do not expire
+	LastUsedAt time.Time
+	RevokedAt  time.Time
+}
+
+// Active reports whether the token is neither revoked nor expired.
+func (t AdminToken) Active() bool {
+	return t.RevokedAt.IsZero() && (t.ExpiresAt.IsZero() || time.Now().Before(t.ExpiresAt))
+}
+
+// IsAdminToken reports whether token looks like an admin token.
+func IsAdminToken(token string) bool {
+	return strings.HasPrefix(token, adminTokenPrefix)
+}
+
+func hashAdminToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateAdminToken stores a new token and returns it. The token itself is
+// not stored and can not be shown again.
+func (d *Database) CreateAdminToken(t *AdminToken) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := adminTokenPrefix + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b))
+	err := d.db.QueryRow(`
+		INSERT INTO admin_tokens (name, token_hash, scope, created_by, expires_at)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at`,
+		t.Name, hashAdminToken(token), t.Scope, nullOrString(t.CreatedBy), nullOrTime(t.ExpiresAt),
+	).Scan(&t.ID, &t.CreatedAt)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+const adminTokenColumns = `id, name, scope, COALESCE(created_by, ''), created_at, expires_at, last_used_at, revoked_at`
+
+func scanAdminToken(row interface{ Scan(...any) error }) (*AdminToken, error) {
+	var t AdminToken
+	var expires, lastUsed, revoked sql.NullTime
+	if err := row.Scan(&t.ID, &t.Name, &t.Scope, &t.CreatedBy, &t.CreatedAt, &expires, &lastUsed, &revoked); err != nil {
+		return nil, err
+	}
+	t.ExpiresAt = expires.Time
+	t.LastUsedAt = lastUsed.Time
+	t.RevokedAt = revoked.Time
+	return &t, nil
+}
+
+// LookupAdminToken returns the token matching token, revoked or not, or
+// sql.ErrNoRows.
+func (d *Database) LookupAdminToken(token string) (*AdminToken, error) {
+	return scanAdminToken(d.db.QueryRow(`SELECT `+adminTokenColumns+` FROM admin_tokens WHERE token_hash = $1`,
+		hashAdminToken(token)))
+}
+
+// ListAdminTokens returns all tokens that are not revoked, newest first.
+func (d *Database) ListAdminTokens() ([]AdminToken, error) {
+	rows, err := d.db.Query(`SELECT ` + adminTokenColumns + ` FROM admin_tokens
+		WHERE revoked_at IS NULL ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []AdminToken
+	for rows.Next() {
+		t, err := scanAdminToken(rows)
+		if err != nil {
+			return tokens, err
+		}
+		tokens = append(tokens, *t)
+	}
+	return tokens, rows.Err()
+}
+
+// RevokeAdminToken revokes the token with the given ID. It returns
+// sql.ErrNoRows if there is no such active token.
+func (d *Database) RevokeAdminToken(id int64) error {
+	res, err := d.db.Exec(`UPDATE admin_tokens SET revoked_at = now() WHERE id = $1 AND revoked_at IS NULL`, id)
+	if err != nil {
+		return err
+	}
+	return expectRows(res)
+}
+
+// TouchAdminToken records the last use of a token.
+func (d *Database) TouchAdminToken(id int64, at time.Time) error {
+	_, err := d.db.Exec(`UPDATE admin_tokens SET last_used_at = $2 WHERE id = $1`, id, at)
+	return err
+}
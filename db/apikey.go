@@ -0,0 +1,402 @@
+package database
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"log"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ApiKeyPrefix starts every key issued as `sk-proxy-<key_id>_<secret>`. The
+// key ID is stored in clear text so a key can be fetched by an indexed lookup
+// and only its own hash has to be verified.
+const ApiKeyPrefix = "sk-proxy-"
+
+// FormatApiKey builds the token handed out to the user.
+func FormatApiKey(keyID, secret string) string {
+	return ApiKeyPrefix + keyID + "_" + secret
+}
+
+// GenerateApiKey creates a new key. token is shown to the user once, keyID
+// and the bcrypt hash are stored.
+func GenerateApiKey() (token, keyID, hash string, err error) {
+	keyID = strings.ToLower(randomToken(12))
+	token = FormatApiKey(keyID, randomToken(32))
+	b, err := bcrypt.GenerateFromPassword([]byte(token), 5)
+	if err != nil {
+		return "", "", "", err
+	}
+	return token, keyID, string(b), nil
+}
+
+// randomToken returns length random base32 characters, at most 51.
+func randomToken(length int) string {
+	randomBytes := make([]byte, 32)
+	if _, err := rand.Read(randomBytes); err != nil {
+		panic(err)
+	}
+	return base32.StdEncoding.EncodeToString(randomBytes)[:length]
+}
+
+// ValidateCIDR checks an entry of an allowed_cidrs list, a network in CIDR
+// notation or a single address.
+func ValidateCIDR(s string) error {
+	var err error
+	if strings.Contains(s, "/") {
+		_, err = netip.ParsePrefix(s)
+	} else {
+		_, err = netip.ParseAddr(s)
+	}
+	return err
+}
+
+// ParseApiKeyID returns the key ID of a prefixed token. ok is false for
+// legacy tokens without prefix.
+func ParseApiKeyID(token string) (keyID string, ok bool) {
+	rest, found := strings.CutPrefix(token, ApiKeyPrefix)
+	if !found {
+		return "", false
+	}
+	keyID, secret, found := strings.Cut(rest, "_")
+	if !found || keyID == "" || secret == "" {
+		return "", false
+	}
+	return keyID, true
+}
+
+// apiKeyAuthColumns are the columns needed to authenticate a key, selected
+// from apiKeys a joined with the users u owning them. They follow the secret
+// columns, either currentSecretColumns or rotatedSecretColumns.
+const apiKeyAuthColumns = `a.UUID, a.Owner, a.Deactivated, a.archived_at IS NOT NULL,
+	a.rpm_limit, a.tpm_limit, u.rpm_limit, u.tpm_limit,
+	a.expires_at, a.allowed_models, a.allowed_endpoints, a.allowed_cidrs, a.audit_content,
+	a.response_cache_opt_out,
+	COALESCE(u.service_group_id, (SELECT min(m.group_id) FROM reporting_group_members m WHERE m.user_id = a.Owner))`
+
+const (
+	currentSecretColumns = "0::bigint, a.ApiKey, a.key_id, NULL::timestamptz, "
+	currentSecretFrom    = " FROM apiKeys a LEFT JOIN users u ON u.id = a.Owner"
+	rotatedSecretColumns = "s.id, s.apikey, s.key_id, s.expires_at, "
+	rotatedSecretFrom    = ` FROM apikey_secrets s JOIN apiKeys a ON a.UUID = s.api_key_id
+		LEFT JOIN users u ON u.id = a.Owner WHERE s.expires_at > now()`
+)
+
+func scanApiKeyAuth(row interface{ Scan(...any) error }) (*ApiKey, error) {
+	var a ApiKey
+	var keyID sql.NullString
+	var rpm, tpm, userRPM, userTPM sql.NullInt64
+	var expires, secretExpires sql.NullTime
+	var models, endpoints, cidrs sql.NullString
+	var group sql.NullInt64
+	if err := row.Scan(&a.SecretID, &a.ApiKey, &keyID, &secretExpires,
+		&a.UUID, &a.Owner, &a.Deactivated, &a.Archived,
+		&rpm, &tpm, &userRPM, &userTPM,
+		&expires, &models, &endpoints, &cidrs, &a.AuditContent,
+		&a.ResponseCacheOptOut, &group); err != nil {
+		return nil, err
+	}
+	a.KeyID = keyID.String
+	a.SecretExpiresAt = secretExpires.Time
+	a.RPMLimit = int(rpm.Int64)
+	a.TPMLimit = int(tpm.Int64)
+	a.UserRPMLimit = int(userRPM.Int64)
+	a.UserTPMLimit = int(userTPM.Int64)
+	a.ExpiresAt = expires.Time
+	a.AllowedModels = splitList(models.String)
+	a.AllowedEndpoints = splitList(endpoints.String)
+	a.AllowedCIDRs = splitList(cidrs.String)
+	a.ReportingGroup = group.Int64
+	return &a, nil
+}
+
+// LookupApiKeyByKeyID returns the key with the given public key ID or
+// sql.ErrNoRows. The key ID may also belong to a rotated secret that is still
+// in its grace period; SecretID and SecretExpiresAt are set then.
+func (d *Database) LookupApiKeyByKeyID(keyID string) (*ApiKey, error) {
+	a, err := scanApiKeyAuth(d.db.QueryRow(
+		"SELECT "+currentSecretColumns+apiKeyAuthColumns+currentSecretFrom+" WHERE a.key_id=$1", keyID,
+	))
+	if !errors.Is(err, sql.ErrNoRows) {
+		return a, err
+	}
+	return scanApiKeyAuth(d.db.QueryRow(
+		"SELECT "+rotatedSecretColumns+apiKeyAuthColumns+rotatedSecretFrom+" AND s.key_id=$1", keyID,
+	))
+}
+
+// RotateApiKey replaces the secret of the key uuid owned by user, or by a
+// team user manages, with the given key ID and hash. The previous secret
+// stays valid for grace and keeps its last use; with a grace of zero it stops
+// working immediately. It returns the end of the grace period or
+// sql.ErrNoRows if the key does not exist.
+func (d *Database) RotateApiKey(uuid, user, keyID, hash string, grace time.Duration) (time.Time, error) {
+	return d.rotateApiKey(uuid, user, keyID, hash, grace)
+}
+
+// RotationGrace is how long the previous secret of a rotated key stays
+// valid, see API_KEY_ROTATION_GRACE.
+func RotationGrace() time.Duration {
+	grace := 24 * time.Hour
+	if v, ok := os.LookupEnv("API_KEY_ROTATION_GRACE"); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			log.Printf("Invalid API_KEY_ROTATION_GRACE %q, using %s", v, grace)
+			return grace
+		}
+		grace = d
+	}
+	return grace
+}
+
+// RotateAnyApiKey is RotateApiKey without ownership check, for admins.
+func (d *Database) RotateAnyApiKey(uuid, keyID, hash string, grace time.Duration) (time.Time, error) {
+	return d.rotateApiKey(uuid, "", keyID, hash, grace)
+}
+
+// rotateApiKey rotates the key uuid, if user is set only when user may
+// manage it.
+func (d *Database) rotateApiKey(uuid, user, keyID, hash string, grace time.Duration) (time.Time, error) {
+	owned, args := "true", []any{uuid}
+	if user != "" {
+		owned, args = ownedBy(2), append(args, user)
+	}
+	tx, err := d.db.Begin()
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer tx.Rollback()
+
+	var oldKeyID sql.NullString
+	var oldHash string
+	var lastUsed sql.NullTime
+	err = tx.QueryRow(
+		"SELECT ApiKey, key_id, last_used_at FROM apiKeys a WHERE a.UUID=$1 AND a.archived_at IS NULL AND "+owned+" FOR UPDATE", args...,
+	).Scan(&oldHash, &oldKeyID, &lastUsed)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	graceUntil := time.Now().Add(grace)
+	if grace > 0 {
+		_, err = tx.Exec(
+			`INSERT INTO apikey_secrets (api_key_id, key_id, apikey, expires_at, last_used_at)
+			VALUES ($1, $2, $3, $4, $5)`,
+			uuid, oldKeyID, oldHash, graceUntil, lastUsed,
+		)
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+	_, err = tx.Exec(
+		"UPDATE apiKeys SET ApiKey=$2, key_id=$3, last_used_at=NULL WHERE UUID=$1",
+		uuid, hash, nullOrString(keyID),
+	)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return time.Time{}, err
+	}
+	d.apiKeyChanged(uuid)
+	return graceUntil, nil
+}
+
+// TouchApiKey records that a secret of the key uuid was used at the given
+// time: the current one for secretID 0, otherwise the rotated one.
+func (d *Database) TouchApiKey(uuid string, secretID int64, at time.Time) error {
+	var err error
+	if secretID == 0 {
+		_, err = d.db.Exec("UPDATE apiKeys SET last_used_at=$2 WHERE UUID=$1", uuid, at)
+	} else {
+		_, err = d.db.Exec("UPDATE apikey_secrets SET last_used_at=$3 WHERE id=$2 AND api_key_id=$1", uuid, secretID, at)
+	}
+	return err
+}
+
+// ListAllApiKeys returns every key that is not archived for the admin view,
+// ordered by owner.
+func (d *Database) ListAllApiKeys() ([]ApiKey, error) {
+	rows, err := d.db.Query(`SELECT ` + adminKeyColumns + ` FROM apiKeys a
+		LEFT JOIN users u ON u.id = a.Owner
+		WHERE a.archived_at IS NULL
+		ORDER BY COALESCE(NULLIF(u.name, ''), a.Owner), a.Description, a.UUID`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []ApiKey
+	for rows.Next() {
+		a, err := scanAdminKey(rows)
+		if err != nil {
+			return keys, err
+		}
+		keys = append(keys, *a)
+	}
+	return keys, rows.Err()
+}
+
+// GetApiKey returns the key uuid, archived or not, or sql.ErrNoRows.
+func (d *Database) GetApiKey(uuid string) (*ApiKey, error) {
+	return scanAdminKey(d.db.QueryRow(`SELECT `+adminKeyColumns+` FROM apiKeys a
+		LEFT JOIN users u ON u.id = a.Owner
+		WHERE a.UUID = $1`, uuid))
+}
+
+// adminKeyColumns describe a key without its secret, selected from apiKeys a
+// joined with the users u owning them.
+const adminKeyColumns = `a.UUID, a.Owner, COALESCE(u.name, ''), a.Description, a.Deactivated,
+	a.archived_at, a.expires_at, a.last_used_at, a.allowed_models, a.allowed_endpoints, a.allowed_cidrs,
+	a.audit_content, a.response_cache_opt_out`
+
+func scanAdminKey(row interface{ Scan(...any) error }) (*ApiKey, error) {
+	var a ApiKey
+	var description, models, endpoints, cidrs sql.NullString
+	var archived, expires, lastUsed sql.NullTime
+	if err := row.Scan(&a.UUID, &a.Owner, &a.OwnerName, &description, &a.Deactivated,
+		&archived, &expires, &lastUsed, &models, &endpoints, &cidrs, &a.AuditContent,
+		&a.ResponseCacheOptOut); err != nil {
+		return nil, err
+	}
+	a.Description = description.String
+	a.Archived = archived.Valid
+	a.ArchivedAt = archived.Time
+	a.ExpiresAt = expires.Time
+	a.LastUsedAt = lastUsed.Time
+	a.AllowedModels = splitList(models.String)
+	a.AllowedEndpoints = splitList(endpoints.String)
+	a.AllowedCIDRs = splitList(cidrs.String)
+	return &a, nil
+}
+
+// SetApiKeyDeactivated deactivates or reactivates any key that is not
+// archived. It returns sql.ErrNoRows if there is no such key.
+func (d *Database) SetApiKeyDeactivated(uuid string, deactivated bool) error {
+	res, err := d.db.Exec(
+		"UPDATE apiKeys SET Deactivated=$2 WHERE UUID=$1 AND archived_at IS NULL", uuid, deactivated,
+	)
+	if err != nil {
+		return err
+	}
+	if err := expectRows(res); err != nil {
+		return err
+	}
+	d.apiKeyChanged(uuid)
+	return nil
+}
+
+// SetApiKeyAuditContent enables or disables storing the prompts and
+// completions of a key in the audit log. It returns sql.ErrNoRows if there is
+// no such key.
+func (d *Database) SetApiKeyAuditContent(uuid string, enabled bool) error {
+	res, err := d.db.Exec("UPDATE apiKeys SET audit_content=$2 WHERE UUID=$1", uuid, enabled)
+	if err != nil {
+		return err
+	}
+	if err := expectRows(res); err != nil {
+		return err
+	}
+	d.apiKeyChanged(uuid)
+	return nil
+}
+
+// SetApiKeyResponseCacheOptOut excludes the requests of a key from the
+// response cache or includes them again. It returns sql.ErrNoRows if there is
+// no such key.
+func (d *Database) SetApiKeyResponseCacheOptOut(uuid string, optOut bool) error {
+	res, err := d.db.Exec("UPDATE apiKeys SET response_cache_opt_out=$2 WHERE UUID=$1", uuid, optOut)
+	if err != nil {
+		return err
+	}
+	if err := expectRows(res); err != nil {
+		return err
+	}
+	d.apiKeyChanged(uuid)
+	return nil
+}
+
+// ListArchivedApiKeys returns the archived keys for the admin view, newest
+// first. Owner is the name of the user if known.
+func (d *Database) ListArchivedApiKeys() ([]ApiKey, error) {
+	rows, err := d.db.Query(`
+		SELECT a.UUID, COALESCE(NULLIF(u.name, ''), a.Owner), a.Description, a.archived_at, a.archived_by
+		FROM apiKeys a
+		LEFT JOIN users u ON u.id = a.Owner
+		WHERE a.archived_at IS NOT NULL
+		ORDER BY a.archived_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []ApiKey
+	for rows.Next() {
+		a := ApiKey{Archived: true}
+		var description, archivedBy sql.NullString
+		if err := rows.Scan(&a.UUID, &a.Owner, &description, &a.ArchivedAt, &archivedBy); err != nil {
+			return keys, err
+		}
+		a.Description = description.String
+		a.ArchivedBy = archivedBy.String
+		keys = append(keys, a)
+	}
+	return keys, rows.Err()
+}
+
+// RestoreApiKey reactivates an archived key. It returns sql.ErrNoRows if the
+// key does not exist or is not archived.
+func (d *Database) RestoreApiKey(uuid string) error {
+	res, err := d.db.Exec(
+		"UPDATE apiKeys SET archived_at=NULL, archived_by=NULL WHERE UUID=$1 AND archived_at IS NOT NULL", uuid,
+	)
+	if err != nil {
+		return err
+	}
+	return expectRows(res)
+}
+
+// expectRows turns an update that matched no row into sql.ErrNoRows.
+func expectRows(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Expired reports whether the key has an expiry date in the past.
+func (a ApiKey) Expired() bool {
+	return !a.ExpiresAt.IsZero() && !a.ExpiresAt.After(time.Now())
+}
+
+// splitList parses a comma separated allow-list column.
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func nullOrList(list []string) interface{} {
+	return nullOrString(strings.Join(list, ","))
+}
+
+func nullOrTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
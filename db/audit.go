@@ -0,0 +1,45 @@
+package database
+
+import (
+	"time"
+)
+
+// AuditEntry is one row of the audit trail. Prompt and Completion are empty
+// unless content capture is enabled for the key or model.
+type AuditEntry struct {
+	ID         int64
+	CreatedAt  time.Time
+	RequestID  string // ID of the upstream response, empty if unknown
+	ApiKeyID   string
+	Model      string
+	Endpoint   string
+	Status     int
+	Latency    time.Duration
+	Streamed   bool
+	Prompt     string
+	Completion string
+}
+
+// WriteAuditEntry stores e. CreatedAt defaults to now.
+func (d *Database) WriteAuditEntry(e *AuditEntry) error {
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now()
+	}
+	return d.db.QueryRow(`
+		INSERT INTO audit_log (created_at, request_id, api_key_id, model, endpoint,
+			status, latency_ms, streamed, prompt, completion)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id`,
+		e.CreatedAt, nullOrString(e.RequestID), nullOrString(e.ApiKeyID), nullOrString(e.Model), e.Endpoint,
+		e.Status, e.Latency.Milliseconds(), e.Streamed, nullOrString(e.Prompt), nullOrString(e.Completion),
+	).Scan(&e.ID)
+}
+
+// PurgeAuditLog deletes the entries created before the given time and
+// returns how many were removed.
+func (d *Database) PurgeAuditLog(before time.Time) (int64, error) {
+	res, err := d.db.Exec(`DELETE FROM audit_log WHERE created_at < $1`, before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
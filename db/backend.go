@@ -0,0 +1,40 @@
+package database
+
+import "database/sql"
+
+// BackendConfig describes an upstream API. It is read from the `backends`
+// table and from the JSON file referenced by BACKENDS_CONFIG.
+type BackendConfig struct {
+	Name       string `json:"name"`
+	Kind       string `json:"kind"`        // "azure" or "openai" (any OpenAI compatible API)
+	BaseURL    string `json:"base_url"`    // e.g. https://my-resource.openai.azure.com/openai
+	ApiKey     string `json:"api_key"`     // provider key, takes precedence over ApiKeyEnv
+	ApiKeyEnv  string `json:"api_key_env"` // name of the env variable holding the provider key
+	AuthHeader string `json:"auth_header"` // optional, defaults to Authorization for openai kinds
+}
+
+func (d *Database) ListBackends() ([]BackendConfig, error) {
+	var backends []BackendConfig
+	rows, err := d.db.Query(`
+		SELECT name, kind, base_url, api_key, api_key_env, auth_header
+		FROM backends
+		WHERE enabled
+		ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var b BackendConfig
+		var apiKey, apiKeyEnv, header sql.NullString
+		if err := rows.Scan(&b.Name, &b.Kind, &b.BaseURL, &apiKey, &apiKeyEnv, &header); err != nil {
+			return backends, err
+		}
+		b.ApiKey = apiKey.String
+		b.ApiKeyEnv = apiKeyEnv.String
+		b.AuthHeader = header.String
+		backends = append(backends, b)
+	}
+	return backends, nil
+}
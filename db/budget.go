@@ -0,0 +1,146 @@
+package database
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// Budget scopes, a budget applies to one key, all keys of a user or all
+// keys of the members of a reporting group.
+const (
+	BudgetScopeKey   = "key"
+	BudgetScopeUser  = "user"
+	BudgetScopeGroup = "group"
+)
+
+// BudgetStatus is a budget together with the spend of the current month.
+// Amounts are in the currency of the costs table.
+type BudgetStatus struct {
+	Scope     string
+	Subject   string  // key UUID, user ID or reporting group ID
+	SoftLimit float64 // 0 if unset
+	HardLimit float64 // 0 if unset
+	Spent     float64
+}
+
+// LookupBudgets returns the budgets applying to requests of key, owned by
+// user, with their month-to-date spend. The group budgets are the ones of
+// the groups of user, or of its team if user is a service account.
+func (d *Database) LookupBudgets(key, user string) ([]BudgetStatus, error) {
+	rows, err := d.db.Query(`
+		SELECT b.scope, b.subject, b.soft_limit, b.hard_limit, COALESCE(s.cost_cents, 0) / 100
+		FROM budgets b
+		LEFT JOIN spend_monthly s
+			ON s.scope = b.scope AND s.subject = b.subject
+			AND s.month = date_trunc('month', now())::date
+		WHERE (b.scope = 'key' AND b.subject = $1)
+			OR (b.scope = 'user' AND b.subject = $2)
+			OR (b.scope = 'group' AND b.subject IN (
+				SELECT group_id::text FROM reporting_group_members WHERE user_id = $2
+				UNION SELECT service_group_id::text FROM users WHERE id = $2 AND service_group_id IS NOT NULL))`,
+		key, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var budgets []BudgetStatus
+	for rows.Next() {
+		var b BudgetStatus
+		var soft, hard sql.NullFloat64
+		if err := rows.Scan(&b.Scope, &b.Subject, &soft, &hard, &b.Spent); err != nil {
+			return budgets, err
+		}
+		b.SoftLimit = soft.Float64
+		b.HardLimit = hard.Float64
+		budgets = append(budgets, b)
+	}
+	return budgets, rows.Err()
+}
+
+// Aliases of the token_type column of the costs table, as used by the
+// reporting of the web app.
+var costTokenTypes = map[string]string{
+	"input": "input", "prompt": "input", "input_tokens": "input", "prompt_tokens": "input",
+	"cached_input": "cached", "cached": "cached", "cache": "cached", "input_cached": "cached", "cached_input_tokens": "cached",
+	"output": "output", "completion": "output", "output_tokens": "output", "completion_tokens": "output",
+}
+
+// lookupTokenPrices returns the current price per token in cents of model by
+// input, cached and output tokens. Prices are stored in cents per 1M tokens,
+// or per 1K tokens if unit_of_messure says so.
+//
+// The rows of backend, the kind of the upstream that served the request, win
+// over those of other backends, and among them the regional prices for Azure,
+// which are what the Azure cost collector stores, and the global ones
+// otherwise. Models only priced for other backends fall back to those rows.
+func lookupTokenPrices(tx *sql.Tx, model, backend string) (map[string]float64, error) {
+	rows, err := tx.Query(`
+		SELECT token_type, price, unit_of_messure
+		FROM costs
+		WHERE lower(model) = lower($1) AND valid_from <= CURRENT_DATE
+		ORDER BY lower(backend_name) = lower($2), is_regional = $3, valid_from`,
+		model, backend, strings.EqualFold(backend, "azure"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	prices := map[string]float64{}
+	for rows.Next() {
+		var tokenType string
+		var price float64
+		var unit sql.NullString
+		if err := rows.Scan(&tokenType, &price, &unit); err != nil {
+			return nil, err
+		}
+		kind, ok := costTokenTypes[strings.ToLower(strings.TrimSpace(tokenType))]
+		if !ok {
+			continue
+		}
+		divisor := 1_000_000.0
+		if unit.String == "1K" {
+			divisor = 1_000
+		}
+		// Later rows match better or are more recent and replace earlier prices.
+		prices[kind] = price / divisor
+	}
+	return prices, rows.Err()
+}
+
+// requestCostCents prices the tokens of r. Token types without price cost nothing.
+func requestCostCents(prices map[string]float64, r *Request) float64 {
+	input := max(r.InputTokenCount-r.CachedInputTokenCount, 0)
+	return float64(input)*prices["input"] +
+		float64(r.CachedInputTokenCount)*prices["cached"] +
+		float64(r.OutputTokenCount)*prices["output"]
+}
+
+// addSpend adds the cost of r to the month-to-date spend of its key, the
+// owner of the key and the reporting groups of the owner, or the team of a
+// service account.
+func addSpend(tx *sql.Tx, r *Request) error {
+	if r.ApiKeyID == "" || r.CostCents <= 0 {
+		return nil
+	}
+	_, err := tx.Exec(`
+		INSERT INTO spend_monthly (scope, subject, month, cost_cents)
+		SELECT s.scope, s.subject, date_trunc('month', now())::date, $2
+		FROM (
+			SELECT 'key' AS scope, a.UUID AS subject FROM apiKeys a WHERE a.UUID = $1
+			UNION ALL
+			SELECT 'user', a.Owner FROM apiKeys a WHERE a.UUID = $1
+			UNION ALL
+			SELECT 'group', m.group_id::text
+			FROM apiKeys a JOIN reporting_group_members m ON m.user_id = a.Owner
+			WHERE a.UUID = $1
+			UNION
+			SELECT 'group', u.service_group_id::text
+			FROM apiKeys a JOIN users u ON u.id = a.Owner
+			WHERE a.UUID = $1 AND u.service_group_id IS NOT NULL
+		) s
+		ON CONFLICT (scope, subject, month)
+		DO UPDATE SET cost_cents = spend_monthly.cost_cents + EXCLUDED.cost_cents`,
+		r.ApiKeyID, r.CostCents)
+	return err
+}
@@ -0,0 +1,66 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// CachedResponse is a response stored by the exact-match response cache
+// under the hash of the request that produced it.
+type CachedResponse struct {
+	Key         string // hex SHA-256 of the normalised request
+	Model       string
+	Status      int
+	ContentType string
+	Body        []byte
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
+}
+
+// LookupCachedResponse returns the unexpired response stored under key or
+// sql.ErrNoRows.
+func (d *Database) LookupCachedResponse(key string) (*CachedResponse, error) {
+	var c CachedResponse
+	var model, contentType sql.NullString
+	err := d.db.QueryRow(`
+		SELECT key, model, status, content_type, body, created_at, expires_at
+		FROM response_cache
+		WHERE key = $1 AND expires_at > now()`, key,
+	).Scan(&c.Key, &model, &c.Status, &contentType, &c.Body, &c.CreatedAt, &c.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	c.Model = model.String
+	c.ContentType = contentType.String
+	return &c, nil
+}
+
+// WriteCachedResponse stores c, replacing an entry with the same key.
+func (d *Database) WriteCachedResponse(c *CachedResponse) error {
+	if c.CreatedAt.IsZero() {
+		c.CreatedAt = time.Now()
+	}
+	_, err := d.db.Exec(`
+		INSERT INTO response_cache (key, model, status, content_type, body, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (key) DO UPDATE SET
+			model = EXCLUDED.model,
+			status = EXCLUDED.status,
+			content_type = EXCLUDED.content_type,
+			body = EXCLUDED.body,
+			created_at = EXCLUDED.created_at,
+			expires_at = EXCLUDED.expires_at`,
+		c.Key, nullOrString(c.Model), c.Status, nullOrString(c.ContentType), c.Body, c.CreatedAt, c.ExpiresAt,
+	)
+	return err
+}
+
+// PurgeResponseCache deletes the expired entries and returns how many were
+// removed.
+func (d *Database) PurgeResponseCache() (int64, error) {
+	res, err := d.db.Exec(`DELETE FROM response_cache WHERE expires_at <= now()`)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -12,22 +12,60 @@ import (
 )
 
 type Database struct {
-	db *sql.DB
+	db         *sql.DB
+	keyChanged []func(uuid string) // see OnApiKeyChange
+}
+
+// OnApiKeyChange registers f to be called with the UUID of a key after it was
+// deactivated, archived, rotated or its settings changed, so caches of the
+// same process can drop it. It is not safe to call while serving requests.
+func (d *Database) OnApiKeyChange(f func(uuid string)) {
+	d.keyChanged = append(d.keyChanged, f)
+}
+
+func (d *Database) apiKeyChanged(uuid string) {
+	for _, f := range d.keyChanged {
+		f(uuid)
+	}
 }
 
 type ApiKey struct {
 	UUID                  string // ID that will be displayed in UI
 	ApiKey                string // Backend, not implemented yet
+	KeyID                 string // public part of sk-proxy-<key_id>_<secret>, empty for legacy keys
 	Owner                 string // sub from oidc claims or name string on return
+	OwnerName             string // name of the owner, set by the admin lookups
 	AiApi                 string // can be openai or azure
 	Description           string // optional, user can describe his key
+	Team                  string // title of the team owning the key, empty for personal keys
 	Deactivated           bool
+	Archived              bool // deleted by the user, kept for the usage history
+	ArchivedAt            time.Time
+	ArchivedBy            string
+	RPMLimit              int // requests per minute, 0 for the default, negative for unlimited
+	TPMLimit              int // tokens per minute, 0 for the default, negative for unlimited
+	UserRPMLimit          int // limits of the owner over all keys, same semantics
+	UserTPMLimit          int
+	ExpiresAt             time.Time // zero if the key does not expire
+	AllowedModels         []string  // model IDs, a trailing * matches a prefix; empty allows all
+	AllowedEndpoints      []string  // paths below /v1, e.g. embeddings; empty allows all
+	AllowedCIDRs          []string  // client networks or addresses; empty allows all
+	AuditContent          bool      // prompts and completions go to the audit log
+	ResponseCacheOptOut   bool      // requests of the key bypass the response cache
+	ReportingGroup        int64     // team of a team key, else the first reporting group of the owner; 0 if none
+	SecretID              int64     // apikey_secrets row of a rotated secret, 0 for the current one
+	SecretExpiresAt       time.Time // end of the grace period of a rotated secret
+	LastUsedAt            time.Time // last use of the current secret
+	GraceUntil            time.Time // end of the grace period of the previous secret, if any
+	GraceLastUsedAt       time.Time // last use of the previous secret
 	TokenCountPrompt      *int
 	TokenCountComplete    *int
 	InputTokenCount       int
 	CachedInputTokenCount int
 	OutputTokenCount      int
 	CacheRatioPercent     float64
+	ResponseCacheHits     int // requests answered from the response cache
+	SavedTokenCount       int // tokens of those requests, not part of the counts above
 }
 
 func DatabaseInit() *Database {
@@ -97,8 +135,11 @@ func (d *Database) LookupDatabasePath() string {
 
 func (d *Database) WriteEntry(a *ApiKey) error {
 	_, err := d.db.Exec(
-		"INSERT INTO apiKeys (UUID, ApiKey, Owner, AiApi, Description, Deactivated) VALUES ($1, $2, $3, $4, $5, $6)",
-		a.UUID, a.ApiKey, a.Owner, a.AiApi, a.Description, a.Deactivated,
+		`INSERT INTO apiKeys (UUID, ApiKey, Owner, AiApi, Description, Deactivated, key_id,
+			expires_at, allowed_models, allowed_endpoints, allowed_cidrs)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`,
+		a.UUID, a.ApiKey, a.Owner, a.AiApi, a.Description, a.Deactivated, nullOrString(a.KeyID),
+		nullOrTime(a.ExpiresAt), nullOrList(a.AllowedModels), nullOrList(a.AllowedEndpoints), nullOrList(a.AllowedCIDRs),
 	)
 	if err != nil {
 		log.Printf("Api-Key Insert Failed: %v", err)
@@ -107,14 +148,34 @@ func (d *Database) WriteEntry(a *ApiKey) error {
 	return nil
 }
 
-func (d *Database) DeleteEntry(key *string, uid string) {
-	log.Println("Deleting Key ", *key)
-	_, err := d.db.Exec("DELETE FROM apiKeys WHERE UUID=$1 AND Owner=$2", *key, uid)
+// DeleteEntry archives the key of uid or of a team uid manages. The row
+// stays so its requests keep their key for the reports; archived keys are
+// rejected by the proxy and can be restored by an admin with RestoreApiKey.
+// It returns sql.ErrNoRows if uid has no such active key.
+func (d *Database) DeleteEntry(key *string, uid string) error {
+	log.Println("Archiving Key ", *key)
+	return d.archiveApiKey(*key, uid, ownedBy(2))
+}
+
+// ArchiveApiKey archives any key on behalf of an admin, see DeleteEntry.
+func (d *Database) ArchiveApiKey(key, by string) error {
+	log.Println("Archiving Key ", key)
+	return d.archiveApiKey(key, by, "true")
+}
+
+func (d *Database) archiveApiKey(key, by, owned string) error {
+	res, err := d.db.Exec(
+		"UPDATE apiKeys a SET archived_at=now(), archived_by=$2 WHERE a.UUID=$1 AND a.archived_at IS NULL AND "+owned,
+		key, by,
+	)
 	if err != nil {
-		log.Printf("Delete Failed: %v", err)
-		return
+		return err
 	}
-
+	if err := expectRows(res); err != nil {
+		return err
+	}
+	d.apiKeyChanged(key)
+	return nil
 }
 
 type Request struct {
@@ -127,36 +188,98 @@ type Request struct {
 	OutputTokenCount      int // Output tokens (should match TokenCountComplete)
 	Model                 string
 	SnapshotVersion       string
-	IsApproximated        bool // true if any token count (e.g., output) was estimated, not provided by API
+	IsApproximated        bool    // true if any token count (e.g., output) was estimated, not provided by API
+	CostCents             float64 // cost computed by WriteRequest from the costs table
+	ResponseCacheHit      bool    // answered from the response cache, billed as zero
+	SavedCents            float64 // cost of a cache hit had it been forwarded, set by WriteRequest
+
+	// Set for proxied requests, Status is 0 for requests recorded otherwise.
+	Status   int           // HTTP status sent to the client
+	Endpoint string        // path requested by the client
+	TTFB     time.Duration // until the response headers arrived
+	Duration time.Duration // until the response was complete
+	Streamed bool
+	Upstream string // backend, with the Azure resource if the model has its own
+	// Kind of the upstream backend, e.g. "azure". Not stored, prices are
+	// looked up with the costs rows of that backend_name.
+	BackendKind string
 }
 
+// WriteRequest records r and adds its cost to the month-to-date spend used
+// by the budgets. r.CostCents is set to the computed cost. Only a failed
+// insert is returned: the request stays recorded if pricing it fails, the
+// error is logged and the spend misses its cost.
 func (d *Database) WriteRequest(r *Request) error {
+	var status, ttfb, duration interface{}
+	if r.Status != 0 {
+		status, ttfb, duration = r.Status, r.TTFB.Milliseconds(), r.Duration.Milliseconds()
+	}
 	_, err := d.db.Exec(`
 		INSERT INTO requests (
 			id, api_key_id,
 			input_token_count, cached_input_token_count, output_token_count,
-			model, snapshot_version, is_approximated
+			model, snapshot_version, is_approximated,
+			status, endpoint, ttfb_ms, duration_ms, streamed, upstream,
+			response_cache_hit
 		)
-		VALUES ($1,$2,$3,$4,$5,$6,$7,$8)`,
+		VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15)`,
 		r.ID, r.ApiKeyID,
 		r.InputTokenCount, r.CachedInputTokenCount, r.OutputTokenCount,
 		r.Model, nullOrString(r.SnapshotVersion), r.IsApproximated,
+		status, nullOrString(r.Endpoint), ttfb, duration, r.Streamed, nullOrString(r.Upstream),
+		r.ResponseCacheHit,
 	)
-	return err
+	if err != nil {
+		return err
+	}
+	if err := d.addRequestCost(r); err != nil {
+		log.Printf("Could not add the cost of request %s to the spend: %v", r.ID, err)
+	}
+	return nil
+}
+
+// addRequestCost prices r and adds its cost to the month-to-date spend.
+func (d *Database) addRequestCost(r *Request) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	prices, err := lookupTokenPrices(tx, r.Model, r.BackendKind)
+	if err != nil {
+		return err
+	}
+	r.CostCents = requestCostCents(prices, r)
+	if r.ResponseCacheHit {
+		r.SavedCents, r.CostCents = r.CostCents, 0
+	}
+	if err := addSpend(tx, r); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 func (d *Database) LookupApiKeyInfos(uid string) ([]ApiKey, error) {
 	var apikeys []ApiKey
 	rows, err := d.db.Query(`
 		SELECT
-			a.UUID, a.Owner, a.AiApi, a.Description,
-			COALESCE(SUM(r.input_token_count), 0),
-			COALESCE(SUM(r.cached_input_token_count), 0),
-			COALESCE(SUM(r.output_token_count), 0)
+			a.UUID, a.Owner, a.AiApi, a.Description, a.Deactivated,
+			a.expires_at, a.allowed_models, a.allowed_endpoints, a.allowed_cidrs,
+			a.last_used_at, s.expires_at, s.last_used_at,
+			COALESCE(SUM(r.input_token_count) FILTER (WHERE NOT r.response_cache_hit), 0),
+			COALESCE(SUM(r.cached_input_token_count) FILTER (WHERE NOT r.response_cache_hit), 0),
+			COALESCE(SUM(r.output_token_count) FILTER (WHERE NOT r.response_cache_hit), 0),
+			`+cacheSavingsColumns+`
 		FROM apiKeys a
 		LEFT JOIN requests r ON a.UUID = r.api_key_id
-		WHERE Owner=$1
-		GROUP BY a.UUID`, uid)
+		LEFT JOIN LATERAL (
+			SELECT expires_at, last_used_at FROM apikey_secrets
+			WHERE api_key_id = a.UUID AND expires_at > now()
+			ORDER BY expires_at DESC LIMIT 1
+		) s ON true
+		WHERE Owner=$1 AND a.archived_at IS NULL
+		GROUP BY a.UUID, s.expires_at, s.last_used_at`, uid)
 	if err != nil {
 		return nil, err
 	}
@@ -164,12 +287,26 @@ func (d *Database) LookupApiKeyInfos(uid string) ([]ApiKey, error) {
 	for rows.Next() {
 		var a ApiKey
 		var inputTotal, cachedTotal, outputTotal int
+		var aiApi, description, models, endpoints, cidrs sql.NullString
+		var expires, lastUsed, graceUntil, graceLastUsed sql.NullTime
 		if err := rows.Scan(
-			&a.UUID, &a.Owner, &a.AiApi, &a.Description,
+			&a.UUID, &a.Owner, &aiApi, &description, &a.Deactivated,
+			&expires, &models, &endpoints, &cidrs,
+			&lastUsed, &graceUntil, &graceLastUsed,
 			&inputTotal, &cachedTotal, &outputTotal,
+			&a.ResponseCacheHits, &a.SavedTokenCount,
 		); err != nil {
 			return apikeys, err
 		}
+		a.AiApi = aiApi.String
+		a.Description = description.String
+		a.ExpiresAt = expires.Time
+		a.AllowedModels = splitList(models.String)
+		a.AllowedEndpoints = splitList(endpoints.String)
+		a.AllowedCIDRs = splitList(cidrs.String)
+		a.LastUsedAt = lastUsed.Time
+		a.GraceUntil = graceUntil.Time
+		a.GraceLastUsedAt = graceLastUsed.Time
 		prompt := inputTotal - cachedTotal
 		if prompt < 0 {
 			prompt = 0
@@ -256,8 +393,98 @@ func (d *Database) ListConfiguredModels() ([]string, error) {
 	return models, nil
 }
 
-func (d *Database) AddConfiguredModel(id string) error {
-	_, err := d.db.Exec(`INSERT INTO models (id) VALUES ($1) ON CONFLICT DO NOTHING`, id)
+// Model is a row of the models table. Backend and Deployment select where
+// requests for the model are routed to, the Azure fields override the
+// resource of the backend per model.
+type Model struct {
+	ID           string
+	Backend      string // name of the backend, empty for the default backend
+	Deployment   string // model name sent upstream, empty to keep ID
+	ResourceHost string // Azure resource host, e.g. my-res-sweden.openai.azure.com
+	ApiVersion   string // Azure api-version, selects the classic /openai/deployments/{name} path
+	ApiKey       string // provider key, empty to use the key of the backend
+	Weight       int    // share of requests relative to the other upstreams of the model
+	Balance      string // how requests are spread across the upstreams, see apiproxy.BalanceWeighted
+	AuditContent bool   // prompts and completions go to the audit log
+}
+
+const modelColumns = `id, backend, deployment, resource_host, api_version, api_key, weight, balance, audit_content`
+
+func scanModel(row interface{ Scan(...any) error }) (*Model, error) {
+	var m Model
+	var backend, deployment, host, version, key, balance sql.NullString
+	if err := row.Scan(&m.ID, &backend, &deployment, &host, &version, &key, &m.Weight, &balance, &m.AuditContent); err != nil {
+		return nil, err
+	}
+	m.Backend = backend.String
+	m.Deployment = deployment.String
+	m.ResourceHost = host.String
+	m.ApiVersion = version.String
+	m.ApiKey = key.String
+	m.Balance = balance.String
+	return &m, nil
+}
+
+func (d *Database) ListModels() ([]Model, error) {
+	var models []Model
+	rows, err := d.db.Query(`SELECT ` + modelColumns + ` FROM models ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		m, err := scanModel(rows)
+		if err != nil {
+			return nil, err
+		}
+		models = append(models, *m)
+	}
+	return models, nil
+}
+
+// LookupModel returns the models row for id or sql.ErrNoRows if the model is not configured.
+func (d *Database) LookupModel(id string) (*Model, error) {
+	return scanModel(d.db.QueryRow(`SELECT `+modelColumns+` FROM models WHERE id = $1`, id))
+}
+
+// LookupModelUpstreams returns the fallback upstreams of model id ordered by
+// priority. The ID of every returned Model is id.
+func (d *Database) LookupModelUpstreams(id string) ([]Model, error) {
+	rows, err := d.db.Query(`
+		SELECT model_id, backend, deployment, resource_host, api_version, api_key, weight, NULL, false
+		FROM model_upstreams WHERE model_id = $1 ORDER BY priority, id`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var upstreams []Model
+	for rows.Next() {
+		m, err := scanModel(rows)
+		if err != nil {
+			return nil, err
+		}
+		upstreams = append(upstreams, *m)
+	}
+	return upstreams, rows.Err()
+}
+
+func (d *Database) AddConfiguredModel(m *Model) error {
+	_, err := d.db.Exec(`
+		INSERT INTO models (`+modelColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (id) DO UPDATE SET
+			backend = EXCLUDED.backend,
+			deployment = EXCLUDED.deployment,
+			resource_host = EXCLUDED.resource_host,
+			api_version = EXCLUDED.api_version,
+			api_key = COALESCE(EXCLUDED.api_key, models.api_key),
+			weight = EXCLUDED.weight,
+			balance = EXCLUDED.balance,
+			audit_content = EXCLUDED.audit_content`,
+		m.ID, nullOrString(m.Backend), nullOrString(m.Deployment),
+		nullOrString(m.ResourceHost), nullOrString(m.ApiVersion), nullOrString(m.ApiKey),
+		max(m.Weight, 1), nullOrString(m.Balance), m.AuditContent)
 	return err
 }
 
@@ -279,6 +506,9 @@ type RequestSummary struct {
 	CachedInputTokenCount int
 	OutputTokenCount      int
 	CacheRatioPercent     float64
+	ResponseCacheHits     int  // requests answered from the response cache
+	SavedTokenCount       int  // tokens of those requests, not part of the counts above
+	IsTeam                bool // ID is the service account of a team
 }
 
 func (d *Database) LookupCosts(model string) (carray []Costs) {
@@ -328,34 +558,38 @@ func GetFilterTruncMap() map[string]string {
 	}
 }
 
-func (d *Database) LookupApiKeyUserStats(uid string, kind string, filter string, overwriteDateTrunc bool) ([]RequestSummary, error) {
-
-	// build sql condition based on filter
-	var condition string
+// requestTimeCondition restricts the requests r to the timeframe of filter.
+func requestTimeCondition(filter string) string {
 	switch filter {
 	case "24 Hours":
-		condition = "r.request_time >= NOW() - INTERVAL '1 day'"
+		return "r.request_time >= NOW() - INTERVAL '1 day'"
 	case "30 days", "7 days":
-		condition = "r.request_time >= NOW() - INTERVAL '1 month'"
+		return "r.request_time >= NOW() - INTERVAL '1 month'"
 	case "This Month":
-		condition = `
+		return `
 			r.request_time >= date_trunc('month', current_timestamp)
 			AND r.request_time < date_trunc('month', current_timestamp) + interval '1 month'`
 	case "Last Month":
-		condition = `
+		return `
 			r.request_time >= date_trunc('month', current_timestamp) - interval '1 month'
 			AND r.request_time < date_trunc('month', current_timestamp)`
 	case "This Year":
-		condition = `
+		return `
 			r.request_time >= date_trunc('year', current_timestamp)
 			AND r.request_time < date_trunc('year', current_timestamp) + interval '1 year'`
 	case "Last Year":
-		condition = `
+		return `
 			r.request_time >= date_trunc('year', current_timestamp) - interval '1 year'
 			AND r.request_time < date_trunc('year', current_timestamp)`
 	default:
 		log.Println("Filter did not match", filter)
+		return "TRUE"
 	}
+}
+
+func (d *Database) LookupApiKeyUserStats(uid string, kind string, filter string, overwriteDateTrunc bool) ([]RequestSummary, error) {
+
+	condition := requestTimeCondition(filter)
 
 	// Overwrite Date Trunc if Money as a unit is selected, to calculate costs based of the model costs of the day
 	dateTrunc := GetFilterTruncMap()[filter]
@@ -382,6 +616,7 @@ func (d *Database) LookupApiKeyUserStats(uid string, kind string, filter string,
 		INNER JOIN users u on a.Owner = u.id 
 		WHERE 
 			%[1]s = $1
+			AND NOT r.response_cache_hit
 			AND %[3]s
 		GROUP BY %[1]s, r.model, rq_time
 		ORDER BY rq_time;`,
@@ -400,22 +635,133 @@ func (d *Database) LookupApiKeyUserStats(uid string, kind string, filter string,
 	}
 	return summary, nil
 }
+
+// cacheSavingsColumns count the requests r answered from the response cache
+// and their tokens, which are not billed.
+const cacheSavingsColumns = `count(r.id) FILTER (WHERE r.response_cache_hit),
+	COALESCE(SUM(r.input_token_count + r.output_token_count) FILTER (WHERE r.response_cache_hit), 0)`
+
+// LookupCacheSavings returns the tokens of the requests of a key or user
+// answered from the response cache per model and day, so their cost can be
+// computed like in LookupApiKeyUserStats.
+func (d *Database) LookupCacheSavings(uid string, kind string, filter string) ([]RequestSummary, error) {
+	if kind == "user" {
+		kind = "u.id"
+	} else {
+		kind = "a.UUID"
+	}
+	query := fmt.Sprintf(`
+		SELECT
+			%[1]s,
+			r.model,
+			count(*),
+			COALESCE(SUM(r.input_token_count), 0) - COALESCE(SUM(r.cached_input_token_count), 0),
+			COALESCE(SUM(r.output_token_count), 0),
+			date_trunc('day', r.request_time) AS rq_time
+		FROM requests r
+		INNER JOIN apikeys a ON a.UUID = r.api_key_id
+		INNER JOIN users u on a.Owner = u.id
+		WHERE
+			%[1]s = $1
+			AND r.response_cache_hit
+			AND %[2]s
+		GROUP BY %[1]s, r.model, rq_time
+		ORDER BY rq_time;`,
+		kind, requestTimeCondition(filter))
+	rows, err := d.db.Query(query, uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var savings []RequestSummary
+	for rows.Next() {
+		var rq RequestSummary
+		if err := rows.Scan(&rq.ID, &rq.Model, &rq.ResponseCacheHits, &rq.TokenCountPrompt, &rq.TokenCountComplete, &rq.RequestTime); err != nil {
+			return savings, err
+		}
+		rq.SavedTokenCount = rq.TokenCountPrompt + rq.TokenCountComplete
+		savings = append(savings, rq)
+	}
+	return savings, rows.Err()
+}
+
+// RequestHealth summarizes the outcome of the requests of one time bucket.
+// Requests recorded before statuses were stored are not counted.
+type RequestHealth struct {
+	RequestTime time.Time
+	Count       int // requests with a recorded status
+	Errors      int // of those with status 400 or above
+	AvgDuration time.Duration
+	AvgTTFB     time.Duration
+}
+
+// LookupRequestHealth returns error counts and average latencies of the
+// requests of a key or user, bucketed like LookupApiKeyUserStats.
+func (d *Database) LookupRequestHealth(uid string, kind string, filter string) ([]RequestHealth, error) {
+	if kind == "user" {
+		kind = "u.id"
+	} else {
+		kind = "a.UUID"
+	}
+	dateTrunc, ok := GetFilterTruncMap()[filter]
+	if !ok {
+		dateTrunc = "day"
+	}
+	query := fmt.Sprintf(`
+		SELECT
+			date_trunc('%[2]s', r.request_time) AS rq_time,
+			count(*),
+			count(*) FILTER (WHERE r.status >= 400),
+			COALESCE(AVG(r.duration_ms), 0),
+			COALESCE(AVG(r.ttfb_ms), 0)
+		FROM requests r
+		INNER JOIN apikeys a ON a.UUID = r.api_key_id
+		INNER JOIN users u on a.Owner = u.id
+		WHERE
+			%[1]s = $1
+			AND r.status IS NOT NULL
+			AND %[3]s
+		GROUP BY rq_time
+		ORDER BY rq_time;`,
+		kind, dateTrunc, requestTimeCondition(filter))
+	rows, err := d.db.Query(query, uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var health []RequestHealth
+	for rows.Next() {
+		var h RequestHealth
+		var duration, ttfb float64
+		if err := rows.Scan(&h.RequestTime, &h.Count, &h.Errors, &duration, &ttfb); err != nil {
+			return health, err
+		}
+		h.AvgDuration = time.Duration(duration * float64(time.Millisecond))
+		h.AvgTTFB = time.Duration(ttfb * float64(time.Millisecond))
+		health = append(health, h)
+	}
+	return health, rows.Err()
+}
+
 func (d *Database) LookupApiKeyUserOverview() ([]RequestSummary, error) {
 	var summary []RequestSummary
 	rows, err := d.db.Query(`
 			SELECT
 				u.name,
 				u.id,
-				COALESCE(SUM(r.input_token_count), 0),
-				COALESCE(SUM(r.cached_input_token_count), 0),
-				COALESCE(SUM(r.output_token_count), 0)
+				u.service_group_id IS NOT NULL,
+				COALESCE(SUM(r.input_token_count) FILTER (WHERE NOT r.response_cache_hit), 0),
+				COALESCE(SUM(r.cached_input_token_count) FILTER (WHERE NOT r.response_cache_hit), 0),
+				COALESCE(SUM(r.output_token_count) FILTER (WHERE NOT r.response_cache_hit), 0),
+				` + cacheSavingsColumns + `
 			FROM apiKeys a
 			LEFT JOIN users u on a.Owner = u.id 
 			LEFT JOIN requests r ON a.UUID = r.api_key_id
 			WHERE 
 				u.name IS NOT NULL
 				AND u.name <> ''
-			GROUP BY u.id, u.name
+			GROUP BY u.id, u.name, u.service_group_id
+			ORDER BY u.service_group_id IS NOT NULL, u.name
 			`)
 	if err != nil {
 		return nil, err
@@ -424,7 +770,8 @@ func (d *Database) LookupApiKeyUserOverview() ([]RequestSummary, error) {
 	for rows.Next() {
 		var rq RequestSummary
 		var inputTotal, cachedTotal, outputTotal sql.NullInt64
-		if err := rows.Scan(&rq.Name, &rq.ID, &inputTotal, &cachedTotal, &outputTotal); err != nil {
+		if err := rows.Scan(&rq.Name, &rq.ID, &rq.IsTeam, &inputTotal, &cachedTotal, &outputTotal,
+			&rq.ResponseCacheHits, &rq.SavedTokenCount); err != nil {
 			return summary, err
 		}
 		in := int(inputTotal.Int64)
@@ -462,20 +809,24 @@ func (d *Database) LookupApiKeys(uid string) ([]ApiKey, error) {
 	var rows *sql.Rows
 	var err error
 	if uid == "*" {
-		rows, err = d.db.Query("SELECT UUID, ApiKey, Owner, Deactivated FROM apiKeys")
+		// Only legacy secrets are compared by hash, including rotated ones in
+		// their grace period; prefixed tokens are looked up by key ID.
+		rows, err = d.db.Query("SELECT " + currentSecretColumns + apiKeyAuthColumns + currentSecretFrom + " WHERE a.key_id IS NULL" +
+			" UNION ALL SELECT " + rotatedSecretColumns + apiKeyAuthColumns + rotatedSecretFrom + " AND s.key_id IS NULL")
 	} else {
-		rows, err = d.db.Query("SELECT UUID, ApiKey, Owner, Deactivated FROM apiKeys WHERE Owner=$1", uid)
+		rows, err = d.db.Query("SELECT "+currentSecretColumns+apiKeyAuthColumns+currentSecretFrom+" WHERE a.Owner=$1", uid)
 	}
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
 	for rows.Next() {
-		var a ApiKey
-		if err := rows.Scan(&a.UUID, &a.ApiKey, &a.Owner, &a.Deactivated); err != nil {
+		a, err := scanApiKeyAuth(rows)
+		if err != nil {
 			return apikeys, err
 		}
-		apikeys = append(apikeys, a)
+		apikeys = append(apikeys, *a)
 	}
 	return apikeys, nil
 }
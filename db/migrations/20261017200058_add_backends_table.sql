@@ -0,0 +1,10 @@
+-- Create "backends" table holding the upstream APIs the proxy forwards to
+CREATE TABLE IF NOT EXISTS "backends" (
+    "name" character varying(255) NOT NULL PRIMARY KEY,
+    "kind" character varying(32) NOT NULL DEFAULT 'openai',
+    "base_url" character varying(1024) NOT NULL,
+    "api_key" text NULL,
+    "api_key_env" character varying(255) NULL,
+    "auth_header" character varying(255) NULL,
+    "enabled" boolean NOT NULL DEFAULT true
+);
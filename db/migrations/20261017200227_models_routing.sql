@@ -0,0 +1,4 @@
+-- Route models to a backend and optionally rename them for the upstream
+ALTER TABLE "models"
+    ADD COLUMN IF NOT EXISTS "backend" character varying(255) NULL,
+    ADD COLUMN IF NOT EXISTS "deployment" character varying(255) NULL;
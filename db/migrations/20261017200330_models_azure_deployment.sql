@@ -0,0 +1,5 @@
+-- Allow each model to target its own Azure resource, api-version and key
+ALTER TABLE "models"
+    ADD COLUMN IF NOT EXISTS "resource_host" character varying(255) NULL,
+    ADD COLUMN IF NOT EXISTS "api_version" character varying(64) NULL,
+    ADD COLUMN IF NOT EXISTS "api_key" text NULL;
@@ -0,0 +1,12 @@
+-- Fallback upstreams of a model, tried in order of priority after the models row
+CREATE TABLE IF NOT EXISTS "model_upstreams" (
+    "id" bigint GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    "model_id" character varying(255) NOT NULL REFERENCES "models" ("id") ON DELETE CASCADE,
+    "priority" integer NOT NULL DEFAULT 0,
+    "backend" character varying(255) NULL,
+    "deployment" character varying(255) NULL,
+    "resource_host" character varying(255) NULL,
+    "api_version" character varying(64) NULL,
+    "api_key" text NULL
+);
+CREATE INDEX IF NOT EXISTS "model_upstreams_model_id_priority_idx" ON "model_upstreams" ("model_id", "priority");
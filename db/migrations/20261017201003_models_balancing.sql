@@ -0,0 +1,6 @@
+-- Spread requests of a model across its upstreams
+ALTER TABLE "models"
+    ADD COLUMN IF NOT EXISTS "weight" integer NOT NULL DEFAULT 1,
+    ADD COLUMN IF NOT EXISTS "balance" character varying(32) NULL;
+ALTER TABLE "model_upstreams"
+    ADD COLUMN IF NOT EXISTS "weight" integer NOT NULL DEFAULT 1;
@@ -0,0 +1,4 @@
+-- Public key ID of keys issued as sk-proxy-<key_id>_<secret>, NULL for legacy keys
+ALTER TABLE "apikeys"
+    ADD COLUMN IF NOT EXISTS "key_id" character varying(64) NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS "apikeys_key_id_idx" ON "apikeys" ("key_id");
@@ -0,0 +1,7 @@
+-- Requests and tokens per minute per API key and per user, NULL for the defaults
+ALTER TABLE "apikeys"
+    ADD COLUMN IF NOT EXISTS "rpm_limit" integer NULL,
+    ADD COLUMN IF NOT EXISTS "tpm_limit" integer NULL;
+ALTER TABLE "users"
+    ADD COLUMN IF NOT EXISTS "rpm_limit" integer NULL,
+    ADD COLUMN IF NOT EXISTS "tpm_limit" integer NULL;
@@ -0,0 +1,18 @@
+-- Monthly spend budgets per API key, user or reporting group, in the currency of the costs table
+CREATE TABLE IF NOT EXISTS "budgets" (
+    "id" bigint GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    "scope" character varying(16) NOT NULL CHECK ("scope" IN ('key', 'user', 'group')),
+    "subject" character varying(255) NOT NULL,
+    "soft_limit" numeric(12,2) NULL,
+    "hard_limit" numeric(12,2) NULL,
+    CONSTRAINT "budgets_scope_subject_key" UNIQUE ("scope", "subject")
+);
+
+-- Month-to-date spend, kept up to date as requests are recorded
+CREATE TABLE IF NOT EXISTS "spend_monthly" (
+    "scope" character varying(16) NOT NULL,
+    "subject" character varying(255) NOT NULL,
+    "month" date NOT NULL,
+    "cost_cents" numeric(18,6) NOT NULL DEFAULT 0,
+    PRIMARY KEY ("scope", "subject", "month")
+);
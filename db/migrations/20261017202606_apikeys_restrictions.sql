@@ -0,0 +1,7 @@
+-- Optional expiry and allow-lists of models, endpoints and client networks per key.
+-- The lists are comma separated, NULL allows everything.
+ALTER TABLE "apikeys"
+    ADD COLUMN IF NOT EXISTS "expires_at" timestamp with time zone NULL,
+    ADD COLUMN IF NOT EXISTS "allowed_models" text NULL,
+    ADD COLUMN IF NOT EXISTS "allowed_endpoints" text NULL,
+    ADD COLUMN IF NOT EXISTS "allowed_cidrs" text NULL;
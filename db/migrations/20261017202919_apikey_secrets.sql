@@ -0,0 +1,15 @@
+-- Secrets replaced by a key rotation stay valid until expires_at. The current
+-- secret of a key remains in apikeys.
+CREATE TABLE IF NOT EXISTS "apikey_secrets" (
+    "id" bigserial PRIMARY KEY,
+    "api_key_id" character varying(255) NOT NULL REFERENCES "apikeys" ("uuid") ON DELETE CASCADE,
+    "key_id" character varying(64) NULL,
+    "apikey" character varying(255) NOT NULL,
+    "rotated_at" timestamp with time zone NOT NULL DEFAULT now(),
+    "expires_at" timestamp with time zone NOT NULL,
+    "last_used_at" timestamp with time zone NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS "apikey_secrets_key_id_idx" ON "apikey_secrets" ("key_id");
+CREATE INDEX IF NOT EXISTS "apikey_secrets_api_key_id_idx" ON "apikey_secrets" ("api_key_id");
+
+ALTER TABLE "apikeys" ADD COLUMN IF NOT EXISTS "last_used_at" timestamp with time zone NULL;
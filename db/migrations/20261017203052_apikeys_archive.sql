@@ -0,0 +1,4 @@
+-- Deleted keys are archived instead, so their requests keep a valid api_key_id.
+ALTER TABLE "apikeys"
+    ADD COLUMN IF NOT EXISTS "archived_at" timestamp with time zone NULL,
+    ADD COLUMN IF NOT EXISTS "archived_by" character varying(255) NULL;
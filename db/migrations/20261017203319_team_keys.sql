@@ -0,0 +1,14 @@
+-- Managers of a reporting group may create, rotate and view its team keys.
+-- The creator of a group is a manager as well.
+CREATE TABLE IF NOT EXISTS "reporting_group_managers" (
+    "group_id" bigint NOT NULL REFERENCES "reporting_groups" ("id") ON DELETE CASCADE,
+    "user_id" character varying(255) NOT NULL REFERENCES "users" ("id") ON DELETE CASCADE,
+    CONSTRAINT "reporting_group_managers_pkey" PRIMARY KEY ("group_id", "user_id")
+);
+
+-- Team keys are owned by a service account user per reporting group, so
+-- they do not depend on the account of the engineer who created them.
+ALTER TABLE "users"
+    ADD COLUMN IF NOT EXISTS "service_group_id" bigint NULL
+    REFERENCES "reporting_groups" ("id") ON DELETE SET NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS "users_service_group_id_idx" ON "users" ("service_group_id");
@@ -0,0 +1,16 @@
+-- Tokens for the /manage/v1 API. Only the SHA-256 of a token is stored; the
+-- token itself is shown once when it is created.
+CREATE TABLE IF NOT EXISTS "admin_tokens" (
+    "id" bigserial NOT NULL,
+    "name" character varying(255) NOT NULL,
+    "token_hash" character(64) NOT NULL,
+    "scope" character varying(16) NOT NULL DEFAULT 'read',
+    "created_by" character varying(255) NULL REFERENCES "users" ("id") ON DELETE SET NULL,
+    "created_at" timestamptz NOT NULL DEFAULT now(),
+    "expires_at" timestamptz NULL,
+    "last_used_at" timestamptz NULL,
+    "revoked_at" timestamptz NULL,
+    CONSTRAINT "admin_tokens_pkey" PRIMARY KEY ("id"),
+    CONSTRAINT "admin_tokens_scope_check" CHECK ("scope" IN ('read', 'write'))
+);
+CREATE UNIQUE INDEX IF NOT EXISTS "admin_tokens_token_hash_idx" ON "admin_tokens" ("token_hash");
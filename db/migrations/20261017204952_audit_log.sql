@@ -0,0 +1,22 @@
+-- Optional audit trail of proxied requests. Prompt and completion are only
+-- stored for keys or models with audit_content set, after redaction.
+CREATE TABLE IF NOT EXISTS "audit_log" (
+    "id" bigserial NOT NULL,
+    "created_at" timestamptz NOT NULL DEFAULT now(),
+    "request_id" character varying(255) NULL,
+    "api_key_id" character varying(255) NULL,
+    "model" character varying(255) NULL,
+    "endpoint" character varying(255) NOT NULL,
+    "status" integer NOT NULL,
+    "latency_ms" integer NOT NULL,
+    "streamed" boolean NOT NULL DEFAULT false,
+    "prompt" text NULL,
+    "completion" text NULL,
+    CONSTRAINT "audit_log_pkey" PRIMARY KEY ("id")
+);
+CREATE INDEX IF NOT EXISTS "audit_log_created_at_idx" ON "audit_log" ("created_at");
+CREATE INDEX IF NOT EXISTS "audit_log_api_key_id_idx" ON "audit_log" ("api_key_id", "created_at");
+ALTER TABLE "apikeys"
+    ADD COLUMN IF NOT EXISTS "audit_content" boolean NOT NULL DEFAULT false;
+ALTER TABLE "models"
+    ADD COLUMN IF NOT EXISTS "audit_content" boolean NOT NULL DEFAULT false;
@@ -0,0 +1,9 @@
+-- Outcome and timing of every proxied request, including failed ones.
+-- NULL for requests recorded before.
+ALTER TABLE "requests"
+    ADD COLUMN IF NOT EXISTS "status" integer NULL,
+    ADD COLUMN IF NOT EXISTS "endpoint" character varying(255) NULL,
+    ADD COLUMN IF NOT EXISTS "ttfb_ms" integer NULL,
+    ADD COLUMN IF NOT EXISTS "duration_ms" integer NULL,
+    ADD COLUMN IF NOT EXISTS "streamed" boolean NOT NULL DEFAULT false,
+    ADD COLUMN IF NOT EXISTS "upstream" character varying(255) NULL;
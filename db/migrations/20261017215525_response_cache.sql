@@ -0,0 +1,17 @@
+-- Exact-match cache of deterministic requests, used with RESPONSE_CACHE=postgres.
+CREATE TABLE IF NOT EXISTS "response_cache" (
+    "key" character varying(64) NOT NULL,
+    "model" character varying(255) NULL,
+    "status" integer NOT NULL,
+    "content_type" character varying(255) NULL,
+    "body" bytea NOT NULL,
+    "created_at" timestamptz NOT NULL DEFAULT now(),
+    "expires_at" timestamptz NOT NULL,
+    CONSTRAINT "response_cache_pkey" PRIMARY KEY ("key")
+);
+CREATE INDEX IF NOT EXISTS "response_cache_expires_at_idx" ON "response_cache" ("expires_at");
+-- Requests answered from the cache are billed as zero and shown as savings.
+ALTER TABLE "requests"
+    ADD COLUMN IF NOT EXISTS "response_cache_hit" boolean NOT NULL DEFAULT false;
+ALTER TABLE "apikeys"
+    ADD COLUMN IF NOT EXISTS "response_cache_opt_out" boolean NOT NULL DEFAULT false;
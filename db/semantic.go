@@ -0,0 +1,121 @@
+package database
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SemanticCacheEntry is a response stored by the semantic cache together
+// with the embedding of the prompt that produced it.
+type SemanticCacheEntry struct {
+	ID             int64
+	Scope          string // key:<uuid>, owner:<owner> or group:<id>, see SEMANTIC_CACHE_SCOPE
+	Model          string
+	Endpoint       string
+	ContextHash    string // hex SHA-256 of the other fields and the messages before the prompt
+	EmbeddingModel string
+	Embedding      []float32
+	Status         int
+	ContentType    string
+	Body           []byte
+	CreatedAt      time.Time
+	ExpiresAt      time.Time
+	Similarity     float64 // cosine similarity to the looked up embedding
+}
+
+// EnsureSemanticCache creates the pgvector extension and the semantic_cache
+// table. Unlike the other tables they are not part of the migrations, so
+// databases without pgvector keep working as long as the cache is off. The
+// extension needs a superuser or the owner of the database.
+func (d *Database) EnsureSemanticCache() error {
+	_, err := d.db.Exec(`
+		CREATE EXTENSION IF NOT EXISTS vector;
+		CREATE TABLE IF NOT EXISTS semantic_cache (
+			id bigserial PRIMARY KEY,
+			scope varchar(255) NOT NULL,
+			model varchar(255) NOT NULL,
+			endpoint varchar(64) NOT NULL,
+			context_hash varchar(64) NOT NULL,
+			embedding_model varchar(255) NOT NULL,
+			embedding vector NOT NULL,
+			status integer NOT NULL,
+			content_type varchar(255) NULL,
+			body bytea NOT NULL,
+			created_at timestamptz NOT NULL DEFAULT now(),
+			expires_at timestamptz NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS semantic_cache_lookup_idx
+			ON semantic_cache (scope, model, endpoint, context_hash, embedding_model);
+		CREATE INDEX IF NOT EXISTS semantic_cache_expires_at_idx ON semantic_cache (expires_at);`)
+	return err
+}
+
+// LookupSemanticCache returns the unexpired entry of q's scope, model,
+// endpoint, context and embedding model whose embedding is the most similar
+// to q.Embedding, or sql.ErrNoRows.
+func (d *Database) LookupSemanticCache(q *SemanticCacheEntry) (*SemanticCacheEntry, error) {
+	e := SemanticCacheEntry{
+		Scope:          q.Scope,
+		Model:          q.Model,
+		Endpoint:       q.Endpoint,
+		ContextHash:    q.ContextHash,
+		EmbeddingModel: q.EmbeddingModel,
+	}
+	var contentType sql.NullString
+	err := d.db.QueryRow(`
+		SELECT id, status, content_type, body, created_at, expires_at, 1 - (embedding <=> $1::vector)
+		FROM semantic_cache
+		WHERE scope = $2 AND model = $3 AND endpoint = $4 AND context_hash = $5 AND embedding_model = $6
+			AND expires_at > now()
+			AND vector_dims(embedding) = vector_dims($1::vector)
+		ORDER BY embedding <=> $1::vector
+		LIMIT 1`,
+		vectorLiteral(q.Embedding), q.Scope, q.Model, q.Endpoint, q.ContextHash, q.EmbeddingModel,
+	).Scan(&e.ID, &e.Status, &contentType, &e.Body, &e.CreatedAt, &e.ExpiresAt, &e.Similarity)
+	if err != nil {
+		return nil, err
+	}
+	e.ContentType = contentType.String
+	return &e, nil
+}
+
+// WriteSemanticCache stores e.
+func (d *Database) WriteSemanticCache(e *SemanticCacheEntry) error {
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now()
+	}
+	return d.db.QueryRow(`
+		INSERT INTO semantic_cache (scope, model, endpoint, context_hash, embedding_model, embedding,
+			status, content_type, body, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6::vector, $7, $8, $9, $10, $11)
+		RETURNING id`,
+		e.Scope, e.Model, e.Endpoint, e.ContextHash, e.EmbeddingModel, vectorLiteral(e.Embedding),
+		e.Status, nullOrString(e.ContentType), e.Body, e.CreatedAt, e.ExpiresAt,
+	).Scan(&e.ID)
+}
+
+// PurgeSemanticCache deletes the expired entries and returns how many were
+// removed.
+func (d *Database) PurgeSemanticCache() (int64, error) {
+	res, err := d.db.Exec(`DELETE FROM semantic_cache WHERE expires_at <= now()`)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// vectorLiteral formats v in the text representation of pgvector, e.g. [1,0.5].
+func vectorLiteral(v []float32) string {
+	var b strings.Builder
+	b.WriteByte('[')
+	for i, f := range v {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(strconv.FormatFloat(float64(f), 'g', -1, 32))
+	}
+	b.WriteByte(']')
+	return b.String()
+}
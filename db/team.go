@@ -0,0 +1,130 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+)
+
+// Team is a reporting group whose keys are owned by a service account
+// instead of a personal user.
+type Team struct {
+	ID       int64
+	Title    string
+	Account  string // users.id of the service account owning the team keys
+	Managers []User // explicit managers, the creator of the group is one as well
+}
+
+// ServiceAccountID is the users.id of the service account of a group.
+func ServiceAccountID(groupID int64) string {
+	return "team:" + strconv.FormatInt(groupID, 10)
+}
+
+// managedGroups selects the IDs of the groups the user in parameter n
+// manages: the ones they created and the ones they were made manager of.
+func managedGroups(n int) string {
+	return fmt.Sprintf(`SELECT g.id FROM reporting_groups g WHERE g.created_by = $%[1]d
+		UNION SELECT m.group_id FROM reporting_group_managers m WHERE m.user_id = $%[1]d`, n)
+}
+
+// ownedBy is a condition on apiKeys a matching the keys of the user in
+// parameter n and the team keys of the groups they manage.
+func ownedBy(n int) string {
+	return fmt.Sprintf(`(a.Owner = $%[1]d OR a.Owner IN (
+		SELECT u.id FROM users u WHERE u.service_group_id IN (%[2]s)))`, n, managedGroups(n))
+}
+
+// ListManagedTeams returns the teams the user manages, ordered by title.
+func (d *Database) ListManagedTeams(user string) ([]Team, error) {
+	rows, err := d.db.Query(`
+		SELECT g.id, g.title FROM reporting_groups g
+		WHERE g.id IN (`+managedGroups(1)+`)
+		ORDER BY g.title`, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var teams []Team
+	for rows.Next() {
+		var t Team
+		if err := rows.Scan(&t.ID, &t.Title); err != nil {
+			return teams, err
+		}
+		t.Account = ServiceAccountID(t.ID)
+		teams = append(teams, t)
+	}
+	return teams, rows.Err()
+}
+
+// IsTeamManager reports whether the user manages the group.
+func (d *Database) IsTeamManager(user string, groupID int64) (bool, error) {
+	var ok bool
+	err := d.db.QueryRow("SELECT $2 IN ("+managedGroups(1)+")", user, groupID).Scan(&ok)
+	return ok, err
+}
+
+// EnsureServiceAccount creates the service account user of a group if it
+// does not exist yet and returns its ID. The account carries the title of
+// the group as name, so the team shows up as such in the usage overview.
+func (d *Database) EnsureServiceAccount(groupID int64) (string, error) {
+	var id string
+	err := d.db.QueryRow(`
+		INSERT INTO users (id, name, is_admin, service_group_id)
+		SELECT $2, g.title, false, g.id FROM reporting_groups g WHERE g.id = $1
+		ON CONFLICT (id) DO UPDATE SET name = EXCLUDED.name, service_group_id = EXCLUDED.service_group_id
+		RETURNING id`, groupID, ServiceAccountID(groupID)).Scan(&id)
+	return id, err
+}
+
+// ListTeams returns all reporting groups with their explicit managers for
+// the admin view.
+func (d *Database) ListTeams() ([]Team, error) {
+	rows, err := d.db.Query(`
+		SELECT g.id, g.title, u.id, COALESCE(u.name, '')
+		FROM reporting_groups g
+		LEFT JOIN reporting_group_managers m ON m.group_id = g.id
+		LEFT JOIN users u ON u.id = m.user_id
+		ORDER BY g.title, g.id, u.name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var teams []Team
+	for rows.Next() {
+		var t Team
+		var managerID, managerName sql.NullString
+		if err := rows.Scan(&t.ID, &t.Title, &managerID, &managerName); err != nil {
+			return teams, err
+		}
+		if n := len(teams); n == 0 || teams[n-1].ID != t.ID {
+			t.Account = ServiceAccountID(t.ID)
+			teams = append(teams, t)
+		}
+		if managerID.Valid {
+			last := &teams[len(teams)-1]
+			last.Managers = append(last.Managers, User{Sub: managerID.String, Name: managerName.String})
+		}
+	}
+	return teams, rows.Err()
+}
+
+// AddTeamManager makes the user a manager of the group.
+func (d *Database) AddTeamManager(groupID int64, user string) error {
+	_, err := d.db.Exec(
+		"INSERT INTO reporting_group_managers (group_id, user_id) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+		groupID, user)
+	return err
+}
+
+// RemoveTeamManager revokes the explicit manager role of the user. It
+// returns sql.ErrNoRows if the user was no manager of the group.
+func (d *Database) RemoveTeamManager(groupID int64, user string) error {
+	res, err := d.db.Exec(
+		"DELETE FROM reporting_group_managers WHERE group_id = $1 AND user_id = $2", groupID, user)
+	if err != nil {
+		return err
+	}
+	return expectRows(res)
+}
@@ -53,3 +53,22 @@ func (d *Database) WriteUser(userClaim *User) (err error) {
 	}
 	return nil
 }
+
+// ListUsers returns the personal users, without service accounts, by name.
+func (d *Database) ListUsers() ([]User, error) {
+	rows, err := d.db.Query("SELECT id, COALESCE(name, ''), COALESCE(is_admin, false) FROM users WHERE service_group_id IS NULL ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.Sub, &u.Name, &u.IsAdmin); err != nil {
+			return users, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
@@ -0,0 +1,127 @@
+// Package logging configures the structured logger shared by all packages.
+// Setup installs it as the slog default, so the log package writes through
+// it as well. The level can be changed at runtime with SetLevel.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// LevelTrace is below debug and logs request and response content, e.g.
+// SSE events and raw response bodies.
+const LevelTrace = slog.Level(-8)
+
+var level = new(slog.LevelVar)
+
+// Setup installs the default logger writing to stderr. LOG_LEVEL sets the
+// initial level (trace, debug, info, warn or error; default info) and
+// LOG_FORMAT=text switches from JSON to logfmt style lines.
+func Setup() {
+	if raw := os.Getenv("LOG_LEVEL"); raw != "" {
+		l, err := ParseLevel(raw)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Ignoring LOG_LEVEL: %v\n", err)
+		} else {
+			level.Set(l)
+		}
+	}
+	slog.SetDefault(New(os.Stderr, os.Getenv("LOG_FORMAT")))
+	// slog.SetDefault routes the log package at info level, its lines
+	// carry their own timestamps otherwise.
+	log.SetFlags(0)
+}
+
+// New returns a logger writing to w with the shared level and redaction.
+func New(w io.Writer, format string) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: replaceAttr}
+	if format == "text" {
+		return slog.New(slog.NewTextHandler(w, opts))
+	}
+	return slog.New(slog.NewJSONHandler(w, opts))
+}
+
+// Level returns the current level.
+func Level() slog.Level {
+	return level.Level()
+}
+
+// SetLevel changes the level of all loggers returned by New.
+func SetLevel(l slog.Level) {
+	level.Set(l)
+}
+
+// ParseLevel parses a level name as used by LOG_LEVEL.
+func ParseLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "trace":
+		return LevelTrace, nil
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+// LevelName is the inverse of ParseLevel.
+func LevelName(l slog.Level) string {
+	if l == LevelTrace {
+		return "trace"
+	}
+	return strings.ToLower(l.String())
+}
+
+// secretKeys are attribute keys whose values are never logged.
+var secretKeys = map[string]bool{
+	"authorization": true,
+	"api-key":       true,
+	"api_key":       true,
+	"apikey":        true,
+	"token":         true,
+	"secret":        true,
+	"password":      true,
+}
+
+// secretPatterns match credentials inside of messages and values: proxy,
+// OpenAI and admin keys, bearer tokens and Azure api-key query parameters.
+var secretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`\b(?:sk|pk|rk)-[A-Za-z0-9_-]{16,}`),
+	regexp.MustCompile(`(?i)\bbearer\s+[A-Za-z0-9._~+/=-]{8,}`),
+	regexp.MustCompile(`(?i)\bapi-key=[^&\s]+`),
+}
+
+const redacted = "[redacted]"
+
+// Redact replaces the credentials in s.
+func Redact(s string) string {
+	for _, re := range secretPatterns {
+		s = re.ReplaceAllString(s, redacted)
+	}
+	return s
+}
+
+func replaceAttr(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) == 0 && a.Key == slog.LevelKey {
+		if l, ok := a.Value.Any().(slog.Level); ok && l == LevelTrace {
+			a.Value = slog.StringValue("TRACE")
+		}
+		return a
+	}
+	if secretKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, redacted)
+	}
+	if a.Value.Kind() == slog.KindString {
+		a.Value = slog.StringValue(Redact(a.Value.String()))
+	}
+	return a
+}
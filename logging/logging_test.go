@@ -0,0 +1,67 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	for _, s := range []string{
+		"Bearer sk-proxy-0123456789abcdefghij",
+		"bearer eyJhbGciOiJSUzI1NiJ9.payload",
+		"https://res.openai.azure.com/openai/deployments/x?api-key=abc123&api-version=1",
+		"key sk-admin-0123456789abcdefghij was rejected",
+	} {
+		got := Redact(s)
+		if !strings.Contains(got, redacted) || strings.Contains(got, "0123456789") || strings.Contains(got, "abc123") || strings.Contains(got, "payload") {
+			t.Errorf("Redact(%q) = %q", s, got)
+		}
+	}
+	if s := "model gpt-4o on backend openai"; Redact(s) != s {
+		t.Errorf("Redact changed %q to %q", s, Redact(s))
+	}
+}
+
+func TestLogger(t *testing.T) {
+	prev := Level()
+	t.Cleanup(func() { SetLevel(prev) })
+	SetLevel(LevelTrace)
+
+	var buf bytes.Buffer
+	l := New(&buf, "")
+	l.Log(context.Background(), LevelTrace, "Outgoing request Bearer sk-proxy-0123456789abcdefghij",
+		"authorization", "anything", "api_key", "x", "model", "gpt-4o")
+	var line map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("not JSON: %s", buf.String())
+	}
+	if line["level"] != "TRACE" || line["model"] != "gpt-4o" || line["authorization"] != redacted || line["api_key"] != redacted {
+		t.Errorf("unexpected line %v", line)
+	}
+	if strings.Contains(line["msg"].(string), "0123456789") {
+		t.Errorf("message not redacted: %v", line["msg"])
+	}
+
+	buf.Reset()
+	SetLevel(slog.LevelInfo)
+	l.Debug("hidden")
+	if buf.Len() != 0 {
+		t.Errorf("debug logged at info level: %s", buf.String())
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for _, name := range []string{"trace", "debug", "info", "warn", "error"} {
+		l, err := ParseLevel(strings.ToUpper(name))
+		if err != nil || LevelName(l) != name {
+			t.Errorf("ParseLevel(%q) = %v, %v", name, l, err)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("expected an error for an unknown level")
+	}
+}
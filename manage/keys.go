@@ -0,0 +1,238 @@
+package manage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	db "openai-api-proxy/db"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// apiKey is the JSON form of a key. The secret is only set in the responses
+// of create and rotate.
+type apiKey struct {
+	ID               string     `json:"id"`
+	Owner            string     `json:"owner"`
+	OwnerName        string     `json:"owner_name,omitempty"`
+	Description      string     `json:"description"`
+	Deactivated      bool       `json:"deactivated"`
+	Archived         bool       `json:"archived"`
+	ExpiresAt        *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt       *time.Time `json:"last_used_at,omitempty"`
+	AllowedModels    []string   `json:"allowed_models,omitempty"`
+	AllowedEndpoints []string   `json:"allowed_endpoints,omitempty"`
+	AllowedCIDRs     []string   `json:"allowed_cidrs,omitempty"`
+	AuditContent     bool       `json:"audit_content"`
+	CacheOptOut      bool       `json:"response_cache_opt_out"`
+	Secret           string     `json:"secret,omitempty"`
+	GraceUntil       *time.Time `json:"grace_until,omitempty"` // end of the grace period of the previous secret
+}
+
+func newApiKey(k *db.ApiKey) apiKey {
+	return apiKey{
+		ID:               k.UUID,
+		Owner:            k.Owner,
+		OwnerName:        k.OwnerName,
+		Description:      k.Description,
+		Deactivated:      k.Deactivated,
+		Archived:         k.Archived,
+		ExpiresAt:        timePtr(k.ExpiresAt),
+		LastUsedAt:       timePtr(k.LastUsedAt),
+		AllowedModels:    k.AllowedModels,
+		AllowedEndpoints: k.AllowedEndpoints,
+		AllowedCIDRs:     k.AllowedCIDRs,
+		AuditContent:     k.AuditContent,
+		CacheOptOut:      k.ResponseCacheOptOut,
+	}
+}
+
+// listKeys returns all keys that are not archived.
+func (h *handler) listKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := h.db.ListAllApiKeys()
+	if err != nil {
+		writeStoreError(w, "keys", err)
+		return
+	}
+	resp := list[apiKey]{Data: []apiKey{}}
+	for i := range keys {
+		resp.Data = append(resp.Data, newApiKey(&keys[i]))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *handler) getKey(w http.ResponseWriter, r *http.Request) {
+	k, err := h.db.GetApiKey(r.PathValue("id"))
+	if err != nil {
+		writeStoreError(w, "key", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newApiKey(k))
+}
+
+type createKeyRequest struct {
+	Owner            string     `json:"owner"`
+	Description      string     `json:"description"`
+	ExpiresAt        *time.Time `json:"expires_at"`
+	AllowedModels    []string   `json:"allowed_models"`
+	AllowedEndpoints []string   `json:"allowed_endpoints"`
+	AllowedCIDRs     []string   `json:"allowed_cidrs"`
+}
+
+// createKey issues a key for an existing user or team service account. The
+// secret is part of the response only.
+func (h *handler) createKey(w http.ResponseWriter, r *http.Request) {
+	var req createKeyRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.Owner == "" {
+		writeError(w, http.StatusBadRequest, "owner is required", "invalid_request")
+		return
+	}
+	if _, err := h.db.GetUser(req.Owner); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusBadRequest, "unknown owner "+req.Owner, "invalid_request")
+			return
+		}
+		writeStoreError(w, "owner", err)
+		return
+	}
+	k := db.ApiKey{
+		Owner:            req.Owner,
+		Description:      req.Description,
+		AllowedModels:    req.AllowedModels,
+		AllowedEndpoints: req.AllowedEndpoints,
+		AllowedCIDRs:     req.AllowedCIDRs,
+	}
+	if req.ExpiresAt != nil {
+		if !req.ExpiresAt.After(time.Now()) {
+			writeError(w, http.StatusBadRequest, "expires_at is in the past", "invalid_request")
+			return
+		}
+		k.ExpiresAt = *req.ExpiresAt
+	}
+	for _, cidr := range k.AllowedCIDRs {
+		if err := db.ValidateCIDR(cidr); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid network "+cidr+" in allowed_cidrs", "invalid_request")
+			return
+		}
+	}
+
+	secret, keyID, hash, err := db.GenerateApiKey()
+	if err != nil {
+		writeStoreError(w, "key", err)
+		return
+	}
+	k.UUID = uuid.NewString()
+	k.KeyID = keyID
+	k.ApiKey = hash
+	if err := h.db.WriteEntry(&k); err != nil {
+		writeStoreError(w, "key", err)
+		return
+	}
+	log.Printf("Key %s for %s created by %s", k.UUID, k.Owner, actor(r))
+	resp := newApiKey(&k)
+	resp.Secret = secret
+	writeJSON(w, http.StatusCreated, resp)
+}
+
+type updateKeyRequest struct {
+	Deactivated  *bool `json:"deactivated"`
+	AuditContent *bool `json:"audit_content"`
+	CacheOptOut  *bool `json:"response_cache_opt_out"`
+}
+
+// updateKey deactivates or reactivates a key, switches the capture of its
+// prompts and completions in the audit log and its use of the response cache.
+func (h *handler) updateKey(w http.ResponseWriter, r *http.Request) {
+	var req updateKeyRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	id := r.PathValue("id")
+	if req.Deactivated != nil {
+		if err := h.db.SetApiKeyDeactivated(id, *req.Deactivated); err != nil {
+			writeStoreError(w, "key", err)
+			return
+		}
+		log.Printf("Key %s deactivated=%t by %s", id, *req.Deactivated, actor(r))
+	}
+	if req.AuditContent != nil {
+		if err := h.db.SetApiKeyAuditContent(id, *req.AuditContent); err != nil {
+			writeStoreError(w, "key", err)
+			return
+		}
+		log.Printf("Key %s audit_content=%t by %s", id, *req.AuditContent, actor(r))
+	}
+	if req.CacheOptOut != nil {
+		if err := h.db.SetApiKeyResponseCacheOptOut(id, *req.CacheOptOut); err != nil {
+			writeStoreError(w, "key", err)
+			return
+		}
+		log.Printf("Key %s response_cache_opt_out=%t by %s", id, *req.CacheOptOut, actor(r))
+	}
+	h.getKey(w, r)
+}
+
+// deleteKey archives a key, like deleting it in the web UI does.
+func (h *handler) deleteKey(w http.ResponseWriter, r *http.Request) {
+	if err := h.db.ArchiveApiKey(r.PathValue("id"), actor(r)); err != nil {
+		writeStoreError(w, "key", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type rotateKeyRequest struct {
+	Grace string `json:"grace"` // Go duration, API_KEY_ROTATION_GRACE if empty
+}
+
+// rotateKey issues a new secret for a key. The previous one stays valid for
+// the grace period.
+func (h *handler) rotateKey(w http.ResponseWriter, r *http.Request) {
+	var req rotateKeyRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, "invalid request body: "+err.Error(), "invalid_request")
+		return
+	}
+	grace := db.RotationGrace()
+	if req.Grace != "" {
+		d, err := time.ParseDuration(req.Grace)
+		if err != nil || d < 0 {
+			writeError(w, http.StatusBadRequest, "invalid grace "+req.Grace, "invalid_request")
+			return
+		}
+		grace = d
+	}
+
+	id := r.PathValue("id")
+	secret, keyID, hash, err := db.GenerateApiKey()
+	if err != nil {
+		writeStoreError(w, "key", err)
+		return
+	}
+	graceUntil, err := h.db.RotateAnyApiKey(id, keyID, hash, grace)
+	if err != nil {
+		writeStoreError(w, "key", err)
+		return
+	}
+	log.Printf("Key %s rotated by %s", id, actor(r))
+	k, err := h.db.GetApiKey(id)
+	if err != nil {
+		writeStoreError(w, "key", err)
+		return
+	}
+	resp := newApiKey(k)
+	resp.Secret = secret
+	if graceUntil.After(time.Now()) {
+		resp.GraceUntil = timePtr(graceUntil)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,34 @@
+package manage
+
+import (
+	"log"
+	"net/http"
+	"openai-api-proxy/logging"
+)
+
+// logLevel is the JSON form of the log level, see logging.ParseLevel.
+type logLevel struct {
+	Level string `json:"level"`
+}
+
+func (h *handler) getLogLevel(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, logLevel{Level: logging.LevelName(logging.Level())})
+}
+
+// setLogLevel changes the level of the running process. It is not stored,
+// a restart goes back to LOG_LEVEL.
+func (h *handler) setLogLevel(w http.ResponseWriter, r *http.Request) {
+	var req logLevel
+	if !readJSON(w, r, &req) {
+		return
+	}
+	l, err := logging.ParseLevel(req.Level)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error(), "invalid_request")
+		return
+	}
+	prev := logging.Level()
+	logging.SetLevel(l)
+	log.Printf("Log level changed from %s to %s by %s", logging.LevelName(prev), logging.LevelName(l), actor(r))
+	writeJSON(w, http.StatusOK, logLevel{Level: logging.LevelName(l)})
+}
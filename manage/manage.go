@@ -0,0 +1,257 @@
+// Package manage serves the versioned JSON management API under /manage/v1.
+// It offers what the admin panel does for scripts and CI pipelines, backed by
+// the same database methods.
+package manage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	auth "openai-api-proxy/auth"
+	db "openai-api-proxy/db"
+	"openai-api-proxy/openapi"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Store is the subset of database methods used by the management API.
+type Store interface {
+	ListAllApiKeys() ([]db.ApiKey, error)
+	GetApiKey(uuid string) (*db.ApiKey, error)
+	WriteEntry(k *db.ApiKey) error
+	SetApiKeyDeactivated(uuid string, deactivated bool) error
+	SetApiKeyAuditContent(uuid string, enabled bool) error
+	SetApiKeyResponseCacheOptOut(uuid string, optOut bool) error
+	ArchiveApiKey(uuid, by string) error
+	RotateAnyApiKey(uuid, keyID, hash string, grace time.Duration) (time.Time, error)
+	GetUser(uid string) (*db.User, error)
+	LookupApiKeyUserOverview() ([]db.RequestSummary, error)
+	LookupApiKeyInfos(uid string) ([]db.ApiKey, error)
+	ListModels() ([]db.Model, error)
+	LookupModel(id string) (*db.Model, error)
+	AddConfiguredModel(m *db.Model) error
+	DeleteConfiguredModel(id string) error
+	LookupAdminToken(token string) (*db.AdminToken, error)
+	TouchAdminToken(id int64, at time.Time) error
+}
+
+// TokenVerifier verifies OIDC access tokens of admins, see
+// auth.Auth.VerifyBearer.
+type TokenVerifier interface {
+	VerifyBearer(ctx context.Context, rawToken string) (*auth.Claims, error)
+}
+
+type handler struct {
+	db   Store
+	oidc TokenVerifier // nil if OIDC is not configured
+}
+
+// Init registers the management API. Requests are authenticated with admin
+// tokens created in the admin panel or, if a is not nil, with OIDC access
+// tokens of admins.
+func Init(mux *http.ServeMux, a *auth.Auth, d *db.Database) {
+	h := &handler{db: d}
+	if a != nil {
+		h.oidc = a
+	}
+	h.register(mux)
+}
+
+// route is an endpoint of the management API. Every route is described in
+// openapi/openapi.json, which TestRoutesMatchSpec checks.
+type route struct {
+	method, pattern string
+	handle          http.HandlerFunc
+}
+
+func (h *handler) routes() []route {
+	return []route{
+		{http.MethodGet, "/manage/v1/keys", h.listKeys},
+		{http.MethodPost, "/manage/v1/keys", h.createKey},
+		{http.MethodGet, "/manage/v1/keys/{id}", h.getKey},
+		{http.MethodPatch, "/manage/v1/keys/{id}", h.updateKey},
+		{http.MethodDelete, "/manage/v1/keys/{id}", h.deleteKey},
+		{http.MethodPost, "/manage/v1/keys/{id}/rotate", h.rotateKey},
+		{http.MethodGet, "/manage/v1/usage", h.listUsage},
+		{http.MethodGet, "/manage/v1/usage/{user}", h.userUsage},
+		{http.MethodGet, "/manage/v1/models", h.listModels},
+		{http.MethodPost, "/manage/v1/models", h.putModel},
+		{http.MethodGet, "/manage/v1/models/{id...}", h.getModel},
+		{http.MethodDelete, "/manage/v1/models/{id...}", h.deleteModel},
+		{http.MethodGet, "/manage/v1/log-level", h.getLogLevel},
+		{http.MethodPut, "/manage/v1/log-level", h.setLogLevel},
+	}
+}
+
+func (h *handler) register(mux *http.ServeMux) {
+	for _, rt := range h.routes() {
+		mux.HandleFunc(rt.method+" "+rt.pattern, h.authorized(rt.handle))
+	}
+	mux.Handle("GET "+openapi.Path, openapi.Handler())
+	// The catch-all matches every method, so the mux never answers a wrong
+	// method with its 405 itself; the routes of the path are asked instead.
+	mux.HandleFunc(catchAll, func(w http.ResponseWriter, r *http.Request) {
+		if allow := allowedMethods(mux, r); len(allow) > 0 {
+			w.Header().Set("Allow", strings.Join(allow, ", "))
+			writeError(w, http.StatusMethodNotAllowed, "method "+r.Method+" not allowed on "+r.URL.Path, "method_not_allowed")
+			return
+		}
+		writeError(w, http.StatusNotFound, "unknown endpoint "+r.URL.Path, "not_found")
+	})
+}
+
+const catchAll = "/manage/v1/"
+
+// allowedMethods returns the methods for which mux has a route other than
+// the catch-all for the path of r, sorted like the Allow header of the mux.
+func allowedMethods(mux *http.ServeMux, r *http.Request) []string {
+	var allow []string
+	for _, m := range []string{http.MethodDelete, http.MethodGet, http.MethodHead, http.MethodPatch, http.MethodPost, http.MethodPut} {
+		probe := r.Clone(r.Context())
+		probe.Method = m
+		if _, pattern := mux.Handler(probe); pattern != catchAll && pattern != "" {
+			allow = append(allow, m)
+		}
+	}
+	return allow
+}
+
+// actorKey carries the caller of a request, see actor.
+type actorKey struct{}
+
+// actor returns who made the request: the subject of an OIDC token or
+// "admin-token:<id>" for admin tokens.
+func actor(r *http.Request) string {
+	s, _ := r.Context().Value(actorKey{}).(string)
+	return s
+}
+
+// authorized wraps next with the authentication of the management API. Read
+// scoped admin tokens may only send GET requests.
+func (h *handler) authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			writeError(w, http.StatusUnauthorized, "missing bearer token", "unauthorized")
+			return
+		}
+		scope, who, err := h.authenticate(r.Context(), token)
+		if err != nil {
+			var notAdmin *auth.NotAdmin
+			if errors.As(err, &notAdmin) {
+				writeError(w, http.StatusForbidden, "the token does not carry the admin role", "forbidden")
+				return
+			}
+			if !errors.Is(err, errInvalidToken) {
+				log.Printf("Error while authenticating management request: %v", err)
+			}
+			writeError(w, http.StatusUnauthorized, "invalid bearer token", "unauthorized")
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && scope != db.AdminScopeWrite {
+			writeError(w, http.StatusForbidden, "the token is limited to read access", "insufficient_scope")
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), actorKey{}, who)))
+	}
+}
+
+var errInvalidToken = errors.New("invalid management token")
+
+// authenticate returns the scope and the caller of token.
+func (h *handler) authenticate(ctx context.Context, token string) (scope, who string, err error) {
+	if db.IsAdminToken(token) {
+		t, err := h.db.LookupAdminToken(token)
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", "", errInvalidToken
+		}
+		if err != nil {
+			return "", "", err
+		}
+		if !t.Active() {
+			return "", "", errInvalidToken
+		}
+		now := time.Now()
+		if now.Sub(t.LastUsedAt) > time.Minute {
+			if err := h.db.TouchAdminToken(t.ID, now); err != nil {
+				log.Printf("Error recording use of admin token %d: %v", t.ID, err)
+			}
+		}
+		return t.Scope, "admin-token:" + strconv.FormatInt(t.ID, 10), nil
+	}
+	if h.oidc == nil {
+		return "", "", errInvalidToken
+	}
+	claims, err := h.oidc.VerifyBearer(ctx, token)
+	if err != nil {
+		var notAdmin *auth.NotAdmin
+		if errors.As(err, &notAdmin) {
+			return "", "", err
+		}
+		return "", "", errInvalidToken
+	}
+	return db.AdminScopeWrite, claims.Sub, nil
+}
+
+// apiError is the error body of every failed request.
+type apiError struct {
+	Error struct {
+		Message string `json:"message"`
+		Code    string `json:"code"`
+	} `json:"error"`
+}
+
+func writeError(w http.ResponseWriter, status int, message, code string) {
+	var e apiError
+	e.Error.Message = message
+	e.Error.Code = code
+	writeJSON(w, status, e)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error writing management response: %v", err)
+	}
+}
+
+// list is the body of every list response.
+type list[T any] struct {
+	Data []T `json:"data"`
+}
+
+// readJSON decodes the request body into v and writes an error response if
+// that fails.
+func readJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body: "+err.Error(), "invalid_request")
+		return false
+	}
+	return true
+}
+
+// writeStoreError answers a failed database call, sql.ErrNoRows as 404.
+func writeStoreError(w http.ResponseWriter, what string, err error) {
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusNotFound, what+" not found", "not_found")
+		return
+	}
+	log.Printf("Error in management API, %s: %v", what, err)
+	writeError(w, http.StatusInternalServerError, "internal error", "internal_error")
+}
+
+// timePtr returns nil for the zero time, so it is omitted from responses.
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	t = t.UTC()
+	return &t
+}
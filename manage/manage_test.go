@@ -0,0 +1,443 @@
+package manage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	auth "openai-api-proxy/auth"
+	db "openai-api-proxy/db"
+	"openai-api-proxy/logging"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeStore keeps keys, models and admin tokens in memory.
+type fakeStore struct {
+	keys     map[string]*db.ApiKey
+	users    map[string]bool
+	models   map[string]*db.Model
+	tokens   map[string]*db.AdminToken
+	archived map[string]string
+	rotated  map[string]string
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{
+		keys:  map[string]*db.ApiKey{"k1": {UUID: "k1", Owner: "alice", Description: "ci"}},
+		users: map[string]bool{"alice": true},
+		models: map[string]*db.Model{
+			"gpt-4o": {ID: "gpt-4o", Backend: "azure", ApiKey: "provider-secret", Weight: 1},
+		},
+		tokens: map[string]*db.AdminToken{
+			"sk-admin-read":    {ID: 1, Name: "reporting", Scope: db.AdminScopeRead},
+			"sk-admin-write":   {ID: 2, Name: "terraform", Scope: db.AdminScopeWrite},
+			"sk-admin-revoked": {ID: 3, Name: "old", Scope: db.AdminScopeWrite, RevokedAt: time.Now()},
+		},
+		archived: map[string]string{},
+		rotated:  map[string]string{},
+	}
+}
+
+func (f *fakeStore) ListAllApiKeys() ([]db.ApiKey, error) {
+	var keys []db.ApiKey
+	for _, k := range f.keys {
+		if !k.Archived {
+			keys = append(keys, *k)
+		}
+	}
+	return keys, nil
+}
+
+func (f *fakeStore) GetApiKey(uuid string) (*db.ApiKey, error) {
+	k, ok := f.keys[uuid]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	c := *k
+	return &c, nil
+}
+
+func (f *fakeStore) WriteEntry(k *db.ApiKey) error {
+	c := *k
+	f.keys[k.UUID] = &c
+	return nil
+}
+
+func (f *fakeStore) SetApiKeyDeactivated(uuid string, deactivated bool) error {
+	k, ok := f.keys[uuid]
+	if !ok || k.Archived {
+		return sql.ErrNoRows
+	}
+	k.Deactivated = deactivated
+	return nil
+}
+
+func (f *fakeStore) SetApiKeyAuditContent(uuid string, enabled bool) error {
+	k, ok := f.keys[uuid]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	k.AuditContent = enabled
+	return nil
+}
+
+func (f *fakeStore) SetApiKeyResponseCacheOptOut(uuid string, optOut bool) error {
+	k, ok := f.keys[uuid]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	k.ResponseCacheOptOut = optOut
+	return nil
+}
+
+func (f *fakeStore) ArchiveApiKey(uuid, by string) error {
+	k, ok := f.keys[uuid]
+	if !ok || k.Archived {
+		return sql.ErrNoRows
+	}
+	k.Archived = true
+	f.archived[uuid] = by
+	return nil
+}
+
+func (f *fakeStore) RotateAnyApiKey(uuid, keyID, hash string, grace time.Duration) (time.Time, error) {
+	k, ok := f.keys[uuid]
+	if !ok || k.Archived {
+		return time.Time{}, sql.ErrNoRows
+	}
+	f.rotated[uuid] = keyID
+	return time.Now().Add(grace), nil
+}
+
+func (f *fakeStore) GetUser(uid string) (*db.User, error) {
+	if !f.users[uid] {
+		return nil, sql.ErrNoRows
+	}
+	return &db.User{Sub: uid}, nil
+}
+
+func (f *fakeStore) LookupApiKeyUserOverview() ([]db.RequestSummary, error) {
+	return []db.RequestSummary{{ID: "alice", Name: "Alice", InputTokenCount: 100, CachedInputTokenCount: 50, OutputTokenCount: 10, CacheRatioPercent: 50}}, nil
+}
+
+func (f *fakeStore) LookupApiKeyInfos(uid string) ([]db.ApiKey, error) {
+	var keys []db.ApiKey
+	for _, k := range f.keys {
+		if k.Owner == uid && !k.Archived {
+			c := *k
+			c.InputTokenCount = 42
+			keys = append(keys, c)
+		}
+	}
+	return keys, nil
+}
+
+func (f *fakeStore) ListModels() ([]db.Model, error) {
+	var models []db.Model
+	for _, m := range f.models {
+		models = append(models, *m)
+	}
+	return models, nil
+}
+
+func (f *fakeStore) LookupModel(id string) (*db.Model, error) {
+	m, ok := f.models[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	c := *m
+	return &c, nil
+}
+
+func (f *fakeStore) AddConfiguredModel(m *db.Model) error {
+	c := *m
+	if old, ok := f.models[m.ID]; ok && c.ApiKey == "" {
+		c.ApiKey = old.ApiKey
+	}
+	f.models[m.ID] = &c
+	return nil
+}
+
+func (f *fakeStore) DeleteConfiguredModel(id string) error {
+	delete(f.models, id)
+	return nil
+}
+
+func (f *fakeStore) LookupAdminToken(token string) (*db.AdminToken, error) {
+	t, ok := f.tokens[token]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	c := *t
+	return &c, nil
+}
+
+func (f *fakeStore) TouchAdminToken(id int64, at time.Time) error {
+	for _, t := range f.tokens {
+		if t.ID == id {
+			t.LastUsedAt = at
+		}
+	}
+	return nil
+}
+
+// fakeVerifier accepts "oidc-admin" as admin and "oidc-user" as non-admin
+// access token.
+type fakeVerifier struct{}
+
+func (fakeVerifier) VerifyBearer(ctx context.Context, raw string) (*auth.Claims, error) {
+	switch raw {
+	case "oidc-admin":
+		return &auth.Claims{Sub: "ci-client", Roles: []string{"admin"}}, nil
+	case "oidc-user":
+		return nil, &auth.NotAdmin{}
+	}
+	return nil, errors.New("token is malformed")
+}
+
+func newTestServer(t *testing.T) (*httptest.Server, *fakeStore) {
+	t.Helper()
+	store := newFakeStore()
+	mux := http.NewServeMux()
+	(&handler{db: store, oidc: fakeVerifier{}}).register(mux)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv, store
+}
+
+func do(t *testing.T, srv *httptest.Server, method, path, token, body string) (*http.Response, map[string]any) {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var out map[string]any
+	if resp.StatusCode != http.StatusNoContent {
+		if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+			t.Fatalf("%s %s: decoding response: %v", method, path, err)
+		}
+	}
+	return resp, out
+}
+
+func errorCode(body map[string]any) string {
+	e, _ := body["error"].(map[string]any)
+	code, _ := e["code"].(string)
+	return code
+}
+
+func TestAuthentication(t *testing.T) {
+	srv, store := newTestServer(t)
+	tests := []struct {
+		name, method, token string
+		status              int
+		code                string
+	}{
+		{"missing token", "GET", "", http.StatusUnauthorized, "unauthorized"},
+		{"unknown admin token", "GET", "sk-admin-unknown", http.StatusUnauthorized, "unauthorized"},
+		{"revoked admin token", "GET", "sk-admin-revoked", http.StatusUnauthorized, "unauthorized"},
+		{"read token may read", "GET", "sk-admin-read", http.StatusOK, ""},
+		{"read token may not write", "DELETE", "sk-admin-read", http.StatusForbidden, "insufficient_scope"},
+		{"oidc admin", "GET", "oidc-admin", http.StatusOK, ""},
+		{"oidc without admin role", "GET", "oidc-user", http.StatusForbidden, "forbidden"},
+		{"invalid oidc token", "GET", "garbage", http.StatusUnauthorized, "unauthorized"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := do(t, srv, tt.method, "/manage/v1/keys/k1", tt.token, "")
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d (%v)", resp.StatusCode, tt.status, body)
+			}
+			if got := errorCode(body); got != tt.code {
+				t.Errorf("error code = %q, want %q", got, tt.code)
+			}
+		})
+	}
+	if store.tokens["sk-admin-read"].LastUsedAt.IsZero() {
+		t.Error("last use of the admin token was not recorded")
+	}
+	if store.keys["k1"].Archived {
+		t.Error("read token archived a key")
+	}
+}
+
+func TestOIDCDisabled(t *testing.T) {
+	mux := http.NewServeMux()
+	(&handler{db: newFakeStore()}).register(mux)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	resp, _ := do(t, srv, "GET", "/manage/v1/keys", "oidc-admin", "")
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want 401 without OIDC", resp.StatusCode)
+	}
+}
+
+func TestKeyLifecycle(t *testing.T) {
+	srv, store := newTestServer(t)
+	const token = "sk-admin-write"
+
+	resp, body := do(t, srv, "POST", "/manage/v1/keys", token,
+		`{"owner":"alice","description":"deploy","allowed_models":["gpt-4o"],"allowed_cidrs":["10.0.0.0/8"]}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create: status = %d (%v)", resp.StatusCode, body)
+	}
+	id, _ := body["id"].(string)
+	secret, _ := body["secret"].(string)
+	if id == "" || !strings.HasPrefix(secret, "sk-proxy-") {
+		t.Fatalf("create returned id %q and secret %q", id, secret)
+	}
+	if got := store.keys[id].AllowedModels; len(got) != 1 || got[0] != "gpt-4o" {
+		t.Errorf("allowed models = %v", got)
+	}
+	if keyID, ok := db.ParseApiKeyID(secret); !ok || keyID != store.keys[id].KeyID {
+		t.Errorf("secret %q does not carry the stored key ID %q", secret, store.keys[id].KeyID)
+	}
+
+	resp, body = do(t, srv, "GET", "/manage/v1/keys/"+id, token, "")
+	if resp.StatusCode != http.StatusOK || body["secret"] != nil {
+		t.Fatalf("get: status = %d, body %v", resp.StatusCode, body)
+	}
+
+	resp, body = do(t, srv, "PATCH", "/manage/v1/keys/"+id, token, `{"deactivated":true}`)
+	if resp.StatusCode != http.StatusOK || body["deactivated"] != true || body["audit_content"] != false {
+		t.Fatalf("patch: status = %d, body %v", resp.StatusCode, body)
+	}
+	resp, body = do(t, srv, "PATCH", "/manage/v1/keys/"+id, token, `{"audit_content":true}`)
+	if resp.StatusCode != http.StatusOK || body["audit_content"] != true || body["deactivated"] != true {
+		t.Fatalf("patch audit_content: status = %d, body %v", resp.StatusCode, body)
+	}
+	resp, body = do(t, srv, "PATCH", "/manage/v1/keys/"+id, token, `{"response_cache_opt_out":true}`)
+	if resp.StatusCode != http.StatusOK || body["response_cache_opt_out"] != true || body["audit_content"] != true {
+		t.Fatalf("patch response_cache_opt_out: status = %d, body %v", resp.StatusCode, body)
+	}
+
+	resp, body = do(t, srv, "POST", "/manage/v1/keys/"+id+"/rotate", token, `{"grace":"1h"}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("rotate: status = %d (%v)", resp.StatusCode, body)
+	}
+	if body["secret"] == secret || body["grace_until"] == nil {
+		t.Errorf("rotate returned %v", body)
+	}
+
+	resp, _ = do(t, srv, "DELETE", "/manage/v1/keys/"+id, token, "")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete: status = %d", resp.StatusCode)
+	}
+	if store.archived[id] != "admin-token:2" {
+		t.Errorf("archived by %q, want admin-token:2", store.archived[id])
+	}
+	resp, _ = do(t, srv, "DELETE", "/manage/v1/keys/"+id, token, "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("second delete: status = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestCreateKeyValidation(t *testing.T) {
+	srv, _ := newTestServer(t)
+	for _, body := range []string{
+		`{"description":"no owner"}`,
+		`{"owner":"mallory"}`,
+		`{"owner":"alice","allowed_cidrs":["10.0.0.0/33"]}`,
+		`{"owner":"alice","expires_at":"2000-01-01T00:00:00Z"}`,
+		`{"owner":"alice","unknown":true}`,
+	} {
+		resp, out := do(t, srv, "POST", "/manage/v1/keys", "sk-admin-write", body)
+		if resp.StatusCode != http.StatusBadRequest || errorCode(out) != "invalid_request" {
+			t.Errorf("%s: status = %d, body %v", body, resp.StatusCode, out)
+		}
+	}
+}
+
+func TestUsage(t *testing.T) {
+	srv, _ := newTestServer(t)
+
+	resp, body := do(t, srv, "GET", "/manage/v1/usage", "sk-admin-read", "")
+	data, _ := body["data"].([]any)
+	if resp.StatusCode != http.StatusOK || len(data) != 1 {
+		t.Fatalf("usage: status = %d, body %v", resp.StatusCode, body)
+	}
+	if u := data[0].(map[string]any); u["user"] != "alice" || u["input_tokens"] != 100.0 {
+		t.Errorf("usage = %v", u)
+	}
+
+	resp, body = do(t, srv, "GET", "/manage/v1/usage/alice", "sk-admin-read", "")
+	data, _ = body["data"].([]any)
+	if resp.StatusCode != http.StatusOK || len(data) != 1 {
+		t.Fatalf("usage of alice: status = %d, body %v", resp.StatusCode, body)
+	}
+	if k := data[0].(map[string]any); k["key"] != "k1" || k["input_tokens"] != 42.0 {
+		t.Errorf("key usage = %v", k)
+	}
+}
+
+func TestModels(t *testing.T) {
+	srv, store := newTestServer(t)
+	const token = "sk-admin-write"
+
+	resp, body := do(t, srv, "GET", "/manage/v1/models/gpt-4o", token, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("get model: status = %d", resp.StatusCode)
+	}
+	if body["api_key"] != nil || body["has_api_key"] != true {
+		t.Errorf("provider key exposed or missing: %v", body)
+	}
+
+	resp, body = do(t, srv, "POST", "/manage/v1/models", token, `{"id":"openai/gpt-4o-mini","backend":"openrouter","weight":2}`)
+	if resp.StatusCode != http.StatusOK || body["id"] != "openai/gpt-4o-mini" {
+		t.Fatalf("add model: status = %d, body %v", resp.StatusCode, body)
+	}
+	resp, _ = do(t, srv, "POST", "/manage/v1/models", token, `{"id":"x","balance":"random"}`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown balance: status = %d, want 400", resp.StatusCode)
+	}
+
+	resp, _ = do(t, srv, "DELETE", "/manage/v1/models/openai/gpt-4o-mini", token, "")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete model: status = %d", resp.StatusCode)
+	}
+	if _, ok := store.models["openai/gpt-4o-mini"]; ok {
+		t.Error("model with slash in its ID was not deleted")
+	}
+	resp, _ = do(t, srv, "DELETE", "/manage/v1/models/unknown", token, "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("delete unknown model: status = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	srv, _ := newTestServer(t)
+	prev := logging.Level()
+	t.Cleanup(func() { logging.SetLevel(prev) })
+	logging.SetLevel(slog.LevelInfo)
+
+	resp, body := do(t, srv, "GET", "/manage/v1/log-level", "sk-admin-read", "")
+	if resp.StatusCode != http.StatusOK || body["level"] != "info" {
+		t.Fatalf("get log level: status = %d, body %v", resp.StatusCode, body)
+	}
+	resp, _ = do(t, srv, "PUT", "/manage/v1/log-level", "sk-admin-read", `{"level":"debug"}`)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("read token changed the level: status = %d", resp.StatusCode)
+	}
+	resp, body = do(t, srv, "PUT", "/manage/v1/log-level", "sk-admin-write", `{"level":"trace"}`)
+	if resp.StatusCode != http.StatusOK || body["level"] != "trace" || logging.Level() != logging.LevelTrace {
+		t.Errorf("set log level: status = %d, body %v, level %v", resp.StatusCode, body, logging.Level())
+	}
+	resp, body = do(t, srv, "PUT", "/manage/v1/log-level", "sk-admin-write", `{"level":"verbose"}`)
+	if resp.StatusCode != http.StatusBadRequest || errorCode(body) != "invalid_request" {
+		t.Errorf("unknown level: status = %d, body %v", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,114 @@
+package manage
+
+import (
+	"log"
+	"net/http"
+	db "openai-api-proxy/db"
+	"strings"
+)
+
+// model is the JSON form of a models row. The provider key is write-only.
+type model struct {
+	ID           string `json:"id"`
+	Backend      string `json:"backend,omitempty"`
+	Deployment   string `json:"deployment,omitempty"`
+	ResourceHost string `json:"resource_host,omitempty"`
+	ApiVersion   string `json:"api_version,omitempty"`
+	ApiKey       string `json:"api_key,omitempty"`
+	HasApiKey    bool   `json:"has_api_key"`
+	Weight       int    `json:"weight"`
+	Balance      string `json:"balance,omitempty"`
+	AuditContent bool   `json:"audit_content"`
+}
+
+func newModel(m *db.Model) model {
+	return model{
+		ID:           m.ID,
+		Backend:      m.Backend,
+		Deployment:   m.Deployment,
+		ResourceHost: m.ResourceHost,
+		ApiVersion:   m.ApiVersion,
+		HasApiKey:    m.ApiKey != "",
+		Weight:       m.Weight,
+		Balance:      m.Balance,
+		AuditContent: m.AuditContent,
+	}
+}
+
+func (h *handler) listModels(w http.ResponseWriter, r *http.Request) {
+	models, err := h.db.ListModels()
+	if err != nil {
+		writeStoreError(w, "models", err)
+		return
+	}
+	resp := list[model]{Data: []model{}}
+	for i := range models {
+		resp.Data = append(resp.Data, newModel(&models[i]))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *handler) getModel(w http.ResponseWriter, r *http.Request) {
+	m, err := h.db.LookupModel(r.PathValue("id"))
+	if err != nil {
+		writeStoreError(w, "model", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newModel(m))
+}
+
+// putModel adds a model or replaces its routing. An empty api_key keeps the
+// stored provider key.
+func (h *handler) putModel(w http.ResponseWriter, r *http.Request) {
+	var req model
+	if !readJSON(w, r, &req) {
+		return
+	}
+	req.ID = strings.TrimSpace(req.ID)
+	if req.ID == "" {
+		writeError(w, http.StatusBadRequest, "id is required", "invalid_request")
+		return
+	}
+	switch req.Balance {
+	case "", "priority", "weighted", "least_outstanding", "remaining_tokens":
+	default:
+		writeError(w, http.StatusBadRequest, "unknown balance "+req.Balance, "invalid_request")
+		return
+	}
+	err := h.db.AddConfiguredModel(&db.Model{
+		ID:           req.ID,
+		Backend:      req.Backend,
+		Deployment:   req.Deployment,
+		ResourceHost: req.ResourceHost,
+		ApiVersion:   req.ApiVersion,
+		ApiKey:       req.ApiKey,
+		Weight:       req.Weight,
+		Balance:      req.Balance,
+		AuditContent: req.AuditContent,
+	})
+	if err != nil {
+		writeStoreError(w, "model", err)
+		return
+	}
+	log.Printf("Model %s configured by %s", req.ID, actor(r))
+	m, err := h.db.LookupModel(req.ID)
+	if err != nil {
+		writeStoreError(w, "model", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newModel(m))
+}
+
+func (h *handler) deleteModel(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if _, err := h.db.LookupModel(id); err != nil {
+		writeStoreError(w, "model", err)
+		return
+	}
+	if err := h.db.DeleteConfiguredModel(id); err != nil {
+		writeStoreError(w, "model", err)
+		return
+	}
+	log.Printf("Model %s deleted by %s", id, actor(r))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,179 @@
+package manage
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"openai-api-proxy/client"
+	"openai-api-proxy/openapi"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// TestRoutesMatchSpec checks that every route is documented in the OpenAPI
+// document and every documented management operation is served.
+func TestRoutesMatchSpec(t *testing.T) {
+	doc, err := openapi.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops, err := doc.Operations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	documented := map[string]bool{}
+	for _, op := range ops {
+		if strings.HasPrefix(op.Path, "/manage/v1/") {
+			documented[op.Method+" "+op.Path] = true
+		}
+	}
+	for _, rt := range (&handler{}).routes() {
+		// {id...} matches IDs with slashes, the document can not express that.
+		key := rt.method + " " + strings.ReplaceAll(rt.pattern, "...}", "}")
+		if !documented[key] {
+			t.Errorf("%s is not documented in openapi.json", key)
+		}
+		delete(documented, key)
+	}
+	for key := range documented {
+		t.Errorf("%s is documented but not served", key)
+	}
+}
+
+// TestSchemasMatchSpec checks the JSON fields of the request and response
+// types against the schemas of the OpenAPI document.
+func TestSchemasMatchSpec(t *testing.T) {
+	doc, err := openapi.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	types := map[string]reflect.Type{
+		"Error":            reflect.TypeOf(apiError{}),
+		"ErrorDetail":      reflect.TypeOf(apiError{}.Error),
+		"ApiKey":           reflect.TypeOf(apiKey{}),
+		"ApiKeyList":       reflect.TypeOf(list[apiKey]{}),
+		"CreateKeyRequest": reflect.TypeOf(createKeyRequest{}),
+		"UpdateKeyRequest": reflect.TypeOf(updateKeyRequest{}),
+		"RotateKeyRequest": reflect.TypeOf(rotateKeyRequest{}),
+		"UserUsage":        reflect.TypeOf(userUsage{}),
+		"UserUsageList":    reflect.TypeOf(list[userUsage]{}),
+		"KeyUsage":         reflect.TypeOf(keyUsage{}),
+		"KeyUsageList":     reflect.TypeOf(list[keyUsage]{}),
+		"Model":            reflect.TypeOf(model{}),
+		"ModelList":        reflect.TypeOf(list[model]{}),
+		"LogLevel":         reflect.TypeOf(logLevel{}),
+	}
+	for name, typ := range types {
+		schema, ok := doc.Components.Schemas[name]
+		if !ok {
+			t.Errorf("schema %s is missing", name)
+			continue
+		}
+		var documented []string
+		for _, p := range schema.Properties {
+			documented = append(documented, p.Name)
+		}
+		sort.Strings(documented)
+		if got := jsonFields(typ); !reflect.DeepEqual(got, documented) {
+			t.Errorf("%s has the JSON fields %v, the schema %s documents %v", typ, got, name, documented)
+		}
+	}
+}
+
+func jsonFields(typ reflect.Type) []string {
+	var fields []string
+	for i := 0; i < typ.NumField(); i++ {
+		name, _, _ := strings.Cut(typ.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			fields = append(fields, name)
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func TestSpecServedWithoutToken(t *testing.T) {
+	srv, _ := newTestServer(t)
+	resp, body := do(t, srv, http.MethodGet, openapi.Path, "", "")
+	if resp.StatusCode != http.StatusOK || body["openapi"] == nil {
+		t.Fatalf("status = %d, body %v", resp.StatusCode, body)
+	}
+}
+
+func TestUnknownEndpoint(t *testing.T) {
+	mux := http.NewServeMux()
+	(&handler{db: newFakeStore()}).register(mux)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/manage/v1/unknown", nil))
+	if rec.Code != http.StatusNotFound || !strings.Contains(rec.Body.String(), `"not_found"`) {
+		t.Errorf("got %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestWrongMethod(t *testing.T) {
+	mux := http.NewServeMux()
+	(&handler{db: newFakeStore()}).register(mux)
+	for path, want := range map[string]string{
+		"/manage/v1/keys":          "GET, HEAD, POST",
+		"/manage/v1/keys/k/rotate": "POST",
+		"/manage/v1/models/a/b":    "DELETE, GET, HEAD",
+	} {
+		method := http.MethodDelete
+		if strings.Contains(want, method) {
+			method = http.MethodPut
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != want ||
+			!strings.Contains(rec.Body.String(), `"method_not_allowed"`) {
+			t.Errorf("%s %s: got %d, Allow %q, %s", method, path, rec.Code, rec.Header().Get("Allow"), rec.Body)
+		}
+	}
+}
+
+// TestGeneratedClient runs the generated client against the handlers.
+func TestGeneratedClient(t *testing.T) {
+	srv, store := newTestServer(t)
+	c := client.New(srv.URL, "sk-admin-write")
+	ctx := context.Background()
+
+	key, err := c.CreateKey(ctx, &client.CreateKeyRequest{Owner: "alice", AllowedCIDRs: []string{"10.0.0.0/8"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Secret == "" || store.keys[key.ID] == nil {
+		t.Fatalf("created key = %+v", key)
+	}
+	rotated, err := c.RotateKey(ctx, key.ID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.Secret == key.Secret || rotated.GraceUntil == nil {
+		t.Errorf("rotated key = %+v", rotated)
+	}
+	usage, err := c.GetUserUsage(ctx, "alice")
+	if err != nil || len(usage.Data) != 2 {
+		t.Errorf("usage = %+v, %v", usage, err)
+	}
+
+	if _, err := c.PutModel(ctx, &client.Model{ID: "openai/gpt-4o-mini", Backend: "openrouter", ApiKey: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	m, err := c.GetModel(ctx, "openai/gpt-4o-mini")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.ApiKey != "" || m.HasApiKey == nil || !*m.HasApiKey {
+		t.Errorf("model = %+v", m)
+	}
+	if err := c.DeleteModel(ctx, "openai/gpt-4o-mini"); err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.New(srv.URL, "sk-admin-read").DeleteKey(ctx, key.ID)
+	if apiErr, ok := err.(*client.APIError); !ok || apiErr.Code != "insufficient_scope" {
+		t.Errorf("delete with read token: %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+package manage
+
+import (
+	"net/http"
+)
+
+// userUsage is the token usage of all keys of a user or team.
+type userUsage struct {
+	User              string  `json:"user"`
+	Name              string  `json:"name"`
+	Team              bool    `json:"team"`
+	InputTokens       int     `json:"input_tokens"`
+	CachedInputTokens int     `json:"cached_input_tokens"`
+	OutputTokens      int     `json:"output_tokens"`
+	CacheRatioPercent float64 `json:"cache_ratio_percent"`
+	CacheHits         int     `json:"response_cache_hits"`
+	SavedTokens       int     `json:"saved_tokens"`
+}
+
+// keyUsage is the token usage of a single key.
+type keyUsage struct {
+	Key               string  `json:"key"`
+	Description       string  `json:"description"`
+	InputTokens       int     `json:"input_tokens"`
+	CachedInputTokens int     `json:"cached_input_tokens"`
+	OutputTokens      int     `json:"output_tokens"`
+	CacheRatioPercent float64 `json:"cache_ratio_percent"`
+	CacheHits         int     `json:"response_cache_hits"`
+	SavedTokens       int     `json:"saved_tokens"`
+}
+
+// listUsage returns the token usage per user and team.
+func (h *handler) listUsage(w http.ResponseWriter, r *http.Request) {
+	summary, err := h.db.LookupApiKeyUserOverview()
+	if err != nil {
+		writeStoreError(w, "usage", err)
+		return
+	}
+	resp := list[userUsage]{Data: []userUsage{}}
+	for _, s := range summary {
+		resp.Data = append(resp.Data, userUsage{
+			User:              s.ID,
+			Name:              s.Name,
+			Team:              s.IsTeam,
+			InputTokens:       s.InputTokenCount,
+			CachedInputTokens: s.CachedInputTokenCount,
+			OutputTokens:      s.OutputTokenCount,
+			CacheRatioPercent: s.CacheRatioPercent,
+			CacheHits:         s.ResponseCacheHits,
+			SavedTokens:       s.SavedTokenCount,
+		})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// userUsage returns the token usage per key of a user.
+func (h *handler) userUsage(w http.ResponseWriter, r *http.Request) {
+	keys, err := h.db.LookupApiKeyInfos(r.PathValue("user"))
+	if err != nil {
+		writeStoreError(w, "usage", err)
+		return
+	}
+	resp := list[keyUsage]{Data: []keyUsage{}}
+	for _, k := range keys {
+		resp.Data = append(resp.Data, keyUsage{
+			Key:               k.UUID,
+			Description:       k.Description,
+			InputTokens:       k.InputTokenCount,
+			CachedInputTokens: k.CachedInputTokenCount,
+			OutputTokens:      k.OutputTokenCount,
+			CacheRatioPercent: k.CacheRatioPercent,
+			CacheHits:         k.ResponseCacheHits,
+			SavedTokens:       k.SavedTokenCount,
+		})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
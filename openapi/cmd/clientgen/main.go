@@ -0,0 +1,25 @@
+// Command clientgen writes the generated part of the client package, see
+// openapi.GenerateClient. It is run by go generate in the client package.
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"openai-api-proxy/openapi"
+)
+
+func main() {
+	out := flag.String("o", "client.gen.go", "output file")
+	pkg := flag.String("package", "client", "package name")
+	flag.Parse()
+
+	src, err := openapi.GenerateClient(*pkg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(*out, src, 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,204 @@
+package openapi
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// GenerateClient returns the Go source of the types and methods of the client
+// package for Spec. The package provides Client, its do method and jsonBody.
+func GenerateClient(pkg string) ([]byte, error) {
+	d, err := Load()
+	if err != nil {
+		return nil, err
+	}
+	ops, err := d.Operations()
+	if err != nil {
+		return nil, err
+	}
+
+	g := &generator{}
+	var names []string
+	for name := range d.Components.Schemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		g.schema(name, d.Components.Schemas[name])
+	}
+	for _, op := range ops {
+		if err := g.operation(op); err != nil {
+			return nil, err
+		}
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "// Code generated by openapi/cmd/clientgen from openapi/openapi.json. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&out, "package %s\n\nimport (\n\t\"context\"\n", pkg)
+	if g.usesURL {
+		out.WriteString("\t\"net/url\"\n")
+	}
+	if g.usesTime {
+		out.WriteString("\t\"time\"\n")
+	}
+	out.WriteString(")\n")
+	out.Write(g.buf.Bytes())
+	return format.Source(out.Bytes())
+}
+
+type generator struct {
+	buf      bytes.Buffer
+	usesURL  bool
+	usesTime bool
+}
+
+func (g *generator) printf(format string, args ...any) {
+	fmt.Fprintf(&g.buf, format, args...)
+}
+
+// schema writes the struct of an object schema.
+func (g *generator) schema(name string, s *Schema) {
+	g.printf("\n")
+	if s.Description != "" {
+		g.printf("// %s %s\n", name, s.Description)
+	}
+	g.printf("type %s struct {\n", name)
+	for _, p := range s.Properties {
+		required := contains(s.Required, p.Name)
+		if p.Schema.Description != "" {
+			g.printf("\t// %s\n", p.Schema.Description)
+		}
+		tag := p.Name
+		if !required {
+			tag += ",omitempty"
+		}
+		g.printf("\t%s %s `json:\"%s\"`\n", goName(p.Name), g.goType(p.Schema, required), tag)
+	}
+	g.printf("}\n")
+}
+
+// goType returns the Go type of s. Optional booleans, times and objects are
+// pointers, so their zero value is not sent.
+func (g *generator) goType(s *Schema, required bool) string {
+	ptr := ""
+	if !required {
+		ptr = "*"
+	}
+	if s.Ref != "" {
+		return ptr + RefName(s.Ref)
+	}
+	switch s.Type {
+	case "string":
+		if s.Format == "date-time" {
+			g.usesTime = true
+			return ptr + "time.Time"
+		}
+		return "string"
+	case "boolean":
+		return ptr + "bool"
+	case "integer":
+		if s.Format == "int64" {
+			return "int64"
+		}
+		return "int"
+	case "number":
+		return "float64"
+	case "array":
+		return "[]" + g.goType(s.Items, true)
+	}
+	return "any"
+}
+
+// operation writes the client method of op.
+func (g *generator) operation(op *Operation) error {
+	name := goName(op.OperationID)
+	params := []string{"ctx context.Context"}
+	path := `"` + op.Path + `"`
+	for _, p := range op.Parameters {
+		if p.In != "path" {
+			return fmt.Errorf("%s: %s parameters are not supported", op.OperationID, p.In)
+		}
+		arg := argName(p.Name)
+		params = append(params, arg+" string")
+		g.usesURL = true
+		path = strings.Replace(path, "{"+p.Name+"}", `" + url.PathEscape(`+arg+`) + "`, 1)
+	}
+	path = strings.TrimSuffix(strings.TrimPrefix(path, `"" + `), ` + ""`)
+
+	body := "nil"
+	if op.RequestBody != nil {
+		s := op.RequestBody.Content["application/json"].Schema
+		if s == nil || s.Ref == "" {
+			return fmt.Errorf("%s: request body must reference a schema", op.OperationID)
+		}
+		params = append(params, "body *"+RefName(s.Ref))
+		body = "jsonBody(body)"
+	}
+
+	_, result := op.Success()
+	g.printf("\n// %s %s\n", name, lowerFirst(op.Summary))
+	if result == nil {
+		g.printf("func (c *Client) %s(%s) error {\n", name, strings.Join(params, ", "))
+		g.printf("\treturn c.do(ctx, %q, %s, %s, nil)\n}\n", op.Method, path, body)
+		return nil
+	}
+	if result.Ref == "" {
+		return fmt.Errorf("%s: response must reference a schema", op.OperationID)
+	}
+	typ := RefName(result.Ref)
+	g.printf("func (c *Client) %s(%s) (*%s, error) {\n", name, strings.Join(params, ", "), typ)
+	g.printf("\tvar out %s\n", typ)
+	g.printf("\tif err := c.do(ctx, %q, %s, %s, &out); err != nil {\n\t\treturn nil, err\n\t}\n", op.Method, path, body)
+	g.printf("\treturn &out, nil\n}\n")
+	return nil
+}
+
+// initialisms are written in upper case in Go names, as in the db package.
+var initialisms = map[string]string{"id": "ID", "cidrs": "CIDRs", "url": "URL"}
+
+// goName turns snake_case and camelCase names into exported Go names.
+func goName(s string) string {
+	var b strings.Builder
+	for _, part := range strings.Split(s, "_") {
+		if v, ok := initialisms[part]; ok {
+			b.WriteString(v)
+			continue
+		}
+		r := []rune(part)
+		if len(r) > 0 {
+			r[0] = unicode.ToUpper(r[0])
+		}
+		b.WriteString(string(r))
+	}
+	return b.String()
+}
+
+// argName turns a parameter name into an unexported Go name.
+func argName(s string) string {
+	first, rest, _ := strings.Cut(s, "_")
+	if rest == "" {
+		return strings.ToLower(first)
+	}
+	return strings.ToLower(first) + goName(rest)
+}
+
+func lowerFirst(s string) string {
+	r := []rune(s)
+	if len(r) > 0 && !(len(r) > 1 && unicode.IsUpper(r[1])) {
+		r[0] = unicode.ToLower(r[0])
+	}
+	return string(r)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,206 @@
+// Package openapi holds the OpenAPI document of the management API and the
+// model list of the proxy, and the generator of the Go client in the client
+// package. The handlers are checked against the document in their tests.
+package openapi
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Path is where the document is served.
+const Path = "/manage/v1/openapi.json"
+
+// Spec is the OpenAPI 3 document.
+//
+//go:embed openapi.json
+var Spec []byte
+
+// Handler serves Spec. The document is public, it contains no secrets.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Write(Spec)
+	})
+}
+
+// Document is the part of an OpenAPI document this package understands.
+type Document struct {
+	Paths      map[string]PathItem `json:"paths"`
+	Components struct {
+		Schemas    map[string]*Schema   `json:"schemas"`
+		Parameters map[string]Parameter `json:"parameters"`
+		Responses  map[string]Response  `json:"responses"`
+	} `json:"components"`
+}
+
+type PathItem struct {
+	Parameters []Parameter `json:"parameters"`
+	Get        *Operation  `json:"get"`
+	Post       *Operation  `json:"post"`
+	Put        *Operation  `json:"put"`
+	Patch      *Operation  `json:"patch"`
+	Delete     *Operation  `json:"delete"`
+}
+
+type Operation struct {
+	OperationID string              `json:"operationId"`
+	Summary     string              `json:"summary"`
+	Parameters  []Parameter         `json:"parameters"`
+	RequestBody *RequestBody        `json:"requestBody"`
+	Responses   map[string]Response `json:"responses"`
+
+	// Set by Operations.
+	Method string `json:"-"`
+	Path   string `json:"-"`
+}
+
+type Parameter struct {
+	Ref         string  `json:"$ref"`
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Required    bool    `json:"required"`
+	Description string  `json:"description"`
+	Schema      *Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Required bool                 `json:"required"`
+	Content  map[string]MediaType `json:"content"`
+}
+
+type Response struct {
+	Ref         string               `json:"$ref"`
+	Description string               `json:"description"`
+	Content     map[string]MediaType `json:"content"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+type Schema struct {
+	Ref         string     `json:"$ref"`
+	Type        string     `json:"type"`
+	Format      string     `json:"format"`
+	Description string     `json:"description"`
+	Required    []string   `json:"required"`
+	Properties  Properties `json:"properties"`
+	Items       *Schema    `json:"items"`
+	Enum        []string   `json:"enum"`
+	ReadOnly    bool       `json:"readOnly"`
+	WriteOnly   bool       `json:"writeOnly"`
+}
+
+// Property is a named property of an object schema.
+type Property struct {
+	Name   string
+	Schema *Schema
+}
+
+// Properties keeps the properties of a schema in document order, so the
+// generated structs read like the document.
+type Properties []Property
+
+func (p *Properties) UnmarshalJSON(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return fmt.Errorf("properties must be an object")
+	}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		var s Schema
+		if err := dec.Decode(&s); err != nil {
+			return err
+		}
+		*p = append(*p, Property{Name: t.(string), Schema: &s})
+	}
+	return nil
+}
+
+// Load parses Spec.
+func Load() (*Document, error) {
+	var d Document
+	if err := json.Unmarshal(Spec, &d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// Operations returns all operations sorted by path and method, with their
+// path level parameters and references resolved.
+func (d *Document) Operations() ([]*Operation, error) {
+	var ops []*Operation
+	for path, item := range d.Paths {
+		for method, op := range map[string]*Operation{
+			http.MethodGet: item.Get, http.MethodPost: item.Post, http.MethodPut: item.Put,
+			http.MethodPatch: item.Patch, http.MethodDelete: item.Delete,
+		} {
+			if op == nil {
+				continue
+			}
+			o := *op
+			o.Method, o.Path = method, path
+			o.Parameters = nil
+			for _, p := range append(append([]Parameter{}, item.Parameters...), op.Parameters...) {
+				if p.Ref != "" {
+					resolved, ok := d.Components.Parameters[RefName(p.Ref)]
+					if !ok {
+						return nil, fmt.Errorf("%s %s: unknown parameter %s", method, path, p.Ref)
+					}
+					p = resolved
+				}
+				o.Parameters = append(o.Parameters, p)
+			}
+			o.Responses = make(map[string]Response, len(op.Responses))
+			for status, r := range op.Responses {
+				if r.Ref != "" {
+					resolved, ok := d.Components.Responses[RefName(r.Ref)]
+					if !ok {
+						return nil, fmt.Errorf("%s %s: unknown response %s", method, path, r.Ref)
+					}
+					r = resolved
+				}
+				o.Responses[status] = r
+			}
+			ops = append(ops, &o)
+		}
+	}
+	sort.Slice(ops, func(i, j int) bool {
+		if ops[i].Path != ops[j].Path {
+			return ops[i].Path < ops[j].Path
+		}
+		return ops[i].Method < ops[j].Method
+	})
+	return ops, nil
+}
+
+// Success returns the status and JSON schema of the successful response of
+// the operation. The schema is nil for responses without body.
+func (o *Operation) Success() (string, *Schema) {
+	var statuses []string
+	for status := range o.Responses {
+		if strings.HasPrefix(status, "2") {
+			statuses = append(statuses, status)
+		}
+	}
+	sort.Strings(statuses)
+	if len(statuses) == 0 {
+		return "", nil
+	}
+	return statuses[0], o.Responses[statuses[0]].Content["application/json"].Schema
+}
+
+// RefName returns the name of the component a $ref points to.
+func RefName(ref string) string {
+	return ref[strings.LastIndex(ref, "/")+1:]
+}
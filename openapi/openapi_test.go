@@ -0,0 +1,93 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestRefsResolve checks that every $ref of the document points to a
+// component.
+func TestRefsResolve(t *testing.T) {
+	var raw any
+	if err := json.Unmarshal(Spec, &raw); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var walk func(v any)
+	walk = func(v any) {
+		switch v := v.(type) {
+		case map[string]any:
+			if ref, ok := v["$ref"].(string); ok {
+				kind, name, _ := strings.Cut(strings.TrimPrefix(ref, "#/components/"), "/")
+				found := false
+				switch kind {
+				case "schemas":
+					_, found = doc.Components.Schemas[name]
+				case "parameters":
+					_, found = doc.Components.Parameters[name]
+				case "responses":
+					_, found = doc.Components.Responses[name]
+				}
+				if !found {
+					t.Errorf("unresolved $ref %s", ref)
+				}
+			}
+			for _, e := range v {
+				walk(e)
+			}
+		case []any:
+			for _, e := range v {
+				walk(e)
+			}
+		}
+	}
+	walk(raw)
+}
+
+func TestOperations(t *testing.T) {
+	doc, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops, err := doc.Operations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]bool{}
+	for _, op := range ops {
+		if op.OperationID == "" || seen[op.OperationID] {
+			t.Errorf("%s %s: missing or duplicate operationId %q", op.Method, op.Path, op.OperationID)
+		}
+		seen[op.OperationID] = true
+		for _, p := range op.Parameters {
+			if p.In == "path" && !strings.Contains(op.Path, "{"+p.Name+"}") {
+				t.Errorf("%s: path parameter %s is not part of %s", op.OperationID, p.Name, op.Path)
+			}
+		}
+		if status, _ := op.Success(); status == "" {
+			t.Errorf("%s has no successful response", op.OperationID)
+		}
+	}
+}
+
+// TestClientUpToDate fails if the client was not regenerated after a change
+// of the document. Run go generate ./client to fix it.
+func TestClientUpToDate(t *testing.T) {
+	want, err := GenerateClient("client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile("../client/client.gen.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("client/client.gen.go is outdated, run go generate ./client")
+	}
+}